@@ -0,0 +1,162 @@
+package mtc
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"net"
+)
+
+var ErrAmbiguousSignatureScheme = errors.New(
+	"Several signature schemes match the public key",
+)
+
+// Builds an Assertion with a TLS subject, for instance
+//
+//	a, err := NewAssertionBuilder().
+//		DNS("example.com").
+//		IP4(net.ParseIP("192.0.2.1")).
+//		TLSKey(pub).
+//		Build()
+//
+// Errors are reported by Build.
+type AssertionBuilder struct {
+	claims  Claims
+	pk      crypto.PublicKey
+	scheme  SignatureScheme
+	compact bool
+	err     error
+}
+
+func NewAssertionBuilder() *AssertionBuilder {
+	return &AssertionBuilder{}
+}
+
+// Records the first error encountered.
+func (b *AssertionBuilder) fail(err error) *AssertionBuilder {
+	if b.err == nil {
+		b.err = err
+	}
+	return b
+}
+
+// Adds DNS claims.
+func (b *AssertionBuilder) DNS(names ...string) *AssertionBuilder {
+	b.claims.DNS = append(b.claims.DNS, names...)
+	return b
+}
+
+// Adds DNS wildcard claims. Names are given without the leading "*.".
+func (b *AssertionBuilder) DNSWildcard(names ...string) *AssertionBuilder {
+	b.claims.DNSWildcard = append(b.claims.DNSWildcard, names...)
+	return b
+}
+
+// Adds ENS claims.
+func (b *AssertionBuilder) ENS(names ...string) *AssertionBuilder {
+	b.claims.ENS = append(b.claims.ENS, names...)
+	return b
+}
+
+// Adds email address claims.
+func (b *AssertionBuilder) Email(addrs ...string) *AssertionBuilder {
+	b.claims.Email = append(b.claims.Email, addrs...)
+	return b
+}
+
+// Adds IPv4 address claims.
+func (b *AssertionBuilder) IP4(ips ...net.IP) *AssertionBuilder {
+	for _, ip := range ips {
+		ip4 := ip.To4()
+		if ip4 == nil {
+			return b.fail(fmt.Errorf("Not an IPv4 address: %s", ip))
+		}
+		b.claims.IPv4 = append(b.claims.IPv4, ip4)
+	}
+	return b
+}
+
+// Adds IPv6 address claims.
+func (b *AssertionBuilder) IP6(ips ...net.IP) *AssertionBuilder {
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			return b.fail(fmt.Errorf("%w: %s", ErrIPv4MappedAddress, ip))
+		}
+		ip16 := ip.To16()
+		if ip16 == nil {
+			return b.fail(fmt.Errorf("Not an IPv6 address: %s", ip))
+		}
+		b.claims.IPv6 = append(b.claims.IPv6, ip16)
+	}
+	return b
+}
+
+// Sets the public key of the TLS subject.
+func (b *AssertionBuilder) TLSKey(pk crypto.PublicKey) *AssertionBuilder {
+	b.pk = pk
+	return b
+}
+
+// Sets the signature scheme of the TLS subject. Only required if several
+// signature schemes match the public key, as is the case for RSA.
+func (b *AssertionBuilder) Scheme(scheme SignatureScheme) *AssertionBuilder {
+	b.scheme = scheme
+	return b
+}
+
+// Uses a CompactTLSSubject if the public key is small enough, such as an
+// Ed25519 key, and a TLSSubject otherwise.
+func (b *AssertionBuilder) Compact() *AssertionBuilder {
+	b.compact = true
+	return b
+}
+
+// Returns the assertion, or the first error encountered.
+func (b *AssertionBuilder) Build() (*Assertion, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	if b.pk == nil {
+		return nil, errors.New("No public key set for the subject")
+	}
+
+	scheme := b.scheme
+	if scheme == 0 {
+		schemes := SignatureSchemesFor(b.pk)
+		if len(schemes) == 0 {
+			return nil, errors.New(
+				"No matching signature scheme for that public key",
+			)
+		}
+		if len(schemes) >= 2 {
+			return nil, fmt.Errorf(
+				"%w: %s",
+				ErrAmbiguousSignatureScheme,
+				schemes,
+			)
+		}
+		scheme = schemes[0]
+	}
+
+	tlsSubj, err := NewTLSSubject(scheme, b.pk)
+	if err != nil {
+		return nil, fmt.Errorf("creating subject: %w", err)
+	}
+	var subj Subject = tlsSubj
+	if b.compact && len(tlsSubj.pk.Bytes()) <= MaxCompactPublicKeySize {
+		subj = &CompactTLSSubject{*tlsSubj}
+	}
+
+	a := &Assertion{
+		Subject: subj,
+		Claims:  b.claims,
+	}
+
+	// Check that the claims are valid, and can be encoded.
+	if _, err := a.MarshalBinary(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
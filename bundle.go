@@ -0,0 +1,71 @@
+package mtc
+
+import (
+	"fmt"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// A certificate together with a signed validity window that covers its
+// batch, so that it can be verified offline with just the CAParams.
+// Encoded as
+//
+//	struct {
+//	    opaque certificate<1..2^24-1>;
+//	    opaque signed_validity_window<1..2^24-1>;
+//	} CertificateBundle;
+type CertificateBundle struct {
+	Certificate BikeshedCertificate
+	Window      SignedValidityWindow
+}
+
+func (b *CertificateBundle) MarshalBinary() ([]byte, error) {
+	cert, err := b.Certificate.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	window, err := b.Window.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	var builder cryptobyte.Builder
+	builder.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(cert)
+	})
+	builder.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(window)
+	})
+	return builder.Bytes()
+}
+
+// Parses a bundle, and checks the signature on its validity window
+// against the public key of the CA.
+func (b *CertificateBundle) UnmarshalBinary(data []byte, p *CAParams) error {
+	var (
+		s      = cryptobyte.String(data)
+		cert   cryptobyte.String
+		window cryptobyte.String
+	)
+	if !s.ReadUint24LengthPrefixed(&cert) ||
+		!s.ReadUint24LengthPrefixed(&window) {
+		return ErrTruncated
+	}
+	if !s.Empty() {
+		return ErrExtraBytes
+	}
+	if err := b.Certificate.UnmarshalBinary([]byte(cert)); err != nil {
+		return fmt.Errorf("parsing certificate: %w", err)
+	}
+	if err := b.Window.UnmarshalBinary([]byte(window), p); err != nil {
+		return fmt.Errorf("parsing validity window: %w", err)
+	}
+	return nil
+}
+
+// Verifies the certificate in the bundle against the validity window that
+// comes with it, which is assumed to have been checked by UnmarshalBinary.
+// Any Window in opts is ignored. See VerifyCertificate.
+func VerifyCertificateBundle(b *CertificateBundle, opts VerifyOptions) error {
+	opts.Window = &b.Window.ValidityWindow
+	return VerifyCertificate(&b.Certificate, opts)
+}
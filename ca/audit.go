@@ -0,0 +1,198 @@
+package ca
+
+// Functions to work with the CA's audit log.
+//
+// The audit log is an append-only text file with one line per issued batch.
+// Each line consists of tab-separated fields:
+//
+//   time  batch  leaf count  root  source  checksum
+//
+// The time is in RFC3339 format, and root and checksum are hex encoded.
+// The source is quoted as a Go string. The checksum is the SHA256 hash of
+// the checksum of the previous line (empty for the first line) followed by
+// the current line up to, and including, the tab before the checksum.
+// Thus the checksums form a chain, and any edit or removal of a line
+// other than the last, is detected.
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/user"
+	gopath "path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Entry in the audit log.
+type AuditEntry struct {
+	Time      time.Time
+	Batch     uint32
+	LeafCount uint64
+	Root      []byte
+	Source    string
+	Checksum  []byte
+}
+
+func (h Handle) auditLogPath() string {
+	return gopath.Join(h.path, "audit-log")
+}
+
+// Sets who or what is recorded in the audit log as having issued batches.
+// Defaults to user@hostname.
+func (h *Handle) SetAuditSource(source string) {
+	h.auditSource = source
+}
+
+func (h *Handle) getAuditSource() string {
+	if h.auditSource != "" {
+		return h.auditSource
+	}
+	username := "unknown"
+	if u, err := user.Current(); err == nil {
+		username = u.Username
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return username + "@" + hostname
+}
+
+// Returns the line for the entry without checksum, and sets the checksum
+// on the entry.
+func (e *AuditEntry) line(prevChecksum []byte) string {
+	line := fmt.Sprintf(
+		"%s\t%d\t%d\t%x\t%s\t",
+		e.Time.UTC().Format(time.RFC3339),
+		e.Batch,
+		e.LeafCount,
+		e.Root,
+		strconv.Quote(e.Source),
+	)
+	h := sha256.New()
+	_, _ = h.Write(prevChecksum)
+	_, _ = h.Write([]byte(line))
+	e.Checksum = h.Sum(nil)
+	return line
+}
+
+func parseAuditEntry(line string) (*AuditEntry, error) {
+	var (
+		e   AuditEntry
+		err error
+	)
+
+	fields := strings.Split(line, "\t")
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("expected 6 fields; got %d", len(fields))
+	}
+
+	e.Time, err = time.Parse(time.RFC3339, fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("parsing time: %w", err)
+	}
+	batch, err := strconv.ParseUint(fields[1], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("parsing batch: %w", err)
+	}
+	e.Batch = uint32(batch)
+	e.LeafCount, err = strconv.ParseUint(fields[2], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("parsing leaf count: %w", err)
+	}
+	e.Root, err = hex.DecodeString(fields[3])
+	if err != nil {
+		return nil, fmt.Errorf("parsing root: %w", err)
+	}
+	e.Source, err = strconv.Unquote(fields[4])
+	if err != nil {
+		return nil, fmt.Errorf("parsing source: %w", err)
+	}
+	e.Checksum, err = hex.DecodeString(fields[5])
+	if err != nil {
+		return nil, fmt.Errorf("parsing checksum: %w", err)
+	}
+	return &e, nil
+}
+
+// Calls f on each entry in the audit log, oldest first, after checking
+// its checksum.
+func (h *Handle) WalkAuditLog(f func(AuditEntry) error) error {
+	r, err := os.Open(h.auditLogPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("opening audit log: %w", err)
+	}
+	defer r.Close()
+
+	var prevChecksum []byte
+	s := bufio.NewScanner(r)
+	for lineNo := 1; s.Scan(); lineNo++ {
+		e, err := parseAuditEntry(s.Text())
+		if err != nil {
+			return fmt.Errorf("parsing audit log line %d: %w", lineNo, err)
+		}
+		checksum := e.Checksum
+		e.line(prevChecksum)
+		if !bytes.Equal(checksum, e.Checksum) {
+			return fmt.Errorf("audit log line %d: %w", lineNo, ErrChecksumInvalid)
+		}
+		prevChecksum = checksum
+		if err := f(*e); err != nil {
+			return err
+		}
+	}
+	if err := s.Err(); err != nil {
+		return fmt.Errorf("reading audit log: %w", err)
+	}
+	return nil
+}
+
+// Appends an entry for the given issued batch to the audit log.
+func (h *Handle) appendAuditLog(number uint32, dt time.Time) error {
+	var prevChecksum []byte
+	err := h.WalkAuditLog(func(e AuditEntry) error {
+		prevChecksum = e.Checksum
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	info, err := h.BatchInfo(number)
+	if err != nil {
+		return err
+	}
+
+	e := AuditEntry{
+		Time:      dt,
+		Batch:     number,
+		LeafCount: info.LeafCount,
+		Root:      info.Root,
+		Source:    h.getAuditSource(),
+	}
+	line := e.line(prevChecksum)
+
+	f, err := os.OpenFile(
+		h.auditLogPath(),
+		os.O_APPEND|os.O_CREATE|os.O_WRONLY,
+		0o600,
+	)
+	if err != nil {
+		return fmt.Errorf("opening audit log: %w", err)
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintf(f, "%s%x\n", line, e.Checksum)
+	if err != nil {
+		return fmt.Errorf("writing audit log: %w", err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,80 @@
+package ca
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/bwesterb/mtc"
+)
+
+// Position of an assertion in an issued batch.
+type Location struct {
+	Batch uint32
+	Index uint64 // index of the leaf in the batch's tree
+}
+
+// Returns the locations of the assertions in batches that are live at now,
+// whose claims cover the given hostname or IP address, newest batch first.
+//
+// Names are matched as by mtc.Claims.Covers, so that wildcard claims are
+// included, and case and a trailing dot are ignored. A frontend can use
+// this to pick the certificate to present for a given SNI.
+//
+// Reads the abridged assertions of each live batch.
+func (h *Handle) Authorizes(name string, now time.Time) ([]Location, error) {
+	if h.closed {
+		return nil, ErrClosed
+	}
+	if strings.TrimSuffix(name, ".") == "" {
+		return nil, errors.New("Empty name")
+	}
+
+	existing, err := h.listBatchRange()
+	if err != nil {
+		return nil, fmt.Errorf("listing batches: %w", err)
+	}
+	live := h.params.ActiveBatches(now)
+	begin := max(live.Begin, existing.Begin)
+	end := min(live.End, existing.End)
+
+	var ret []Location
+	for batch := end; batch > begin; batch-- {
+		locs, err := h.authorizesIn(batch-1, name)
+		if err != nil {
+			return nil, fmt.Errorf("batch %d: %w", batch-1, err)
+		}
+		ret = append(ret, locs...)
+	}
+	return ret, nil
+}
+
+// Returns the locations of assertions in the given batch covering name.
+func (h *Handle) authorizesIn(batch uint32, name string) ([]Location, error) {
+	obj, err := h.storage.Open(batchKey(batch, "abridged-assertions"))
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+	r := bufio.NewReader(io.NewSectionReader(obj, 0, int64(obj.Len())))
+
+	var (
+		ret   []Location
+		index uint64
+	)
+	err = mtc.UnmarshalAbridgedAssertions(r, func(_ int,
+		aa *mtc.AbridgedAssertion) error {
+		if aa.Claims.Covers(name) {
+			ret = append(ret, Location{Batch: batch, Index: index})
+		}
+		index++
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading abridged-assertions: %w", err)
+	}
+	return ret, nil
+}
@@ -3,16 +3,21 @@ package ca
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
+	"math"
 	"os"
 	gopath "path"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/bwesterb/mtc"
@@ -23,9 +28,29 @@ import (
 
 const csLen = 32
 
+// Maximum length of QueuedAssertion.Label.
+const MaxLabelLength = 255
+
 var (
 	ErrChecksumInvalid = errors.New("Invalid checksum")
 	ErrClosed          = errors.New("Handle is closed")
+	ErrUnknownBatch    = errors.New("No such batch")
+	ErrBatchExpired    = errors.New("Batch has expired")
+	ErrUnknownKey      = errors.New("No assertion with that key")
+	ErrNoCA            = errors.New("No CA found")
+	ErrCAExists        = errors.New("CA already exists")
+	ErrKeyCollision    = errors.New("Assertions with the same key")
+	ErrKeyMismatch     = errors.New("Signing key doesn't match the public key in ca-params")
+	ErrLabelTooLong    = errors.New("Label of queued assertion is too long")
+	ErrReadOnly        = errors.New("Handle is read-only")
+
+	// Returned by New with NewOpts.IfNotExists when there is a CA
+	// already, with other parameters than requested.
+	ErrCAMismatch = errors.New("Existing CA has different parameters")
+
+	// Returned, wrapped, when a subject key is for a signature scheme
+	// that's not in mtc.CAParams.AllowedSubjectSchemes.
+	ErrSchemeNotAllowed = errors.New("Subject signature scheme not accepted by CA")
 )
 
 type NewOpts struct {
@@ -38,28 +63,117 @@ type NewOpts struct {
 	BatchDuration   time.Duration
 	Lifetime        time.Duration
 	StorageDuration time.Duration
+
+	// Overwrite the CA at path, if one exists, instead of failing
+	// with ErrCAExists.
+	Force bool
+
+	// If there is a CA at path already with exactly the requested
+	// parameters, open it instead of failing with ErrCAExists. Fails with
+	// ErrCAMismatch if its parameters differ. For provisioning scripts
+	// that might run more than once.
+	IfNotExists bool
+
+	// Permissions of the files that are published, such as ca-params and
+	// the batches, subject to the umask. Directories get the corresponding
+	// search bits. Defaults to 0644. The signing key, queue, audit log and
+	// temporary files are only accessible by the owner regardless.
+	FileMode os.FileMode
+
+	// Signature schemes accepted for the public keys of subjects. They're
+	// published in the CA parameters, see
+	// mtc.CAParams.AllowedSubjectSchemes. If empty, any is accepted.
+	AllowedSubjectSchemes []mtc.SignatureScheme
+
+	// What the leaves of the Merkle trees of the batches commit to. See
+	// mtc.LeafEncoding. Defaults to mtc.AbridgedAssertionLeaf.
+	LeafEncoding mtc.LeafEncoding
+
+	// Planned changes of the batch duration, in the order they take
+	// effect. They're in the CA parameters from the start, see
+	// mtc.CAParams.BatchDurationChanges: the batch duration of an existing
+	// CA can't be changed, as that would change its fingerprint.
+	BatchDurationChanges []BatchDurationChange
+}
+
+// Planned change of the batch duration of a new CA. See
+// NewOpts.BatchDurationChanges.
+type BatchDurationChange struct {
+	// Time after the start of the CA from which the new batch duration is
+	// used. Must fall on the boundary between two batches.
+	After time.Duration
+
+	BatchDuration time.Duration
 }
 
-// Handle for exclusive access to a Merkle Tree CA state.
+// Handle for exclusive access to a Merkle Tree CA state, or for shared
+// read-only access, see OpenReadOnly.
 type Handle struct {
-	params mtc.CAParams
-	signer mtc.Signer
-	flock  lockfile.Lockfile
-	path   string
-	closed bool
+	params   mtc.CAParams
+	signer   mtc.Signer
+	flock    lockfile.Lockfile
+	path     string
+	closed   bool
+	readOnly bool
 
 	indices map[uint32]*Index
-	aas     map[uint32]*os.File
 	trees   map[uint32]*Tree
 
 	batchNumbersCache []uint32 // cache for existing batches
+
+	auditSource string          // recorded in the audit log, see SetAuditSource()
+	policy      Policy          // issuance policy, see SetPolicy()
+	keyPolicy   *KeyPolicy      // see SetKeyPolicy()
+	leafOrder   LeafOrder       // order of leaves in a batch, see SetLeafOrder()
+	retention   RetentionPolicy // see SetRetentionPolicy()
+	fileMode    os.FileMode     // of published files, see NewOpts.FileMode
+	storage     Storage         // of issued batches, see SetStorage()
+	workers     int             // for hashing the tree, see SetIssueWorkers()
+
+	clock func() time.Time // overrides time.Now() in tests
+}
+
+// Returns the current time.
+func (h *Handle) now() time.Time {
+	if h.clock != nil {
+		return h.clock()
+	}
+	return time.Now()
 }
 
+// Entry in the queue.
+//
+// The Checksum is that of the assertion, see mtc.Assertion.Checksum().
+//
+// On disk, an entry consists of the checksum, a uint16 length-prefixed list
+// of attributes, and the assertion. Each attribute is a uint16 type
+// followed by a uint16 length-prefixed value, in increasing order of type.
+// Entries written before attributes were introduced lack the attribute list.
 type QueuedAssertion struct {
 	Checksum  []byte
 	Assertion mtc.Assertion
+
+	// Time the assertion was queued. Set by QueueMultiple if zero.
+	// Not covered by the checksum.
+	QueuedAt time.Time
+
+	// If set, the assertion is not issued in a batch before this one,
+	// and stays in the queue until then. Not covered by the checksum.
+	NotBeforeBatch uint32
+
+	// Opaque reference of the operator, for instance to a subscriber,
+	// at most MaxLabelLength bytes. Only kept in the queue: it's not part
+	// of the assertion, and so not covered by the checksum, nor by the key.
+	Label string
 }
 
+// Types of attributes of entries in the queue.
+const (
+	queuedAtAttribute uint16 = iota
+	notBeforeBatchAttribute
+	labelAttribute
+)
+
 func (a *QueuedAssertion) UnmarshalBinary(data []byte) error {
 	var (
 		s        cryptobyte.String = cryptobyte.String(data)
@@ -71,10 +185,27 @@ func (a *QueuedAssertion) UnmarshalBinary(data []byte) error {
 
 	a.Checksum = make([]byte, csLen)
 	copy(a.Checksum, checksum)
+	a.QueuedAt = time.Time{}
+	a.NotBeforeBatch = 0
+	a.Label = ""
 
+	// If the checksum matches the remainder, this is an entry without
+	// attributes.
 	checksum2 := sha256.Sum256([]byte(s))
 	if !bytes.Equal(checksum2[:], checksum) {
-		return ErrChecksumInvalid
+		var attrs cryptobyte.String
+		if !s.ReadUint16LengthPrefixed(&attrs) {
+			return mtc.ErrTruncated
+		}
+
+		checksum2 = sha256.Sum256([]byte(s))
+		if !bytes.Equal(checksum2[:], checksum) {
+			return ErrChecksumInvalid
+		}
+
+		if err := a.unmarshalAttributes(attrs); err != nil {
+			return err
+		}
 	}
 
 	if err := a.Assertion.UnmarshalBinary([]byte(s)); err != nil {
@@ -84,12 +215,82 @@ func (a *QueuedAssertion) UnmarshalBinary(data []byte) error {
 	return nil
 }
 
+func (a *QueuedAssertion) unmarshalAttributes(s cryptobyte.String) error {
+	first := true
+	var previousType uint16
+	for !s.Empty() {
+		var (
+			typ uint16
+			val cryptobyte.String
+		)
+		if !s.ReadUint16(&typ) || !s.ReadUint16LengthPrefixed(&val) {
+			return mtc.ErrTruncated
+		}
+		if !first && previousType >= typ {
+			return errors.New("Attributes duplicated or not sorted")
+		}
+		first = false
+		previousType = typ
+
+		switch typ {
+		case queuedAtAttribute:
+			var ts uint64
+			if !val.ReadUint64(&ts) {
+				return mtc.ErrTruncated
+			}
+			if !val.Empty() {
+				return mtc.ErrExtraBytes
+			}
+			a.QueuedAt = time.Unix(int64(ts), 0)
+		case notBeforeBatchAttribute:
+			if !val.ReadUint32(&a.NotBeforeBatch) {
+				return mtc.ErrTruncated
+			}
+			if !val.Empty() {
+				return mtc.ErrExtraBytes
+			}
+		case labelAttribute:
+			if len(val) > MaxLabelLength {
+				return ErrLabelTooLong
+			}
+			a.Label = string(val)
+		}
+
+		// Unknown attributes are ignored.
+	}
+	return nil
+}
+
+func (a *QueuedAssertion) marshalAttributes(b *cryptobyte.Builder) {
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		if !a.QueuedAt.IsZero() {
+			b.AddUint16(queuedAtAttribute)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint64(uint64(a.QueuedAt.Unix()))
+			})
+		}
+		if a.NotBeforeBatch != 0 {
+			b.AddUint16(notBeforeBatchAttribute)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint32(a.NotBeforeBatch)
+			})
+		}
+		if a.Label != "" {
+			b.AddUint16(labelAttribute)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddBytes([]byte(a.Label))
+			})
+		}
+	})
+}
+
 func (a *QueuedAssertion) marshalAndCheckAssertion() ([]byte, error) {
 	buf, err := a.Assertion.MarshalBinary()
 	if err != nil {
 		return nil, err
 	}
 
+	// Same as a.Assertion.Checksum(), without marshalling twice.
 	checksum2 := sha256.Sum256([]byte(buf))
 	if a.Checksum == nil {
 		a.Checksum = checksum2[:]
@@ -110,11 +311,15 @@ func (a *QueuedAssertion) Check() error {
 func (a *QueuedAssertion) MarshalBinary() ([]byte, error) {
 	var b cryptobyte.Builder
 
+	if len(a.Label) > MaxLabelLength {
+		return nil, ErrLabelTooLong
+	}
 	buf, err := a.marshalAndCheckAssertion()
 	if err != nil {
 		return nil, err
 	}
 	b.AddBytes(a.Checksum)
+	a.marshalAttributes(&b)
 	b.AddBytes(buf)
 
 	return b.Bytes()
@@ -133,23 +338,70 @@ func (ca *Handle) Close() error {
 		idx.Close()
 	}
 
-	for _, r := range ca.aas {
-		r.Close()
-	}
-
 	for _, t := range ca.trees {
 		t.Close()
 	}
 
 	ca.closed = true
+	if ca.readOnly {
+		return nil
+	}
 	return ca.flock.Unlock()
 }
 
-// Drops all entries from the queue
-func (h *Handle) dropQueue() error {
+// Returns ErrClosed or ErrReadOnly if the handle can't be used to change
+// the CA, or to sign.
+func (h *Handle) checkWritable() error {
 	if h.closed {
 		return ErrClosed
 	}
+	if h.readOnly {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// Drops the entries issued in the given batch, from the first size bytes
+// of the queue, from the queue: all but those deferred to a later batch.
+// Entries queued after the batch was started are kept.
+func (h *Handle) dropQueue(number uint32, size int64) error {
+	if err := h.checkWritable(); err != nil {
+		return err
+	}
+
+	var deferred bytes.Buffer
+	if err := h.walkQueuePrefix(size, func(qa QueuedAssertion) error {
+		if qa.NotBeforeBatch <= number {
+			return nil
+		}
+		return writeQueueEntry(&deferred, &qa)
+	}); err != nil {
+		return err
+	}
+
+	r, err := os.Open(h.queuePath())
+	if err != nil {
+		return fmt.Errorf("Opening queue: %w", err)
+	}
+	_, err = io.Copy(&deferred, io.NewSectionReader(r, size, math.MaxInt64-size))
+	r.Close()
+	if err != nil {
+		return fmt.Errorf("Reading queue: %w", err)
+	}
+
+	if deferred.Len() != 0 {
+		// Write to a temporary file first, so that the queue is replaced
+		// atomically.
+		tmpPath := gopath.Join(h.tmpPath(), "queue")
+		if err := os.WriteFile(tmpPath, deferred.Bytes(), 0o600); err != nil {
+			return fmt.Errorf("writing %s: %w", tmpPath, err)
+		}
+		if err := os.Rename(tmpPath, h.queuePath()); err != nil {
+			return fmt.Errorf("renaming %s: %w", tmpPath, err)
+		}
+		return nil
+	}
+
 	w, err := os.OpenFile(h.queuePath(), os.O_TRUNC, 0o644)
 	if err != nil {
 		return fmt.Errorf("truncating queue: %w", err)
@@ -164,10 +416,12 @@ func (h *Handle) dropQueue() error {
 // Queue multiple assertions for publication.
 //
 // For each entry, if checksum is not nil, makes sure the assertion
-// matches the checksum
+// matches the checksum. Refuses assertions with subject keys for schemes
+// the CA doesn't accept, and those rejected by the policies set with
+// SetKeyPolicy() and SetPolicy().
 func (h *Handle) QueueMultiple(it func(yield func(qa QueuedAssertion) error) error) error {
-	if h.closed {
-		return ErrClosed
+	if err := h.checkWritable(); err != nil {
+		return err
 	}
 
 	w, err := os.OpenFile(h.queuePath(), os.O_APPEND|os.O_WRONLY, 0o644)
@@ -177,27 +431,31 @@ func (h *Handle) QueueMultiple(it func(yield func(qa QueuedAssertion) error) err
 	defer w.Close()
 	bw := bufio.NewWriter(w)
 
+	now := h.now()
+
 	if err := it(func(qa QueuedAssertion) error {
-		buf, err := qa.MarshalBinary()
-		if err != nil {
-			return err
+		if qa.QueuedAt.IsZero() {
+			qa.QueuedAt = now
 		}
 
-		var b cryptobyte.Builder
-		b.AddUint16(uint16(len(buf)))
-		prefix, _ := b.Bytes()
+		if err := checkSubjectSchemes(&h.params, qa.Assertion.Subject); err != nil {
+			return err
+		}
 
-		_, err = bw.Write(prefix)
-		if err != nil {
-			return fmt.Errorf("writing to queue: %w", err)
+		if h.keyPolicy != nil {
+			if err := h.keyPolicy.Check(qa.Assertion.Subject); err != nil {
+				return err
+			}
 		}
 
-		_, err = bw.Write(buf)
-		if err != nil {
-			return fmt.Errorf("writing to queue: %w", err)
+		if h.policy != nil {
+			err := h.policy(qa.Assertion.Subject, qa.Assertion.Claims)
+			if err != nil {
+				return fmt.Errorf("refused by policy: %w", err)
+			}
 		}
 
-		return nil
+		return writeQueueEntry(bw, &qa)
 	}); err != nil {
 		return err
 	}
@@ -205,6 +463,30 @@ func (h *Handle) QueueMultiple(it func(yield func(qa QueuedAssertion) error) err
 	return bw.Flush()
 }
 
+// Writes the length-prefixed QueuedAssertion, as in the queue file, to w.
+func writeQueueEntry(w io.Writer, qa *QueuedAssertion) error {
+	buf, err := qa.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	var b cryptobyte.Builder
+	b.AddUint16(uint16(len(buf)))
+	prefix, _ := b.Bytes()
+
+	_, err = w.Write(prefix)
+	if err != nil {
+		return fmt.Errorf("writing to queue: %w", err)
+	}
+
+	_, err = w.Write(buf)
+	if err != nil {
+		return fmt.Errorf("writing to queue: %w", err)
+	}
+
+	return nil
+}
+
 // Queue assertion for publication.
 //
 // If checksum is not nil, makes sure assertion matches the checksum.
@@ -221,23 +503,30 @@ func (h *Handle) Queue(a mtc.Assertion, checksum []byte) error {
 
 // Load private state of Merkle Tree CA, and acquire lock.
 //
+// Checks that the signing key matches the public key in ca-params, and
+// returns ErrKeyMismatch otherwise, so that we don't issue batches nobody
+// can verify.
+//
 // Call Handle.Close() when done.
 func Open(path string) (*Handle, error) {
-	h := Handle{
-		path:    path,
-		indices: make(map[uint32]*Index),
-		aas:     make(map[uint32]*os.File),
-		trees:   make(map[uint32]*Tree),
+	h := newHandle(path)
+	if _, err := os.Stat(h.paramsPath()); os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w at %s", ErrNoCA, path)
 	}
 	if err := h.lock(); err != nil {
 		return nil, err
 	}
-	paramsBuf, err := os.ReadFile(h.paramsPath())
-	if err != nil {
-		return nil, fmt.Errorf("reading %s: %w", h.paramsPath(), err)
+	unlock := true
+	defer func() {
+		if unlock {
+			h.flock.Unlock()
+		}
+	}()
+	if err := h.loadParams(); err != nil {
+		return nil, err
 	}
-	if err := h.params.UnmarshalBinary(paramsBuf); err != nil {
-		return nil, fmt.Errorf("parsing %s: %w", h.paramsPath(), err)
+	if err := h.loadRetention(); err != nil {
+		return nil, err
 	}
 	skBuf, err := os.ReadFile(h.skPath())
 	if err != nil {
@@ -255,7 +544,72 @@ func Open(path string) (*Handle, error) {
 	if err != nil {
 		return nil, fmt.Errorf("parsing %s: %w", h.skPath(), err)
 	}
-	return &h, nil
+	if err := h.checkKey(); err != nil {
+		return nil, err
+	}
+	if err := h.clearTmp(); err != nil {
+		return nil, err
+	}
+	unlock = false
+	return h, nil
+}
+
+// Load the public state of a Merkle Tree CA for reading, such as to serve
+// proofs. Doesn't acquire the lock, and doesn't touch the signing key nor
+// the temporary files, so that it can be used while the CA is held by
+// another handle, in this process or another. As batches are moved into
+// place whole, readers don't see those that are being issued.
+//
+// Methods that change the CA or sign return ErrReadOnly.
+//
+// Call Handle.Close() when done.
+func OpenReadOnly(path string) (*Handle, error) {
+	h := newHandle(path)
+	if _, err := os.Stat(h.paramsPath()); os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w at %s", ErrNoCA, path)
+	}
+	if err := h.loadParams(); err != nil {
+		return nil, err
+	}
+	h.readOnly = true
+	return h, nil
+}
+
+func newHandle(path string) *Handle {
+	return &Handle{
+		path:    path,
+		indices: make(map[uint32]*Index),
+		trees:   make(map[uint32]*Tree),
+	}
+}
+
+// Reads ca-params, and sets up the storage of batches accordingly.
+func (h *Handle) loadParams() error {
+	paramsBuf, err := os.ReadFile(h.paramsPath())
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", h.paramsPath(), err)
+	}
+	if err := h.params.UnmarshalBinary(paramsBuf); err != nil {
+		return fmt.Errorf("parsing %s: %w", h.paramsPath(), err)
+	}
+	// Published files get the same permissions as ca-params.
+	paramsInfo, err := os.Stat(h.paramsPath())
+	if err != nil {
+		return fmt.Errorf("stat %s: %w", h.paramsPath(), err)
+	}
+	h.fileMode = paramsInfo.Mode().Perm()
+	h.SetStorage(nil)
+	return nil
+}
+
+// Signs a test message, and checks the signature against the public key
+// in ca-params.
+func (h *Handle) checkKey() error {
+	msg := []byte("mtc signing key self-test")
+	if err := h.params.PublicKey.Verify(msg, h.signer.Sign(msg)); err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrKeyMismatch, h.skPath(), err)
+	}
+	return nil
 }
 
 func (h Handle) skPath() string {
@@ -298,13 +652,47 @@ func (h Handle) tmpPath() string {
 	return gopath.Join(h.path, "tmp")
 }
 
+// Returns the permissions for published directories: those of published
+// files, with search permission wherever there's read permission.
+func (h Handle) dirMode() os.FileMode {
+	return h.fileMode | 0o700 | (h.fileMode&0o444)>>2
+}
+
+// Creates a published file in the given directory.
+func (h Handle) createFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, h.fileMode)
+}
+
+// Removes what's left in the temporary directory, such as a temporary
+// queue that was being written when a previous process crashed. As we
+// hold the lock, nobody else is using it. The resume folder is kept, so
+// that an interrupted issuance can continue, see resume.go.
+func (h *Handle) clearTmp() error {
+	entries, err := os.ReadDir(h.tmpPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("reading %s: %w", h.tmpPath(), err)
+	}
+	for _, entry := range entries {
+		path := gopath.Join(h.tmpPath(), entry.Name())
+		if path == h.resumePath() {
+			continue
+		}
+		slog.Info("Removing leftover temporary file", "path", path)
+		if err := os.RemoveAll(path); err != nil {
+			return fmt.Errorf("removing %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
 func (h Handle) getSignedValidityWindow(number uint32) (
 	*mtc.SignedValidityWindow, error) {
 	var w mtc.SignedValidityWindow
 
-	buf, err := os.ReadFile(
-		gopath.Join(h.batchPath(number), "signed-validity-window"),
-	)
+	buf, err := h.storage.Get(batchKey(number, "signed-validity-window"))
 	if err != nil {
 		return nil, err
 	}
@@ -340,17 +728,14 @@ func (h *Handle) listBatchNumbers() ([]uint32, error) {
 		return h.batchNumbersCache, nil
 	}
 
-	ds, err := os.ReadDir(h.batchesPath())
+	// Only the folders of the batches, not the files in them.
+	prefixes, err := h.storage.ListPrefixes("")
 	if err != nil {
 		return nil, err
 	}
 	ret := []uint32{}
-	for _, d := range ds {
-		if !d.IsDir() {
-			continue
-		}
-		name := d.Name()
-		batch, err := strconv.ParseUint(name, 10, 32)
+	for _, prefix := range prefixes {
+		batch, err := strconv.ParseUint(strings.TrimSuffix(prefix, "/"), 10, 32)
 		if err != nil {
 			continue
 		}
@@ -386,6 +771,102 @@ func (h *Handle) listBatchRange() (mtc.BatchRange, error) {
 	}, nil
 }
 
+// Information about an issued batch.
+type BatchInfo struct {
+	Number    uint32
+	Start     time.Time // Start of the period the batch covers
+	End       time.Time // End of the period the batch covers
+	LeafCount uint64
+	Root      []byte
+}
+
+// Returns range of batches that have been issued, and are still stored.
+func (h *Handle) ExistingBatches() (mtc.BatchRange, error) {
+	if h.closed {
+		return mtc.BatchRange{}, ErrClosed
+	}
+	return h.listBatchRange()
+}
+
+// Returns information about the given issued batch.
+func (h *Handle) BatchInfo(number uint32) (*BatchInfo, error) {
+	if h.closed {
+		return nil, ErrClosed
+	}
+
+	t, err := h.treeFor(number)
+	if err != nil {
+		return nil, fmt.Errorf("opening tree: %w", err)
+	}
+	w, err := h.getSignedValidityWindow(number)
+	if err != nil {
+		return nil, fmt.Errorf("loading signed validity window: %w", err)
+	}
+
+	start, end := h.params.BatchTimeRange(number)
+	return &BatchInfo{
+		Number:    number,
+		Start:     start,
+		End:       end,
+		LeafCount: t.LeafCount(),
+		Root:      w.TreeHeads[len(w.TreeHeads)-mtc.HashLen:],
+	}, nil
+}
+
+// Returns the signed validity window of the given issued batch.
+func (h *Handle) SignedValidityWindow(number uint32) (
+	*mtc.SignedValidityWindow, error) {
+	if h.closed {
+		return nil, ErrClosed
+	}
+	w, err := h.getSignedValidityWindow(number)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrUnknownBatch
+	}
+	return w, err
+}
+
+// Returns the tree head of each stored batch, by batch number, as its own
+// signed validity window has it.
+func (h *Handle) TreeHeads() (map[uint32][]byte, error) {
+	br, err := h.ExistingBatches()
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[uint32][]byte, br.Len())
+	for number := br.Begin; number < br.End; number++ {
+		w, err := h.SignedValidityWindow(number)
+		if err != nil {
+			return nil, fmt.Errorf("batch %d: %w", number, err)
+		}
+		head, ok := w.HeadForBatch(number)
+		if !ok {
+			return nil, fmt.Errorf("batch %d: window has no head for it", number)
+		}
+		ret[number] = head
+	}
+	return ret, nil
+}
+
+// Returns the signed validity windows that prove the window of batch to
+// is consistent with that of batch from, as checked by
+// mtc.VerifyConsistencyProof. All of them have to be stored still.
+func (h *Handle) ConsistencyProof(from, to uint32) (
+	[]*mtc.SignedValidityWindow, error) {
+	if from >= to {
+		return nil, fmt.Errorf("Batch %d is not before batch %d", from, to)
+	}
+	var ret []*mtc.SignedValidityWindow
+	for _, number := range h.params.ConsistencyProofBatches(from, to) {
+		w, err := h.SignedValidityWindow(number)
+		if err != nil {
+			return nil, fmt.Errorf("batch %d: %w", number, err)
+		}
+		ret = append(ret, w)
+	}
+	return ret, nil
+}
+
 // Calls f on each assertion queued to be published.
 func (h *Handle) WalkQueue(f func(QueuedAssertion) error) error {
 	r, err := os.OpenFile(h.queuePath(), os.O_RDONLY, 0)
@@ -394,8 +875,12 @@ func (h *Handle) WalkQueue(f func(QueuedAssertion) error) error {
 	}
 	defer r.Close()
 
-	br := bufio.NewReader(r)
+	return readQueue(bufio.NewReader(r), f)
+}
 
+// Reads length-prefixed QueuedAssertions, as in the queue file, from r,
+// and calls f on each.
+func readQueue(br *bufio.Reader, f func(QueuedAssertion) error) error {
 	for {
 		var (
 			prefix [2]byte
@@ -463,12 +948,15 @@ func (h *Handle) dropOldBatches(dt time.Time) error {
 			return err
 		}
 
-		slog.Info("Removing batch", "batch", batch)
-		if err := os.RemoveAll(h.batchPath(batch)); err != nil {
-			return fmt.Errorf("Removing batch %d: %w", batch, err)
+		if err := h.unpublishBatch(batch); err != nil {
+			return err
+		}
+
+		if err := h.retireBatch(batch, dt); err != nil {
+			return err
 		}
 	}
-	return nil
+	return h.pruneArchive(dt)
 }
 
 // Close any (cached) open files for the given batch.
@@ -481,14 +969,6 @@ func (h *Handle) closeBatch(batch uint32) error {
 		delete(h.indices, batch)
 	}
 
-	if r, ok := h.aas[batch]; ok {
-		err := r.Close()
-		if err != nil {
-			return fmt.Errorf("closing abridged-assertions for %d: %w", batch, err)
-		}
-		delete(h.aas, batch)
-	}
-
 	if r, ok := h.trees[batch]; ok {
 		err := r.Close()
 		if err != nil {
@@ -505,10 +985,11 @@ func (ca *Handle) indexFor(batch uint32) (*Index, error) {
 		return idx, nil
 	}
 
-	idx, err := OpenIndex(ca.indexPath(batch))
+	r, err := ca.storage.Open(batchKey(batch, "index"))
 	if err != nil {
 		return nil, err
 	}
+	idx := newIndex(r)
 
 	ca.indices[batch] = idx
 
@@ -521,30 +1002,22 @@ func (ca *Handle) treeFor(batch uint32) (*Tree, error) {
 		return t, nil
 	}
 
-	t, err := OpenTree(ca.treePath(batch))
+	r, err := ca.storage.Open(batchKey(batch, "tree"))
 	if err != nil {
 		return nil, err
 	}
+	t, err := NewTreeFromReaderAt(r, int64(r.Len()))
+	if err != nil {
+		r.Close()
+		return nil, fmt.Errorf("batch %d: tree: %w", batch, err)
+	}
+	t.closer = r
 
 	ca.trees[batch] = t
 
 	return t, nil
 }
 
-// Returns file handle to abridged-assertions file for the given batch.
-func (ca *Handle) aaFileFor(batch uint32) (*os.File, error) {
-	if r, ok := ca.aas[batch]; ok {
-		return r, nil
-	}
-
-	r, err := os.Open(ca.aaPath(batch))
-	if err != nil {
-		return nil, err
-	}
-
-	return r, nil
-}
-
 type keySearchResult struct {
 	Batch          uint32
 	SequenceNumber uint64
@@ -568,40 +1041,87 @@ func (ca *Handle) CertificateFor(a mtc.Assertion) (*mtc.BikeshedCertificate, err
 		return nil, fmt.Errorf("no assertion with key %x on record", key)
 	}
 
-	tree, err := ca.treeFor(res.Batch)
+	proof, err := ca.proofAt(res.Batch, res.SequenceNumber)
 	if err != nil {
 		return nil, err
 	}
 
-	path, err := tree.AuthenticationPath(res.SequenceNumber)
-	if err != nil {
-		return nil, fmt.Errorf("creating authentication path: %w", err)
-	}
-
-	p := ca.Params()
 	return &mtc.BikeshedCertificate{
 		Assertion: a,
-		Proof: mtc.NewMerkleTreeProof(
-			&mtc.Batch{CA: &p, Number: res.Batch},
-			res.SequenceNumber,
-			path,
-		),
+		Proof:     proof,
 	}, nil
 }
 
-// Search for AbridgedAssertions's batch/seqno/offset by key.
-func (ca *Handle) aaByKey(key []byte) (*keySearchResult, error) {
+// Returns the proof for the assertion with the given key in the given batch.
+//
+// Returns ErrBatchExpired if the batch is no longer active, ErrUnknownBatch
+// if it has not been issued (yet), and ErrUnknownKey if there is no
+// assertion with that key in the batch.
+func (ca *Handle) ProofFor(batch uint32, key []byte) (*mtc.MerkleTreeProof, error) {
+	if ca.closed {
+		return nil, ErrClosed
+	}
+
+	if len(key) != mtc.HashLen {
+		return nil, fmt.Errorf("key must be %d bytes", mtc.HashLen)
+	}
+
+	if batch < ca.params.ActiveBatches(ca.now()).Begin {
+		return nil, ErrBatchExpired
+	}
+
 	batches, err := ca.listBatchRange()
 	if err != nil {
 		return nil, fmt.Errorf("listing batches: %w", err)
 	}
+	if !batches.Contains(batch) {
+		return nil, ErrUnknownBatch
+	}
 
-	if batches.Len() == 0 {
-		return nil, nil
+	res, err := ca.aaByKeyIn(batch, key)
+	if err != nil {
+		return nil, fmt.Errorf("searching by key: %w", err)
+	}
+	if res == nil {
+		return nil, ErrUnknownKey
 	}
 
-	for batch := batches.End - 1; batch <= batches.End; batch-- {
-		res, err := ca.aaByKeyIn(batch, key)
+	return ca.proofAt(batch, res.SequenceNumber)
+}
+
+// Returns the proof for the assertion at the given index in the batch.
+func (ca *Handle) proofAt(batch uint32, index uint64) (*mtc.MerkleTreeProof, error) {
+	tree, err := ca.treeFor(batch)
+	if err != nil {
+		return nil, err
+	}
+
+	path, err := tree.AuthenticationPath(index)
+	if err != nil {
+		return nil, fmt.Errorf("creating authentication path: %w", err)
+	}
+
+	p := ca.Params()
+	return mtc.NewMerkleTreeProof(
+		&mtc.Batch{CA: &p, Number: batch},
+		index,
+		path,
+	), nil
+}
+
+// Search for AbridgedAssertions's batch/seqno/offset by key.
+func (ca *Handle) aaByKey(key []byte) (*keySearchResult, error) {
+	batches, err := ca.listBatchRange()
+	if err != nil {
+		return nil, fmt.Errorf("listing batches: %w", err)
+	}
+
+	if batches.Len() == 0 {
+		return nil, nil
+	}
+
+	for batch := batches.End - 1; batch <= batches.End; batch-- {
+		res, err := ca.aaByKeyIn(batch, key)
 		if err != nil {
 			return nil, fmt.Errorf("Searching in batch %d: %w", batch, err)
 		}
@@ -629,14 +1149,46 @@ func (ca *Handle) aaByKeyIn(batch uint32, key []byte) (*IndexSearchResult, error
 
 // Issue queued assertions into new batch.
 //
+// Issues all batches that are ready. The queued assertions go into the
+// last of these, and the others are empty. An empty queue is not an error:
+// the batch is issued nonetheless, without assertions, and its tree
+// consists of just the hash of the empty batch. If no batch is ready yet,
+// Issue does nothing, and returns nil.
+//
 // Drops batches that fall outside of storage window.
 func (h *Handle) Issue() error {
-	if h.closed {
-		return ErrClosed
+	return h.IssueContext(context.Background())
+}
+
+// Sets the number of goroutines that hash the tree of batches issued from
+// now on, to cap the CPU used by issuance on a shared host. If n is not
+// positive, which is the default, uses GOMAXPROCS. The tree doesn't
+// depend on the number of workers.
+func (h *Handle) SetIssueWorkers(n int) {
+	h.workers = n
+}
+
+// Like Issue, but stops when ctx is cancelled.
+//
+// Each batch is built in a temporary directory, and only moved into place
+// after its validity window has been signed. Thus if ctx is cancelled, or
+// the process crashes, before that, the batch is not issued, and the
+// queue is left untouched. Batches issued earlier in the same call remain.
+// The next call continues building the batch where this one stopped, see
+// resume.go.
+//
+// First moves the entries of the queue log into the queue, see QueueLog.
+func (h *Handle) IssueContext(ctx context.Context) error {
+	if err := h.checkWritable(); err != nil {
+		return err
 	}
 
-	dt := time.Now()
-	err := h.issue(dt)
+	if err := h.FoldQueueLog(); err != nil {
+		return fmt.Errorf("folding queue log: %w", err)
+	}
+
+	dt := h.now()
+	err := h.issue(ctx, dt)
 	if err != nil {
 		return err
 	}
@@ -647,7 +1199,7 @@ func (h *Handle) Issue() error {
 	return nil
 }
 
-func (h *Handle) issue(dt time.Time) error {
+func (h *Handle) issue(ctx context.Context, dt time.Time) error {
 	slog.Info("Starting issuance", "time", dt)
 
 	expectedStored := h.params.StoredBatches(dt)
@@ -702,11 +1254,20 @@ func (h *Handle) issue(dt time.Time) error {
 
 	slog.Info("To issue", "batches", toCreate)
 
+	if err := h.checkNextBatch(toCreate.Begin, dt); err != nil {
+		return err
+	}
+
 	for batch := toCreate.Begin; batch < toCreate.End; batch++ {
-		err := h.issueBatch(batch, batch < toCreate.End-1)
+		err := h.issueBatch(ctx, batch, batch < toCreate.End-1)
 		if err != nil {
 			return fmt.Errorf("issuing %d: %w", batch, err)
 		}
+
+		err = h.appendAuditLog(batch, dt)
+		if err != nil {
+			return fmt.Errorf("writing audit log for %d: %w", batch, err)
+		}
 	}
 
 	return nil
@@ -716,53 +1277,75 @@ func (h *Handle) issue(dt time.Time) error {
 //
 // Assumes this is the first batch, or the previous batch exists already.
 //
-// If empty is true, issues an empty batch. Otherwise, drain the queue.
-func (h *Handle) issueBatch(number uint32, empty bool) error {
-	deleteDir1 := true
-
-	// We perform issuance twice, and compare results.
-	dir1, err := os.MkdirTemp(h.tmpPath(), fmt.Sprintf("batch1-%d-*", number))
+// If empty is true, issues an empty batch. Otherwise, drain the queue,
+// except for the assertions deferred to a later batch.
+//
+// The batch is built in the resume folder, see resume.go. If issuance of
+// the same batch was interrupted before, it continues from the last
+// checkpoint, with the part of the queue it started with, even if the
+// batch would be empty otherwise.
+func (h *Handle) issueBatch(ctx context.Context, number uint32, empty bool) error {
+	is, err := h.startIssuance(number, empty)
 	if err != nil {
-		return fmt.Errorf("creating temporary directory: %w", err)
+		return fmt.Errorf("starting issuance: %w", err)
 	}
-	dir2, err := os.MkdirTemp(h.tmpPath(), fmt.Sprintf("batch2-%d-*", number))
-	if err != nil {
-		return fmt.Errorf("creating temporary directory: %w", err)
-	}
-
-	defer func() {
-		os.RemoveAll(dir2)
-		if deleteDir1 {
-			os.RemoveAll(dir1)
-		}
-	}()
 
 	batch := mtc.Batch{
 		Number: number,
 		CA:     &h.params,
 	}
 
-	err = h.issueBatchTo(dir1, batch, empty)
-	if err != nil {
-		return err
-	}
-
-	err = h.issueBatchTo(dir2, batch, empty)
-	if err != nil {
-		return err
+	// We perform issuance twice, and compare results.
+	for i := 1; i <= 2; i++ {
+		// The first is moved into place, so create it with the
+		// permissions of published directories.
+		dir := is.buildDir(i)
+		if err := os.MkdirAll(dir, h.dirMode()); err != nil {
+			return fmt.Errorf("creating %s: %w", dir, err)
+		}
+		progress, err := is.progress(i)
+		if err != nil {
+			return fmt.Errorf("loading progress: %w", err)
+		}
+		err = h.issueBatchTo(ctx, dir, batch, is.queueSize, is.issuedAt,
+			progress, is.runDir(i))
+		if err != nil {
+			return err
+		}
 	}
 
 	// Ok, let's compare
+	dir1 := is.buildDir(1)
 	err = assertFilesEqual(
 		dir1,
-		dir2,
+		is.buildDir(2),
 		[]string{
 			"tree",
 			"signed-validity-window",
 			"abridged-assertions",
 			"index",
+			"summary",
 		},
 	)
+	if err != nil {
+		// We can't tell which is wrong, so start over next time.
+		if err2 := h.DiscardIssuanceCheckpoint(); err2 != nil {
+			slog.Error("Discarding issuance checkpoint", "err", err2)
+		}
+		return err
+	}
+
+	// Last chance to back out: after this, the batch is issued.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := h.publishBatch(number, dir1); err != nil {
+		if err2 := h.unpublishBatch(number); err2 != nil {
+			slog.Error("Removing partially stored batch", "batch", number, "err", err2)
+		}
+		return fmt.Errorf("storing batch: %w", err)
+	}
 
 	h.batchNumbersCache = nil // Invalidate cache of existing batches
 
@@ -775,15 +1358,17 @@ func (h *Handle) issueBatch(number uint32, empty bool) error {
 		)
 	}
 
-	deleteDir1 = false
-
-	if !empty {
-		err = h.dropQueue()
+	if is.queueSize != 0 {
+		err = h.dropQueue(number, is.queueSize)
 		if err != nil {
 			return fmt.Errorf("Emptying queue: %w", err)
 		}
 	}
 
+	if err := h.DiscardIssuanceCheckpoint(); err != nil {
+		return err
+	}
+
 	err = h.updateLatest(number)
 	if err != nil {
 		return fmt.Errorf("Updating latest symlink: %w", err)
@@ -862,7 +1447,13 @@ func sha256File(path string) ([]byte, error) {
 
 // Like issueBatch, but don't write out to the correct directory yet.
 // Instead, write to dir. Also, don't empty the queue.
-func (h *Handle) issueBatchTo(dir string, batch mtc.Batch, empty bool) error {
+//
+// Takes the assertions from the first queueSize bytes of the queue.
+// Continues from progress, and stores it after each step, with the runs
+// of the index in runDir.
+func (h *Handle) issueBatchTo(ctx context.Context, dir string,
+	batch mtc.Batch, queueSize int64, issuedAt time.Time,
+	progress *buildProgress, runDir string) error {
 	// First fetch previous tree heads
 	var prevHeads []byte
 
@@ -881,122 +1472,394 @@ func (h *Handle) issueBatchTo(dir string, batch mtc.Batch, empty bool) error {
 		prevHeads = w.ValidityWindow.TreeHeads
 	}
 
-	// Read queue and write abridged-assertions
 	aasPath := gopath.Join(dir, "abridged-assertions")
-	aasW, err := os.Create(aasPath)
+	if progress.stage < stageAbridgedAssertions {
+		err := h.writeAbridgedAssertions(ctx, aasPath, batch, queueSize)
+		if err != nil {
+			return err
+		}
+		progress.stage = stageAbridgedAssertions
+		if err := progress.save(); err != nil {
+			return err
+		}
+	}
+
+	aasR, err := os.OpenFile(aasPath, os.O_RDONLY, 0)
 	if err != nil {
-		return fmt.Errorf("creating %s: %w", aasPath, err)
+		return fmt.Errorf("opening %s: %w", aasPath, err)
 	}
-	defer aasW.Close()
-	aasBW := bufio.NewWriter(aasW)
+	defer aasR.Close()
 
-	if !empty {
-		err = h.WalkQueue(func(qa QueuedAssertion) error {
-			aa := qa.Assertion.Abridge()
-			buf, err := aa.MarshalBinary()
-			if err != nil {
-				return fmt.Errorf("Marshalling assertion %x: %w", qa.Checksum, err)
-			}
+	// Compute tree. It's written out level by level, so that we don't
+	// need to keep it in memory, and can continue after the last level
+	// that was written.
+	if progress.stage < stageTree {
+		treePath := gopath.Join(dir, "tree")
+		var treeW *os.File
+		if progress.tree.Levels == 0 {
+			treeW, err = h.createFile(treePath)
+		} else {
+			treeW, err = os.OpenFile(treePath, os.O_RDWR, 0)
+		}
+		if err != nil {
+			return fmt.Errorf("opening %s: %w", treePath, err)
+		}
 
-			_, err = aasBW.Write(buf)
-			if err != nil {
-				return fmt.Errorf(
-					"Writing assertion %x to %s: %w",
-					qa.Checksum,
-					aasPath,
-					err,
-				)
-			}
-			return nil
-		})
+		defer treeW.Close()
+
+		_, root, err := batch.WriteTreeResumable(bufio.NewReader(aasR), treeW,
+			h.workers, progress.tree, func(tp mtc.TreeProgress) error {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				if err := treeW.Sync(); err != nil {
+					return err
+				}
+				progress.tree = tp
+				return progress.save()
+			})
+		if err != nil {
+			return fmt.Errorf("computing tree: %w", err)
+		}
+
+		err = treeW.Sync()
+		if err == nil {
+			err = treeW.Close()
+		}
 		if err != nil {
-			return fmt.Errorf("walking queue: %w", err)
+			return fmt.Errorf("closing %s: %w", treePath, err)
+		}
+
+		progress.stage = stageTree
+		progress.root = root
+		if err := progress.save(); err != nil {
+			return err
 		}
 	}
+	root := progress.root
 
-	err = aasBW.Flush()
+	// Compute index
+	if progress.stage < stageIndex {
+		_, err = aasR.Seek(0, 0)
+		if err != nil {
+			return fmt.Errorf("seeking %s to start: %w", aasPath, err)
+		}
+
+		indexPath := gopath.Join(dir, "index")
+		indexW, err := h.createFile(indexPath)
+		if err != nil {
+			return fmt.Errorf("creating %s: %w", indexPath, err)
+		}
+
+		defer indexW.Close()
+
+		if err := os.MkdirAll(runDir, 0o700); err != nil {
+			return fmt.Errorf("os.MkdirAll(%s): %w", runDir, err)
+		}
+		err = computeIndexResumable(aasR, indexW, runDir, progress.index,
+			func(ip indexProgress) error {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				progress.index = ip
+				return progress.save()
+			})
+		if err != nil {
+			return fmt.Errorf("computing %s to start: %w", indexPath, err)
+		}
+
+		err = indexW.Sync()
+		if err == nil {
+			err = indexW.Close()
+		}
+		if err != nil {
+			return fmt.Errorf("closing %s: %w", indexPath, err)
+		}
+
+		progress.stage = stageIndex
+		if err := progress.save(); err != nil {
+			return err
+		}
+		if err := os.RemoveAll(runDir); err != nil {
+			return fmt.Errorf("removing %s: %w", runDir, err)
+		}
+	}
+
+	// Sign validity window
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	w, err := batch.SignValidityWindow(h.signer, prevHeads, root)
 	if err != nil {
-		return fmt.Errorf("flushing %s: %w", aasPath, err)
+		return fmt.Errorf("signing ValidityWindow: %w", err)
 	}
 
-	err = aasW.Close()
+	buf, err := w.MarshalBinary()
 	if err != nil {
-		return fmt.Errorf("closing %s: %w", aasPath, err)
+		return fmt.Errorf("marhshalling SignedValidityWindow: %w", err)
 	}
-	aasR, err := os.OpenFile(aasPath, os.O_RDONLY, 0)
+
+	wPath := gopath.Join(dir, "signed-validity-window")
+	err = os.WriteFile(wPath, buf, h.fileMode)
 	if err != nil {
-		return fmt.Errorf("opening %s: %w", aasPath, err)
+		return fmt.Errorf("writing to %s: %w", wPath, err)
 	}
-	defer aasR.Close()
 
-	// Compute tree
-	tree, err := batch.ComputeTree(bufio.NewReader(aasR))
+	// Write summary
+	_, err = aasR.Seek(0, 0)
+	if err != nil {
+		return fmt.Errorf("seeking %s to start: %w", aasPath, err)
+	}
+	summary, err := batch.Summary(root, bufio.NewReader(aasR), issuedAt)
+	if err != nil {
+		return fmt.Errorf("computing summary: %w", err)
+	}
+	buf, err = summary.MarshalBinary()
 	if err != nil {
-		return fmt.Errorf("computing tree: %w", err)
+		return fmt.Errorf("marshalling summary: %w", err)
 	}
+	sPath := gopath.Join(dir, "summary")
+	if err := os.WriteFile(sPath, buf, h.fileMode); err != nil {
+		return fmt.Errorf("writing to %s: %w", sPath, err)
+	}
+	return writeProducer(dir, h.fileMode)
+}
 
-	treePath := gopath.Join(dir, "tree")
-	treeW, err := os.Create(treePath)
+// Writes the abridged assertions of the batch, from the first queueSize
+// bytes of the queue, to aasPath, and syncs it.
+//
+// Duplicates are dropped, keeping the first. So as not to keep the key of
+// every assertion in memory, they're found as the index is: the assertions
+// are written to a temporary file first, and sorted by key in runs, which
+// are merged. There duplicates are adjacent, and the merge marks them in a
+// file with a byte per assertion. The others are copied to aasPath.
+func (h *Handle) writeAbridgedAssertions(ctx context.Context, aasPath string,
+	batch mtc.Batch, queueSize int64) error {
+	allPath := aasPath + ".all"
+	marksPath := aasPath + ".duplicates"
+	defer os.Remove(allPath)
+	defer os.Remove(marksPath)
+
+	n, err := h.writeQueuedAbridgedAssertions(ctx, allPath, batch, queueSize)
 	if err != nil {
-		return fmt.Errorf("creating %s: %w", treePath, err)
+		return err
 	}
 
-	defer treeW.Close()
+	allR, err := os.Open(allPath)
+	if err != nil {
+		return fmt.Errorf("opening %s: %w", allPath, err)
+	}
+	defer allR.Close()
 
-	err = tree.WriteTo(treeW)
+	marks, err := os.OpenFile(marksPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
 	if err != nil {
-		return fmt.Errorf("writing out %s: %w", treePath, err)
+		return fmt.Errorf("creating %s: %w", marksPath, err)
+	}
+	defer marks.Close()
+	if err := marks.Truncate(int64(n)); err != nil {
+		return fmt.Errorf("truncating %s: %w", marksPath, err)
 	}
 
-	err = treeW.Close()
+	err = buildIndex(bufio.NewReader(allR), io.Discard, indexBuild{
+		tmpDir: gopath.Dir(aasPath),
+		duplicate: func(entry indexEntry) error {
+			_, err := marks.WriteAt([]byte{1}, int64(entry.seqno))
+			return err
+		},
+	})
 	if err != nil {
-		return fmt.Errorf("closing %s: %w", treePath, err)
+		return fmt.Errorf("finding duplicates: %w", err)
 	}
 
-	// Compute index
-	_, err = aasR.Seek(0, 0)
+	if _, err := allR.Seek(0, 0); err != nil {
+		return fmt.Errorf("seeking %s to start: %w", allPath, err)
+	}
+	if _, err := marks.Seek(0, 0); err != nil {
+		return fmt.Errorf("seeking %s to start: %w", marksPath, err)
+	}
+	marksR := bufio.NewReader(marks)
+
+	aasW, err := h.createFile(aasPath)
 	if err != nil {
-		return fmt.Errorf("seeking %s to start: %w", aasPath, err)
+		return fmt.Errorf("creating %s: %w", aasPath, err)
 	}
+	defer aasW.Close()
+	aasBW := bufio.NewWriter(aasW)
 
-	indexPath := gopath.Join(dir, "index")
-	indexW, err := os.Create(indexPath)
+	// We only know the number of assertions after dropping duplicates, so
+	// we write the header with a zero count first, and fill it in later.
+	aasHeader := mtc.AbridgedAssertionsHeader{
+		Version: mtc.AbridgedAssertionsVersion,
+	}
+	hdrBuf, err := aasHeader.MarshalBinary()
 	if err != nil {
-		return fmt.Errorf("creating %s: %w", indexPath, err)
+		return fmt.Errorf("marshalling abridged-assertions header: %w", err)
+	}
+	_, err = aasBW.Write(hdrBuf)
+	if err != nil {
+		return fmt.Errorf("writing header to %s: %w", aasPath, err)
 	}
 
-	defer indexW.Close()
+	err = mtc.UnmarshalAbridgedAssertions(bufio.NewReader(allR),
+		func(_ int, aa *mtc.AbridgedAssertion) error {
+			duplicate, err := marksR.ReadByte()
+			if err != nil {
+				return fmt.Errorf("reading %s: %w", marksPath, err)
+			}
+			if duplicate != 0 {
+				return nil
+			}
 
-	err = ComputeIndex(aasR, indexW)
+			buf, err := aa.MarshalBinary()
+			if err != nil {
+				return fmt.Errorf("Marshalling assertion: %w", err)
+			}
+			if _, err := aasBW.Write(buf); err != nil {
+				return fmt.Errorf("writing to %s: %w", aasPath, err)
+			}
+			aasHeader.Count++
+			return nil
+		})
 	if err != nil {
-		return fmt.Errorf("computing %s to start: %w", indexPath, err)
+		return fmt.Errorf("reading %s: %w", allPath, err)
 	}
 
-	// Sign validity window
-	w, err := batch.SignValidityWindow(h.signer, prevHeads, tree.Root())
+	err = aasBW.Flush()
 	if err != nil {
-		return fmt.Errorf("signing ValidityWindow: %w", err)
+		return fmt.Errorf("flushing %s: %w", aasPath, err)
 	}
 
-	buf, err := w.MarshalBinary()
+	hdrBuf, err = aasHeader.MarshalBinary()
 	if err != nil {
-		return fmt.Errorf("marhshalling SignedValidityWindow: %w", err)
+		return fmt.Errorf("marshalling abridged-assertions header: %w", err)
+	}
+	_, err = aasW.WriteAt(hdrBuf, 0)
+	if err != nil {
+		return fmt.Errorf("writing header to %s: %w", aasPath, err)
 	}
 
-	wPath := gopath.Join(dir, "signed-validity-window")
-	err = os.WriteFile(wPath, buf, 0o644)
+	err = aasW.Sync()
+	if err == nil {
+		err = aasW.Close()
+	}
 	if err != nil {
-		return fmt.Errorf("writing to %s: %w", wPath, err)
+		return fmt.Errorf("closing %s: %w", aasPath, err)
+	}
+	return nil
+}
+
+// Writes the abridged assertions of the batch, from the first queueSize
+// bytes of the queue, to path in leaf order, without a header, and
+// duplicates included. Returns their number.
+func (h *Handle) writeQueuedAbridgedAssertions(ctx context.Context,
+	path string, batch mtc.Batch, queueSize int64) (uint64, error) {
+	w, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return 0, fmt.Errorf("creating %s: %w", path, err)
+	}
+	defer w.Close()
+	bw := bufio.NewWriter(w)
+
+	var n uint64
+	if queueSize != 0 {
+		order := h.leafOrder
+		if order == nil {
+			order = QueueOrder
+		}
+
+		walk := func(f func(QueuedAssertion) error) error {
+			return h.walkQueuePrefix(queueSize, f)
+		}
+		err = order(walk, func(qa QueuedAssertion) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if qa.NotBeforeBatch > batch.Number {
+				return nil
+			}
+
+			aa := qa.Assertion.Abridge()
+			buf, err := aa.MarshalBinary()
+			if err != nil {
+				return fmt.Errorf("Marshalling assertion %x: %w", qa.Checksum, err)
+			}
+
+			_, err = bw.Write(buf)
+			if err != nil {
+				return fmt.Errorf(
+					"Writing assertion %x to %s: %w",
+					qa.Checksum,
+					path,
+					err,
+				)
+			}
+			n++
+			return nil
+		})
+		if err != nil {
+			return 0, fmt.Errorf("walking queue: %w", err)
+		}
+	}
+
+	if err := bw.Flush(); err != nil {
+		return 0, fmt.Errorf("flushing %s: %w", path, err)
+	}
+	if err := w.Close(); err != nil {
+		return 0, fmt.Errorf("closing %s: %w", path, err)
+	}
+	return n, nil
+}
+
+// Writes out the CA parameters, and the producer annotation next to it.
+func (h *Handle) writeParams() error {
+	paramsBuf, err := h.params.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("Marshalling params: %w", err)
+	}
+
+	// Write to a temporary file first, so that ca-params is replaced
+	// atomically.
+	tmpPath := h.paramsPath() + ".tmp"
+	if err := os.WriteFile(tmpPath, paramsBuf, h.fileMode); err != nil {
+		return fmt.Errorf("Writing %s: %w", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, h.paramsPath()); err != nil {
+		return fmt.Errorf("Renaming %s: %w", tmpPath, err)
+	}
+	return writeProducer(gopath.Dir(h.paramsPath()), h.fileMode)
+}
+
+// Removes the state of an existing CA at h.path, except for the lock.
+func (h *Handle) removeState() error {
+	for _, p := range []string{
+		h.skPath(),
+		h.paramsPath(),
+		h.queuePath(),
+		h.queueLogPath(),
+		h.auditLogPath(),
+		h.retentionPath(),
+		h.archivePath(),
+		h.tmpPath(),
+		gopath.Join(h.path, "www"),
+	} {
+		if err := os.RemoveAll(p); err != nil {
+			return fmt.Errorf("removing %s: %w", p, err)
+		}
 	}
 	return nil
 }
 
 // Creates a new Merkle Tree CA, and opens it.
 //
+// Fails with ErrCAExists if there is a CA at path already, unless
+// opts.Force or opts.IfNotExists is set.
+//
 // Call Handle.Close() when done.
 func New(path string, opts NewOpts) (*Handle, error) {
 	h := Handle{
-		path: path,
+		path:    path,
+		indices: make(map[uint32]*Index),
+		trees:   make(map[uint32]*Tree),
 	}
 
 	// Set defaults
@@ -1009,6 +1872,9 @@ func New(path string, opts NewOpts) (*Handle, error) {
 	if opts.StorageDuration == 0 {
 		opts.StorageDuration = 2 * opts.Lifetime
 	}
+	if opts.FileMode == 0 {
+		opts.FileMode = 0o644
+	}
 
 	// Check options
 	if opts.BatchDuration.Nanoseconds()%1000000000 != 0 {
@@ -1026,6 +1892,20 @@ func New(path string, opts NewOpts) (*Handle, error) {
 	if opts.StorageDuration.Nanoseconds()%opts.BatchDuration.Nanoseconds() != 0 {
 		return nil, errors.New("StorageDuration has to be a multiple of BatchDuration")
 	}
+	if opts.FileMode&^os.ModePerm != 0 {
+		return nil, fmt.Errorf("FileMode %o has bits other than permissions", opts.FileMode)
+	}
+	if opts.FileMode&0o600 != 0o600 {
+		return nil, fmt.Errorf("FileMode %o has to allow the owner to read and write", opts.FileMode)
+	}
+	if opts.HttpServer == "" {
+		return nil, errors.New("HttpServer can't be empty")
+	}
+	if opts.Force && opts.IfNotExists {
+		return nil, errors.New("Force and IfNotExists can't both be set")
+	}
+	h.fileMode = opts.FileMode
+	h.SetStorage(nil)
 	h.params.ValidityWindowSize = uint64(opts.Lifetime.Nanoseconds() / opts.BatchDuration.Nanoseconds())
 	h.params.BatchDuration = uint64(opts.BatchDuration.Nanoseconds() / 1000000000)
 	h.params.Lifetime = uint64(opts.Lifetime.Nanoseconds() / 1000000000)
@@ -1036,6 +1916,26 @@ func New(path string, opts NewOpts) (*Handle, error) {
 	h.params.HttpServer = opts.HttpServer
 	h.params.IssuerId = opts.IssuerId
 
+	if len(opts.AllowedSubjectSchemes) != 0 {
+		schemes := slices.Clone(opts.AllowedSubjectSchemes)
+		slices.Sort(schemes)
+		h.params.AllowedSubjectSchemes = slices.Compact(schemes)
+	}
+	h.params.LeafEncoding = opts.LeafEncoding
+
+	for _, c := range opts.BatchDurationChanges {
+		if c.After <= 0 || c.After%time.Second != 0 ||
+			c.BatchDuration <= 0 || c.BatchDuration%time.Second != 0 {
+			return nil, errors.New(
+				"BatchDurationChanges have to be positive and in full seconds")
+		}
+		h.params.BatchDurationChanges = append(h.params.BatchDurationChanges,
+			mtc.BatchDurationChange{
+				EffectiveFrom: h.params.StartTime + uint64(c.After/time.Second),
+				BatchDuration: uint64(c.BatchDuration / time.Second),
+			})
+	}
+
 	if opts.SignatureScheme == 0 {
 		opts.SignatureScheme = mtc.TLSDilitihium5r3
 	}
@@ -1056,7 +1956,7 @@ func New(path string, opts NewOpts) (*Handle, error) {
 	// Write out. First, create directory if it doesn't exist
 	info, err := os.Stat(path)
 	if os.IsNotExist(err) {
-		err = os.MkdirAll(path, 0o755)
+		err = os.MkdirAll(path, h.dirMode())
 		if err != nil {
 			return nil, fmt.Errorf("os.MkdirAll(%s): %w", path, err)
 		}
@@ -1077,6 +1977,23 @@ func New(path string, opts NewOpts) (*Handle, error) {
 		}
 	}()
 
+	// Check for an existing CA
+	if _, err := os.Stat(h.paramsPath()); err == nil {
+		if opts.IfNotExists {
+			h.flock.Unlock()
+			unlock = false
+			return openExisting(path, &h.params)
+		}
+		if !opts.Force {
+			return nil, fmt.Errorf("%w at %s", ErrCAExists, path)
+		}
+		if err := h.removeState(); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("os.Stat(%s): %w", h.paramsPath(), err)
+	}
+
 	// Write out signing key
 	if err := os.WriteFile(h.skPath(), signer.Bytes(), 0o400); err != nil {
 		return nil, fmt.Errorf("writing %s: %w", h.skPath(), err)
@@ -1084,30 +2001,90 @@ func New(path string, opts NewOpts) (*Handle, error) {
 
 	// Create folders
 	pubPath := h.batchesPath()
-	err = os.MkdirAll(pubPath, 0o755)
+	err = os.MkdirAll(pubPath, h.dirMode())
 	if err != nil {
 		return nil, fmt.Errorf("os.MkdirAll(%s): %w", pubPath, err)
 	}
 
 	tmpPath := h.tmpPath()
-	err = os.MkdirAll(tmpPath, 0o755)
+	err = os.MkdirAll(tmpPath, 0o700)
 	if err != nil {
 		return nil, fmt.Errorf("os.MkdirAll(%s): %w", tmpPath, err)
 	}
 
 	// Queue
-	if err := os.WriteFile(h.queuePath(), []byte{}, 0o644); err != nil {
+	if err := os.WriteFile(h.queuePath(), []byte{}, 0o600); err != nil {
 		return nil, fmt.Errorf("Writing %s: %w", h.queuePath(), err)
 	}
 
-	paramsBuf, err := h.params.MarshalBinary()
-	if err != nil {
-		return nil, fmt.Errorf("Marshalling params: %w", err)
-	}
-	if err := os.WriteFile(h.paramsPath(), paramsBuf, 0o644); err != nil {
-		return nil, fmt.Errorf("Writing %s: %w", h.paramsPath(), err)
+	if err := h.writeParams(); err != nil {
+		return nil, err
 	}
 
 	unlock = false
 	return &h, nil
 }
+
+// Opens the CA at path, and checks that it has the parameters p that
+// New would've created, apart from the start time and the key.
+func openExisting(path string, p *mtc.CAParams) (*Handle, error) {
+	h, err := Open(path)
+	if err != nil {
+		return nil, err
+	}
+	q := &h.params
+	var diff string
+	switch {
+	case q.IssuerId != p.IssuerId:
+		diff = fmt.Sprintf("issuer %q, not %q", q.IssuerId, p.IssuerId)
+	case q.HttpServer != p.HttpServer:
+		diff = fmt.Sprintf("HTTP server %q, not %q", q.HttpServer, p.HttpServer)
+	case q.BatchDuration != p.BatchDuration:
+		diff = fmt.Sprintf("batch duration %ds, not %ds",
+			q.BatchDuration, p.BatchDuration)
+	case q.Lifetime != p.Lifetime:
+		diff = fmt.Sprintf("lifetime %ds, not %ds", q.Lifetime, p.Lifetime)
+	case q.ValidityWindowSize != p.ValidityWindowSize:
+		diff = fmt.Sprintf("validity window size %d, not %d",
+			q.ValidityWindowSize, p.ValidityWindowSize)
+	case q.StorageWindowSize != p.StorageWindowSize:
+		diff = fmt.Sprintf("storage window size %d, not %d",
+			q.StorageWindowSize, p.StorageWindowSize)
+	case q.PublicKey.Scheme() != p.PublicKey.Scheme():
+		diff = fmt.Sprintf("signature scheme %v, not %v",
+			q.PublicKey.Scheme(), p.PublicKey.Scheme())
+	case !slices.Equal(q.AllowedSubjectSchemes, p.AllowedSubjectSchemes):
+		diff = fmt.Sprintf("allowed subject schemes %v, not %v",
+			q.AllowedSubjectSchemes, p.AllowedSubjectSchemes)
+	case q.LeafEncoding != p.LeafEncoding:
+		diff = fmt.Sprintf("leaf encoding %s, not %s",
+			q.LeafEncoding, p.LeafEncoding)
+	case !slices.EqualFunc(q.BatchDurationChanges, p.BatchDurationChanges,
+		func(a, b mtc.BatchDurationChange) bool {
+			// Relative to the start, which differs.
+			return a.EffectiveFrom-q.StartTime == b.EffectiveFrom-p.StartTime &&
+				a.BatchDuration == b.BatchDuration
+		}):
+		diff = "different batch duration changes"
+	}
+	if diff != "" {
+		h.Close()
+		return nil, fmt.Errorf("%w at %s: %s", ErrCAMismatch, path, diff)
+	}
+	return h, nil
+}
+
+// Returns the checkpoint of the given batch as a note signed by the CA.
+// See mtc.Checkpoint.
+func (h *Handle) Checkpoint(number uint32) ([]byte, error) {
+	if err := h.checkWritable(); err != nil {
+		return nil, err
+	}
+	info, err := h.BatchInfo(number)
+	if err != nil {
+		return nil, err
+	}
+	batch := mtc.Batch{CA: &h.params, Number: number}
+	c := batch.Checkpoint(info.LeafCount, info.Root)
+	return c.Sign(h.params.IssuerId, h.signer, h.params.PublicKey)
+}
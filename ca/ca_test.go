@@ -0,0 +1,2731 @@
+package ca
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwesterb/mtc"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+func createTestCA(t *testing.T) *Handle {
+	h, err := New(t.TempDir(), NewOpts{
+		IssuerId:      "example",
+		HttpServer:    "ca.example.com",
+		BatchDuration: time.Second,
+		Lifetime:      10 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+// Moves the CA's clock to the given number of seconds after its start.
+func setTestClock(h *Handle, seconds float64) {
+	start := time.Unix(int64(h.params.StartTime), 0)
+	now := start.Add(time.Duration(seconds * float64(time.Second)))
+	h.clock = func() time.Time { return now }
+}
+
+func TestIssueEmptyQueue(t *testing.T) {
+	h := createTestCA(t)
+
+	// Nothing is ready yet
+	setTestClock(h, 0.5)
+	if err := h.Issue(); err != nil {
+		t.Fatal(err)
+	}
+	br, err := h.ExistingBatches()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if br.Len() != 0 {
+		t.Fatalf("expected no batches; got %s", br)
+	}
+
+	setTestClock(h, 3.5)
+	if err := h.Issue(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Issuing again without any new batch ready is a no-op
+	if err := h.Issue(); err != nil {
+		t.Fatal(err)
+	}
+
+	br, err = h.ExistingBatches()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if br != (mtc.BatchRange{Begin: 0, End: 3}) {
+		t.Fatalf("expected batches 0,…,2; got %s", br)
+	}
+
+	for number := br.Begin; number < br.End; number++ {
+		info, err := h.BatchInfo(number)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.LeafCount != 0 {
+			t.Fatalf("batch %d: expected no leaves; got %d", number, info.LeafCount)
+		}
+
+		batch := mtc.Batch{CA: &h.params, Number: number}
+		tree, err := batch.ComputeTreeFromAssertions(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(info.Root, tree.Root()) {
+			t.Fatalf("batch %d: root %x ≠ %x", number, info.Root, tree.Root())
+		}
+	}
+
+	entries := 0
+	if err := h.WalkAuditLog(func(AuditEntry) error {
+		entries++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if entries != 3 {
+		t.Fatalf("expected 3 audit log entries; got %d", entries)
+	}
+}
+
+func createTestAssertion(t *testing.T, name string) mtc.Assertion {
+	pk, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := mtc.NewAssertionBuilder().DNS(name).TLSKey(pk).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *a
+}
+
+func TestAssertionChecksum(t *testing.T) {
+	h := createTestCA(t)
+	defer h.Close()
+
+	a := createTestAssertion(t, "example.com")
+	checksum, err := a.Checksum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Queue(a, checksum); err != nil {
+		t.Fatal(err)
+	}
+
+	err = h.WalkQueue(func(qa QueuedAssertion) error {
+		if !bytes.Equal(qa.Checksum, checksum) {
+			t.Fatalf("queued %x, computed %x", qa.Checksum, checksum)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checksum[0] ^= 1
+	if err := h.Queue(a, checksum); err != ErrChecksumInvalid {
+		t.Fatalf("expected ErrChecksumInvalid, got %v", err)
+	}
+}
+
+func TestIssueSkipsDuplicates(t *testing.T) {
+	h := createTestCA(t)
+	setTestClock(h, 0.5)
+
+	a := createTestAssertion(t, "example.com")
+	b := createTestAssertion(t, "other.example.com")
+	for _, x := range []mtc.Assertion{a, b, a} {
+		if err := h.Queue(x, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	setTestClock(h, 1.5)
+	if err := h.Issue(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := h.BatchInfo(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.LeafCount != 2 {
+		t.Fatalf("expected 2 leaves; got %d", info.LeafCount)
+	}
+	root, err := h.ComputeRoot(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(root, info.Root) {
+		t.Fatalf("computed root %x ≠ %x", root, info.Root)
+	}
+	if _, err := h.ComputeRoot(1); !errors.Is(err, ErrUnknownBatch) {
+		t.Fatalf("expected ErrUnknownBatch; got %v", err)
+	}
+
+	for _, x := range []mtc.Assertion{a, b} {
+		if _, err := h.CertificateFor(x); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Duplicates are found in the merge of the runs sorted by key, also when
+// they're in different runs.
+func TestIssueSkipsDuplicatesAcrossRuns(t *testing.T) {
+	defer func(old int) { indexRunSize = old }(indexRunSize)
+	indexRunSize = 2
+
+	h := createTestCA(t)
+	setTestClock(h, 0.5)
+
+	var queued, unique []mtc.AbridgedAssertion
+	as := make([]mtc.Assertion, 5)
+	for i := range as {
+		as[i] = createTestAssertion(t, fmt.Sprintf("%d.example.com", i))
+	}
+	for _, i := range []int{0, 1, 2, 0, 3, 1, 1, 4, 0} {
+		if err := h.Queue(as[i], nil); err != nil {
+			t.Fatal(err)
+		}
+		queued = append(queued, as[i].Abridge())
+	}
+	for i := range as {
+		unique = append(unique, as[i].Abridge())
+	}
+
+	setTestClock(h, 1.5)
+	if err := h.Issue(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := h.BatchInfo(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.LeafCount != uint64(len(as)) {
+		t.Fatalf("expected %d leaves; got %d", len(as), info.LeafCount)
+	}
+	for _, aas := range [][]mtc.AbridgedAssertion{queued, unique} {
+		root, err := mtc.ExpectedRoot(&h.params, 0, aas)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(root, info.Root) {
+			t.Fatalf("expected root %x ≠ %x", root, info.Root)
+		}
+	}
+	if err := h.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(h.batchPath(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), "abridged-assertions.") ||
+			strings.HasPrefix(e.Name(), "index-run-") {
+			t.Fatalf("left %s", e.Name())
+		}
+	}
+}
+
+func TestIssueENSOnly(t *testing.T) {
+	h := createTestCA(t)
+	setTestClock(h, 0.5)
+
+	pk, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := mtc.NewAssertionBuilder().ENS("vitalik.eth").TLSKey(pk).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Queue(*a, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	setTestClock(h, 1.5)
+	if err := h.Issue(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.CertificateFor(*a); err != nil {
+		t.Fatal(err)
+	}
+	locs, err := h.Authorizes("vitalik.eth", h.now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locs) != 0 {
+		t.Fatalf("ENS claim authorizes a DNS name: %v", locs)
+	}
+}
+
+func TestAuthorizes(t *testing.T) {
+	h := createTestCA(t)
+	setTestClock(h, 0.5)
+
+	pk, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wildcard, err := mtc.NewAssertionBuilder().
+		DNSWildcard("example.com").TLSKey(pk).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range []mtc.Assertion{
+		createTestAssertion(t, "other.example.com"),
+		createTestAssertion(t, "example.com"),
+		*wildcard,
+	} {
+		if err := h.Queue(a, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setTestClock(h, 1.5)
+	if err := h.Issue(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Queue(createTestAssertion(t, "example.com"), nil); err != nil {
+		t.Fatal(err)
+	}
+	setTestClock(h, 2.5)
+	if err := h.Issue(); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Unix(int64(h.params.StartTime), 0)
+	for _, tc := range []struct {
+		name     string
+		at       float64
+		expected []Location
+	}{
+		{"EXAMPLE.com.", 2.5, []Location{{1, 0}, {0, 1}}},
+		{"www.example.com", 2.5, []Location{{0, 2}}},
+		{"other.example.com", 2.5, []Location{{0, 0}, {0, 2}}},
+		{"a.b.example.com", 2.5, nil},
+		{"example.com", 11.5, []Location{{1, 0}}},
+		{"example.com", 12.5, nil},
+	} {
+		now := start.Add(time.Duration(tc.at * float64(time.Second)))
+		locs, err := h.Authorizes(tc.name, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(locs, tc.expected) {
+			t.Errorf("%s at %v: expected %v; got %v",
+				tc.name, tc.at, tc.expected, locs)
+		}
+	}
+
+	if _, err := h.Authorizes("", start); err == nil {
+		t.Fatal("expected error for empty name")
+	}
+}
+
+func TestFileMode(t *testing.T) {
+	path := t.TempDir()
+	opts := NewOpts{
+		IssuerId:      "example",
+		HttpServer:    "ca.example.com",
+		BatchDuration: time.Second,
+		Lifetime:      10 * time.Second,
+		FileMode:      0o200,
+	}
+	if _, err := New(path, opts); err == nil {
+		t.Fatal("expected error for write-only FileMode")
+	}
+
+	opts.FileMode = 0o600
+	h, err := New(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Close()
+
+	// The mode should survive reopening.
+	h, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if err := h.Queue(createTestAssertion(t, "example.com"), nil); err != nil {
+		t.Fatal(err)
+	}
+	setTestClock(h, 1.5)
+	if err := h.Issue(); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, expected := range map[string]os.FileMode{
+		h.skPath():       0o400,
+		h.queuePath():    0o600,
+		h.auditLogPath(): 0o600,
+		h.tmpPath():      0o700,
+		h.paramsPath():   0o600,
+		h.batchesPath():  0o700,
+		h.batchPath(0):   0o700,
+		h.treePath(0):    0o600,
+		h.aaPath(0):      0o600,
+		h.indexPath(0):   0o600,
+		filepath.Join(h.batchPath(0), "signed-validity-window"): 0o600,
+	} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := info.Mode().Perm(); perm != expected {
+			t.Errorf("%s: expected %o; got %o", name, expected, perm)
+		}
+	}
+}
+
+func TestOpenKeyMismatch(t *testing.T) {
+	h := createTestCA(t)
+	path := h.path
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	h, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Close()
+
+	// Replace the signing key by another one.
+	signer, _, err := mtc.GenerateSigningKeypair(mtc.TLSDilitihium5r3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(h.skPath(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(h.skPath(), signer.Bytes(), 0o400); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(h.skPath(), 0o400); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Open(path); !errors.Is(err, ErrKeyMismatch) {
+		t.Fatalf("expected ErrKeyMismatch; got %v", err)
+	}
+
+	// Reading doesn't involve the signing key.
+	h, err = OpenReadOnly(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Close()
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	h := createTestCA(t)
+	setTestClock(h, 0.5)
+	a := createTestAssertion(t, "example.com")
+	if err := h.Queue(a, nil); err != nil {
+		t.Fatal(err)
+	}
+	setTestClock(h, 1.5)
+	if err := h.Issue(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Left behind by an issuance that's underway.
+	leftover := filepath.Join(h.tmpPath(), "leftover")
+	if err := os.WriteFile(leftover, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// h holds the lock.
+	ro, err := OpenReadOnly(h.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ro.clock = h.clock
+
+	aa := a.Abridge()
+	var key [mtc.HashLen]byte
+	if err := aa.Key(key[:]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ro.ProofFor(0, key[:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := ro.Queue(a, nil); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected ErrReadOnly; got %v", err)
+	}
+	if err := ro.Issue(); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected ErrReadOnly; got %v", err)
+	}
+	if _, err := ro.Staple(key[:], 0); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected ErrReadOnly; got %v", err)
+	}
+	if err := ro.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(leftover); err != nil {
+		t.Fatalf("temporary file removed: %v", err)
+	}
+
+	// The lock of h is left alone.
+	if _, err := os.Stat(filepath.Join(h.path, "lock")); err != nil {
+		t.Fatalf("lock removed: %v", err)
+	}
+
+	if _, err := OpenReadOnly(t.TempDir()); !errors.Is(err, ErrNoCA) {
+		t.Fatalf("expected ErrNoCA; got %v", err)
+	}
+}
+
+func queueLen(t *testing.T, h *Handle) int {
+	n := 0
+	if err := h.WalkQueue(func(QueuedAssertion) error {
+		n++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestIssueCancelled(t *testing.T) {
+	h := createTestCA(t)
+	setTestClock(h, 0.5)
+	for i := 0; i < 3; i++ {
+		a := createTestAssertion(t, fmt.Sprintf("%d.example.com", i))
+		if err := h.Queue(a, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	setTestClock(h, 1.5)
+	if err := h.IssueContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled; got %v", err)
+	}
+
+	br, err := h.ExistingBatches()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if br.Len() != 0 {
+		t.Fatalf("expected no batches; got %s", br)
+	}
+	if n := queueLen(t, h); n != 3 {
+		t.Fatalf("expected 3 queued assertions; got %d", n)
+	}
+	// Only the checkpoint to resume from is left.
+	leftover, err := os.ReadDir(h.tmpPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range leftover {
+		if filepath.Join(h.tmpPath(), entry.Name()) != h.resumePath() {
+			t.Fatalf("unexpected %s in tmp", entry.Name())
+		}
+	}
+
+	if err := h.Issue(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := h.BatchInfo(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.LeafCount != 3 {
+		t.Fatalf("expected 3 leaves; got %d", info.LeafCount)
+	}
+}
+
+// Interrupts issuance once the abridged assertions of the first build are
+// written, and checks that issuance continues from there after a restart.
+func TestIssueResume(t *testing.T) {
+	h := createTestCA(t)
+	setTestClock(h, 0.5)
+	for i := 0; i < 3; i++ {
+		a := createTestAssertion(t, fmt.Sprintf("%d.example.com", i))
+		if err := h.Queue(a, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	walks := 0
+	order := func(walk func(func(QueuedAssertion) error) error,
+		yield func(QueuedAssertion) error) error {
+		walks++
+		defer cancel()
+		return QueueOrder(walk, yield)
+	}
+	h.SetLeafOrder(order)
+
+	setTestClock(h, 1.5)
+	if err := h.IssueContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled; got %v", err)
+	}
+	if walks != 1 {
+		t.Fatalf("expected 1 walk of the queue; got %d", walks)
+	}
+
+	// Queued after the batch was started, so it's left for the next one.
+	if err := h.Queue(createTestAssertion(t, "late.example.com"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Restart.
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	h, err := Open(h.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	setTestClock(h, 1.5)
+	h.SetLeafOrder(order)
+
+	walks = 0
+	if err := h.Issue(); err != nil {
+		t.Fatal(err)
+	}
+	if walks != 1 {
+		t.Fatalf("expected only the second build to walk the queue; got %d walks",
+			walks)
+	}
+	info, err := h.BatchInfo(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.LeafCount != 3 {
+		t.Fatalf("expected 3 leaves; got %d", info.LeafCount)
+	}
+	if n := queueLen(t, h); n != 1 {
+		t.Fatalf("expected 1 queued assertion; got %d", n)
+	}
+	if _, err := os.Stat(h.resumePath()); !os.IsNotExist(err) {
+		t.Fatalf("checkpoint wasn't removed: %v", err)
+	}
+
+	// If the queue was changed otherwise, issuance starts over.
+	setTestClock(h, 2.5)
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	if err := h.IssueContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled; got %v", err)
+	}
+	if err := os.WriteFile(h.queuePath(), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	other := createTestAssertion(t, "other.example.com")
+	if err := h.Queue(other, nil); err != nil {
+		t.Fatal(err)
+	}
+	h.SetLeafOrder(nil)
+	if err := h.Issue(); err != nil {
+		t.Fatal(err)
+	}
+	if n := queueLen(t, h); n != 0 {
+		t.Fatalf("expected empty queue; got %d", n)
+	}
+	info, err = h.BatchInfo(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.LeafCount != 1 {
+		t.Fatalf("expected 1 leaf; got %d", info.LeafCount)
+	}
+	if _, err := h.CertificateFor(other); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Simulates a crash after a batch has been built and signed in the
+// staging directory, but before it was moved into place.
+func TestIssueCrash(t *testing.T) {
+	h := createTestCA(t)
+	setTestClock(h, 0.5)
+	for i := 0; i < 3; i++ {
+		a := createTestAssertion(t, fmt.Sprintf("%d.example.com", i))
+		if err := h.Queue(a, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir, err := os.MkdirTemp(h.tmpPath(), "batch1-0-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	queueInfo, err := os.Stat(h.queuePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := mtc.Batch{CA: &h.params, Number: 0}
+	progress := &buildProgress{path: dir + ".progress"}
+	err = h.issueBatchTo(context.Background(), dir, batch, queueInfo.Size(),
+		h.now(), progress, dir+".runs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The process dies here.
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err = Open(h.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	br, err := h.ExistingBatches()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if br.Len() != 0 {
+		t.Fatalf("expected no batches; got %s", br)
+	}
+	if n := queueLen(t, h); n != 3 {
+		t.Fatalf("expected 3 queued assertions; got %d", n)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("staging directory %s wasn't removed", dir)
+	}
+
+	setTestClock(h, 1.5)
+	if err := h.Issue(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := h.BatchInfo(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.LeafCount != 3 {
+		t.Fatalf("expected 3 leaves; got %d", info.LeafCount)
+	}
+	if n := queueLen(t, h); n != 0 {
+		t.Fatalf("expected empty queue; got %d", n)
+	}
+}
+
+func TestSubjectOrder(t *testing.T) {
+	h := createTestCA(t)
+	h.SetLeafOrder(SubjectOrder)
+	setTestClock(h, 0.5)
+
+	pk, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var as []mtc.Assertion
+	for i := 0; i < 4; i++ {
+		a := createTestAssertion(t, fmt.Sprintf("%d.example.com", i))
+		if i%2 == 1 {
+			b, err := mtc.NewAssertionBuilder().
+				DNS(fmt.Sprintf("%d.example.com", i)).TLSKey(pk).Build()
+			if err != nil {
+				t.Fatal(err)
+			}
+			a = *b
+		}
+		if err := h.Queue(a, nil); err != nil {
+			t.Fatal(err)
+		}
+		as = append(as, a)
+	}
+
+	setTestClock(h, 1.5)
+	if err := h.Issue(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The assertions for pk are adjacent.
+	var indices []uint64
+	for _, a := range as {
+		c, err := h.CertificateFor(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		indices = append(indices, c.Proof.(*mtc.MerkleTreeProof).Index())
+	}
+	diff := int(indices[3]) - int(indices[1])
+	if diff != 1 && diff != -1 {
+		t.Fatalf("leaves of the same subject aren't adjacent: %v", indices)
+	}
+}
+
+func TestNewHttpServer(t *testing.T) {
+	for _, httpServer := range []string{"", "ftp://ca.example.com", "ca_example.com"} {
+		_, err := New(t.TempDir(), NewOpts{
+			IssuerId:   "example",
+			HttpServer: httpServer,
+		})
+		if err == nil {
+			t.Fatalf("created CA with http_server %q", httpServer)
+		}
+	}
+}
+
+func TestNewIfNotExists(t *testing.T) {
+	dir := t.TempDir()
+	opts := NewOpts{
+		IssuerId:      "example",
+		HttpServer:    "ca.example.com",
+		BatchDuration: time.Second,
+		Lifetime:      10 * time.Second,
+	}
+	h, err := New(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := h.Params()
+	h.Close()
+
+	if _, err := New(dir, opts); !errors.Is(err, ErrCAExists) {
+		t.Fatalf("expected ErrCAExists, got %v", err)
+	}
+
+	opts.IfNotExists = true
+	h, err = New(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(h.Params().PublicKey.Bytes(), params.PublicKey.Bytes()) {
+		t.Fatal("existing CA was replaced")
+	}
+	h.Close()
+
+	opts.Lifetime = 20 * time.Second
+	if _, err := New(dir, opts); !errors.Is(err, ErrCAMismatch) {
+		t.Fatalf("expected ErrCAMismatch, got %v", err)
+	}
+}
+
+func TestNewForce(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := Open(dir); !errors.Is(err, ErrNoCA) {
+		t.Fatalf("expected ErrNoCA, got %v", err)
+	}
+
+	opts := NewOpts{
+		IssuerId:      "example",
+		HttpServer:    "ca.example.com",
+		BatchDuration: time.Second,
+		Lifetime:      10 * time.Second,
+	}
+	h, err := New(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := h.Params()
+	setTestClock(h, 0.5)
+	if err := h.Queue(createTestAssertion(t, "example.com"), nil); err != nil {
+		t.Fatal(err)
+	}
+	setTestClock(h, 1.5)
+	if err := h.Issue(); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Queue(createTestAssertion(t, "example.org"), nil); err != nil {
+		t.Fatal(err)
+	}
+	h.Close()
+
+	opts.IssuerId = "other"
+	if _, err := New(dir, opts); !errors.Is(err, ErrCAExists) {
+		t.Fatalf("expected ErrCAExists, got %v", err)
+	}
+	h, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Params().IssuerId != "example" {
+		t.Fatal("existing CA was changed")
+	}
+	h.Close()
+
+	opts.Force = true
+	opts.IfNotExists = true
+	if _, err := New(dir, opts); err == nil {
+		t.Fatal("accepted both Force and IfNotExists")
+	}
+
+	opts.IfNotExists = false
+	h, err = New(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if h.Params().IssuerId != "other" ||
+		bytes.Equal(h.Params().PublicKey.Bytes(), params.PublicKey.Bytes()) {
+		t.Fatal("existing CA wasn't replaced")
+	}
+
+	// Nothing of the old CA is left.
+	br, err := h.ExistingBatches()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if br.Len() != 0 {
+		t.Fatalf("batches %s of the old CA left", br)
+	}
+	if n := queueLen(t, h); n != 0 {
+		t.Fatalf("%d queued assertions of the old CA left", n)
+	}
+	if _, err := os.Stat(h.auditLogPath()); !os.IsNotExist(err) {
+		t.Fatalf("audit log of the old CA left: %v", err)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	h := createTestCA(t)
+	setTestClock(h, 0.5)
+	a := createTestAssertion(t, "example.com")
+	if err := h.Queue(a, nil); err != nil {
+		t.Fatal(err)
+	}
+	setTestClock(h, 1.5)
+	if err := h.Issue(); err != nil {
+		t.Fatal(err)
+	}
+	root, err := h.ComputeRoot(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Batch 0 is active still.
+	compacted, err := h.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(compacted) != 0 {
+		t.Fatalf("compacted active batches %v", compacted)
+	}
+
+	setTestClock(h, 12.5)
+	if err := h.Issue(); err != nil {
+		t.Fatal(err)
+	}
+	compacted, err = h.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(compacted) == 0 || compacted[0] != 0 {
+		t.Fatalf("batch 0 not compacted: %v", compacted)
+	}
+	if _, err := h.ComputeRoot(0); !errors.Is(err, ErrBatchCompacted) {
+		t.Fatalf("expected ErrBatchCompacted, got %v", err)
+	}
+	if _, err := h.ComputeRoot(11); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Proofs can still be reproduced.
+	c, err := h.CertificateFor(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof := c.Proof.(*mtc.MerkleTreeProof)
+	aa := a.Abridge()
+	batch := mtc.Batch{CA: &h.params, Number: 0}
+	got, err := batch.ComputeRootFromAuthenticationPath(
+		proof.Index(), proof.Path(), &aa)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, root) {
+		t.Fatalf("root changed from %x to %x", root, got)
+	}
+
+	compacted, err = h.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(compacted) != 0 {
+		t.Fatalf("compacted batches twice: %v", compacted)
+	}
+}
+
+func TestQueueLog(t *testing.T) {
+	h := createTestCA(t)
+	setTestClock(h, 0.5)
+
+	l, err := OpenQueueLog(h.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		as   []mtc.Assertion
+		wg   sync.WaitGroup
+		errs = make([]error, 50)
+	)
+	for i := 0; i < len(errs); i++ {
+		as = append(as, createTestAssertion(t, fmt.Sprintf("%d.example.com", i)))
+	}
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = l.Queue(QueuedAssertion{Assertion: as[i]})
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A segment that's still open is folded, but kept.
+	if err := h.FoldQueueLog(); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.FoldQueueLog(); err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	if err := h.WalkQueue(func(QueuedAssertion) error {
+		n++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n != len(as) {
+		t.Fatalf("expected %d queued assertions, got %d", len(as), n)
+	}
+
+	// An entry after the fold, and a partial one, as left by a crash.
+	a := createTestAssertion(t, "last.example.com")
+	if err := l.Queue(QueuedAssertion{Assertion: a}); err != nil {
+		t.Fatal(err)
+	}
+	as = append(as, a)
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{0, 100, 1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	setTestClock(h, 1.5)
+	if err := h.Issue(); err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range as {
+		if _, err := h.CertificateFor(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The segment is gone once its writer is.
+	ds, err := os.ReadDir(h.queueLogPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ds) != 0 {
+		t.Fatalf("queue log not cleaned up: %d files left", len(ds))
+	}
+}
+
+func TestIssueWorkers(t *testing.T) {
+	var as []mtc.Assertion
+	for i := 0; i < 100; i++ {
+		as = append(as, createTestAssertion(t, fmt.Sprintf("%d.example.com", i)))
+	}
+
+	var roots [][]byte
+	for _, workers := range []int{1, 4} {
+		h := createTestCA(t)
+		h.SetIssueWorkers(workers)
+		setTestClock(h, 0.5)
+		for _, a := range as {
+			if err := h.Queue(a, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		setTestClock(h, 1.5)
+		if err := h.Issue(); err != nil {
+			t.Fatal(err)
+		}
+		w, err := h.SignedValidityWindow(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		roots = append(roots, w.Root(&h.params, 0))
+	}
+
+	if !bytes.Equal(roots[0], roots[1]) {
+		t.Fatalf("roots differ: %x and %x", roots[0], roots[1])
+	}
+}
+
+func TestNonMonotonicIssuance(t *testing.T) {
+	h := createTestCA(t)
+	setTestClock(h, 3.5)
+	if err := h.Issue(); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Swap in the validity window of another batch.
+	buf, err := os.ReadFile(filepath.Join(h.batchPath(1), "signed-validity-window"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wPath := filepath.Join(h.batchPath(2), "signed-validity-window")
+	orig, err := os.ReadFile(wPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(wPath, buf, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Verify(); !errors.Is(err, ErrNonMonotonic) {
+		t.Fatalf("expected ErrNonMonotonic; got %v", err)
+	}
+	if err := os.WriteFile(wPath, orig, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Restore a backup from before batch 2 was issued.
+	if err := os.RemoveAll(h.batchPath(2)); err != nil {
+		t.Fatal(err)
+	}
+	h.batchNumbersCache = nil
+	if err := h.Issue(); !errors.Is(err, ErrNonMonotonic) {
+		t.Fatalf("expected ErrNonMonotonic; got %v", err)
+	}
+}
+
+func TestReissueWindow(t *testing.T) {
+	h := createTestCA(t)
+	setTestClock(h, 0.5)
+	if err := h.Queue(createTestAssertion(t, "example.com"), nil); err != nil {
+		t.Fatal(err)
+	}
+	setTestClock(h, 3.5)
+	if err := h.Issue(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Break the signature on the window of batch 1.
+	wPath := filepath.Join(h.batchPath(1), "signed-validity-window")
+	orig, err := os.ReadFile(wPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.Clone(orig)
+	buf[len(buf)-5] ^= 1
+	if err := os.WriteFile(wPath, buf, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Verify(); err == nil {
+		t.Fatal("broken signature went unnoticed")
+	}
+
+	w, err := h.ReissueWindow(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	var w2 mtc.SignedValidityWindow
+	if err := w2.UnmarshalBinary(orig, &h.params); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(w.TreeHeads, w2.TreeHeads) {
+		t.Fatal("tree heads changed")
+	}
+
+	// Refuse to sign a window whose tree heads were tampered with.
+	buf, err = os.ReadFile(wPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf[10] ^= 1
+	if err := os.WriteFile(wPath, buf, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.ReissueWindow(1); !errors.Is(err, ErrNonMonotonic) {
+		t.Fatalf("expected ErrNonMonotonic; got %v", err)
+	}
+	buf[10] ^= 1
+	buf[len(w.TreeHeads)] ^= 1 // in the head of batch 1
+	if err := os.WriteFile(wPath, buf, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.ReissueWindow(1); err == nil {
+		t.Fatal("re-signed window with a changed head")
+	}
+
+	if _, err := h.ReissueWindow(7); !errors.Is(err, ErrUnknownBatch) {
+		t.Fatalf("expected ErrUnknownBatch; got %v", err)
+	}
+}
+
+func TestExternalStorage(t *testing.T) {
+	h := createTestCA(t)
+	s := &FileStorage{Dir: t.TempDir(), Mode: 0o644}
+	h.SetStorage(s)
+
+	setTestClock(h, 0.5)
+	a := createTestAssertion(t, "example.com")
+	if err := h.Queue(a, nil); err != nil {
+		t.Fatal(err)
+	}
+	setTestClock(h, 1.5)
+	if err := h.Issue(); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := s.List("0/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"tree", "index", "abridged-assertions",
+		"signed-validity-window", "summary"} {
+		if !slices.Contains(keys, "0/"+name) {
+			t.Fatalf("%s missing from storage: %v", name, keys)
+		}
+	}
+
+	// Proofs and batch information come from the storage.
+	if err := os.RemoveAll(h.batchPath(0)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.CertificateFor(a); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.BatchInfo(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.ComputeRoot(0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Batches outside of the storage window are removed from it.
+	setTestClock(h, 25.5)
+	if err := h.Issue(); err != nil {
+		t.Fatal(err)
+	}
+	keys, err = s.List("0/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Fatalf("batch 0 still in storage: %v", keys)
+	}
+	prefixes, err := s.ListPrefixes("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slices.Contains(prefixes, "0/") {
+		t.Fatalf("batch 0 still listed: %v", prefixes)
+	}
+	if !slices.Contains(prefixes, "24/") {
+		t.Fatalf("batch 24 not listed: %v", prefixes)
+	}
+}
+
+func TestRetentionPolicy(t *testing.T) {
+	h, err := New(t.TempDir(), NewOpts{
+		IssuerId:        "example",
+		HttpServer:      "ca.example.com",
+		BatchDuration:   time.Second,
+		Lifetime:        2 * time.Second,
+		StorageDuration: 4 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	// Keep even batches until 6s after they end.
+	h.SetRetentionPolicy(func(number uint32, _, end, now time.Time) bool {
+		return number%2 == 0 && now.Sub(end) < 6*time.Second
+	})
+
+	setTestClock(h, 8.5)
+	if err := h.Issue(); err != nil {
+		t.Fatal(err)
+	}
+	br, err := h.ExistingBatches()
+	if err != nil {
+		t.Fatal(err)
+	}
+	archived, err := h.ArchivedBatches()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if br.Begin != 4 || !slices.Equal(archived, []uint32{2}) {
+		t.Fatalf("stored %s, archived %v", br, archived)
+	}
+	if err := h.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	setTestClock(h, 9.5)
+	if err := h.GC(); err != nil {
+		t.Fatal(err)
+	}
+	archived, err = h.ArchivedBatches()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(archived, []uint32{4}) {
+		t.Fatalf("archived %v", archived)
+	}
+
+	// Without a policy, the archive is left alone.
+	h.SetRetentionPolicy(nil)
+	setTestClock(h, 20.5)
+	if err := h.Issue(); err != nil {
+		t.Fatal(err)
+	}
+	archived, err = h.ArchivedBatches()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(archived, []uint32{4}) {
+		t.Fatalf("archived %v", archived)
+	}
+}
+
+func TestStoredRetention(t *testing.T) {
+	h := createTestCA(t)
+	if r, err := h.StoredRetention(); err != nil || r != nil {
+		t.Fatalf("%v %v", r, err)
+	}
+	r := Retention{KeepEvery: 2 * time.Second, KeepFor: time.Hour}
+	if err := h.SaveRetention(&r); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A handle opened later, as by a scheduled issue, uses the stored
+	// policy.
+	h, err := Open(h.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	r2, err := h.StoredRetention()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r2 == nil || *r2 != r {
+		t.Fatalf("stored %v, expected %v", r2, r)
+	}
+	setTestClock(h, 25.5)
+	if err := h.Issue(); err != nil {
+		t.Fatal(err)
+	}
+	archived, err := h.ArchivedBatches()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archived) == 0 {
+		t.Fatal("nothing archived")
+	}
+	keep := KeepOneEvery(r.KeepEvery, r.KeepFor)
+	for _, batch := range archived {
+		start, end := h.params.BatchTimeRange(batch)
+		if !keep(batch, start, end, h.now()) {
+			t.Fatalf("archived batch %d", batch)
+		}
+	}
+
+	if err := h.SaveRetention(nil); err != nil {
+		t.Fatal(err)
+	}
+	if r, err := h.StoredRetention(); err != nil || r != nil {
+		t.Fatalf("%v %v", r, err)
+	}
+}
+
+func TestKeepOneEvery(t *testing.T) {
+	keep := KeepOneEvery(24*time.Hour, 48*time.Hour)
+	midnight := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	hour := time.Hour
+
+	for _, tc := range []struct {
+		start, end, now time.Time
+		expected        bool
+	}{
+		{midnight, midnight.Add(hour), midnight.Add(hour), true},
+		{midnight.Add(-hour), midnight, midnight, false},
+		{midnight.Add(-hour / 2), midnight.Add(hour / 2), midnight, true},
+		{midnight.Add(hour), midnight.Add(2 * hour), midnight, false},
+		{midnight, midnight.Add(hour), midnight.Add(49 * hour), false},
+	} {
+		if got := keep(0, tc.start, tc.end, tc.now); got != tc.expected {
+			t.Fatalf("[%s, %s) at %s: got %v", tc.start, tc.end, tc.now, got)
+		}
+	}
+}
+
+func TestExpectedRoot(t *testing.T) {
+	h := createTestCA(t)
+	setTestClock(h, 0.5)
+
+	var aas []mtc.AbridgedAssertion
+	for i := 0; i < 5; i++ {
+		a := createTestAssertion(t, fmt.Sprintf("%d.example.com", i))
+		if err := h.Queue(a, nil); err != nil {
+			t.Fatal(err)
+		}
+		aas = append(aas, a.Abridge())
+	}
+
+	setTestClock(h, 1.5)
+	if err := h.Issue(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := h.BatchInfo(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root, err := mtc.ExpectedRoot(&h.params, 0, append(aas, aas[2]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(root, info.Root) {
+		t.Fatalf("expected root %x; got %x", info.Root, root)
+	}
+
+	for _, wrong := range [][]mtc.AbridgedAssertion{
+		aas[:4],
+		{aas[1], aas[0], aas[2], aas[3], aas[4]},
+	} {
+		root, err := mtc.ExpectedRoot(&h.params, 0, wrong)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(root, info.Root) {
+			t.Fatal("root matches for a different set of assertions")
+		}
+	}
+}
+
+func TestComputeIndexKeyCollision(t *testing.T) {
+	aas := [][]byte{}
+	for i := 0; i < 5; i++ {
+		a := createTestAssertion(t, fmt.Sprintf("%d.example.com", i))
+		aa := a.Abridge()
+		buf, err := aa.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		aas = append(aas, buf)
+	}
+
+	// Inject a collision: assertion 3 has the same key as assertion 1.
+	aas[3] = aas[1]
+
+	err := ComputeIndex(bytes.NewReader(bytes.Join(aas, nil)), io.Discard)
+	if !errors.Is(err, ErrKeyCollision) {
+		t.Fatalf("expected ErrKeyCollision; got %v", err)
+	}
+	if !strings.Contains(err.Error(), "assertions 1 and 3") {
+		t.Fatalf("offending indices missing from error: %v", err)
+	}
+}
+
+func TestComputeIndexRuns(t *testing.T) {
+	aas := [][]byte{}
+	for i := 0; i < 50; i++ {
+		a := createTestAssertion(t, fmt.Sprintf("%d.example.com", i))
+		aa := a.Abridge()
+		buf, err := aa.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		aas = append(aas, buf)
+	}
+	input := bytes.Join(aas, nil)
+
+	expected := &bytes.Buffer{}
+	if err := ComputeIndex(bytes.NewReader(input), expected); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(old int) { indexRunSize = old }(indexRunSize)
+	for _, runSize := range []int{1, 7, 49, 50} {
+		indexRunSize = runSize
+		tmpDir := t.TempDir()
+
+		got := &bytes.Buffer{}
+		if err := computeIndex(bytes.NewReader(input), got, tmpDir); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Bytes(), expected.Bytes()) {
+			t.Fatalf("index differs with runs of %d", runSize)
+		}
+
+		leftover, err := os.ReadDir(tmpDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(leftover) != 0 {
+			t.Fatalf("runs of %d left %d temporary files", runSize, len(leftover))
+		}
+	}
+
+	// Interrupted after each run in turn, and resumed.
+	indexRunSize = 7
+	errStop := errors.New("stop")
+	for stopAt := uint32(1); stopAt <= 8; stopAt++ {
+		runDir := t.TempDir()
+		var progress indexProgress
+		err := computeIndexResumable(bytes.NewReader(input), io.Discard,
+			runDir, indexProgress{}, func(p indexProgress) error {
+				progress = p
+				if p.runs == stopAt {
+					return errStop
+				}
+				return nil
+			})
+		if !errors.Is(err, errStop) {
+			t.Fatalf("expected to stop after run %d; got %v", stopAt, err)
+		}
+
+		got := &bytes.Buffer{}
+		err = computeIndexResumable(bytes.NewReader(input), got, runDir,
+			progress, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Bytes(), expected.Bytes()) {
+			t.Fatalf("index differs when resumed after run %d", stopAt)
+		}
+		leftover, err := os.ReadDir(runDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(leftover) != 0 {
+			t.Fatalf("resumed after run %d left %d runs", stopAt, len(leftover))
+		}
+	}
+
+	// Collisions between runs are detected as well.
+	indexRunSize = 2
+	aas[40] = aas[1]
+	err := computeIndex(bytes.NewReader(bytes.Join(aas, nil)), io.Discard, t.TempDir())
+	if !errors.Is(err, ErrKeyCollision) {
+		t.Fatalf("expected ErrKeyCollision; got %v", err)
+	}
+}
+
+// Issues batches one by one with a fake clock, and checks how the
+// validity window slides past the certificate issued in the first batch.
+func TestValidityWindowLifecycle(t *testing.T) {
+	h, err := New(t.TempDir(), NewOpts{
+		IssuerId:        "example",
+		HttpServer:      "ca.example.com",
+		BatchDuration:   time.Second,
+		Lifetime:        4 * time.Second,
+		StorageDuration: 8 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	p := h.Params()
+
+	var (
+		cert *mtc.BikeshedCertificate
+		key  [mtc.HashLen]byte
+	)
+
+	for number := uint32(0); number < 10; number++ {
+		a := createTestAssertion(t, fmt.Sprintf("%d.example.com", number))
+		setTestClock(h, float64(number)+0.5)
+		if err := h.Queue(a, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		setTestClock(h, float64(number)+1.5)
+		if err := h.Issue(); err != nil {
+			t.Fatal(err)
+		}
+
+		if number == 0 {
+			if cert, err = h.CertificateFor(a); err != nil {
+				t.Fatal(err)
+			}
+			aa := a.Abridge()
+			if err := aa.Key(key[:]); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		w, err := h.getSignedValidityWindow(number)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.BatchNumber != number {
+			t.Fatalf("window of batch %d has number %d", number, w.BatchNumber)
+		}
+
+		active := p.ActiveBatches(h.now())
+		stored, err := h.ExistingBatches()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Logf("batch %d: active %s, stored %s", number, active, stored)
+
+		// Check the certificate from batch 0 against the latest window, as
+		// a relying party would.
+		valid := mtc.VerifyCertificate(cert, mtc.VerifyOptions{
+			CA:     &p,
+			Window: &w.ValidityWindow,
+			Now:    h.now(),
+		}) == nil
+
+		expectValid := number < uint32(p.ValidityWindowSize)
+		if valid != expectValid {
+			t.Fatalf("batch %d: certificate valid=%v, expected %v",
+				number, valid, expectValid)
+		}
+
+		_, err = h.ProofFor(0, key[:])
+		if active.Contains(0) {
+			if err != nil {
+				t.Fatalf("batch %d: %v", number, err)
+			}
+		} else if err != ErrBatchExpired {
+			t.Fatalf("batch %d: expected ErrBatchExpired, got %v", number, err)
+		}
+
+		if stored.Begin != p.StoredBatches(h.now()).Begin {
+			t.Fatalf("batch %d: stored %s, expected %s", number, stored,
+				p.StoredBatches(h.now()))
+		}
+	}
+}
+
+func TestBatchDurationChanges(t *testing.T) {
+	path := t.TempDir()
+	opts := NewOpts{
+		IssuerId:      "example",
+		HttpServer:    "ca.example.com",
+		BatchDuration: time.Second,
+		Lifetime:      10 * time.Second,
+
+		// Batch 2 runs from 2s to 4s, and batch 3 from 4s to 6s.
+		BatchDurationChanges: []BatchDurationChange{{
+			After:         2 * time.Second,
+			BatchDuration: 2 * time.Second,
+		}},
+	}
+	h, err := New(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	fp, err := h.params.Fingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	paramsBuf, err := os.ReadFile(h.paramsPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setTestClock(h, 0.5)
+	a0 := createTestAssertion(t, "example.com")
+	if err := h.Queue(a0, nil); err != nil {
+		t.Fatal(err)
+	}
+	setTestClock(h, 1.5)
+	if err := h.Issue(); err != nil {
+		t.Fatal(err)
+	}
+	cert0, err := h.CertificateFor(a0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a1 := createTestAssertion(t, "example.org")
+	if err := h.Queue(a1, nil); err != nil {
+		t.Fatal(err)
+	}
+	setTestClock(h, 4.5)
+	if err := h.Issue(); err != nil {
+		t.Fatal(err)
+	}
+	cert1, err := h.CertificateFor(a1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	anchor := cert1.Proof.TrustAnchor().(*mtc.MerkleTreeTrustAnchor)
+	if batch := anchor.BatchNumber(); batch != 2 {
+		t.Fatalf("issued in batch %d instead of 2", batch)
+	}
+	if err := h.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	p := h.Params()
+	if p.MaxLifetime() != 20*time.Second {
+		t.Fatalf("longest lifetime %s", p.MaxLifetime())
+	}
+	start, end := p.BatchTimeRange(2)
+	if start.Unix() != int64(p.StartTime)+2 || end.Sub(start) != 2*time.Second {
+		t.Fatalf("batch 2 runs from %s to %s", start, end)
+	}
+
+	// The changes are in the ca-params from the start, so they, and the
+	// pinned fingerprint, stay the same.
+	paramsBuf2, err := os.ReadFile(h.paramsPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(paramsBuf, paramsBuf2) {
+		t.Fatal("ca-params changed")
+	}
+	w, err := h.getSignedValidityWindow(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, cert := range []*mtc.BikeshedCertificate{cert0, cert1} {
+		err := mtc.VerifyCertificate(cert, mtc.VerifyOptions{
+			CA:            &p,
+			Window:        &w.ValidityWindow,
+			Now:           h.now(),
+			CAFingerprint: fp,
+		})
+		if err != nil {
+			t.Fatalf("certificate %d: %v", i, err)
+		}
+	}
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Provisioning again with the same changes keeps the CA.
+	opts.IfNotExists = true
+	h, err = New(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	opts.BatchDurationChanges[0].After = 4 * time.Second
+	if _, err := New(path, opts); !errors.Is(err, ErrCAMismatch) {
+		t.Fatalf("expected ErrCAMismatch; got %v", err)
+	}
+
+	opts.IfNotExists = false
+	opts.BatchDurationChanges[0].After = 1500 * time.Millisecond
+	if _, err := New(t.TempDir(), opts); err == nil {
+		t.Fatal("accepted a change in the middle of a second")
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	h := createTestCA(t)
+	h.SetAuditSource("test")
+	setTestClock(h, 0.5)
+	if err := h.Queue(createTestAssertion(t, "example.com"), nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, ts := range []float64{1.5, 2.5, 3.5} {
+		setTestClock(h, ts)
+		if err := h.Issue(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var entries []AuditEntry
+	if err := h.WalkAuditLog(func(e AuditEntry) error {
+		entries = append(entries, e)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries; got %d", len(entries))
+	}
+	for i, e := range entries {
+		info, err := h.BatchInfo(uint32(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Batch != uint32(i) || e.LeafCount != info.LeafCount ||
+			!bytes.Equal(e.Root, info.Root) || e.Source != "test" {
+			t.Fatalf("unexpected entry %d: %+v", i, e)
+		}
+	}
+
+	buf, err := os.ReadFile(h.auditLogPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(string(buf), "\n")
+	lines = lines[:len(lines)-1] // empty after the last newline
+
+	checkBroken := func(lines []string, lineNo int) {
+		t.Helper()
+		err := os.WriteFile(h.auditLogPath(), []byte(strings.Join(lines, "")), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = h.WalkAuditLog(func(AuditEntry) error { return nil })
+		if !errors.Is(err, ErrChecksumInvalid) ||
+			!strings.Contains(err.Error(), fmt.Sprintf("line %d:", lineNo)) {
+			t.Fatalf("expected invalid checksum on line %d; got %v", lineNo, err)
+		}
+	}
+
+	// Editing a line is detected on that line.
+	edited := slices.Clone(lines)
+	edited[1] = strings.Replace(edited[1], `"test"`, `"mallory"`, 1)
+	checkBroken(edited, 2)
+
+	// Fixing up its checksum breaks the chain at the next line.
+	e := entries[1]
+	e.Source = "mallory"
+	line := e.line(entries[0].Checksum)
+	edited[1] = fmt.Sprintf("%s%x\n", line, e.Checksum)
+	checkBroken(edited, 3)
+
+	// As does removing a line.
+	checkBroken(slices.Delete(slices.Clone(lines), 0, 1), 1)
+}
+
+func TestExportImportQueue(t *testing.T) {
+	h := createTestCA(t)
+	setTestClock(h, 0.5)
+	for i := 0; i < 3; i++ {
+		a := createTestAssertion(t, fmt.Sprintf("%d.example.com", i))
+		if err := h.Queue(a, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	count, err := h.ExportQueue(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Fatalf("exported %d assertions", count)
+	}
+
+	queued := func(h *Handle) []QueuedAssertion {
+		var ret []QueuedAssertion
+		if err := h.WalkQueue(func(qa QueuedAssertion) error {
+			ret = append(ret, qa)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return ret
+	}
+
+	// A truncated export adds nothing.
+	h2 := createTestCA(t)
+	_, err = h2.ImportQueue(bytes.NewReader(buf.Bytes()[:buf.Len()-10]))
+	if err == nil {
+		t.Fatal("imported truncated export")
+	}
+	if len(queued(h2)) != 0 {
+		t.Fatal("truncated import added assertions")
+	}
+
+	if _, err := h2.ImportQueue(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+
+	qas, qas2 := queued(h), queued(h2)
+	if len(qas2) != len(qas) {
+		t.Fatalf("imported %d assertions, expected %d", len(qas2), len(qas))
+	}
+	for i := range qas {
+		if !bytes.Equal(qas[i].Checksum, qas2[i].Checksum) ||
+			!qas[i].QueuedAt.Equal(qas2[i].QueuedAt) {
+			t.Fatalf("assertion %d differs after import", i)
+		}
+	}
+}
+
+func TestProjectStorage(t *testing.T) {
+	h := createTestCA(t)
+	setTestClock(h, 0.5)
+	for i := 0; i < 5; i++ {
+		a := createTestAssertion(t, fmt.Sprintf("%d.example.com", i))
+		if err := h.Queue(a, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setTestClock(h, 1.5)
+	if err := h.Issue(); err != nil {
+		t.Fatal(err)
+	}
+
+	sample := createTestAssertion(t, "x.example.com")
+	p, err := h.ProjectStorage(5, sample)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Batches != h.Params().StorageWindowSize {
+		t.Fatalf("%d batches", p.Batches)
+	}
+	for name, size := range map[string]int64{
+		"abridged-assertions":    p.AbridgedAssertions,
+		"tree":                   p.Tree,
+		"index":                  p.Index,
+		"signed-validity-window": p.Window,
+		"summary":                p.Summary,
+		"producer":               p.Producer,
+	} {
+		fi, err := os.Stat(filepath.Join(h.batchPath(0), name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() != size {
+			t.Fatalf("%s: projected %d, actual %d", name, size, fi.Size())
+		}
+	}
+	if p.Total() != int64(p.Batches)*p.BatchSize()+p.Queue {
+		t.Fatal("total doesn't add up")
+	}
+
+	// It doesn't need the signing key.
+	ro, err := OpenReadOnly(h.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	p2, err := ro.ProjectStorage(5, sample)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p2.Total() != p.Total() {
+		t.Fatalf("read-only handle projected %d; got %d", p2.Total(), p.Total())
+	}
+}
+
+func TestQueueNotBeforeBatch(t *testing.T) {
+	h := createTestCA(t)
+	setTestClock(h, 0.5)
+
+	a := createTestAssertion(t, "example.com")
+	b := createTestAssertion(t, "later.example.com")
+	if err := h.QueueMultiple(func(yield func(qa QueuedAssertion) error) error {
+		if err := yield(QueuedAssertion{Assertion: a}); err != nil {
+			return err
+		}
+		return yield(QueuedAssertion{Assertion: b, NotBeforeBatch: 3})
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	queued := func() []QueuedAssertion {
+		var ret []QueuedAssertion
+		if err := h.WalkQueue(func(qa QueuedAssertion) error {
+			ret = append(ret, qa)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return ret
+	}
+	if qas := queued(); len(qas) != 2 || qas[1].NotBeforeBatch != 3 {
+		t.Fatalf("unexpected queue %v", qas)
+	}
+
+	leafCount := func(number uint32) uint64 {
+		info, err := h.BatchInfo(number)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.LeafCount
+	}
+
+	// b stays queued until batch 3.
+	setTestClock(h, 1.5)
+	if err := h.Issue(); err != nil {
+		t.Fatal(err)
+	}
+	if n := leafCount(0); n != 1 {
+		t.Fatalf("expected 1 leaf in batch 0; got %d", n)
+	}
+	if _, err := h.CertificateFor(a); err != nil {
+		t.Fatal(err)
+	}
+	if qas := queued(); len(qas) != 1 || qas[0].NotBeforeBatch != 3 {
+		t.Fatalf("unexpected queue %v", qas)
+	}
+
+	setTestClock(h, 3.5)
+	if err := h.Issue(); err != nil {
+		t.Fatal(err)
+	}
+	if n := leafCount(2); n != 0 {
+		t.Fatalf("expected empty batch 2; got %d leaves", n)
+	}
+	if len(queued()) != 1 {
+		t.Fatal("deferred assertion dropped from queue")
+	}
+
+	setTestClock(h, 4.5)
+	if err := h.Issue(); err != nil {
+		t.Fatal(err)
+	}
+	if n := leafCount(3); n != 1 {
+		t.Fatalf("expected 1 leaf in batch 3; got %d", n)
+	}
+	if _, err := h.CertificateFor(b); err != nil {
+		t.Fatal(err)
+	}
+	if len(queued()) != 0 {
+		t.Fatal("queue not drained")
+	}
+}
+
+func TestStaple(t *testing.T) {
+	h := createTestCA(t)
+	setTestClock(h, 0.5)
+	a := createTestAssertion(t, "example.com")
+	if err := h.Queue(a, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, ts := range []float64{1.5, 3.5} {
+		setTestClock(h, ts)
+		if err := h.Issue(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	aa := a.Abridge()
+	var key [mtc.HashLen]byte
+	if err := aa.Key(key[:]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Staple(key[:], 1); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("expected ErrUnknownKey; got %v", err)
+	}
+	s, err := h.Staple(key[:], 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.BatchNumber != 0 || s.AsOf != 2 {
+		t.Fatalf("staple for batch %d as of %d", s.BatchNumber, s.AsOf)
+	}
+	buf, err := s.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s2 mtc.SignedStaple
+	p := h.Params()
+	if err := s2.UnmarshalBinary(buf, &p); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Deny(key[:]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Staple(key[:], 0); !errors.Is(err, mtc.ErrAssertionDenied) {
+		t.Fatalf("expected ErrAssertionDenied; got %v", err)
+	}
+}
+
+func TestDenyListPruning(t *testing.T) {
+	h := createTestCA(t)
+	setTestClock(h, 0.5)
+	a := createTestAssertion(t, "example.com")
+	if err := h.Queue(a, nil); err != nil {
+		t.Fatal(err)
+	}
+	aa := a.Abridge()
+	var key [mtc.HashLen]byte
+	if err := aa.Key(key[:]); err != nil {
+		t.Fatal(err)
+	}
+	deny := func(key [mtc.HashLen]byte) {
+		t.Helper()
+		if err := h.Deny(key[:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	denied := func(key [mtc.HashLen]byte) bool {
+		t.Helper()
+		l, err := h.DenyList()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l.Contains(key[:])
+	}
+	unknown := func(b byte) (ret [mtc.HashLen]byte) {
+		ret[0] = b
+		return
+	}
+
+	// Queued assertions stay on the list, and so does the newly denied
+	// key, until the list is reissued.
+	deny(key)
+	deny(unknown(1))
+	deny(unknown(2))
+	if !denied(key) || denied(unknown(1)) || !denied(unknown(2)) {
+		t.Fatal("unexpected deny list")
+	}
+
+	// So do issued ones, until they expire.
+	setTestClock(h, 1.5)
+	if err := h.Issue(); err != nil {
+		t.Fatal(err)
+	}
+	deny(unknown(3))
+	if !denied(key) {
+		t.Fatal("issued assertion dropped from deny list")
+	}
+	setTestClock(h, 12.5)
+	if err := h.Issue(); err != nil {
+		t.Fatal(err)
+	}
+	deny(unknown(4))
+	if denied(key) {
+		t.Fatal("expired assertion still on deny list")
+	}
+}
+
+func TestQueueLabel(t *testing.T) {
+	h := createTestCA(t)
+	setTestClock(h, 0.5)
+
+	a := createTestAssertion(t, "example.com")
+	checksum, err := a.Checksum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.QueueMultiple(func(yield func(qa QueuedAssertion) error) error {
+		return yield(QueuedAssertion{
+			Assertion:      a,
+			Checksum:       checksum,
+			Label:          "subscriber-42",
+			NotBeforeBatch: 1,
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	queued := func() []QueuedAssertion {
+		var ret []QueuedAssertion
+		if err := h.WalkQueue(func(qa QueuedAssertion) error {
+			ret = append(ret, qa)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return ret
+	}
+
+	// The label doesn't affect the checksum, and survives deferral.
+	qas := queued()
+	if len(qas) != 1 || qas[0].Label != "subscriber-42" ||
+		!bytes.Equal(qas[0].Checksum, checksum) {
+		t.Fatalf("unexpected queue %v", qas)
+	}
+	setTestClock(h, 1.5)
+	if err := h.Issue(); err != nil {
+		t.Fatal(err)
+	}
+	if qas := queued(); len(qas) != 1 || qas[0].Label != "subscriber-42" {
+		t.Fatalf("unexpected queue %v", qas)
+	}
+
+	// Nor does it end up in the batch.
+	setTestClock(h, 2.5)
+	if err := h.Issue(); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := h.CertificateFor(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checksum2, err := cert.Assertion.Checksum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(checksum, checksum2) {
+		t.Fatal("assertion changed")
+	}
+
+	err = h.QueueMultiple(func(yield func(qa QueuedAssertion) error) error {
+		return yield(QueuedAssertion{
+			Assertion: a,
+			Label:     strings.Repeat("x", MaxLabelLength+1),
+		})
+	})
+	if !errors.Is(err, ErrLabelTooLong) {
+		t.Fatalf("expected ErrLabelTooLong; got %v", err)
+	}
+}
+
+func TestQueuedAssertionAttributes(t *testing.T) {
+	a := createTestAssertion(t, "example.com")
+	for _, qa := range []QueuedAssertion{
+		{Assertion: a},
+		{Assertion: a, QueuedAt: time.Unix(1705677777, 0)},
+		{Assertion: a, NotBeforeBatch: 7},
+		{Assertion: a, Label: "subscriber-42"},
+		{
+			Assertion:      a,
+			QueuedAt:       time.Unix(1705677777, 0),
+			NotBeforeBatch: 7,
+			Label:          strings.Repeat("x", MaxLabelLength),
+		},
+	} {
+		buf, err := qa.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var qa2 QueuedAssertion
+		if err := qa2.UnmarshalBinary(buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(qa2.Checksum, qa.Checksum) ||
+			!qa2.QueuedAt.Equal(qa.QueuedAt) ||
+			qa2.NotBeforeBatch != qa.NotBeforeBatch ||
+			qa2.Label != qa.Label {
+			t.Fatalf("%+v became %+v", qa, qa2)
+		}
+		buf2, err := qa2.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, buf2) {
+			t.Fatal("encoding changed on round trip")
+		}
+	}
+
+	aBuf, err := a.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checksum, err := a.Checksum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	withAttributes := func(f func(b *cryptobyte.Builder)) []byte {
+		var b cryptobyte.Builder
+		b.AddBytes(checksum)
+		b.AddUint16LengthPrefixed(f)
+		b.AddBytes(aBuf)
+		return b.BytesOrPanic()
+	}
+
+	// Unknown attributes are skipped.
+	var qa QueuedAssertion
+	buf := withAttributes(func(b *cryptobyte.Builder) {
+		b.AddUint16(labelAttribute)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes([]byte("label"))
+		})
+		b.AddUint16(1000)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes([]byte("from the future"))
+		})
+	})
+	if err := qa.UnmarshalBinary(buf); err != nil {
+		t.Fatal(err)
+	}
+	if qa.Label != "label" {
+		t.Fatalf("unexpected label %q", qa.Label)
+	}
+
+	// But they have to be in increasing order.
+	buf = withAttributes(func(b *cryptobyte.Builder) {
+		b.AddUint16(labelAttribute)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {})
+		b.AddUint16(notBeforeBatchAttribute)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint32(7)
+		})
+	})
+	if err := qa.UnmarshalBinary(buf); err == nil {
+		t.Fatal("accepted unsorted attributes")
+	}
+
+	// An attribute list that's cut short doesn't pass the checksum.
+	buf = withAttributes(func(b *cryptobyte.Builder) {
+		b.AddUint16(notBeforeBatchAttribute)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint32(7)
+		})
+	})
+	buf = append(buf[:csLen+2], buf[csLen+3:]...)
+	if err := qa.UnmarshalBinary(buf); err == nil {
+		t.Fatal("accepted corrupted entry")
+	}
+}
+
+// Queues written before entries had attributes consist of the checksum
+// followed by the assertion.
+func TestLegacyQueue(t *testing.T) {
+	h := createTestCA(t)
+	setTestClock(h, 0.5)
+
+	var (
+		b          cryptobyte.Builder
+		assertions []mtc.Assertion
+	)
+	for _, name := range []string{"example.com", "example.org"} {
+		a := createTestAssertion(t, name)
+		assertions = append(assertions, a)
+		aBuf, err := a.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		checksum, err := a.Checksum()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(checksum)
+			b.AddBytes(aBuf)
+		})
+	}
+	if err := os.WriteFile(h.queuePath(), b.BytesOrPanic(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Entries in the new format can be appended.
+	if err := h.QueueMultiple(func(yield func(qa QueuedAssertion) error) error {
+		return yield(QueuedAssertion{
+			Assertion: createTestAssertion(t, "example.net"),
+			Label:     "new",
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var qas []QueuedAssertion
+	if err := h.WalkQueue(func(qa QueuedAssertion) error {
+		qas = append(qas, qa)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(qas) != 3 {
+		t.Fatalf("expected 3 queued assertions; got %d", len(qas))
+	}
+	for i, qa := range qas[:2] {
+		if !qa.QueuedAt.IsZero() || qa.NotBeforeBatch != 0 || qa.Label != "" {
+			t.Fatalf("legacy entry %d has attributes: %+v", i, qa)
+		}
+		checksum, err := assertions[i].Checksum()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(qa.Checksum, checksum) {
+			t.Fatalf("legacy entry %d has the wrong checksum", i)
+		}
+	}
+	if qas[2].Label != "new" || qas[2].QueuedAt.IsZero() {
+		t.Fatalf("unexpected new entry %+v", qas[2])
+	}
+
+	setTestClock(h, 1.5)
+	if err := h.Issue(); err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range assertions {
+		if _, err := h.CertificateFor(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := queueLen(t, h); n != 0 {
+		t.Fatalf("expected an empty queue; got %d entries", n)
+	}
+}
+
+func TestKeyPolicy(t *testing.T) {
+	h := createTestCA(t)
+	h.SetKeyPolicy(&KeyPolicy{MinSecurityBits: 112})
+
+	rsaAssertion := func(bits int) mtc.Assertion {
+		sk, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a, err := mtc.NewAssertionBuilder().DNS("example.com").
+			TLSKey(&sk.PublicKey).Scheme(mtc.TLSPSSWithSHA256).Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return *a
+	}
+
+	weak := rsaAssertion(1024)
+	if err := h.Queue(weak, nil); !errors.Is(err, ErrWeakKey) {
+		t.Fatalf("expected ErrWeakKey; got %v", err)
+	}
+	if err := h.Queue(rsaAssertion(2048), nil); err != nil {
+		t.Fatal(err)
+	}
+	ed := createTestAssertion(t, "example.com")
+	if err := h.Queue(ed, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every key of a multi subject has to pass.
+	weakSubj := weak.Subject.(*mtc.TLSSubject)
+	edSubj := ed.Subject.(*mtc.TLSSubject)
+	multi, err := mtc.NewMultiTLSSubject(edSubj, weakSubj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = h.Queue(mtc.Assertion{Subject: multi, Claims: ed.Claims}, nil)
+	if !errors.Is(err, ErrWeakKey) {
+		t.Fatalf("expected ErrWeakKey; got %v", err)
+	}
+
+	h.SetKeyPolicy(&KeyPolicy{
+		AllowedSchemes: []mtc.SignatureScheme{mtc.TLSPSSWithSHA256},
+	})
+	if err := h.Queue(weak, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Queue(ed, nil); !errors.Is(err, ErrWeakKey) {
+		t.Fatalf("expected ErrWeakKey; got %v", err)
+	}
+
+	n := 0
+	if err := h.WalkQueue(func(qa QueuedAssertion) error {
+		n++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("expected 3 queued assertions; got %d", n)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	h := createTestCA(t)
+	if err := h.Queue(createTestAssertion(t, "example.com"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	errRefused := errors.New("refused")
+	h.SetPolicy(func(_ mtc.Subject, claims mtc.Claims) error {
+		if slices.Contains(claims.DNS, "evil.com") {
+			return errRefused
+		}
+		return nil
+	})
+
+	if err := h.Queue(createTestAssertion(t, "evil.com"), nil); !errors.Is(err, errRefused) {
+		t.Fatalf("expected refusal; got %v", err)
+	}
+
+	// None of a batch is queued if one is refused.
+	err := h.QueueMultiple(func(yield func(qa QueuedAssertion) error) error {
+		for _, name := range []string{"example.org", "evil.com"} {
+			if err := yield(QueuedAssertion{
+				Assertion: createTestAssertion(t, name),
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if !errors.Is(err, errRefused) {
+		t.Fatalf("expected refusal; got %v", err)
+	}
+	if n := queueLen(t, h); n != 1 {
+		t.Fatalf("expected 1 queued assertion; got %d", n)
+	}
+
+	h.SetPolicy(nil)
+	if err := h.Queue(createTestAssertion(t, "evil.com"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := queueLen(t, h); n != 2 {
+		t.Fatalf("expected 2 queued assertions; got %d", n)
+	}
+}
+
+func TestWeakRSAKeyLifetimePolicy(t *testing.T) {
+	h := createTestCA(t)
+	sk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := mtc.NewAssertionBuilder().DNS("example.com").
+		TLSKey(&sk.PublicKey).Scheme(mtc.TLSPSSWithSHA256).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed := createTestAssertion(t, "example.com")
+
+	// The test CA has a lifetime of 10s.
+	for _, tc := range []struct {
+		minBits     int
+		maxLifetime time.Duration
+		ok          bool
+	}{
+		{2048, 9 * time.Second, true},
+		{2049, 9 * time.Second, false},
+		{2049, 10 * time.Second, true},
+	} {
+		policy := WeakRSAKeyLifetimePolicy(h.Params(), tc.minBits, tc.maxLifetime)
+		err := policy(a.Subject, a.Claims)
+		if tc.ok && err != nil {
+			t.Fatalf("%d bits, %s: %v", tc.minBits, tc.maxLifetime, err)
+		}
+		if !tc.ok && err == nil {
+			t.Fatalf("%d bits, %s: 2048 bit key accepted", tc.minBits, tc.maxLifetime)
+		}
+
+		// Only RSA keys are checked.
+		if err := policy(ed.Subject, ed.Claims); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAllowedSubjectSchemes(t *testing.T) {
+	dir := t.TempDir()
+	h, err := New(dir, NewOpts{
+		IssuerId:   "example",
+		HttpServer: "ca.example.com",
+
+		BatchDuration: time.Second,
+		Lifetime:      10 * time.Second,
+
+		AllowedSubjectSchemes: []mtc.SignatureScheme{
+			mtc.TLSEd25519,
+			mtc.TLSECDSAWithP256AndSHA256,
+			mtc.TLSEd25519,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	expected := []mtc.SignatureScheme{
+		mtc.TLSECDSAWithP256AndSHA256,
+		mtc.TLSEd25519,
+	}
+	if !slices.Equal(h.params.AllowedSubjectSchemes, expected) {
+		t.Fatalf("schemes %v", h.params.AllowedSubjectSchemes)
+	}
+
+	if err := h.Queue(createTestAssertion(t, "example.com"), nil); err != nil {
+		t.Fatal(err)
+	}
+	sk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := mtc.NewAssertionBuilder().DNS("example.com").
+		TLSKey(&sk.PublicKey).Scheme(mtc.TLSPSSWithSHA256).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Queue(*a, nil); !errors.Is(err, ErrSchemeNotAllowed) {
+		t.Fatalf("expected ErrSchemeNotAllowed; got %v", err)
+	}
+
+	// Submissions through the queue log are checked too.
+	l, err := OpenQueueLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	err = l.Queue(QueuedAssertion{Assertion: *a})
+	if !errors.Is(err, ErrSchemeNotAllowed) {
+		t.Fatalf("expected ErrSchemeNotAllowed; got %v", err)
+	}
+}
+
+func TestClaimsHashLeaf(t *testing.T) {
+	dir := t.TempDir()
+	opts := NewOpts{
+		IssuerId:   "example",
+		HttpServer: "ca.example.com",
+
+		BatchDuration: time.Second,
+		Lifetime:      10 * time.Second,
+
+		LeafEncoding: mtc.ClaimsHashLeaf,
+	}
+	h, err := New(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	setTestClock(h, 0.5)
+	var as []mtc.Assertion
+	for _, name := range []string{"a.example.com", "b.example.com", "c.example.com"} {
+		a := createTestAssertion(t, name)
+		if err := h.Queue(a, nil); err != nil {
+			t.Fatal(err)
+		}
+		as = append(as, a)
+	}
+	setTestClock(h, 1.5)
+	if err := h.Issue(); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	root, err := h.ComputeRoot(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := mtc.Batch{CA: &h.params, Number: 0}
+	var claimsHashes []byte
+	for _, a := range as {
+		c, err := h.CertificateFor(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proof := c.Proof.(*mtc.MerkleTreeProof)
+		aa := a.Abridge()
+		if err := batch.VerifyAuthenticationPath(
+			proof.Index(), proof.Path(), root, &aa); err != nil {
+			t.Fatal(err)
+		}
+		claimsHash, err := aa.ClaimsHash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		claimsHashes = append(claimsHashes, claimsHash...)
+	}
+
+	// Without the abridged assertions, the tree can be checked
+	// from their claims hashes. The assertions are in queue order here.
+	tree, err := batch.ComputeTreeFromClaimsHashes(claimsHashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tree.Root(), root) {
+		t.Fatalf("root from claims hashes %x ≠ %x", tree.Root(), root)
+	}
+	h.Close()
+
+	opts.IfNotExists = true
+	opts.LeafEncoding = mtc.AbridgedAssertionLeaf
+	if _, err := New(dir, opts); !errors.Is(err, ErrCAMismatch) {
+		t.Fatalf("expected ErrCAMismatch, got %v", err)
+	}
+}
+
+func TestConsistencyProof(t *testing.T) {
+	h := createTestCA(t)
+	setTestClock(h, 16.5)
+	if err := h.Issue(); err != nil {
+		t.Fatal(err)
+	}
+
+	window := func(number uint32) *mtc.ValidityWindow {
+		w, err := h.SignedValidityWindow(number)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &w.ValidityWindow
+	}
+
+	proof, err := h.ConsistencyProof(0, 15)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var windows []*mtc.ValidityWindow
+	for _, w := range proof {
+		windows = append(windows, &w.ValidityWindow)
+	}
+	p := h.Params()
+	if err := mtc.VerifyConsistencyProof(&p, window(0), window(15),
+		windows); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := h.ConsistencyProof(0, 100); !errors.Is(err, ErrUnknownBatch) {
+		t.Fatalf("expected ErrUnknownBatch; got %v", err)
+	}
+}
+
+func TestTreeHeads(t *testing.T) {
+	h := createTestCA(t)
+	setTestClock(h, 0.5)
+	if err := h.Queue(createTestAssertion(t, "example.com"), nil); err != nil {
+		t.Fatal(err)
+	}
+	setTestClock(h, 3.5)
+	if err := h.Issue(); err != nil {
+		t.Fatal(err)
+	}
+
+	heads, err := h.TreeHeads()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(heads) != 3 {
+		t.Fatalf("expected 3 heads; got %d", len(heads))
+	}
+	for number, head := range heads {
+		info, err := h.BatchInfo(number)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(head, info.Root) {
+			t.Fatalf("batch %d: head %x, root %x", number, head, info.Root)
+		}
+	}
+	if bytes.Equal(heads[0], heads[1]) {
+		t.Fatal("batch 0, which has an assertion, has the head of an empty batch")
+	}
+}
@@ -0,0 +1,79 @@
+package ca
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+)
+
+// Returned when the abridged assertions of a batch have been removed by
+// Compact.
+var ErrBatchCompacted = errors.New("Batch has been compacted")
+
+// Removes the abridged assertions of the stored batches that have expired,
+// which are most of the batches with a long storage window. Returns the
+// numbers of the batches compacted.
+//
+// All assertions in a batch expire together with the batch, so a batch is
+// compacted as a whole, and only once none of its assertions are valid.
+// What's kept, and so keeps working:
+//
+//   - The tree, with every node, so the root doesn't change, Verify still
+//     checks it against the validity window, and the authentication path
+//     of any leaf can be reproduced.
+//   - The index, which maps the key of an assertion to its leaf, so proofs
+//     can still be looked up by key, as CertificateFor does. Its offsets
+//     into the abridged assertions are meaningless after compaction.
+//   - The validity window and summary.
+//
+// What's dropped, and so no longer possible for the batch:
+//
+//   - Recomputing the tree from its leaves. ComputeRoot returns
+//     ErrBatchCompacted.
+//   - Finding out which assertions the batch held, or checking a leaf
+//     against its assertion, as monitors and `mtc inspect` do.
+//
+// Archived batches, see SetRetentionPolicy, are not compacted: they're
+// kept for audits, which need the assertions.
+func (h *Handle) Compact() ([]uint32, error) {
+	if err := h.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	existing, err := h.listBatchRange()
+	if err != nil {
+		return nil, fmt.Errorf("listing batches: %w", err)
+	}
+	end := min(existing.End, h.params.ActiveBatches(h.now()).Begin)
+
+	var ret []uint32
+	for batch := existing.Begin; batch < end; batch++ {
+		key := batchKey(batch, "abridged-assertions")
+		obj, err := h.storage.Open(key)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue // compacted already
+		}
+		if err != nil {
+			return ret, err
+		}
+		obj.Close()
+
+		if err := h.closeBatch(batch); err != nil {
+			return ret, err
+		}
+		slog.Info("Compacting batch", "batch", batch)
+		if err := h.storage.Delete(key); err != nil {
+			return ret, fmt.Errorf("removing %s from storage: %w", key, err)
+		}
+		if h.externalStorage() {
+			err := os.Remove(h.aaPath(batch))
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return ret, err
+			}
+		}
+		ret = append(ret, batch)
+	}
+	return ret, nil
+}
@@ -0,0 +1,125 @@
+package ca
+
+import (
+	"fmt"
+	"os"
+	gopath "path"
+
+	"github.com/bwesterb/mtc"
+)
+
+func (h Handle) denyListPath() string {
+	return gopath.Join(h.path, "www", "mtc", "v1", "deny-list")
+}
+
+// Returns the CA's current deny list, which is empty if none has been
+// published.
+func (h *Handle) DenyList() (*mtc.DenyList, error) {
+	if h.closed {
+		return nil, ErrClosed
+	}
+
+	buf, err := os.ReadFile(h.denyListPath())
+	if os.IsNotExist(err) {
+		return &mtc.DenyList{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var l mtc.SignedDenyList
+	if err := l.UnmarshalBinary(buf, &h.params); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", h.denyListPath(), err)
+	}
+	return &l.DenyList, nil
+}
+
+// Adds the assertion with the given key to the deny list, and publishes
+// the newly signed list. See mtc.DenyList.
+//
+// The keys of assertions that have expired are dropped from the new list,
+// as relying parties reject those anyway. So are those of assertions that
+// are neither queued nor issued in an active batch, except for the given
+// key, which is kept until the next call.
+func (h *Handle) Deny(key []byte) error {
+	if err := h.checkWritable(); err != nil {
+		return err
+	}
+	if len(key) != mtc.HashLen {
+		return fmt.Errorf("key must be %d bytes", mtc.HashLen)
+	}
+
+	l, err := h.DenyList()
+	if err != nil {
+		return err
+	}
+
+	if !l.Add([mtc.HashLen]byte(key)) {
+		return nil // already denied
+	}
+	if err := h.pruneDenyList(l, [mtc.HashLen]byte(key)); err != nil {
+		return fmt.Errorf("pruning deny list: %w", err)
+	}
+	l.Timestamp = uint64(h.now().Unix())
+
+	sl, err := l.Sign(h.signer, &h.params)
+	if err != nil {
+		return fmt.Errorf("signing deny list: %w", err)
+	}
+	buf, err := sl.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, so that the deny list is replaced
+	// atomically.
+	tmpPath := h.denyListPath() + ".tmp"
+	if err := os.WriteFile(tmpPath, buf, h.fileMode); err != nil {
+		return fmt.Errorf("writing %s: %w", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, h.denyListPath()); err != nil {
+		return fmt.Errorf("renaming %s: %w", tmpPath, err)
+	}
+	return nil
+}
+
+// Removes the keys of assertions that are neither queued nor issued in
+// an active batch from the list, except for keep.
+func (h *Handle) pruneDenyList(l *mtc.DenyList, keep [mtc.HashLen]byte) error {
+	queued := make(map[[mtc.HashLen]byte]struct{})
+	err := h.WalkQueue(func(qa QueuedAssertion) error {
+		aa := qa.Assertion.Abridge()
+		var key [mtc.HashLen]byte
+		if err := aa.Key(key[:]); err != nil {
+			return err
+		}
+		queued[key] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	batches, err := h.listBatchRange()
+	if err != nil {
+		return fmt.Errorf("listing batches: %w", err)
+	}
+	batches.Begin = max(batches.Begin, h.params.ActiveBatches(h.now()).Begin)
+
+	keys := l.Keys[:0]
+	for _, key := range l.Keys {
+		_, ok := queued[key]
+		for batch := batches.Begin; !ok && batch < batches.End; batch++ {
+			res, err := h.aaByKeyIn(batch, key[:])
+			if err != nil {
+				return fmt.Errorf("searching in batch %d: %w", batch, err)
+			}
+			ok = res != nil
+		}
+		if ok || key == keep {
+			keys = append(keys, key)
+		}
+	}
+	l.Keys = keys
+	return nil
+}
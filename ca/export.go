@@ -0,0 +1,131 @@
+package ca
+
+// Functions to export and import the queue.
+//
+// An export consists of a header, followed by the queued assertions in
+// the same format as in the queue file: each prefixed by its length as
+// a big endian uint16.
+//
+//   +---------+----------------+--------------+---------+
+//   | "MTCQ"  | uint16 version | uint64 count | entries |
+//   +---------+----------------+--------------+---------+
+//
+// The entries retain their checksums and attributes, such as the time
+// they were queued.
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/bwesterb/mtc"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+const queueExportVersion = 1
+
+var queueExportMagic = []byte("MTCQ")
+
+// Writes all queued assertions to w. Returns the number written.
+func (h *Handle) ExportQueue(w io.Writer) (uint64, error) {
+	if h.closed {
+		return 0, ErrClosed
+	}
+
+	var count uint64
+	if err := h.WalkQueue(func(QueuedAssertion) error {
+		count++
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	var b cryptobyte.Builder
+	b.AddBytes(queueExportMagic)
+	b.AddUint16(queueExportVersion)
+	b.AddUint64(count)
+	header, _ := b.Bytes()
+
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(header); err != nil {
+		return 0, err
+	}
+
+	var written uint64
+	if err := h.WalkQueue(func(qa QueuedAssertion) error {
+		written++
+		return writeQueueEntry(bw, &qa)
+	}); err != nil {
+		return 0, err
+	}
+
+	if written != count {
+		return 0, errors.New("Queue changed during export")
+	}
+
+	return count, bw.Flush()
+}
+
+// Reads queued assertions exported with ExportQueue from r, and adds them
+// to the queue. Returns the number added.
+//
+// Nothing is added if the export is malformed or truncated.
+func (h *Handle) ImportQueue(r io.Reader) (uint64, error) {
+	if err := h.checkWritable(); err != nil {
+		return 0, err
+	}
+
+	br := bufio.NewReader(r)
+
+	var (
+		header  [14]byte
+		magic   []byte
+		version uint16
+		count   uint64
+	)
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return 0, fmt.Errorf("reading header: %w", err)
+	}
+	s := cryptobyte.String(header[:])
+	_ = s.ReadBytes(&magic, len(queueExportMagic))
+	_ = s.ReadUint16(&version)
+	_ = s.ReadUint64(&count)
+	if !bytes.Equal(magic, queueExportMagic) {
+		return 0, errors.New("Not a queue export")
+	}
+	if version != queueExportVersion {
+		return 0, fmt.Errorf("Unsupported queue export version %d", version)
+	}
+
+	var qas []QueuedAssertion
+	if err := readQueue(br, func(qa QueuedAssertion) error {
+		qas = append(qas, qa)
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	if uint64(len(qas)) != count {
+		return 0, fmt.Errorf(
+			"%w: header declares %d assertions, but found %d",
+			mtc.ErrTruncated,
+			count,
+			len(qas),
+		)
+	}
+
+	err := h.QueueMultiple(func(yield func(qa QueuedAssertion) error) error {
+		for _, qa := range qas {
+			if err := yield(qa); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
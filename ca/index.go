@@ -21,9 +21,13 @@ package ca
 import (
 	"bufio"
 	"bytes"
+	"cmp"
+	"container/heap"
 	"fmt"
 	"io"
 	"math/big"
+	"os"
+	gopath "path"
 	"slices"
 
 	"github.com/bwesterb/mtc"
@@ -34,7 +38,7 @@ import (
 
 // Handle to an index
 type Index struct {
-	r *mmap.ReaderAt
+	r Object
 }
 
 type IndexSearchResult struct {
@@ -49,6 +53,11 @@ func OpenIndex(path string) (*Index, error) {
 		return nil, fmt.Errorf("mmap(%s): %w", path, err)
 	}
 
+	return newIndex(r), nil
+}
+
+// Returns an Index that reads from r, which it closes on Close().
+func newIndex(r Object) *Index {
 	if r.Len() == 0 {
 		r.Close()
 		r = nil
@@ -56,7 +65,7 @@ func OpenIndex(path string) (*Index, error) {
 
 	return &Index{
 		r: r,
-	}, nil
+	}
 }
 
 func (h *Index) Close() error {
@@ -151,8 +160,6 @@ func (h *Index) Search(hash []byte) (*IndexSearchResult, error) {
 			return nil, nil
 		}
 	}
-
-	return nil, nil
 }
 
 type indexEntry struct {
@@ -161,15 +168,244 @@ type indexEntry struct {
 	offset uint64
 }
 
+const indexEntrySize = int(mtc.HashLen) + 16
+
+// Maximum number of entries ComputeIndex sorts in memory at a time.
+// Larger batches are sorted in runs stored in temporary files, which are
+// merged afterwards.
+var indexRunSize = 1 << 20
+
+func compareIndexEntries(a, b indexEntry) int {
+	if c := bytes.Compare(a.key[:], b.key[:]); c != 0 {
+		return c
+	}
+	return cmp.Compare(a.seqno, b.seqno)
+}
+
+func (e *indexEntry) write(w io.Writer) error {
+	var b cryptobyte.Builder
+	b.AddBytes(e.key[:])
+	b.AddUint64(e.seqno)
+	b.AddUint64(e.offset)
+	buf, _ := b.Bytes()
+	_, err := w.Write(buf)
+	return err
+}
+
+// Reads an entry from r. Returns io.EOF if there are no entries left.
+func (e *indexEntry) read(r io.Reader) error {
+	var buf [indexEntrySize]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return err
+	}
+	s := cryptobyte.String(buf[:])
+	copy(e.key[:], buf[:mtc.HashLen])
+	s.Skip(int(mtc.HashLen))
+	s.ReadUint64(&e.seqno)
+	s.ReadUint64(&e.offset)
+	return nil
+}
+
+// Writes sorted entries to the index, checking for duplicate keys.
+type indexWriter struct {
+	bw    *bufio.Writer
+	prev  indexEntry
+	first bool
+
+	// If set, called on entries with the same key as the one before,
+	// which are then skipped, instead of failing with ErrKeyCollision.
+	duplicate func(indexEntry) error
+}
+
+func newIndexWriter(w io.Writer) *indexWriter {
+	return &indexWriter{bw: bufio.NewWriter(w), first: true}
+}
+
+func (w *indexWriter) write(entry indexEntry) error {
+	// Duplicate assertions are removed when issuing, so the keys
+	// must be strictly increasing. If not, one leaf would shadow
+	// the other in lookups.
+	if !w.first && w.prev.key == entry.key {
+		if w.duplicate != nil {
+			return w.duplicate(entry)
+		}
+		return fmt.Errorf(
+			"%w: assertions %d and %d have key %x",
+			ErrKeyCollision,
+			w.prev.seqno,
+			entry.seqno,
+			entry.key,
+		)
+	}
+	w.first = false
+	w.prev = entry
+
+	if err := entry.write(w.bw); err != nil {
+		return fmt.Errorf("writing index: %w", err)
+	}
+	return nil
+}
+
+// Sorted run of entries stored in a temporary file.
+type indexRun struct {
+	f   *os.File
+	br  *bufio.Reader
+	cur indexEntry
+}
+
+// Min-heap of runs by their current entry.
+type indexRunHeap []*indexRun
+
+func (h indexRunHeap) Len() int { return len(h) }
+func (h indexRunHeap) Less(i, j int) bool {
+	return compareIndexEntries(h[i].cur, h[j].cur) < 0
+}
+func (h indexRunHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *indexRunHeap) Push(x any)   { *h = append(*h, x.(*indexRun)) }
+func (h *indexRunHeap) Pop() any {
+	old := *h
+	run := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return run
+}
+
 // Reads a stream of AbridgedAssertions from r, and writes the index to w.
+//
+// At most indexRunSize entries are kept in memory. If there are more,
+// they're sorted in runs in temporary files, which are merged.
 func ComputeIndex(r io.Reader, w io.Writer) error {
-	// First compute keys
-	seqno := uint64(0)
-	entries := []indexEntry{}
+	return computeIndex(r, w, "")
+}
+
+// As ComputeIndex, but stores temporary files in tmpDir. If tmpDir is
+// empty, the default directory for temporary files is used.
+func computeIndex(r io.Reader, w io.Writer, tmpDir string) error {
+	return buildIndex(r, w, indexBuild{tmpDir: tmpDir})
+}
+
+// How far a resumable index computation got: the number of runs written,
+// and the number of assertions they hold.
+type indexProgress struct {
+	runs    uint32
+	entries uint64
+}
+
+// As computeIndex, but keeps the runs in runDir, and calls checkpoint
+// after each is synced to disk. If from is not zero, continues where the
+// computation that reported it left off, reusing its runs. The runs are
+// only removed once the index is written.
+func computeIndexResumable(r io.Reader, w io.Writer, runDir string,
+	from indexProgress, checkpoint func(indexProgress) error) error {
+	return buildIndex(r, w, indexBuild{
+		runDir:     runDir,
+		from:       from,
+		checkpoint: checkpoint,
+	})
+}
+
+// Options for buildIndex.
+type indexBuild struct {
+	tmpDir string // for the runs, if runDir is not set
+
+	// If set, the runs are kept here. See computeIndexResumable.
+	runDir     string
+	from       indexProgress
+	checkpoint func(indexProgress) error
+
+	// If set, see indexWriter.
+	duplicate func(indexEntry) error
+}
+
+func (b *indexBuild) runPath(i uint32) string {
+	return gopath.Join(b.runDir, fmt.Sprintf("index-run-%d", i))
+}
+
+func buildIndex(r io.Reader, w io.Writer, b indexBuild) error {
+	var (
+		seqno   uint64
+		entries []indexEntry
+		runs    []*indexRun
+		key     [mtc.HashLen]byte
+		done    bool
+	)
+
+	defer func() {
+		for _, run := range runs {
+			run.f.Close()
+			if b.runDir == "" || done {
+				os.Remove(run.f.Name())
+			}
+		}
+	}()
+
+	// Runs written by an earlier attempt.
+	for i := uint32(0); i < b.from.runs; i++ {
+		f, err := os.Open(b.runPath(i))
+		if err != nil {
+			return fmt.Errorf("opening index run: %w", err)
+		}
+		runs = append(runs, &indexRun{f: f, br: bufio.NewReader(f)})
+	}
+
+	// Sorts the entries in memory, and writes them to a new run.
+	spill := func() error {
+		slices.SortFunc(entries, compareIndexEntries)
+
+		var (
+			f   *os.File
+			err error
+		)
+		if b.runDir == "" {
+			f, err = os.CreateTemp(b.tmpDir, "index-run-*")
+		} else {
+			f, err = os.OpenFile(b.runPath(uint32(len(runs))),
+				os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+		}
+		if err != nil {
+			return fmt.Errorf("creating index run: %w", err)
+		}
+		run := &indexRun{f: f}
+		runs = append(runs, run)
+
+		bw := bufio.NewWriter(f)
+		for i := range entries {
+			if err := entries[i].write(bw); err != nil {
+				return fmt.Errorf("writing index run: %w", err)
+			}
+		}
+		if err := bw.Flush(); err != nil {
+			return fmt.Errorf("writing index run: %w", err)
+		}
+		if b.runDir != "" {
+			if err := f.Sync(); err != nil {
+				return fmt.Errorf("syncing index run: %w", err)
+			}
+			if b.checkpoint != nil {
+				err := b.checkpoint(indexProgress{
+					runs:    uint32(len(runs)),
+					entries: seqno,
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		run.br = bufio.NewReader(f)
+
+		entries = entries[:0]
+		return nil
+	}
 
-	var key [mtc.HashLen]byte
+	// First compute keys
 	err := mtc.UnmarshalAbridgedAssertions(r, func(offset int,
 		aa *mtc.AbridgedAssertion) error {
+		if seqno < b.from.entries {
+			seqno++ // in one of the earlier runs
+			return nil
+		}
 		err := aa.Key(key[:])
 		if err != nil {
 			return err
@@ -180,6 +416,10 @@ func ComputeIndex(r io.Reader, w io.Writer) error {
 			offset: uint64(offset),
 		})
 		seqno++
+
+		if len(entries) >= indexRunSize {
+			return spill()
+		}
 		return nil
 	})
 
@@ -187,32 +427,61 @@ func ComputeIndex(r io.Reader, w io.Writer) error {
 		return fmt.Errorf("computing keys: %w", err)
 	}
 
-	// Sort by key
-	slices.SortFunc(entries, func(a, b indexEntry) int {
-		return bytes.Compare(a.key[:], b.key[:])
-	})
+	iw := newIndexWriter(w)
+	iw.duplicate = b.duplicate
 
-	// Write out
-	bw := bufio.NewWriter(w)
-	var lastKey [mtc.HashLen]byte
-	for _, entry := range entries {
-		if lastKey == entry.key {
-			// skip duplicate entries
-			continue
+	// Everything fit in memory: sort and write out
+	if len(runs) == 0 {
+		slices.SortFunc(entries, compareIndexEntries)
+		for _, entry := range entries {
+			if err := iw.write(entry); err != nil {
+				return err
+			}
+		}
+		if err := iw.bw.Flush(); err != nil {
+			return err
+		}
+		done = true
+		return nil
+	}
+
+	if len(entries) > 0 {
+		if err := spill(); err != nil {
+			return err
+		}
+	}
+	entries = nil
+
+	// Merge the runs
+	h := make(indexRunHeap, 0, len(runs))
+	for _, run := range runs {
+		if err := run.cur.read(run.br); err != nil {
+			return fmt.Errorf("reading index run: %w", err)
 		}
+		h = append(h, run)
+	}
+	heap.Init(&h)
 
-		lastKey = entry.key
-		var b cryptobyte.Builder
-		b.AddBytes(entry.key[:])
-		b.AddUint64(entry.seqno)
-		b.AddUint64(entry.offset)
-		buf, _ := b.Bytes()
+	for h.Len() > 0 {
+		run := h[0]
+		if err := iw.write(run.cur); err != nil {
+			return err
+		}
 
-		_, err = bw.Write(buf)
+		err := run.cur.read(run.br)
+		if err == io.EOF {
+			heap.Pop(&h)
+			continue
+		}
 		if err != nil {
-			return fmt.Errorf("writing index: %w", err)
+			return fmt.Errorf("reading index run: %w", err)
 		}
+		heap.Fix(&h, 0)
 	}
 
-	return bw.Flush()
+	if err := iw.bw.Flush(); err != nil {
+		return err
+	}
+	done = true
+	return nil
 }
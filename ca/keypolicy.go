@@ -0,0 +1,123 @@
+package ca
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/bwesterb/mtc"
+)
+
+// Returned, wrapped, when a subject key is refused by the KeyPolicy.
+var ErrWeakKey = errors.New("Subject key refused by key policy")
+
+// Requirements on the public keys of subjects, such as "no RSA keys
+// below 2048 bits". Unlike a Policy, it's checked on every key of
+// a subject: a handshake signed by any of them would be accepted.
+type KeyPolicy struct {
+	// If not empty, only keys for these signature schemes are accepted.
+	AllowedSchemes []mtc.SignatureScheme
+
+	// Keys with a lower security level, see SecurityBits, are refused.
+	MinSecurityBits int
+}
+
+// Sets the requirements on subject keys that QueueMultiple and Queue
+// enforce, next to the policy set with SetPolicy(). If nil, which is the
+// default, every key is accepted.
+func (h *Handle) SetKeyPolicy(kp *KeyPolicy) {
+	h.keyPolicy = kp
+}
+
+// Returns the security level in bits of the public key, as estimated in
+// NIST SP 800-57 part 1: for instance 112 for a 2048-bit RSA key, and 128
+// for a P-256 or Ed25519 key. RSA keys below 1024 bits get 0.
+func SecurityBits(v mtc.Verifier) (int, error) {
+	switch v.Scheme() {
+	case mtc.TLSPSSWithSHA256, mtc.TLSPSSWithSHA384, mtc.TLSPSSWithSHA512:
+		pk, err := x509.ParsePKCS1PublicKey(v.Bytes())
+		if err != nil {
+			return 0, err
+		}
+		bits := pk.N.BitLen()
+		switch {
+		case bits >= 15360:
+			return 256, nil
+		case bits >= 7680:
+			return 192, nil
+		case bits >= 3072:
+			return 128, nil
+		case bits >= 2048:
+			return 112, nil
+		case bits >= 1024:
+			return 80, nil
+		}
+		return 0, nil
+	case mtc.TLSECDSAWithP256AndSHA256, mtc.TLSEd25519,
+		mtc.TLSECDSAWithBrainpoolP256r1AndSHA256:
+		return 128, nil
+	case mtc.TLSECDSAWithP384AndSHA384, mtc.TLSECDSAWithBrainpoolP384r1AndSHA384:
+		return 192, nil
+	case mtc.TLSECDSAWithP521AndSHA512, mtc.TLSECDSAWithBrainpoolP512r1AndSHA512:
+		return 256, nil
+	case mtc.TLSDilitihium5r3:
+		return 256, nil // NIST category 5
+	}
+	return 0, fmt.Errorf("Unknown security level for scheme %s", v.Scheme())
+}
+
+// Checks that every public key of the subject is for a signature scheme
+// the CA accepts. See mtc.CAParams.AllowedSubjectSchemes.
+func checkSubjectSchemes(p *mtc.CAParams, subject mtc.Subject) error {
+	if len(p.AllowedSubjectSchemes) == 0 {
+		return nil
+	}
+	a := mtc.Assertion{Subject: subject}
+	vs, err := a.Verifiers()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrSchemeNotAllowed, err)
+	}
+	for _, v := range vs {
+		if !p.AllowsSubjectScheme(v.Scheme()) {
+			return fmt.Errorf("%w: %s; accepted are %v", ErrSchemeNotAllowed,
+				v.Scheme(), p.AllowedSubjectSchemes)
+		}
+	}
+	return nil
+}
+
+// Checks every public key of the subject against the policy.
+func (kp *KeyPolicy) Check(subject mtc.Subject) error {
+	a := mtc.Assertion{Subject: subject}
+	vs, err := a.Verifiers()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrWeakKey, err)
+	}
+
+	for _, v := range vs {
+		if len(kp.AllowedSchemes) != 0 &&
+			!slices.Contains(kp.AllowedSchemes, v.Scheme()) {
+			return fmt.Errorf("%w: scheme %s is not allowed", ErrWeakKey,
+				v.Scheme())
+		}
+		if kp.MinSecurityBits == 0 {
+			continue
+		}
+		bits, err := SecurityBits(v)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrWeakKey, err)
+		}
+		if bits < kp.MinSecurityBits {
+			return fmt.Errorf(
+				"%w: %s key has a security level of %d bits; "+
+					"at least %d are required",
+				ErrWeakKey,
+				v.Scheme(),
+				bits,
+				kp.MinSecurityBits,
+			)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package ca
+
+import (
+	"bytes"
+	"cmp"
+	"slices"
+)
+
+// Assigns the assertions of a batch their position in the tree.
+//
+// Called with walk, which walks the queue, and should call yield on each
+// assertion in the order they're to appear in the tree. Duplicates are
+// dropped afterwards. The batch is built twice and compared, so the order
+// must be deterministic.
+//
+// The key-sorted index is built separately, so any order yields a valid
+// batch. Each proof is a full authentication path whatever the order.
+// The order only matters when several proofs are handled together: the
+// paths of nearby leaves share their upper nodes, which helps a subscriber
+// or relying party that fetches, caches or compresses proofs for the same
+// subscriber, at the cost of less predictable positions for others.
+type LeafOrder func(
+	walk func(func(QueuedAssertion) error) error,
+	yield func(QueuedAssertion) error,
+) error
+
+// Keeps the assertions in the order they were queued. This is the default,
+// and the only order that doesn't load the queue into memory.
+func QueueOrder(walk func(func(QueuedAssertion) error) error,
+	yield func(QueuedAssertion) error) error {
+	return walk(yield)
+}
+
+// Groups assertions with the same subject, such as a subscriber's public
+// key, so that their leaves are adjacent. Otherwise, keeps queue order.
+//
+// Loads the whole queue into memory.
+func SubjectOrder(walk func(func(QueuedAssertion) error) error,
+	yield func(QueuedAssertion) error) error {
+	var qas []QueuedAssertion
+	if err := walk(func(qa QueuedAssertion) error {
+		qas = append(qas, qa)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	slices.SortStableFunc(qas, func(a, b QueuedAssertion) int {
+		sa, sb := a.Assertion.Subject, b.Assertion.Subject
+		if c := cmp.Compare(sa.Type(), sb.Type()); c != 0 {
+			return c
+		}
+		return bytes.Compare(sa.Info(), sb.Info())
+	})
+
+	for _, qa := range qas {
+		if err := yield(qa); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sets the order of the leaves in batches issued from now on.
+// A nil order keeps the queue order.
+func (h *Handle) SetLeafOrder(order LeafOrder) {
+	h.leafOrder = order
+}
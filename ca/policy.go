@@ -0,0 +1,75 @@
+package ca
+
+import (
+	"crypto/x509"
+	"fmt"
+	"time"
+
+	"github.com/bwesterb/mtc"
+)
+
+// Issuance policy. Called on each assertion before it's queued, by
+// Handle.QueueMultiple, which Queue and ImportQueue use, and by
+// QueueLog.Queue. If it returns an error, the assertion is refused.
+// Assertions that are in the queue already aren't checked again on issuance.
+type Policy func(subject mtc.Subject, claims mtc.Claims) error
+
+// Policy that accepts every assertion. This is the default.
+func NoPolicy(subject mtc.Subject, claims mtc.Claims) error {
+	return nil
+}
+
+// Sets the issuance policy that QueueMultiple and Queue enforce.
+// A nil policy accepts every assertion.
+func (h *Handle) SetPolicy(policy Policy) {
+	h.policy = policy
+}
+
+// Example policy that refuses RSA subject keys of fewer than minBits bits,
+// if assertions issued by the CA are valid for longer than maxLifetime.
+// Takes the longest lifetime in the schedule of the CA, see
+// mtc.CAParams.MaxLifetime.
+func WeakRSAKeyLifetimePolicy(params mtc.CAParams, minBits int,
+	maxLifetime time.Duration) Policy {
+	lifetime := params.MaxLifetime()
+
+	return func(subject mtc.Subject, _ mtc.Claims) error {
+		if lifetime <= maxLifetime {
+			return nil
+		}
+
+		var vs []mtc.Verifier
+		switch subject.(type) {
+		case *mtc.TLSSubject, *mtc.MultiTLSSubject, *mtc.CompactTLSSubject:
+			var err error
+			a := mtc.Assertion{Subject: subject}
+			vs, err = a.Verifiers()
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, v := range vs {
+			switch v.Scheme() {
+			case mtc.TLSPSSWithSHA256, mtc.TLSPSSWithSHA384, mtc.TLSPSSWithSHA512:
+			default:
+				continue
+			}
+
+			pk, err := x509.ParsePKCS1PublicKey(v.Bytes())
+			if err != nil {
+				return err
+			}
+			if bits := pk.N.BitLen(); bits < minBits {
+				return fmt.Errorf(
+					"RSA key of %d bits is too weak for lifetime %s; "+
+						"need at least %d bits",
+					bits,
+					lifetime,
+					minBits,
+				)
+			}
+		}
+		return nil
+	}
+}
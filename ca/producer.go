@@ -0,0 +1,67 @@
+package ca
+
+// Functions to work with producer annotations.
+//
+// To help debug interoperability between implementations, the CA writes
+// a producer file next to its ca-params, and in each batch directory.
+// It contains a single line identifying the implementation and version
+// that wrote the other files, such as
+//
+//   github.com/bwesterb/mtc v0.1.0
+//
+// The producer files are not covered by any signature, and are not used
+// when verifying.
+
+import (
+	"fmt"
+	"os"
+	gopath "path"
+	"runtime/debug"
+	"strings"
+)
+
+const (
+	producerFileName = "producer"
+	modulePath       = "github.com/bwesterb/mtc"
+)
+
+// Returns the annotation identifying this implementation and its version.
+func Producer() string {
+	version := "(devel)"
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if bi.Main.Path == modulePath && bi.Main.Version != "" {
+			version = bi.Main.Version
+		}
+		for _, dep := range bi.Deps {
+			if dep.Path == modulePath {
+				version = dep.Version
+			}
+		}
+	}
+	return modulePath + " " + version
+}
+
+// Writes the producer annotation into the given directory, with the
+// given permissions.
+func writeProducer(dir string, mode os.FileMode) error {
+	path := gopath.Join(dir, producerFileName)
+	err := os.WriteFile(path, []byte(Producer()+"\n"), mode)
+	if err != nil {
+		return fmt.Errorf("writing %s: %w", path, err)
+	}
+	return nil
+}
+
+// Reads the producer annotation from the given directory, which is either
+// the directory containing ca-params, or that of a batch. Returns the
+// empty string if there is none.
+func ReadProducer(dir string) (string, error) {
+	buf, err := os.ReadFile(gopath.Join(dir, producerFileName))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(buf)), nil
+}
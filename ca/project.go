@@ -0,0 +1,114 @@
+package ca
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/bwesterb/mtc"
+
+	dil5 "github.com/cloudflare/circl/sign/dilithium/mode5"
+)
+
+// Estimated disk usage of a CA at steady state: when it stores a full
+// storage window of batches, each with the same number of assertions.
+type StorageProjection struct {
+	Batches    uint64 // number of batches stored at a time
+	Assertions uint64 // per batch
+
+	// Sizes of the files of a single batch.
+	AbridgedAssertions int64
+	Tree               int64
+	Index              int64
+	Window             int64
+	Summary            int64
+	Producer           int64
+
+	// Size of the queue just before a batch is issued.
+	Queue int64
+}
+
+// Returns the size of the files of a single batch.
+func (p *StorageProjection) BatchSize() int64 {
+	return p.AbridgedAssertions + p.Tree + p.Index + p.Window + p.Summary +
+		p.Producer
+}
+
+// Returns the total size of the stored batches and the queue.
+func (p *StorageProjection) Total() int64 {
+	return int64(p.Batches)*p.BatchSize() + p.Queue
+}
+
+// Estimates the disk usage of the CA if each batch has perBatch
+// assertions like sample. The sizes are those of actual encodings of the
+// sample, and of a validity window with a signature of the size of the
+// CA's scheme. Archived batches aren't counted. Doesn't sign anything,
+// so it also works on a handle opened with OpenReadOnly.
+func (h *Handle) ProjectStorage(perBatch uint64, sample mtc.Assertion) (
+	*StorageProjection, error) {
+	if h.closed {
+		return nil, ErrClosed
+	}
+
+	aa := sample.Abridge()
+	aaBuf, err := aa.MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("encoding abridged assertion: %w", err)
+	}
+
+	var queue bytes.Buffer
+	qa := QueuedAssertion{Assertion: sample, QueuedAt: h.now()}
+	if err := writeQueueEntry(&queue, &qa); err != nil {
+		return nil, fmt.Errorf("encoding queue entry: %w", err)
+	}
+
+	sigSize, err := signatureSize(h.params.PublicKey.Scheme())
+	if err != nil {
+		return nil, err
+	}
+	w := mtc.SignedValidityWindow{
+		ValidityWindow: mtc.ValidityWindow{TreeHeads: h.params.PreEpochRoots()},
+		Signature:      make([]byte, sigSize),
+	}
+	wBuf, err := w.MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("encoding ValidityWindow: %w", err)
+	}
+
+	fp := make([]byte, mtc.HashLen)
+	summary := mtc.BatchSummary{
+		Root:           fp,
+		FirstKey:       fp,
+		LastKey:        fp,
+		IssuedAt:       time.Unix(0, 0),
+		KeyFingerprint: fp,
+	}
+	sBuf, err := summary.MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("encoding summary: %w", err)
+	}
+
+	n := int64(perBatch)
+	return &StorageProjection{
+		Batches:            h.params.StorageWindowSize,
+		Assertions:         perBatch,
+		AbridgedAssertions: mtc.AbridgedAssertionsHeaderSize + n*int64(len(aaBuf)),
+		Tree:               8 + int64(mtc.TreeNodeCount(perBatch))*mtc.HashLen,
+		Index:              n * int64(indexEntrySize),
+		Window:             int64(len(wBuf)),
+		Summary:            int64(len(sBuf)),
+		Producer:           int64(len(Producer()) + 1),
+		Queue:              n * int64(queue.Len()),
+	}, nil
+}
+
+// Returns the size of a signature with the given scheme, which has to be
+// one that CA keys can have, see mtc.GenerateSigningKeypair.
+func signatureSize(scheme mtc.SignatureScheme) (int, error) {
+	switch scheme {
+	case mtc.TLSDilitihium5r3:
+		return dil5.SignatureSize, nil
+	default:
+		return 0, fmt.Errorf("%w: %s", mtc.ErrUnsupportedScheme, scheme)
+	}
+}
@@ -0,0 +1,385 @@
+package ca
+
+// Write-ahead log of the queue, for submissions that shouldn't wait for
+// the lock of the CA.
+//
+// Each QueueLog appends to its own segment in the queue-log folder,
+// which holds entries as in the queue file. Next to the segment is a lock
+// file with the pid of the writer, so that a segment left behind by a
+// crashed writer can be told apart from one that's in use. Under the lock
+// of the CA, FoldQueueLog appends the complete entries of each segment to
+// the queue, and records how far it got in a .folded file. Segments whose
+// writer is gone are removed once they're folded completely.
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	gopath "path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwesterb/mtc"
+
+	"github.com/nightlyone/lockfile"
+)
+
+// Maximum number of entries QueueLog writes, and syncs, at once.
+const queueLogGroupSize = 1024
+
+// Absolute paths of the segments of the QueueLogs open in this process.
+// Their lock files can't tell, as they have our own pid.
+var openQueueLogs sync.Map
+
+// Appends submissions to the queue of a CA, without taking the lock of
+// the CA, so that they don't have to wait for issuance or for each other.
+// They're moved into the queue by FoldQueueLog, which Issue calls.
+//
+// A single goroutine writes the entries, grouping those submitted at the
+// same time into one write and sync. Safe for concurrent use.
+type QueueLog struct {
+	path      string // of the segment
+	f         *os.File
+	flock     lockfile.Lockfile
+	params    mtc.CAParams
+	policy    Policy
+	keyPolicy *KeyPolicy
+
+	mux    sync.RWMutex // protects closed, and sending on reqs
+	closed bool
+	reqs   chan queueLogRequest
+	done   chan struct{}
+}
+
+type queueLogRequest struct {
+	buf []byte
+	err chan error
+}
+
+func (h Handle) queueLogPath() string {
+	return gopath.Join(h.path, "queue-log")
+}
+
+// Opens a new segment of the queue log of the CA at path.
+//
+// Call QueueLog.Close() when done.
+func OpenQueueLog(path string) (*QueueLog, error) {
+	h := Handle{path: path}
+	paramsBuf, err := os.ReadFile(h.paramsPath())
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w at %s", ErrNoCA, path)
+	} else if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", h.paramsPath(), err)
+	}
+	var params mtc.CAParams
+	if err := params.UnmarshalBinary(paramsBuf); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", h.paramsPath(), err)
+	}
+	dir, err := filepath.Abs(h.queueLogPath())
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("os.MkdirAll(%s): %w", dir, err)
+	}
+
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	base := filepath.Join(dir, hex.EncodeToString(id[:]))
+
+	// The lock has to exist before the segment, so that FoldQueueLog
+	// doesn't take the segment for an abandoned one.
+	l := &QueueLog{
+		path:   base + ".wal",
+		params: params,
+		reqs:   make(chan queueLogRequest),
+		done:   make(chan struct{}),
+	}
+	l.flock, err = lockfile.New(base + ".lock")
+	if err != nil {
+		return nil, err
+	}
+	if err := l.flock.TryLock(); err != nil {
+		return nil, fmt.Errorf("Acquiring lock %s: %w", l.flock, err)
+	}
+	openQueueLogs.Store(l.path, struct{}{})
+
+	l.f, err = os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0o600)
+	if err != nil {
+		openQueueLogs.Delete(l.path)
+		l.flock.Unlock()
+		return nil, fmt.Errorf("creating %s: %w", l.path, err)
+	}
+
+	go l.run()
+	return l, nil
+}
+
+// Sets the policy submissions are checked against, as Handle.SetPolicy.
+// Call before Queue.
+func (l *QueueLog) SetPolicy(policy Policy) {
+	l.policy = policy
+}
+
+// Sets the requirements on subject keys, as Handle.SetKeyPolicy.
+// Call before Queue.
+func (l *QueueLog) SetKeyPolicy(kp *KeyPolicy) {
+	l.keyPolicy = kp
+}
+
+// Appends the assertion to the queue log, and returns once it's synced
+// to disk. Checks the checksum, if set, the subject schemes the CA accepts,
+// and the policies, as Handle.QueueMultiple does.
+func (l *QueueLog) Queue(qa QueuedAssertion) error {
+	if qa.QueuedAt.IsZero() {
+		qa.QueuedAt = time.Now()
+	}
+	if err := checkSubjectSchemes(&l.params, qa.Assertion.Subject); err != nil {
+		return err
+	}
+	if l.keyPolicy != nil {
+		if err := l.keyPolicy.Check(qa.Assertion.Subject); err != nil {
+			return err
+		}
+	}
+	if l.policy != nil {
+		if err := l.policy(qa.Assertion.Subject, qa.Assertion.Claims); err != nil {
+			return fmt.Errorf("refused by policy: %w", err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := writeQueueEntry(&buf, &qa); err != nil {
+		return err
+	}
+
+	req := queueLogRequest{buf: buf.Bytes(), err: make(chan error, 1)}
+	l.mux.RLock()
+	if l.closed {
+		l.mux.RUnlock()
+		return ErrClosed
+	}
+	l.reqs <- req
+	l.mux.RUnlock()
+	return <-req.err
+}
+
+// Writes the requests, grouping those that are waiting.
+func (l *QueueLog) run() {
+	defer close(l.done)
+
+	// After a failed write, the segment might end in a partial entry,
+	// which would hide the entries after it, so we stop writing.
+	var failed error
+
+	for req := range l.reqs {
+		group := []queueLogRequest{req}
+	more:
+		for len(group) < queueLogGroupSize {
+			select {
+			case req, ok := <-l.reqs:
+				if !ok {
+					break more
+				}
+				group = append(group, req)
+			default:
+				break more
+			}
+		}
+
+		err := failed
+		if err == nil {
+			var buf []byte
+			for _, req := range group {
+				buf = append(buf, req.buf...)
+			}
+			if _, err = l.f.Write(buf); err == nil {
+				err = l.f.Sync()
+			}
+			if err != nil {
+				err = fmt.Errorf("writing %s: %w", l.path, err)
+				failed = err
+			}
+		}
+		for _, req := range group {
+			req.err <- err
+		}
+	}
+}
+
+func (l *QueueLog) Close() error {
+	l.mux.Lock()
+	if l.closed {
+		l.mux.Unlock()
+		return ErrClosed
+	}
+	l.closed = true
+	close(l.reqs)
+	l.mux.Unlock()
+	<-l.done
+
+	err := l.f.Close()
+	openQueueLogs.Delete(l.path)
+	if err2 := l.flock.Unlock(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// Returns whether the writer of the segment at path, which is absolute,
+// is gone, so that it won't be appended to anymore.
+func queueLogSegmentAbandoned(path string) bool {
+	if _, ok := openQueueLogs.Load(path); ok {
+		return false
+	}
+	flock, err := lockfile.New(strings.TrimSuffix(path, ".wal") + ".lock")
+	if err != nil {
+		return false
+	}
+	proc, err := flock.GetOwner()
+	switch {
+	case err == nil:
+		return proc.Pid == os.Getpid()
+	case errors.Is(err, lockfile.ErrDeadOwner),
+		errors.Is(err, lockfile.ErrInvalidPid),
+		errors.Is(err, os.ErrNotExist):
+		return true
+	}
+	return false
+}
+
+// Returns the length of the complete and valid entries at the start of
+// buf, which is read from a segment of the queue log.
+func queueLogEntriesLen(buf []byte) int {
+	n := 0
+	for len(buf)-n >= 2 {
+		size := int(binary.BigEndian.Uint16(buf[n:]))
+		if len(buf)-n-2 < size {
+			break
+		}
+		var qa QueuedAssertion
+		if err := qa.UnmarshalBinary(buf[n+2 : n+2+size]); err != nil {
+			break
+		}
+		n += 2 + size
+	}
+	return n
+}
+
+// Moves the entries of the queue log into the queue. Issue does this
+// before issuing a batch.
+//
+// If this is interrupted, entries might end up in the queue twice, which
+// is harmless: a batch doesn't get the same assertion twice.
+func (h *Handle) FoldQueueLog() error {
+	if err := h.checkWritable(); err != nil {
+		return err
+	}
+
+	dir, err := filepath.Abs(h.queueLogPath())
+	if err != nil {
+		return err
+	}
+	ds, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var segments []string
+	for _, d := range ds {
+		if d.Type().IsRegular() && strings.HasSuffix(d.Name(), ".wal") {
+			segments = append(segments, filepath.Join(dir, d.Name()))
+		}
+	}
+	sort.Strings(segments)
+
+	for _, path := range segments {
+		if err := h.foldQueueLogSegment(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *Handle) foldQueueLogSegment(path string) error {
+	base := strings.TrimSuffix(path, ".wal")
+	foldedPath := base + ".folded"
+
+	// Check before reading, so that an abandoned segment is complete.
+	abandoned := queueLogSegmentAbandoned(path)
+
+	var offset int64
+	foldedBuf, err := os.ReadFile(foldedPath)
+	if err == nil && len(foldedBuf) == 8 {
+		offset = int64(binary.BigEndian.Uint64(foldedBuf))
+	} else if err == nil {
+		return fmt.Errorf("%s: malformed", foldedPath)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	buf, err := io.ReadAll(io.NewSectionReader(f, offset, 1<<62))
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	n := queueLogEntriesLen(buf)
+	if n != 0 {
+		w, err := os.OpenFile(h.queuePath(), os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			return fmt.Errorf("opening queue: %w", err)
+		}
+		_, err = w.Write(buf[:n])
+		if err == nil {
+			err = w.Sync()
+		}
+		if err2 := w.Close(); err == nil {
+			err = err2
+		}
+		if err != nil {
+			return fmt.Errorf("appending %s to queue: %w", path, err)
+		}
+
+		offset += int64(n)
+		foldedBuf = binary.BigEndian.AppendUint64(nil, uint64(offset))
+		if err := os.WriteFile(foldedPath+".tmp", foldedBuf, 0o600); err != nil {
+			return err
+		}
+		if err := os.Rename(foldedPath+".tmp", foldedPath); err != nil {
+			return err
+		}
+	}
+
+	if !abandoned {
+		return nil
+	}
+	if n != len(buf) {
+		slog.Warn("Dropping partial entry at end of queue log",
+			"segment", path, "bytes", len(buf)-n)
+	}
+	for _, p := range []string{path, foldedPath, base + ".lock"} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
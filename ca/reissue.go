@@ -0,0 +1,123 @@
+package ca
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	gopath "path"
+
+	"github.com/bwesterb/mtc"
+)
+
+// Signs the validity window of an issued batch anew with the CA's current
+// key, for instance when its signature is broken, or was made with a key
+// that has since been replaced. Returns the new window.
+//
+// Only the signature changes. The stored window doesn't have to verify,
+// but its tree heads must: its own head has to match the root recomputed
+// from the batch's abridged assertions and its stored tree, and the
+// window has to extend that of the previous batch, if it's still around.
+func (h *Handle) ReissueWindow(number uint32) (*mtc.SignedValidityWindow, error) {
+	if err := h.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	wPath := gopath.Join(h.batchPath(number), "signed-validity-window")
+	buf, err := os.ReadFile(wPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrUnknownBatch
+		}
+		return nil, err
+	}
+	var old mtc.SignedValidityWindow
+	if err := old.UnmarshalBinaryWithoutVerification(buf, &h.params); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", wPath, err)
+	}
+	if old.BatchNumber != number {
+		return nil, fmt.Errorf("%w: batch %d has the validity window of batch %d",
+			ErrNonMonotonic, number, old.BatchNumber)
+	}
+
+	heads := old.TreeHeads
+	head := heads[len(heads)-mtc.HashLen:]
+	root, err := h.ComputeRoot(number)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(root, head) {
+		return nil, fmt.Errorf("batch %d: computed root %x doesn't match window %x",
+			number, root, head)
+	}
+	t, err := h.treeFor(number)
+	if err != nil {
+		return nil, fmt.Errorf("batch %d: opening tree: %w", number, err)
+	}
+	treeRoot, err := t.Root()
+	if err != nil {
+		return nil, fmt.Errorf("batch %d: reading tree: %w", number, err)
+	}
+	if !bytes.Equal(treeRoot, head) {
+		return nil, fmt.Errorf("batch %d: root of tree %x doesn't match window %x",
+			number, treeRoot, head)
+	}
+
+	var prevHeads []byte
+	if number == 0 {
+		prevHeads = h.params.PreEpochRoots()
+	} else {
+		prevPath := gopath.Join(h.batchPath(number-1), "signed-validity-window")
+		prevBuf, err := os.ReadFile(prevPath)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			var prev mtc.SignedValidityWindow
+			err := prev.UnmarshalBinaryWithoutVerification(prevBuf, &h.params)
+			if err != nil {
+				return nil, fmt.Errorf("parsing %s: %w", prevPath, err)
+			}
+			prevHeads = prev.TreeHeads
+		}
+	}
+	if prevHeads != nil &&
+		!bytes.Equal(heads[:len(heads)-mtc.HashLen], prevHeads[mtc.HashLen:]) {
+		return nil, fmt.Errorf(
+			"%w: validity window of batch %d doesn't extend that of batch %d",
+			ErrNonMonotonic, number, number-1)
+	}
+
+	// SignValidityWindow drops the oldest of the previous heads, so we
+	// can pass the stored heads shifted by one.
+	shifted := append(make([]byte, mtc.HashLen), heads[:len(heads)-mtc.HashLen]...)
+	batch := mtc.Batch{CA: &h.params, Number: number}
+	w, err := batch.SignValidityWindow(h.signer, shifted, root)
+	if err != nil {
+		return nil, fmt.Errorf("signing ValidityWindow: %w", err)
+	}
+	if !bytes.Equal(w.TreeHeads, heads) {
+		return nil, fmt.Errorf("batch %d: tree heads changed on re-signing", number)
+	}
+
+	buf, err = w.MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("marshalling SignedValidityWindow: %w", err)
+	}
+
+	// Write to a temporary file first, so that the window is replaced
+	// atomically.
+	tmpPath := wPath + ".tmp"
+	if err := os.WriteFile(tmpPath, buf, h.fileMode); err != nil {
+		return nil, fmt.Errorf("writing %s: %w", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, wPath); err != nil {
+		return nil, fmt.Errorf("renaming %s: %w", tmpPath, err)
+	}
+	if h.externalStorage() {
+		key := batchKey(number, "signed-validity-window")
+		if err := h.storage.Put(key, buf); err != nil {
+			return nil, fmt.Errorf("storing %s: %w", key, err)
+		}
+	}
+	return &w, nil
+}
@@ -0,0 +1,298 @@
+package ca
+
+// Checkpoints of the issuance of a batch, so that issuing a large queue
+// continues where it left off after a crash or an error, instead of
+// starting over.
+//
+// While a batch is issued, the resume folder in tmp holds a state file
+// with the batch number, the time of issuance, and the size and hash of
+// the part of the queue that goes into the batch. Next to it are the two
+// folders the batch is built in, see issueBatch, each with a progress file
+// and a folder for the runs of its index. The batch is resumed only if it
+// has the same number, and the queue still starts with the same entries.
+// Entries queued after the batch was started are left in the queue.
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	gopath "path"
+	"time"
+
+	"github.com/bwesterb/mtc"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// Issuance of a batch, which might be resumed.
+type issuance struct {
+	dir       string
+	number    uint32
+	issuedAt  time.Time
+	queueSize int64 // of the part of the queue in the batch
+	queueHash [sha256.Size]byte
+}
+
+// Steps of building a batch in a folder, after which its progress is
+// stored.
+type buildStage uint8
+
+const (
+	stageStarted            buildStage = iota
+	stageAbridgedAssertions            // abridged-assertions written
+	stageTree                          // tree written
+	stageIndex                         // index written
+)
+
+// Progress of building a batch in a folder. Within a stage, tree and index
+// record how far the next one got.
+type buildProgress struct {
+	path  string // of the progress file
+	stage buildStage
+	tree  mtc.TreeProgress
+	index indexProgress
+	root  []byte // of the tree, from stageTree on
+}
+
+func (h Handle) resumePath() string {
+	return gopath.Join(h.tmpPath(), "resume")
+}
+
+// Returns the issuance of batch number stored in the resume folder, if it
+// can be resumed, and otherwise starts a new one. If empty, the batch
+// won't take any entries from the queue.
+func (h *Handle) startIssuance(number uint32, empty bool) (*issuance, error) {
+	is, err := h.loadIssuance()
+	if err != nil {
+		slog.Warn("Ignoring issuance checkpoint", "err", err)
+	} else if is != nil {
+		ok, err := is.matches(h, number)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			slog.Info("Resuming issuance", "batch", number)
+			return is, nil
+		}
+		slog.Info("Discarding issuance checkpoint", "batch", is.number)
+	}
+
+	if err := h.DiscardIssuanceCheckpoint(); err != nil {
+		return nil, err
+	}
+
+	is = &issuance{
+		dir:      h.resumePath(),
+		number:   number,
+		issuedAt: h.now(),
+	}
+	if !empty {
+		info, err := os.Stat(h.queuePath())
+		if err != nil {
+			return nil, fmt.Errorf("stat queue: %w", err)
+		}
+		is.queueSize = info.Size()
+	}
+	is.queueHash, err = h.hashQueuePrefix(is.queueSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(is.dir, 0o700); err != nil {
+		return nil, fmt.Errorf("os.MkdirAll(%s): %w", is.dir, err)
+	}
+	if err := writeFileAtomic(is.statePath(), is.marshal()); err != nil {
+		return nil, fmt.Errorf("writing %s: %w", is.statePath(), err)
+	}
+	return is, nil
+}
+
+// Removes the checkpoint of an interrupted issuance, if any, so that the
+// next batch is built from scratch.
+func (h *Handle) DiscardIssuanceCheckpoint() error {
+	if err := h.checkWritable(); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(h.resumePath()); err != nil {
+		return fmt.Errorf("removing %s: %w", h.resumePath(), err)
+	}
+	return nil
+}
+
+// Loads the issuance in the resume folder. Returns nil if there is none.
+func (h *Handle) loadIssuance() (*issuance, error) {
+	is := &issuance{dir: h.resumePath()}
+	buf, err := os.ReadFile(is.statePath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var issuedAt, queueSize uint64
+	s := cryptobyte.String(buf)
+	if !s.ReadUint32(&is.number) ||
+		!s.ReadUint64(&issuedAt) ||
+		!s.ReadUint64(&queueSize) ||
+		!s.CopyBytes(is.queueHash[:]) {
+		return nil, mtc.ErrTruncated
+	}
+	if !s.Empty() {
+		return nil, mtc.ErrExtraBytes
+	}
+	is.issuedAt = time.Unix(0, int64(issuedAt))
+	is.queueSize = int64(queueSize)
+	return is, nil
+}
+
+func (is *issuance) marshal() []byte {
+	var b cryptobyte.Builder
+	b.AddUint32(is.number)
+	b.AddUint64(uint64(is.issuedAt.UnixNano()))
+	b.AddUint64(uint64(is.queueSize))
+	b.AddBytes(is.queueHash[:])
+	return b.BytesOrPanic()
+}
+
+// Returns whether the issuance is of the given batch, with the entries
+// still at the start of the queue.
+func (is *issuance) matches(h *Handle, number uint32) (bool, error) {
+	if is.number != number {
+		return false, nil
+	}
+	info, err := os.Stat(h.queuePath())
+	if err != nil {
+		return false, fmt.Errorf("stat queue: %w", err)
+	}
+	if info.Size() < is.queueSize {
+		return false, nil
+	}
+	hash, err := h.hashQueuePrefix(is.queueSize)
+	if err != nil {
+		return false, err
+	}
+	return hash == is.queueHash, nil
+}
+
+func (is *issuance) statePath() string {
+	return gopath.Join(is.dir, "state")
+}
+
+// Returns the folder the batch is built in for the ith time.
+func (is *issuance) buildDir(i int) string {
+	return gopath.Join(is.dir, fmt.Sprintf("batch%d", i))
+}
+
+// Returns the folder with the runs of the index built in buildDir(i).
+func (is *issuance) runDir(i int) string {
+	return is.buildDir(i) + ".runs"
+}
+
+// Returns the progress of building the batch in buildDir(i).
+func (is *issuance) progress(i int) (*buildProgress, error) {
+	p := &buildProgress{path: is.buildDir(i) + ".progress"}
+	buf, err := os.ReadFile(p.path)
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		root cryptobyte.String
+		s    = cryptobyte.String(buf)
+	)
+	if !s.ReadUint8((*uint8)(&p.stage)) ||
+		!s.ReadUint64(&p.tree.Leaves) ||
+		!s.ReadUint8(&p.tree.Levels) ||
+		!s.ReadUint32(&p.index.runs) ||
+		!s.ReadUint64(&p.index.entries) ||
+		!s.ReadUint8LengthPrefixed(&root) {
+		return nil, fmt.Errorf("parsing %s: %w", p.path, mtc.ErrTruncated)
+	}
+	if !s.Empty() {
+		return nil, fmt.Errorf("parsing %s: %w", p.path, mtc.ErrExtraBytes)
+	}
+	if p.stage > stageIndex {
+		return nil, fmt.Errorf("parsing %s: unknown stage %d", p.path, p.stage)
+	}
+	if p.stage >= stageTree && len(root) != mtc.HashLen {
+		return nil, fmt.Errorf("parsing %s: missing root", p.path)
+	}
+	if len(root) != 0 {
+		p.root = []byte(root)
+	}
+	return p, nil
+}
+
+// Stores the progress. The files it refers to have to be synced first.
+func (p *buildProgress) save() error {
+	var b cryptobyte.Builder
+	b.AddUint8(uint8(p.stage))
+	b.AddUint64(p.tree.Leaves)
+	b.AddUint8(p.tree.Levels)
+	b.AddUint32(p.index.runs)
+	b.AddUint64(p.index.entries)
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(p.root)
+	})
+	if err := writeFileAtomic(p.path, b.BytesOrPanic()); err != nil {
+		return fmt.Errorf("writing %s: %w", p.path, err)
+	}
+	return nil
+}
+
+// Returns the SHA256 hash of the first size bytes of the queue.
+func (h *Handle) hashQueuePrefix(size int64) ([sha256.Size]byte, error) {
+	var ret [sha256.Size]byte
+	r, err := os.Open(h.queuePath())
+	if err != nil {
+		return ret, fmt.Errorf("Opening queue: %w", err)
+	}
+	defer r.Close()
+
+	hh := sha256.New()
+	if _, err := io.CopyN(hh, r, size); err != nil {
+		return ret, fmt.Errorf("Reading queue: %w", err)
+	}
+	hh.Sum(ret[:0])
+	return ret, nil
+}
+
+// Calls f on each assertion in the first size bytes of the queue.
+func (h *Handle) walkQueuePrefix(size int64,
+	f func(QueuedAssertion) error) error {
+	r, err := os.Open(h.queuePath())
+	if err != nil {
+		return fmt.Errorf("Opening queue: %w", err)
+	}
+	defer r.Close()
+
+	return readQueue(bufio.NewReader(io.LimitReader(r, size)), f)
+}
+
+// Writes data to path, and syncs it, through a temporary file, so that
+// path either has the old or the new contents after a crash.
+func writeFileAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
@@ -0,0 +1,193 @@
+package ca
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	gopath "path"
+	"strconv"
+	"time"
+)
+
+// Decides whether to keep a batch that has fallen outside of the storage
+// window, for instance for audits. The batch covers [start, end).
+//
+// Batches that are kept are moved out of the published batches into the
+// archive directory of the CA. Archived batches are checked against the
+// policy again on each clean up, and removed once it returns false.
+type RetentionPolicy func(number uint32, start, end, now time.Time) bool
+
+// Keeps the batch covering each multiple of every since the zero time,
+// for keepFor after it ended. With every set to 24h, that's the batch
+// covering midnight UTC.
+func KeepOneEvery(every, keepFor time.Duration) RetentionPolicy {
+	return func(_ uint32, start, end, now time.Time) bool {
+		if now.Sub(end) >= keepFor {
+			return false
+		}
+		return !end.Add(-1).Truncate(every).Before(start)
+	}
+}
+
+// Sets the retention policy for batches that fall outside of the storage
+// window, for this handle only. A nil policy removes them, and leaves
+// the batches that were archived before alone. Defaults to the policy
+// stored with SaveRetention, if any.
+func (h *Handle) SetRetentionPolicy(policy RetentionPolicy) {
+	h.retention = policy
+}
+
+// Retention settings that are stored with the CA, so that every handle
+// that issues applies the same policy: KeepOneEvery(KeepEvery, KeepFor).
+type Retention struct {
+	KeepEvery time.Duration
+	KeepFor   time.Duration
+}
+
+// Stores the retention settings with the CA, and sets the corresponding
+// policy. Handles opened later use it too. If r is nil, removes the
+// stored settings, and sets a nil policy.
+func (h *Handle) SaveRetention(r *Retention) error {
+	if err := h.checkWritable(); err != nil {
+		return err
+	}
+	if r == nil {
+		if err := os.Remove(h.retentionPath()); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("removing %s: %w", h.retentionPath(), err)
+		}
+		h.retention = nil
+		return nil
+	}
+	if r.KeepEvery <= 0 || r.KeepFor < 0 {
+		return errors.New("KeepEvery has to be positive, and KeepFor not negative")
+	}
+	buf := fmt.Sprintf("%d %d\n", int64(r.KeepEvery), int64(r.KeepFor))
+	tmpPath := h.retentionPath() + ".tmp"
+	if err := os.WriteFile(tmpPath, []byte(buf), 0o600); err != nil {
+		return fmt.Errorf("writing %s: %w", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, h.retentionPath()); err != nil {
+		return fmt.Errorf("renaming %s: %w", tmpPath, err)
+	}
+	h.retention = KeepOneEvery(r.KeepEvery, r.KeepFor)
+	return nil
+}
+
+// Returns the retention settings stored with the CA, or nil if there
+// are none.
+func (h *Handle) StoredRetention() (*Retention, error) {
+	buf, err := os.ReadFile(h.retentionPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", h.retentionPath(), err)
+	}
+	var every, keepFor int64
+	if _, err := fmt.Sscanf(string(buf), "%d %d\n", &every, &keepFor); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", h.retentionPath(), err)
+	}
+	return &Retention{
+		KeepEvery: time.Duration(every),
+		KeepFor:   time.Duration(keepFor),
+	}, nil
+}
+
+// Sets the policy to the one stored with the CA, if any.
+func (h *Handle) loadRetention() error {
+	r, err := h.StoredRetention()
+	if err != nil {
+		return err
+	}
+	if r != nil {
+		h.retention = KeepOneEvery(r.KeepEvery, r.KeepFor)
+	}
+	return nil
+}
+
+func (h Handle) retentionPath() string {
+	return gopath.Join(h.path, "retention")
+}
+
+func (h Handle) archivePath() string {
+	return gopath.Join(h.path, "archive")
+}
+
+// Returns the numbers of the archived batches.
+func (h *Handle) ArchivedBatches() ([]uint32, error) {
+	ds, err := os.ReadDir(h.archivePath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ret []uint32
+	for _, d := range ds {
+		batch, err := strconv.ParseUint(d.Name(), 10, 32)
+		if err != nil || !d.IsDir() {
+			continue
+		}
+		ret = append(ret, uint32(batch))
+	}
+	return ret, nil
+}
+
+// Removes or archives the given batch, which has fallen outside of the
+// storage window.
+func (h *Handle) retireBatch(batch uint32, dt time.Time) error {
+	start, end := h.params.BatchTimeRange(batch)
+	if h.retention == nil || !h.retention(batch, start, end, dt) {
+		slog.Info("Removing batch", "batch", batch)
+		if err := os.RemoveAll(h.batchPath(batch)); err != nil {
+			return fmt.Errorf("Removing batch %d: %w", batch, err)
+		}
+		return nil
+	}
+
+	slog.Info("Archiving batch", "batch", batch)
+	if err := os.MkdirAll(h.archivePath(), h.dirMode()); err != nil {
+		return err
+	}
+	path := gopath.Join(h.archivePath(), strconv.FormatUint(uint64(batch), 10))
+	if err := os.Rename(h.batchPath(batch), path); err != nil {
+		return fmt.Errorf("Archiving batch %d: %w", batch, err)
+	}
+	return nil
+}
+
+// Removes archived batches the retention policy no longer keeps. Without
+// a policy, the archive is left alone: it's not up to us to undo what
+// the policy of an earlier run decided.
+func (h *Handle) pruneArchive(dt time.Time) error {
+	if h.retention == nil {
+		return nil
+	}
+	batches, err := h.ArchivedBatches()
+	if err != nil {
+		return fmt.Errorf("listing archived batches: %w", err)
+	}
+	for _, batch := range batches {
+		start, end := h.params.BatchTimeRange(batch)
+		if h.retention(batch, start, end, dt) {
+			continue
+		}
+		slog.Info("Removing archived batch", "batch", batch)
+		path := gopath.Join(h.archivePath(), strconv.FormatUint(uint64(batch), 10))
+		if err := os.RemoveAll(path); err != nil {
+			return fmt.Errorf("Removing archived batch %d: %w", batch, err)
+		}
+	}
+	return nil
+}
+
+// Removes batches that fall outside of the storage window, or archives
+// them if the retention policy says so. Also removes archived batches the
+// policy no longer keeps. Issue does this as well.
+func (h *Handle) GC() error {
+	if err := h.checkWritable(); err != nil {
+		return err
+	}
+	return h.dropOldBatches(h.now())
+}
@@ -0,0 +1,47 @@
+package ca
+
+import (
+	"fmt"
+
+	"github.com/bwesterb/mtc"
+)
+
+// Signs a staple stating that the assertion with the given key, issued in
+// the given batch, is still in good standing as of the latest batch. See
+// mtc.Staple.
+//
+// Returns mtc.ErrAssertionDenied if the assertion is on the deny list,
+// and the errors of ProofFor if it wasn't issued in that batch, or the
+// batch has expired.
+func (h *Handle) Staple(key []byte, batch uint32) (*mtc.SignedStaple, error) {
+	if err := h.checkWritable(); err != nil {
+		return nil, err
+	}
+	if _, err := h.ProofFor(batch, key); err != nil {
+		return nil, err
+	}
+
+	l, err := h.DenyList()
+	if err != nil {
+		return nil, err
+	}
+	if l.Contains(key) {
+		return nil, mtc.ErrAssertionDenied
+	}
+
+	batches, err := h.listBatchRange()
+	if err != nil {
+		return nil, fmt.Errorf("listing batches: %w", err)
+	}
+
+	s := mtc.Staple{
+		Key:         [mtc.HashLen]byte(key),
+		BatchNumber: batch,
+		AsOf:        batches.End - 1,
+	}
+	ss, err := s.Sign(h.signer, &h.params)
+	if err != nil {
+		return nil, fmt.Errorf("signing staple: %w", err)
+	}
+	return &ss, nil
+}
@@ -0,0 +1,251 @@
+package ca
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	gopath "path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/exp/mmap"
+)
+
+// Storage for the files of issued batches, such as their trees and
+// validity windows. Keys are slash-separated paths relative to the batches
+// folder, such as "12/tree".
+//
+// The CA issues batches to its local folder, and from there puts them in
+// the storage, if it's not that folder. Proofs, validity windows and batch
+// information are read from the storage. Thus a serving tier can be backed
+// by, for instance, an S3-compatible object store.
+type Storage interface {
+	// Stores data under key, replacing what's there.
+	Put(key string, data []byte) error
+
+	// Returns the data stored under key. Returns an error wrapping
+	// fs.ErrNotExist if there is none.
+	Get(key string) ([]byte, error)
+
+	// Like Get, but for random access, which is how trees and indices
+	// are read.
+	Open(key string) (Object, error)
+
+	// Returns the keys that start with prefix, in any order.
+	List(prefix string) ([]string, error)
+
+	// Returns the distinct beginnings of the keys that start with prefix,
+	// up to and including the first slash after it, in any order, as
+	// object stores do when listing with a "/" delimiter. For instance,
+	// "12/" for "12/tree". Keys without a slash after prefix are left
+	// out. Used to list the batches without going through their files.
+	ListPrefixes(prefix string) ([]string, error)
+
+	// Removes the data stored under key, if any.
+	Delete(key string) error
+}
+
+// Data in a Storage opened for random access.
+type Object interface {
+	io.ReaderAt
+	io.Closer
+	Len() int
+}
+
+// Storage in a folder on the local filesystem. This is the default, with
+// the CA's own batches folder.
+type FileStorage struct {
+	Dir  string
+	Mode os.FileMode // of new files and, with search bits, directories
+}
+
+func (s *FileStorage) path(key string) (string, error) {
+	if !fs.ValidPath(key) || key == "." {
+		return "", fmt.Errorf("Invalid key %q", key)
+	}
+	return filepath.Join(s.Dir, filepath.FromSlash(key)), nil
+}
+
+func (s *FileStorage) Put(key string, data []byte) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	dirMode := s.Mode | 0o700 | (s.Mode&0o444)>>2
+	if err := os.MkdirAll(filepath.Dir(path), dirMode); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, so that readers never see
+	// a partial file.
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, s.Mode); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func (s *FileStorage) Get(key string) ([]byte, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(path)
+}
+
+// Opens the file using mmap.
+func (s *FileStorage) Open(key string) (Object, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	r, err := mmap.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("mmap(%s): %w", path, err)
+	}
+	return r, nil
+}
+
+// Lists regular files only; symbolic links, such as latest, are skipped.
+func (s *FileStorage) List(prefix string) ([]string, error) {
+	var ret []string
+	err := filepath.WalkDir(s.Dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == s.Dir && errors.Is(err, fs.ErrNotExist) {
+				return fs.SkipAll
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(s.Dir, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) && !strings.HasSuffix(key, ".tmp") {
+			ret = append(ret, key)
+		}
+		return nil
+	})
+	return ret, err
+}
+
+// Lists the folders in the folder of prefix, which has to be empty or end
+// in a slash.
+func (s *FileStorage) ListPrefixes(prefix string) ([]string, error) {
+	dir := s.Dir
+	if prefix != "" {
+		if !strings.HasSuffix(prefix, "/") {
+			return nil, fmt.Errorf("Prefix %q doesn't end in a slash", prefix)
+		}
+		var err error
+		dir, err = s.path(strings.TrimSuffix(prefix, "/"))
+		if err != nil {
+			return nil, err
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ret []string
+	for _, e := range entries {
+		if e.IsDir() {
+			ret = append(ret, prefix+e.Name()+"/")
+		}
+	}
+	return ret, nil
+}
+
+// Also removes the folder of key, if that leaves it empty, so that
+// ListPrefixes doesn't list it anymore.
+func (s *FileStorage) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(path); dir != filepath.Clean(s.Dir) {
+		os.Remove(dir) // fails if it's not empty
+	}
+	return nil
+}
+
+// Sets the storage that batches are put in and read from. A nil storage
+// restores the default: the CA's own batches folder.
+func (h *Handle) SetStorage(s Storage) {
+	if s == nil {
+		s = &FileStorage{Dir: h.batchesPath(), Mode: h.fileMode}
+	}
+	h.storage = s
+	h.batchNumbersCache = nil
+}
+
+// Returns the key of the given file of a batch.
+func batchKey(number uint32, name string) string {
+	return gopath.Join(strconv.FormatUint(uint64(number), 10), name)
+}
+
+// Returns whether the batches are kept in a storage other than the
+// CA's own batches folder.
+func (h *Handle) externalStorage() bool {
+	s, ok := h.storage.(*FileStorage)
+	return !ok || filepath.Clean(s.Dir) != filepath.Clean(h.batchesPath())
+}
+
+// Puts the files of the given batch in dir in the storage, if it's not the
+// CA's own batches folder.
+func (h *Handle) publishBatch(number uint32, dir string) error {
+	if !h.externalStorage() {
+		return nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		buf, err := os.ReadFile(gopath.Join(dir, e.Name()))
+		if err != nil {
+			return err
+		}
+		if err := h.storage.Put(batchKey(number, e.Name()), buf); err != nil {
+			return fmt.Errorf("storing %s of batch %d: %w", e.Name(), number, err)
+		}
+	}
+	return nil
+}
+
+// Removes the files of the given batch from the storage, if it's not the
+// CA's own batches folder.
+func (h *Handle) unpublishBatch(number uint32) error {
+	if !h.externalStorage() {
+		return nil
+	}
+	keys, err := h.storage.List(batchKey(number, "") + "/")
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := h.storage.Delete(key); err != nil {
+			return fmt.Errorf("removing %s from storage: %w", key, err)
+		}
+	}
+	return nil
+}
@@ -1,8 +1,8 @@
 package ca
 
 import (
-	"bytes"
 	"fmt"
+	"io"
 
 	"github.com/bwesterb/mtc"
 	"golang.org/x/exp/mmap"
@@ -13,21 +13,36 @@ import (
 // Handle to a batches tree file. In contrast to mtc.Tree, this doesn't
 // load the whole tree in memory.
 type Tree struct {
-	r       *mmap.ReaderAt
+	r       io.ReaderAt
+	closer  io.Closer // nil if the caller owns r
 	nLeaves uint64
 }
 
-// Opens an index
+// Opens a tree file, using mmap.
 func OpenTree(path string) (*Tree, error) {
-	var nLeaves uint64
-
 	r, err := mmap.Open(path)
 	if err != nil {
 		return nil, fmt.Errorf("mmap(%s): %w", path, err)
 	}
 
+	t, err := NewTreeFromReaderAt(r, int64(r.Len()))
+	if err != nil {
+		r.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	t.closer = r
+
+	return t, nil
+}
+
+// Returns a Tree that reads the nodes it needs from the tree file
+// of the given size in r, on demand. Useful to serve proofs without
+// loading or mapping the tree. Close() does not close r.
+func NewTreeFromReaderAt(r io.ReaderAt, size int64) (*Tree, error) {
+	var nLeaves uint64
+
 	var buf [8]byte
-	_, err = r.ReadAt(buf[:], 0)
+	_, err := r.ReadAt(buf[:], 0)
 	if err != nil {
 		return nil, err
 	}
@@ -37,8 +52,8 @@ func OpenTree(path string) (*Tree, error) {
 
 	nNodes := mtc.TreeNodeCount(nLeaves)
 
-	if r.Len() != int(nNodes*mtc.HashLen+8) {
-		return nil, fmt.Errorf("%s: incorrect filesize", path)
+	if size != int64(nNodes*mtc.HashLen+8) {
+		return nil, fmt.Errorf("incorrect filesize")
 	}
 
 	return &Tree{
@@ -47,8 +62,16 @@ func OpenTree(path string) (*Tree, error) {
 	}, nil
 }
 
+// Returns the number of leaves (assertions) in the tree.
+func (t *Tree) LeafCount() uint64 {
+	return t.nLeaves
+}
+
 func (h *Tree) Close() error {
-	return h.r.Close()
+	if h.closer == nil {
+		return nil
+	}
+	return h.closer.Close()
 }
 
 // Return authentication path proving that the leaf at the given index
@@ -58,29 +81,18 @@ func (t *Tree) AuthenticationPath(index uint64) ([]byte, error) {
 		return nil, fmt.Errorf("Tree index out of range %d", index)
 	}
 
-	var buf [mtc.HashLen]byte
-	ret := bytes.Buffer{}
-	offset := 8 // Skip nLeaves header
-	nNodes := t.nLeaves
-	for nNodes != 1 {
-		index ^= 1 // index of sibling
-		start := offset + int(mtc.HashLen*index)
-
-		_, err := t.r.ReadAt(buf[:], int64(start))
-		if err != nil {
-			return nil, err
-		}
-		_, _ = ret.Write(buf[:])
-
-		// Account for the empty node
-		if nNodes&1 == 1 {
-			nNodes++
-		}
-
-		offset += mtc.HashLen * int(nNodes)
-		index >>= 1
-		nNodes >>= 1
-	}
+	// Skip nLeaves header
+	nodes := io.NewSectionReader(t.r, 8, int64(mtc.TreeNodeCount(t.nLeaves)*mtc.HashLen))
+	return mtc.ReadAuthenticationPath(nodes, t.nLeaves, index)
+}
 
-	return ret.Bytes(), nil
+// Returns the root of the tree.
+func (t *Tree) Root() ([]byte, error) {
+	nNodes := mtc.TreeNodeCount(t.nLeaves)
+	root := make([]byte, mtc.HashLen)
+	_, err := t.r.ReadAt(root, int64(8+(nNodes-1)*mtc.HashLen))
+	if err != nil {
+		return nil, err
+	}
+	return root, nil
 }
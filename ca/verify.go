@@ -0,0 +1,170 @@
+package ca
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"time"
+
+	"github.com/bwesterb/mtc"
+)
+
+// Returned when batches have been issued out of order, for instance after
+// restoring the CA from an old backup.
+var ErrNonMonotonic = errors.New("Batches issued out of order")
+
+// Checks that batch number can be issued at dt, following the batches
+// issued before.
+func (h *Handle) checkNextBatch(number uint32, dt time.Time) error {
+	if number > 0 {
+		w, err := h.getSignedValidityWindow(number - 1)
+		if err != nil {
+			return fmt.Errorf("loading validity window of batch %d: %w",
+				number-1, err)
+		}
+		if w.BatchNumber != number-1 {
+			return fmt.Errorf(
+				"%w: batch %d is next, but the previous batch has number %d",
+				ErrNonMonotonic,
+				number,
+				w.BatchNumber,
+			)
+		}
+	}
+
+	var last *AuditEntry
+	if err := h.WalkAuditLog(func(e AuditEntry) error {
+		last = &e
+		return nil
+	}); err != nil {
+		return err
+	}
+	if last == nil {
+		return nil
+	}
+	if last.Batch >= number {
+		return fmt.Errorf(
+			"%w: batch %d is next, but the audit log shows batch %d was issued",
+			ErrNonMonotonic,
+			number,
+			last.Batch,
+		)
+	}
+	if last.Time.After(dt) {
+		return fmt.Errorf(
+			"%w: batch %d was issued at %s, which is after the current time %s",
+			ErrNonMonotonic,
+			last.Batch,
+			last.Time.Format(time.RFC3339),
+			dt.Format(time.RFC3339),
+		)
+	}
+	return nil
+}
+
+// Checks that the stored batches are consistent. That is, that each has
+// a validly signed validity window for its own number, which extends the
+// window of the previous batch with the root of its tree, and that the
+// audit log lists batches in increasing order and time.
+func (h *Handle) Verify() error {
+	if h.closed {
+		return ErrClosed
+	}
+
+	br, err := h.listBatchRange()
+	if err != nil {
+		return err
+	}
+
+	var prevHeads []byte
+	if br.Begin == 0 {
+		prevHeads = h.params.PreEpochRoots()
+	}
+
+	for number := br.Begin; number < br.End; number++ {
+		w, err := h.getSignedValidityWindow(number)
+		if err != nil {
+			return fmt.Errorf("batch %d: loading validity window: %w",
+				number, err)
+		}
+		if w.BatchNumber != number {
+			return fmt.Errorf("%w: batch %d has the validity window of batch %d",
+				ErrNonMonotonic, number, w.BatchNumber)
+		}
+
+		heads := w.TreeHeads
+		head := heads[len(heads)-mtc.HashLen:]
+		if prevHeads != nil &&
+			!bytes.Equal(heads[:len(heads)-mtc.HashLen], prevHeads[mtc.HashLen:]) {
+			return fmt.Errorf(
+				"%w: validity window of batch %d doesn't extend that of batch %d",
+				ErrNonMonotonic, number, number-1)
+		}
+		prevHeads = heads
+
+		t, err := h.treeFor(number)
+		if err != nil {
+			return fmt.Errorf("batch %d: opening tree: %w", number, err)
+		}
+		root, err := t.Root()
+		if err != nil {
+			return fmt.Errorf("batch %d: reading tree: %w", number, err)
+		}
+		if !bytes.Equal(root, head) {
+			return fmt.Errorf("batch %d: root of tree %x doesn't match window %x",
+				number, root, head)
+		}
+	}
+
+	var prev *AuditEntry
+	return h.WalkAuditLog(func(e AuditEntry) error {
+		if prev != nil && e.Batch <= prev.Batch {
+			return fmt.Errorf("%w: audit log lists batch %d after batch %d",
+				ErrNonMonotonic, e.Batch, prev.Batch)
+		}
+		if prev != nil && e.Time.Before(prev.Time) {
+			return fmt.Errorf("%w: audit log lists batch %d issued before batch %d",
+				ErrNonMonotonic, e.Batch, prev.Batch)
+		}
+		prev = &e
+		return nil
+	})
+}
+
+// Recomputes the root of the given batch from its abridged assertions,
+// without relying on the stored tree or validity window. Useful to check
+// the root a CA published for a batch against a local copy.
+//
+// Returns ErrBatchCompacted if the batch has been compacted.
+func (h *Handle) ComputeRoot(number uint32) ([]byte, error) {
+	if h.closed {
+		return nil, ErrClosed
+	}
+
+	r, err := h.storage.Open(batchKey(number, "abridged-assertions"))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		existing, err := h.listBatchRange()
+		if err != nil {
+			return nil, fmt.Errorf("listing batches: %w", err)
+		}
+		if existing.Contains(number) {
+			return nil, ErrBatchCompacted
+		}
+		return nil, ErrUnknownBatch
+	}
+	defer r.Close()
+
+	batch := mtc.Batch{CA: &h.params, Number: number}
+	t, err := batch.ComputeTree(bufio.NewReader(
+		io.NewSectionReader(r, 0, int64(r.Len()))))
+	if err != nil {
+		return nil, fmt.Errorf("batch %d: computing tree: %w", number, err)
+	}
+	return t.Root(), nil
+}
@@ -0,0 +1,141 @@
+package mtc
+
+// Functions to export batch roots as checkpoints.
+//
+// A checkpoint is the signed note used by transparency logs, see
+// https://c2sp.org/tlog-checkpoint and https://c2sp.org/signed-note,
+// such as
+//
+//   example.com/mtc/batch/42
+//   1000
+//   2fa9X4dFz8k7ZbDLl1fa3OXtGOhjA5vBzwP2jLfp0pk=
+//
+//   — example.com AbCdEf…
+//
+// Each batch has its own tree, and thus its own origin line. Note that
+// the root is that of the MTC batch tree, which is computed differently
+// from an RFC 6962 tree head.
+//
+// Signed notes only define an identifier for Ed25519 keys. For the other
+// signature schemes, we use the reserved identifier 0xff followed by the
+// big endian TLS SignatureScheme when computing the key ID.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var ErrCheckpointSignature = errors.New("No valid signature on checkpoint")
+
+// Body of a checkpoint.
+type Checkpoint struct {
+	Origin string
+	Size   uint64
+	Hash   []byte
+}
+
+// Returns the checkpoint for the batch with the given number of
+// assertions and root.
+func (batch *Batch) Checkpoint(size uint64, root []byte) Checkpoint {
+	return Checkpoint{
+		Origin: fmt.Sprintf("%s/mtc/batch/%d", batch.CA.IssuerId, batch.Number),
+		Size:   size,
+		Hash:   root,
+	}
+}
+
+func (c *Checkpoint) MarshalText() ([]byte, error) {
+	if c.Origin == "" || strings.ContainsAny(c.Origin, "\n") {
+		return nil, errors.New("Invalid checkpoint origin")
+	}
+	return []byte(fmt.Sprintf(
+		"%s\n%d\n%s\n",
+		c.Origin,
+		c.Size,
+		base64.StdEncoding.EncodeToString(c.Hash),
+	)), nil
+}
+
+func (c *Checkpoint) UnmarshalText(text []byte) error {
+	lines := strings.Split(string(text), "\n")
+	if len(lines) < 4 || lines[len(lines)-1] != "" {
+		return errors.New("Malformed checkpoint")
+	}
+	size, err := strconv.ParseUint(lines[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("Malformed checkpoint size: %w", err)
+	}
+	hash, err := base64.StdEncoding.DecodeString(lines[2])
+	if err != nil {
+		return fmt.Errorf("Malformed checkpoint hash: %w", err)
+	}
+	c.Origin = lines[0]
+	c.Size = size
+	c.Hash = hash
+	return nil
+}
+
+// Returns the four byte key ID of the note signing key.
+func checkpointKeyId(name string, v Verifier) []byte {
+	h := sha256.New()
+	_, _ = h.Write([]byte(name + "\n"))
+	_, _ = h.Write([]byte{0xff})
+	_ = binary.Write(h, binary.BigEndian, uint16(v.Scheme()))
+	_, _ = h.Write(v.Bytes())
+	return h.Sum(nil)[:4]
+}
+
+// Returns the checkpoint as a note signed with the given key. The key
+// name is typically the IssuerId of the CA.
+func (c *Checkpoint) Sign(name string, signer Signer, v Verifier) ([]byte, error) {
+	if name == "" || strings.ContainsAny(name, " \n+") {
+		return nil, errors.New("Invalid key name")
+	}
+	text, err := c.MarshalText()
+	if err != nil {
+		return nil, err
+	}
+	sig := append(checkpointKeyId(name, v), signer.Sign(text)...)
+
+	buf := bytes.NewBuffer(text)
+	fmt.Fprintf(buf, "\n— %s %s\n", name,
+		base64.StdEncoding.EncodeToString(sig))
+	return buf.Bytes(), nil
+}
+
+// Parses the signed checkpoint note, and checks that it carries a valid
+// signature by the given key.
+func VerifyCheckpoint(note []byte, name string, v Verifier) (*Checkpoint, error) {
+	text, sigs, ok := bytes.Cut(note, []byte("\n\n"))
+	if !ok {
+		return nil, errors.New("Malformed note: no signatures")
+	}
+	text = append(text, '\n')
+
+	var c Checkpoint
+	if err := c.UnmarshalText(text); err != nil {
+		return nil, err
+	}
+
+	keyId := checkpointKeyId(name, v)
+	for _, line := range strings.Split(string(sigs), "\n") {
+		sigName, sig64, ok := strings.Cut(strings.TrimPrefix(line, "— "), " ")
+		if !ok || sigName != name {
+			continue
+		}
+		sig, err := base64.StdEncoding.DecodeString(sig64)
+		if err != nil || len(sig) < 4 || !bytes.Equal(sig[:4], keyId) {
+			continue
+		}
+		if v.Verify(text, sig[4:]) == nil {
+			return &c, nil
+		}
+	}
+	return nil, ErrCheckpointSignature
+}
@@ -0,0 +1,55 @@
+//go:build js && wasm
+
+// Exposes certificate verification to JavaScript, for relying parties that
+// run in the browser. Build with
+//
+//	GOOS=js GOARCH=wasm go build -o mtc.wasm ./cmd/mtc-wasm
+//
+// and load it with the wasm_exec.js that comes with Go. It defines
+//
+//	mtcVerify(caParams, window, cert) → null | string
+//
+// which takes the encoded CA parameters, signed validity window and
+// certificate as Uint8Arrays, and returns null if the certificate is
+// valid now, and the reason otherwise.
+package main
+
+import (
+	"errors"
+	"syscall/js"
+	"time"
+
+	"github.com/bwesterb/mtc"
+)
+
+func bytesArg(v js.Value) ([]byte, error) {
+	if v.Type() != js.TypeObject || !v.InstanceOf(js.Global().Get("Uint8Array")) {
+		return nil, errors.New("Expected Uint8Array")
+	}
+	buf := make([]byte, v.Length())
+	js.CopyBytesToGo(buf, v)
+	return buf, nil
+}
+
+func verify(this js.Value, args []js.Value) any {
+	if len(args) != 3 {
+		return "Expected three arguments: caParams, window and cert"
+	}
+	var bufs [3][]byte
+	for i, arg := range args {
+		buf, err := bytesArg(arg)
+		if err != nil {
+			return err.Error()
+		}
+		bufs[i] = buf
+	}
+	if err := mtc.VerifyEncoded(bufs[0], bufs[1], bufs[2], time.Now()); err != nil {
+		return err.Error()
+	}
+	return nil
+}
+
+func main() {
+	js.Global().Set("mtcVerify", js.FuncOf(verify))
+	select {}
+}
@@ -8,15 +8,36 @@ import (
 	"golang.org/x/crypto/cryptobyte"
 
 	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"math/big"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
 	"runtime/pprof"
+	"slices"
+	"strconv"
+	"strings"
 	"text/tabwriter"
 	"time"
 )
@@ -24,13 +45,30 @@ import (
 var (
 	errNoCaParams = errors.New("missing ca-params flag")
 	errArgs       = errors.New("Wrong number of arguments")
+	errNotFound   = errors.New("not found")
 	fCpuProfile   *os.File
+
+	// Permissions of files written with --out-file, see --out-file-mode.
+	outFileMode os.FileMode = 0o644
+
+	// Set at build time with -ldflags "-X main.version=...". If empty,
+	// the module version from the build info is used.
+	version string
 )
 
+// Parses file permissions in octal, such as 0640.
+func parseFileMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || os.FileMode(mode)&^os.ModePerm != 0 {
+		return 0, fmt.Errorf("Invalid file mode %q: expected octal permissions, such as 0640", s)
+	}
+	return os.FileMode(mode), nil
+}
+
 // Writes buf either to stdout (if path is empty) or path.
 func writeToFileOrStdout(path string, buf []byte) error {
 	if path != "" {
-		err := os.WriteFile(path, buf, 0644)
+		err := os.WriteFile(path, buf, outFileMode)
 		if err != nil {
 			return fmt.Errorf("writing %s: %w", path, err)
 		}
@@ -64,6 +102,10 @@ func assertionFlags(inFile bool) []cli.Flag {
 			Aliases:  []string{"e"},
 			Category: "Assertion",
 		},
+		&cli.StringSliceFlag{
+			Name:     "email",
+			Category: "Assertion",
+		},
 		&cli.StringSliceFlag{
 			Name:     "ip4",
 			Category: "Assertion",
@@ -78,21 +120,49 @@ func assertionFlags(inFile bool) []cli.Flag {
 			Category: "Assertion",
 			Usage:    "path to PEM encoded subject public key",
 		},
+		&cli.IntFlag{
+			Name:     "pem-index",
+			Category: "Assertion",
+			Usage: "index of PEM block in --tls-pem file to use " +
+				"(default: first public key or certificate)",
+		},
 		&cli.StringFlag{
 			Name:     "tls-der",
 			Category: "Assertion",
 			Usage:    "path to DER encoded subject public key",
 		},
+		&cli.StringFlag{
+			Name:     "tls-jwk",
+			Category: "Assertion",
+			Usage:    "path to subject public key as EC or RSA JSON Web Key",
+		},
 		&cli.StringFlag{
 			Name:     "tls-scheme",
 			Category: "Assertion",
 			Usage:    "TLS signature scheme to be used by subject",
 		},
+		&cli.BoolFlag{
+			Name:     "compact",
+			Category: "Assertion",
+			Usage: "put the subject public key itself in the abridged " +
+				"assertion, if it's small enough, such as for Ed25519",
+		},
 		&cli.StringFlag{
 			Name:     "checksum",
 			Category: "Assertion",
 			Usage:    "Only proceed if assertion matches checksum",
 		},
+		&cli.StringFlag{
+			Name:     "json",
+			Category: "Assertion",
+			Usage:    "Read assertion in JSON from the given file",
+		},
+		&cli.StringFlag{
+			Name:     "template",
+			Category: "Assertion",
+			Usage: "Start from the assertion template in the given file; " +
+				"claim flags are added to it",
+		},
 	}
 	if inFile {
 		ret = append(
@@ -132,11 +202,20 @@ func assertionFromFlagsUnchecked(cc *cli.Context) (*ca.QueuedAssertion, error) {
 	if cc.String("checksum") != "" {
 		checksum, err = hex.DecodeString(cc.String("checksum"))
 		if err != nil {
-			fmt.Errorf("Parsing checksum: %w", err)
+			return nil, fmt.Errorf("Parsing checksum: %w", err)
 		}
 	}
 
+	if err := checkAssertionSources(cc); err != nil {
+		return nil, err
+	}
+
 	assertionPath := cc.String("in-file")
+	isJSON := false
+	if cc.String("json") != "" {
+		assertionPath = cc.String("json")
+		isJSON = true
+	}
 	if assertionPath != "" {
 		assertionBuf, err := os.ReadFile(assertionPath)
 		if err != nil {
@@ -147,25 +226,13 @@ func assertionFromFlagsUnchecked(cc *cli.Context) (*ca.QueuedAssertion, error) {
 			)
 		}
 
-		for _, flag := range []string{
-			"dns",
-			"dns-wildcard",
-			"ens",
-			"ip4",
-			"ip6",
-			"tls-der",
-			"tls-pem",
-		} {
-			if cc.IsSet(flag) {
-				return nil, fmt.Errorf(
-					"Can't specify --in-file and --%s together",
-					flag,
-				)
-			}
-		}
-
 		var a mtc.Assertion
-		err = a.UnmarshalBinary(assertionBuf)
+		if isJSON {
+			err = json.Unmarshal(assertionBuf, &a)
+			err = describeJSONError(assertionBuf, err)
+		} else {
+			err = a.UnmarshalBinary(assertionBuf)
+		}
 		if err != nil {
 			return nil, fmt.Errorf(
 				"parsing assertion %s: %w",
@@ -180,108 +247,370 @@ func assertionFromFlagsUnchecked(cc *cli.Context) (*ca.QueuedAssertion, error) {
 		}, nil
 	}
 
-	cs := mtc.Claims{
-		DNS:         cc.StringSlice("dns"),
-		DNSWildcard: cc.StringSlice("dns-wildcard"),
+	b := mtc.NewAssertionBuilder().
+		DNS(cc.StringSlice("dns")...).
+		DNSWildcard(cc.StringSlice("dns-wildcard")...).
+		ENS(cc.StringSlice("ens")...).
+		Email(cc.StringSlice("email")...)
+	if cc.Bool("compact") {
+		b.Compact()
 	}
 
-        cs.ENS = cc.StringSlice("ens")
 	for _, ip := range cc.StringSlice("ip4") {
-		cs.IPv4 = append(cs.IPv4, net.ParseIP(ip))
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			return nil, fmt.Errorf("Invalid IPv4 address: %s", ip)
+		}
+		b.IP4(parsed)
 	}
 
 	for _, ip := range cc.StringSlice("ip6") {
-		cs.IPv6 = append(cs.IPv6, net.ParseIP(ip))
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			return nil, fmt.Errorf("Invalid IPv6 address: %s", ip)
+		}
+		b.IP6(parsed)
 	}
 
-	if (cc.String("tls-pem") == "" &&
-		cc.String("tls-der") == "") ||
-		(cc.String("tls-pem") != "" &&
-			cc.String("tls-der") != "") {
-		return nil, errors.New("Expect either tls-pem or tls-der flag")
+	if cc.String("template") != "" {
+		var unknown []mtc.UnknownClaim
+		unknown, err = builderFromTemplate(cc, b)
+		if err != nil {
+			return nil, err
+		}
+		a, err := b.Build()
+		if err != nil {
+			return nil, err
+		}
+		if len(unknown) != 0 {
+			// Round trip through the binary encoding to sort the claims.
+			a.Claims.Unknown = append(a.Claims.Unknown, unknown...)
+			buf, err := a.MarshalBinary()
+			if err != nil {
+				return nil, err
+			}
+			if err := a.UnmarshalBinary(buf); err != nil {
+				return nil, err
+			}
+		}
+		return &ca.QueuedAssertion{
+			Assertion: *a,
+			Checksum:  checksum,
+		}, nil
 	}
 
-	usingPem := false
-	subjectPath := cc.String("tls-der")
-	if cc.String("tls-pem") != "" {
-		usingPem = true
-		subjectPath = cc.String("tls-pem")
+	keyFlags := setFlags(cc, "tls-pem", "tls-der", "tls-jwk")
+	if len(keyFlags) != 1 {
+		return nil, errors.New("Expect one of tls-pem, tls-der or tls-jwk flag")
 	}
 
+	subjectPath := cc.String(keyFlags[0][2:])
 	subjectBuf, err := os.ReadFile(subjectPath)
 	if err != nil {
 		return nil, fmt.Errorf("reading subject %s: %w", subjectPath, err)
 	}
 
-	if usingPem {
-		block, _ := pem.Decode([]byte(subjectBuf))
-		if block == nil {
-			return nil, fmt.Errorf(
-				"reading subject %s: failed to parse PEM block",
-				subjectPath,
-			)
-		}
-		subjectBuf = block.Bytes
+	if cc.IsSet("pem-index") && keyFlags[0] != "--tls-pem" {
+		return nil, errors.New("--pem-index requires --tls-pem")
 	}
 
-	pub, err := x509.ParsePKIXPublicKey(subjectBuf)
+	var pub crypto.PublicKey
+	switch keyFlags[0] {
+	case "--tls-pem":
+		pemIndex := autoPEMIndex
+		if cc.IsSet("pem-index") {
+			pemIndex = cc.Int("pem-index")
+			if pemIndex < 0 {
+				return nil, fmt.Errorf(
+					"--pem-index must not be negative; got %d", pemIndex)
+			}
+		}
+		pub, err = publicKeyFromPEM(subjectBuf, pemIndex)
+	case "--tls-jwk":
+		pub, err = publicKeyFromJWK(subjectBuf)
+	default:
+		pub, err = x509.ParsePKIXPublicKey(subjectBuf)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("Parsing subject %s: %w", subjectPath, err)
 	}
 
-	var scheme mtc.SignatureScheme
+	b.TLSKey(pub)
 	if cc.String("tls-scheme") != "" {
-		scheme = mtc.SignatureSchemeFromString(cc.String("tls-scheme"))
+		scheme := mtc.SignatureSchemeFromString(cc.String("tls-scheme"))
 		if scheme == 0 {
-			return nil, fmt.Errorf("Unknown TLS signature scheme: %s", scheme)
-		}
-	} else {
-		schemes := mtc.SignatureSchemesFor(pub)
-		if len(schemes) == 0 {
-			return nil, fmt.Errorf(
-				"No matching signature scheme for that public key",
-			)
-		}
-		if len(schemes) >= 2 {
 			return nil, fmt.Errorf(
-				"Specify --tls-scheme with one of %s",
-				schemes,
+				"Unknown TLS signature scheme: %s",
+				cc.String("tls-scheme"),
 			)
 		}
-		scheme = schemes[0]
+		b.Scheme(scheme)
 	}
 
-	subj, err := mtc.NewTLSSubject(scheme, pub)
-	if err != nil {
-		return nil, fmt.Errorf("creating subject: %w", err)
+	a, err := b.Build()
+	if errors.Is(err, mtc.ErrAmbiguousSignatureScheme) {
+		return nil, fmt.Errorf("%w; specify one with --tls-scheme", err)
 	}
-
-	a := mtc.Assertion{
-		Claims:  cs,
-		Subject: subj,
+	if err != nil {
+		return nil, err
 	}
 
 	return &ca.QueuedAssertion{
-		Assertion: a,
+		Assertion: *a,
 		Checksum:  checksum,
 	}, nil
 }
 
+// Returns the flags of the given names that are set, as "--name".
+func setFlags(cc *cli.Context, names ...string) []string {
+	var ret []string
+	for _, name := range names {
+		if cc.IsSet(name) {
+			ret = append(ret, "--"+name)
+		}
+	}
+	return ret
+}
+
+// Checks that the assertion is specified in only one way: by --in-file,
+// --json, --template, or by claim and subject flags. A template can be
+// combined with claim flags, but not with subject flags.
+func checkAssertionSources(cc *cli.Context) error {
+	sources := setFlags(cc, "in-file", "json", "template")
+	if len(sources) > 1 {
+		return fmt.Errorf("Can't specify %s together: pick one",
+			strings.Join(sources, " and "))
+	}
+	if len(sources) == 0 {
+		return nil
+	}
+
+	subjectFlags := []string{"tls-der", "tls-pem", "tls-jwk", "pem-index", "tls-scheme"}
+	claimFlags := []string{"dns", "dns-wildcard", "ens", "email", "ip4", "ip6"}
+	if sources[0] == "--template" {
+		if conflicts := setFlags(cc, subjectFlags...); len(conflicts) != 0 {
+			return fmt.Errorf(
+				"Can't specify --template and %s together: "+
+					"the subject is taken from the template",
+				strings.Join(conflicts, ", "))
+		}
+		return nil
+	}
+	conflicts := setFlags(cc, append(claimFlags, subjectFlags...)...)
+	if len(conflicts) != 0 {
+		return fmt.Errorf(
+			"Can't specify %s and %s together: "+
+				"the assertion is taken from the file",
+			sources[0], strings.Join(conflicts, ", "))
+	}
+	return nil
+}
+
+// Adds the subject and claims of the template at --template to b.
+// Returns the unknown claims, which b can't hold.
+func builderFromTemplate(cc *cli.Context, b *mtc.AssertionBuilder) (
+	[]mtc.UnknownClaim, error) {
+	path := cc.String("template")
+
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading template %s: %w", path, err)
+	}
+	var a mtc.Assertion
+	if err := json.Unmarshal(buf, &a); err != nil {
+		return nil, fmt.Errorf("parsing template %s: %w",
+			path, describeJSONError(buf, err))
+	}
+
+	subj, ok := a.Subject.(*mtc.TLSSubject)
+	if !ok {
+		return nil, fmt.Errorf("template %s: only TLS subjects are supported", path)
+	}
+	v, err := subj.Verifier()
+	if err != nil {
+		return nil, fmt.Errorf("template %s: %w", path, err)
+	}
+	pk, err := mtc.VerifierPublicKey(v)
+	if err != nil {
+		return nil, fmt.Errorf("template %s: %w", path, err)
+	}
+
+	cs := a.Claims
+	b.TLSKey(pk).
+		Scheme(v.Scheme()).
+		DNS(cs.DNS...).
+		DNSWildcard(cs.DNSWildcard...).
+		ENS(cs.ENS...).
+		IP4(cs.IPv4...).
+		IP6(cs.IPv6...).
+		Email(cs.Email...)
+	return cs.Unknown, nil
+}
+
+// Public members of a JSON Web Key, see RFC 7517 and RFC 7518.
+type jwk struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// Parses the public key from a JSON Web Key, which has to be an EC key
+// on P-256, P-384 or P-521, or an RSA key.
+func publicKeyFromJWK(buf []byte) (crypto.PublicKey, error) {
+	var key jwk
+	if err := json.Unmarshal(buf, &key); err != nil {
+		return nil, err
+	}
+
+	field := func(name, val string) ([]byte, error) {
+		if val == "" {
+			return nil, fmt.Errorf("JWK lacks %q", name)
+		}
+		ret, err := base64.RawURLEncoding.DecodeString(val)
+		if err != nil {
+			return nil, fmt.Errorf("JWK %q: %w", name, err)
+		}
+		return ret, nil
+	}
+
+	switch key.Kty {
+	case "EC":
+		var curve elliptic.Curve
+		switch key.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("Unsupported JWK curve %q", key.Crv)
+		}
+		x, err := field("x", key.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := field("y", key.Y)
+		if err != nil {
+			return nil, err
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		if len(x) != size || len(y) != size {
+			return nil, fmt.Errorf("JWK coordinates for %s have to be %d bytes",
+				key.Crv, size)
+		}
+		X, Y := elliptic.Unmarshal(curve, append(append([]byte{4}, x...), y...))
+		if X == nil {
+			return nil, errors.New("JWK point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: X, Y: Y}, nil
+
+	case "RSA":
+		n, err := field("n", key.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := field("e", key.E)
+		if err != nil {
+			return nil, err
+		}
+		E := new(big.Int).SetBytes(e)
+		if !E.IsInt64() || E.Int64() < 3 || E.Int64() > 1<<31-1 {
+			return nil, errors.New("Unsupported JWK RSA exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(E.Int64())}, nil
+
+	case "":
+		return nil, errors.New("JWK lacks \"kty\"")
+	default:
+		return nil, fmt.Errorf("Unsupported JWK key type %q", key.Kty)
+	}
+}
+
+// Index for publicKeyFromPEM when --pem-index is not set.
+const autoPEMIndex = -1
+
+// Parses the public key from the PEM block with the given index in buf.
+// If index is autoPEMIndex, picks the first PUBLIC KEY block, or the key of
+// the first CERTIFICATE block, whichever comes first.
+func publicKeyFromPEM(buf []byte, index int) (crypto.PublicKey, error) {
+	var blocks []*pem.Block
+	for {
+		var block *pem.Block
+		block, buf = pem.Decode(buf)
+		if block == nil {
+			break
+		}
+		blocks = append(blocks, block)
+	}
+
+	if len(blocks) == 0 {
+		return nil, errors.New("failed to parse PEM block")
+	}
+
+	if index == autoPEMIndex {
+		index = slices.IndexFunc(blocks, func(block *pem.Block) bool {
+			return block.Type == "PUBLIC KEY" || block.Type == "CERTIFICATE"
+		})
+		if index < 0 {
+			return nil, errors.New("no PUBLIC KEY or CERTIFICATE PEM block")
+		}
+	}
+
+	if index < 0 || index >= len(blocks) {
+		return nil, fmt.Errorf(
+			"PEM block %d requested, but there are only %d",
+			index,
+			len(blocks),
+		)
+	}
+
+	block := blocks[index]
+	switch block.Type {
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	}
+	return nil, fmt.Errorf(
+		"PEM block %d is a %s, not a public key or certificate",
+		index,
+		block.Type,
+	)
+}
+
+// Opens the CA at --ca-path.
+func openCA(cc *cli.Context) (*ca.Handle, error) {
+	h, err := ca.Open(cc.String("ca-path"))
+	if errors.Is(err, ca.ErrNoCA) {
+		return nil, fmt.Errorf("%w; run 'mtc ca new' first", err)
+	}
+	return h, err
+}
+
 func handleCaQueue(cc *cli.Context) error {
 	qa, err := assertionFromFlags(cc)
 	if err != nil {
 		return err
 	}
 
-	h, err := ca.Open(cc.String("ca-path"))
+	kp, err := keyPolicyFromFlags(cc)
 	if err != nil {
 		return err
 	}
-	defer h.Close()
 
-	return h.QueueMultiple(func(yield func(qa ca.QueuedAssertion) error) error {
+	queue := func(yield func(qa ca.QueuedAssertion) error) error {
 		for i := 0; i < cc.Int("debug-repeat"); i++ {
 			qa2 := *qa
+			qa2.NotBeforeBatch = uint32(cc.Uint("not-before-batch"))
+			qa2.Label = cc.String("label")
 			if cc.Bool("debug-vary") {
 				qa2.Checksum = nil
 				qa2.Assertion.Claims.DNS = append(
@@ -294,7 +623,100 @@ func handleCaQueue(cc *cli.Context) error {
 			}
 		}
 		return nil
-	})
+	}
+
+	// The queue log doesn't need the lock of the CA, so this works while
+	// it's issuing, for instance.
+	if cc.Bool("log") {
+		l, err := ca.OpenQueueLog(cc.String("ca-path"))
+		if errors.Is(err, ca.ErrNoCA) {
+			return fmt.Errorf("%w; run 'mtc ca new' first", err)
+		}
+		if err != nil {
+			return err
+		}
+		l.SetKeyPolicy(kp)
+		err = queue(l.Queue)
+		if err2 := l.Close(); err == nil {
+			err = err2
+		}
+		return err
+	}
+
+	h, err := openCA(cc)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	h.SetKeyPolicy(kp)
+	return h.QueueMultiple(queue)
+}
+
+// Returns the requirements on subject keys set by --min-key-bits and
+// --allow-scheme, or nil if neither is set.
+func keyPolicyFromFlags(cc *cli.Context) (*ca.KeyPolicy, error) {
+	if !cc.IsSet("min-key-bits") && !cc.IsSet("allow-scheme") {
+		return nil, nil
+	}
+	kp := &ca.KeyPolicy{MinSecurityBits: cc.Int("min-key-bits")}
+	for _, name := range cc.StringSlice("allow-scheme") {
+		scheme := mtc.SignatureSchemeFromString(name)
+		if scheme == 0 {
+			return nil, fmt.Errorf("Unknown signature scheme: %s", name)
+		}
+		kp.AllowedSchemes = append(kp.AllowedSchemes, scheme)
+	}
+	return kp, nil
+}
+
+// Adds the line and column to errors from decoding the JSON in buf.
+func describeJSONError(buf []byte, err error) error {
+	var (
+		syntaxError        *json.SyntaxError
+		unmarshalTypeError *json.UnmarshalTypeError
+	)
+	switch {
+	case errors.As(err, &syntaxError):
+		return fmt.Errorf("badly-formed JSON at %s: %w",
+			jsonPosition(buf, syntaxError.Offset), err)
+	case errors.As(err, &unmarshalTypeError):
+		// Assertion.UnmarshalJSON decodes the object by itself, so the
+		// offset is relative to the start of the object.
+		start := len(buf) - len(bytes.TrimLeft(buf, " \t\r\n"))
+		return fmt.Errorf("invalid value for the %q field at %s: %w",
+			unmarshalTypeError.Field,
+			jsonPosition(buf, int64(start)+unmarshalTypeError.Offset),
+			err,
+		)
+	}
+	return err
+}
+
+// Returns the line and column of the given offset in buf.
+func jsonPosition(buf []byte, offset int64) string {
+	if offset > int64(len(buf)) {
+		offset = int64(len(buf))
+	}
+	before := buf[:offset]
+	line := 1 + bytes.Count(before, []byte("\n"))
+	column := len(before) - bytes.LastIndexByte(before, '\n')
+	return fmt.Sprintf("line %d, column %d", line, column)
+}
+
+func handleAssertionTemplate(cc *cli.Context) error {
+	qa, err := assertionFromFlags(cc)
+	if err != nil {
+		return err
+	}
+
+	buf, err := json.MarshalIndent(&qa.Assertion, "", "  ")
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+
+	return writeToFileOrStdout(cc.String("out-file"), buf)
 }
 
 func handleNewAssertion(cc *cli.Context) error {
@@ -317,114 +739,937 @@ func handleNewAssertion(cc *cli.Context) error {
 	return nil
 }
 
-func handleCaIssue(cc *cli.Context) error {
-	h, err := ca.Open(cc.String("ca-path"))
-	if err != nil {
-		return err
-	}
-	defer h.Close()
-
-	return h.Issue()
+// Generates a private key for a subject using the given signature scheme.
+// Only schemes with a PKCS #8 encoding are supported.
+func generateSubjectKey(scheme mtc.SignatureScheme) (crypto.Signer, error) {
+	switch scheme {
+	case mtc.TLSEd25519:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
+	case mtc.TLSECDSAWithP256AndSHA256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case mtc.TLSECDSAWithP384AndSHA384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case mtc.TLSECDSAWithP521AndSHA512:
+		return ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	case mtc.TLSPSSWithSHA256, mtc.TLSPSSWithSHA384, mtc.TLSPSSWithSHA512:
+		return rsa.GenerateKey(rand.Reader, 3072)
+	}
+	return nil, fmt.Errorf("Can't generate a key for %s: use ed25519, p256, "+
+		"p384, p521, rsa-sha256, rsa-sha384 or rsa-sha512", scheme)
 }
 
-func handleCaCert(cc *cli.Context) error {
-	h, err := ca.Open(cc.String("ca-path"))
+func handleGenKey(cc *cli.Context) error {
+	scheme := mtc.SignatureSchemeFromString(cc.String("scheme"))
+	if scheme == 0 {
+		return fmt.Errorf("Unknown signature scheme: %s", cc.String("scheme"))
+	}
+	priv, err := generateSubjectKey(scheme)
 	if err != nil {
 		return err
 	}
-	defer h.Close()
 
-	qa, err := assertionFromFlags(cc)
+	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
 	if err != nil {
 		return err
 	}
-
-	cert, err := h.CertificateFor(qa.Assertion)
+	pubDER, err := x509.MarshalPKIXPublicKey(priv.Public())
 	if err != nil {
 		return err
 	}
 
-	buf, err := cert.MarshalBinary()
+	// Don't overwrite an existing private key, and keep it to ourselves.
+	privPath := cc.String("out-file")
+	pubPath := privPath + ".pub"
+	f, err := os.OpenFile(privPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
 	if err != nil {
-		return err
+		return fmt.Errorf("creating %s: %w", privPath, err)
+	}
+	err = pem.Encode(f, &pem.Block{Type: "PRIVATE KEY", Bytes: privDER})
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return fmt.Errorf("writing %s: %w", privPath, err)
 	}
 
-	if err := writeToFileOrStdout(cc.String("out-file"), buf); err != nil {
+	pubPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER})
+	if err := writeToFileOrStdout(pubPath, pubPEM); err != nil {
 		return err
 	}
 
+	fmt.Fprintf(os.Stderr, "%s key written to %s and %s\n", scheme,
+		privPath, pubPath)
 	return nil
 }
 
-func handleCaShowQueue(cc *cli.Context) error {
-	h, err := ca.Open(cc.String("ca-path"))
+// Subject alternative names and public key for an X.509 certificate,
+// as written by cert-to-x509-template.
+type x509Template struct {
+	DNSNames       []string `json:"dns_names,omitempty"`
+	IPAddresses    []net.IP `json:"ip_addresses,omitempty"`
+	EmailAddresses []string `json:"email_addresses,omitempty"`
+	PublicKey      string   `json:"public_key"`
+}
+
+func handleCertToX509Template(cc *cli.Context) error {
+	buf, err := inspectGetBuf(cc)
 	if err != nil {
 		return err
 	}
-	defer h.Close()
 
-	count := 0
+	// Accept both certificates and assertions.
+	var (
+		c mtc.BikeshedCertificate
+		a mtc.Assertion
+	)
+	if err := c.UnmarshalBinary(buf); err == nil {
+		a = c.Assertion
+	} else if err2 := a.UnmarshalBinary(buf); err2 != nil {
+		return fmt.Errorf("neither a certificate (%v) nor an assertion (%w)",
+			err, err2)
+	}
 
-	err = h.WalkQueue(func(qa ca.QueuedAssertion) error {
-		count++
-		a := qa.Assertion
-		cs := a.Claims
-		subj := a.Subject
-		w := tabwriter.NewWriter(os.Stdout, 1, 1, 1, ' ', 0)
-		fmt.Fprintf(w, "checksum\t%x\n", qa.Checksum)
-		fmt.Fprintf(w, "subject_type\t%s\n", subj.Type())
-		switch subj := subj.(type) {
-		case *mtc.TLSSubject:
-			asubj := subj.Abridge().(*mtc.AbridgedTLSSubject)
-			fmt.Fprintf(w, "signature_scheme\t%s\n", asubj.SignatureScheme)
-			fmt.Fprintf(w, "public_key_hash\t%x\n", asubj.PublicKeyHash[:])
-		}
-		if len(cs.DNS) != 0 {
-			fmt.Fprintf(w, "dns\t%s\n", cs.DNS)
-		}
-		if len(cs.ENS) != 0 {
-			fmt.Fprintf(w, "ens\t%s\n", cs.ENS)
-		}
-		if len(cs.DNSWildcard) != 0 {
-			fmt.Fprintf(w, "dns_wildcard\t%s\n", cs.DNSWildcard)
-		}
-		if len(cs.IPv4) != 0 {
-			fmt.Fprintf(w, "ip4\t%s\n", cs.IPv4)
-		}
-		if len(cs.IPv6) != 0 {
-			fmt.Fprintf(w, "ip6\t%s\n", cs.IPv6)
-		}
-		w.Flush()
-		fmt.Printf("\n")
-		return nil
-	})
+	tmpl, dropped, err := a.X509Template()
 	if err != nil {
 		return err
 	}
-	fmt.Printf("Total number of assertions in queue: %d\n", count)
-	return nil
-}
-
-func handleCaNew(cc *cli.Context) error {
-	if cc.Args().Len() != 2 {
-		cli.ShowSubcommandHelp(cc)
-		return errArgs
+	if dropped.Count() != 0 {
+		fmt.Fprintf(os.Stderr, "Claims without X.509 counterpart: %s\n",
+			dropped)
 	}
-	h, err := ca.New(
-		cc.String("ca-path"),
-		ca.NewOpts{
-			IssuerId:   cc.Args().Get(0),
-			HttpServer: cc.Args().Get(1),
 
-			BatchDuration:   cc.Duration("batch-duration"),
-			StorageDuration: cc.Duration("storage-duration"),
-			Lifetime:        cc.Duration("lifetime"),
-		},
-	)
+	v, err := a.Subject.(*mtc.TLSSubject).Verifier()
 	if err != nil {
 		return err
 	}
-	h.Close()
+	pk, err := mtc.MarshalPKIXVerifier(v)
+	if err != nil {
+		return err
+	}
+
+	out, err := json.MarshalIndent(x509Template{
+		DNSNames:       tmpl.DNSNames,
+		IPAddresses:    tmpl.IPAddresses,
+		EmailAddresses: tmpl.EmailAddresses,
+		PublicKey: string(pem.EncodeToMemory(&pem.Block{
+			Type:  "PUBLIC KEY",
+			Bytes: pk,
+		})),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeToFileOrStdout(cc.String("out-file"), append(out, '\n'))
+}
+
+func handleCaExportPubkey(cc *cli.Context) error {
+	h, err := openCA(cc)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	buf, err := mtc.MarshalPKIXVerifier(h.Params().PublicKey)
+	if err != nil {
+		return err
+	}
+
+	switch cc.String("format") {
+	case "pem":
+		buf = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: buf})
+	case "der":
+	default:
+		return fmt.Errorf("Unknown format: %s", cc.String("format"))
+	}
+
+	return writeToFileOrStdout(cc.String("out-file"), buf)
+}
+
+func handleCaCheckpoint(cc *cli.Context) error {
+	h, err := openCA(cc)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	batches, err := h.ExistingBatches()
+	if err != nil {
+		return err
+	}
+	if batches.Len() == 0 {
+		return errors.New("No batches have been issued yet")
+	}
+
+	number := batches.End - 1
+	if cc.IsSet("batch") {
+		number = uint32(cc.Uint("batch"))
+		if !batches.Contains(number) {
+			return fmt.Errorf("Batch %d is not available; have %s", number, batches)
+		}
+	}
+
+	buf, err := h.Checkpoint(number)
+	if err != nil {
+		return err
+	}
+	return writeToFileOrStdout(cc.String("out-file"), buf)
+}
+
+func handleCaDeny(cc *cli.Context) error {
+	if cc.Args().Len() != 1 {
+		cli.ShowSubcommandHelp(cc)
+		return errArgs
+	}
+	key, err := hex.DecodeString(cc.Args().Get(0))
+	if err != nil {
+		return fmt.Errorf("Parsing key: %w", err)
+	}
+
+	h, err := openCA(cc)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	return h.Deny(key)
+}
+
+func handleCaStaple(cc *cli.Context) error {
+	if cc.Args().Len() != 1 {
+		cli.ShowSubcommandHelp(cc)
+		return errArgs
+	}
+	key, err := hex.DecodeString(cc.Args().Get(0))
+	if err != nil {
+		return fmt.Errorf("Parsing key: %w", err)
+	}
+
+	h, err := openCA(cc)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	s, err := h.Staple(key, uint32(cc.Uint("batch")))
+	if err != nil {
+		return err
+	}
+	buf, err := s.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return writeToFileOrStdout(cc.String("out-file"), buf)
+}
+
+func handleCaIssue(cc *cli.Context) error {
+	h, err := openCA(cc)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	if cc.IsSet("audit-source") {
+		h.SetAuditSource(cc.String("audit-source"))
+	}
+
+	if err := setRetentionPolicy(cc, h); err != nil {
+		return err
+	}
+
+	switch order := cc.String("leaf-order"); order {
+	case "", "queue":
+	case "subject":
+		h.SetLeafOrder(ca.SubjectOrder)
+	default:
+		return fmt.Errorf("Unknown leaf order %q: use queue or subject", order)
+	}
+
+	h.SetIssueWorkers(cc.Int("workers"))
+
+	if cc.Bool("restart") {
+		if err := h.DiscardIssuanceCheckpoint(); err != nil {
+			return err
+		}
+	}
+
+	// On interrupt, stop building the batch at the next checkpoint.
+	// The queue is kept, and the next run continues from there.
+	ctx, stop := signal.NotifyContext(cc.Context, os.Interrupt)
+	defer stop()
+	return h.IssueContext(ctx)
+}
+
+// Flags for the retention policy of batches outside the storage window.
+func retentionFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.DurationFlag{
+			Name:     "keep-every",
+			Category: "Retention",
+			Usage:    "archive the batch covering each multiple of this duration, such as 24h, instead of removing it. Stored with the CA for later runs; 0 stops archiving",
+		},
+		&cli.DurationFlag{
+			Name:     "keep-for",
+			Category: "Retention",
+			Usage:    "with --keep-every, how long to keep archived batches",
+			Value:    365 * 24 * time.Hour,
+		},
+	}
+}
+
+// Stores the retention policy given on the command line, if any. Without
+// the flags, the handle uses the policy stored earlier.
+func setRetentionPolicy(cc *cli.Context, h *ca.Handle) error {
+	if !cc.IsSet("keep-every") {
+		if cc.IsSet("keep-for") {
+			return errors.New("--keep-for requires --keep-every")
+		}
+		return nil
+	}
+	every := cc.Duration("keep-every")
+	if every <= 0 {
+		return h.SaveRetention(nil)
+	}
+	return h.SaveRetention(&ca.Retention{
+		KeepEvery: every,
+		KeepFor:   cc.Duration("keep-for"),
+	})
+}
+
+func handleCaGC(cc *cli.Context) error {
+	h, err := openCA(cc)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	if err := setRetentionPolicy(cc, h); err != nil {
+		return err
+	}
+	return h.GC()
+}
+
+func handleCaCompact(cc *cli.Context) error {
+	h, err := openCA(cc)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	batches, err := h.Compact()
+	for _, batch := range batches {
+		fmt.Printf("compacted batch %d\n", batch)
+	}
+	return err
+}
+
+// Fetches the signed validity window of the given batch, which may be
+// "latest", from the CA at remote, and checks its signature.
+func fetchValidityWindow(remote string, p *mtc.CAParams, batch string) (
+	*mtc.SignedValidityWindow, error) {
+	url := strings.TrimSuffix(remote, "/") +
+		"/batches/" + batch + "/signed-validity-window"
+	buf, err := fetch(url)
+	if err != nil {
+		return nil, fmt.Errorf("fetching %s: %w", url, err)
+	}
+	var w mtc.SignedValidityWindow
+	if err := w.UnmarshalBinary(buf, p); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", url, err)
+	}
+	skew := time.Duration(p.BatchDuration) * time.Second
+	err = w.CheckPlausible(p, time.Now(), skew, batch == "latest")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", url, err)
+	}
+	return &w, nil
+}
+
+func handleCaCheckConsistency(cc *cli.Context) error {
+	h, err := openCA(cc)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	p := h.Params()
+	number := uint32(cc.Uint("batch"))
+	root, err := h.ComputeRoot(number)
+	if err != nil {
+		return err
+	}
+
+	remote := cc.String("remote")
+	w, err := fetchValidityWindow(remote, &p, fmt.Sprint(number))
+	if errors.Is(err, errNotFound) {
+		fmt.Printf("not yet published: batch %d\n", number)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if w.BatchNumber != number {
+		return fmt.Errorf("remote serves the window of batch %d as that of batch %d",
+			w.BatchNumber, number)
+	}
+
+	// The window of the batch itself, and the latest window if it still
+	// covers the batch, should both have the root we computed.
+	windows := []*mtc.SignedValidityWindow{w}
+	latest, err := fetchValidityWindow(remote, &p, "latest")
+	if err != nil && !errors.Is(err, errNotFound) {
+		return err
+	}
+	if latest != nil && latest.BatchNumber != number {
+		windows = append(windows, latest)
+	}
+	for _, w := range windows {
+		remoteRoot := w.Root(&p, number)
+		if remoteRoot == nil {
+			continue
+		}
+		if !bytes.Equal(remoteRoot, root) {
+			return fmt.Errorf(
+				"mismatch: window of batch %d has root %x for batch %d, "+
+					"but we computed %x; the CA might be equivocating",
+				w.BatchNumber, remoteRoot, number, root)
+		}
+	}
+
+	fmt.Printf("match: batch %d root %x\n", number, root)
+	return nil
+}
+
+func handleCaReissueWindow(cc *cli.Context) error {
+	h, err := openCA(cc)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	w, err := h.ReissueWindow(uint32(cc.Uint("batch")))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("signed validity window of batch %d with %s\n",
+		w.BatchNumber, h.Params().PublicKey.Scheme())
+	return nil
+}
+
+func handleCaProjectStorage(cc *cli.Context) error {
+	var sample mtc.Assertion
+	if len(setFlags(cc, "in-file", "json", "template", "tls-pem", "tls-der", "tls-jwk")) != 0 {
+		qa, err := assertionFromFlags(cc)
+		if err != nil {
+			return err
+		}
+		sample = qa.Assertion
+	} else {
+		// A typical assertion: a single domain with a P-256 key.
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		a, err := mtc.NewAssertionBuilder().
+			DNS("www.example.com").
+			TLSKey(priv.Public()).
+			Build()
+		if err != nil {
+			return err
+		}
+		sample = *a
+	}
+
+	h, err := openCA(cc)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	p, err := h.ProjectStorage(cc.Uint64("rate"), sample)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 1, ' ', 0)
+	fmt.Fprintf(w, "batches\t%d\n", p.Batches)
+	fmt.Fprintf(w, "assertions per batch\t%d\n", p.Assertions)
+	fmt.Fprintf(w, "abridged-assertions\t%d\t%s\n",
+		p.AbridgedAssertions, formatSize(p.AbridgedAssertions))
+	fmt.Fprintf(w, "tree\t%d\t%s\n", p.Tree, formatSize(p.Tree))
+	fmt.Fprintf(w, "index\t%d\t%s\n", p.Index, formatSize(p.Index))
+	fmt.Fprintf(w, "signed-validity-window\t%d\t%s\n",
+		p.Window, formatSize(p.Window))
+	fmt.Fprintf(w, "summary\t%d\t%s\n", p.Summary, formatSize(p.Summary))
+	fmt.Fprintf(w, "producer\t%d\t%s\n", p.Producer, formatSize(p.Producer))
+	fmt.Fprintf(w, "per batch\t%d\t%s\n", p.BatchSize(), formatSize(p.BatchSize()))
+	fmt.Fprintf(w, "queue\t%d\t%s\n", p.Queue, formatSize(p.Queue))
+	fmt.Fprintf(w, "total\t%d\t%s\n", p.Total(), formatSize(p.Total()))
+	w.Flush()
+	return nil
+}
+
+// Formats a number of bytes with a binary prefix, such as 1.5 MiB.
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func handleCaVerify(cc *cli.Context) error {
+	h, err := openCA(cc)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	if err := h.Verify(); err != nil {
+		return err
+	}
+
+	batches, err := h.ExistingBatches()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("ok: batches %s\n", batches)
+	return nil
+}
+
+func handleCaAuditLog(cc *cli.Context) error {
+	h, err := openCA(cc)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 1, ' ', 0)
+	fmt.Fprintf(w, "time\tbatch\tleaves\troot\tsource\n")
+	err = h.WalkAuditLog(func(e ca.AuditEntry) error {
+		fmt.Fprintf(
+			w,
+			"%s\t%d\t%d\t%x\t%s\n",
+			e.Time.Local().Format(time.RFC3339),
+			e.Batch,
+			e.LeafCount,
+			e.Root,
+			e.Source,
+		)
+		return nil
+	})
+	w.Flush()
+	return err
+}
+
+func handleCaCert(cc *cli.Context) error {
+	h, err := openCA(cc)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	qa, err := assertionFromFlags(cc)
+	if err != nil {
+		return err
+	}
+
+	cert, err := h.CertificateFor(qa.Assertion)
+	if err != nil {
+		return err
+	}
+
+	var buf []byte
+	if cc.Bool("embed-window") {
+		// The latest window covers the batch of the certificate, as
+		// that's still active.
+		batches, err := h.ExistingBatches()
+		if err != nil {
+			return err
+		}
+		w, err := h.SignedValidityWindow(batches.End - 1)
+		if err != nil {
+			return err
+		}
+		bundle := mtc.CertificateBundle{Certificate: *cert, Window: *w}
+		buf, err = bundle.MarshalBinary()
+		if err != nil {
+			return err
+		}
+	} else {
+		buf, err = cert.MarshalBinary()
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := writeToFileOrStdout(cc.String("out-file"), buf); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func timeRangeFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.TimestampFlag{
+			Name:   "since",
+			Usage:  "only show entries at or after this time (RFC3339)",
+			Layout: time.RFC3339,
+		},
+		&cli.TimestampFlag{
+			Name:   "until",
+			Usage:  "only show entries before this time (RFC3339)",
+			Layout: time.RFC3339,
+		},
+	}
+}
+
+// Returns whether the period [start, end] overlaps with the one set
+// by --since and --until. Zero start and end means the period is unknown,
+// which only matches if neither flag is set.
+func inTimeRange(cc *cli.Context, start, end time.Time) bool {
+	return overlapsTimeRange(cc.Timestamp("since"), cc.Timestamp("until"),
+		start, end)
+}
+
+// Returns whether the period [start, end] overlaps with [since, until),
+// where either bound may be nil. See inTimeRange.
+func overlapsTimeRange(since, until *time.Time, start, end time.Time) bool {
+	if since == nil && until == nil {
+		return true
+	}
+	if start.IsZero() && end.IsZero() {
+		return false
+	}
+	if since != nil && end.Before(*since) {
+		return false
+	}
+	if until != nil && !start.Before(*until) {
+		return false
+	}
+	return true
+}
+
+func handleCaListBatches(cc *cli.Context) error {
+	h, err := openCA(cc)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	br, err := h.ExistingBatches()
+	if err != nil {
+		return err
+	}
+
+	params := h.Params()
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 1, ' ', 0)
+	fmt.Fprintf(w, "batch\tstart\tend\tleaves\troot\n")
+	for number := br.Begin; number < br.End; number++ {
+		start, end := params.BatchTimeRange(number)
+		if !inTimeRange(cc, start, end) {
+			continue
+		}
+		info, err := h.BatchInfo(number)
+		if err != nil {
+			w.Flush()
+			return fmt.Errorf("batch %d: %w", number, err)
+		}
+		fmt.Fprintf(
+			w,
+			"%d\t%s\t%s\t%d\t%x\n",
+			number,
+			info.Start.Local().Format(time.RFC3339),
+			info.End.Local().Format(time.RFC3339),
+			info.LeafCount,
+			info.Root,
+		)
+	}
+	w.Flush()
+	return nil
+}
+
+func handleCaTreeHeads(cc *cli.Context) error {
+	h, err := openCA(cc)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	heads, err := h.TreeHeads()
+	if err != nil {
+		return err
+	}
+	numbers := make([]uint32, 0, len(heads))
+	for number := range heads {
+		numbers = append(numbers, number)
+	}
+	slices.Sort(numbers)
+
+	params := h.Params()
+	active := params.ActiveBatches(time.Now())
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 1, ' ', 0)
+	fmt.Fprintf(w, "batch\thead\tactive\n")
+	for _, number := range numbers {
+		fmt.Fprintf(w, "%d\t%x\t%t\n", number, heads[number],
+			active.Contains(number))
+	}
+	w.Flush()
+	return nil
+}
+
+func handleCaExportQueue(cc *cli.Context) error {
+	h, err := openCA(cc)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	buf := &bytes.Buffer{}
+	count, err := h.ExportQueue(buf)
+	if err != nil {
+		return err
+	}
+	if err := writeToFileOrStdout(cc.String("out-file"), buf.Bytes()); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d assertions\n", count)
+	return nil
+}
+
+func handleCaImportQueue(cc *cli.Context) error {
+	if cc.Args().Len() != 1 {
+		cli.ShowSubcommandHelp(cc)
+		return errArgs
+	}
+
+	h, err := openCA(cc)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	r, err := os.Open(cc.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	count, err := h.ImportQueue(r)
+	if err != nil {
+		return fmt.Errorf("importing %s: %w", cc.Args().Get(0), err)
+	}
+	fmt.Fprintf(os.Stderr, "Imported %d assertions\n", count)
+	return nil
+}
+
+func handleCaShowQueue(cc *cli.Context) error {
+	h, err := openCA(cc)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	count := 0
+
+	err = h.WalkQueue(func(qa ca.QueuedAssertion) error {
+		if !inTimeRange(cc, qa.QueuedAt, qa.QueuedAt) {
+			return nil
+		}
+		if cc.IsSet("label") && qa.Label != cc.String("label") {
+			return nil
+		}
+		count++
+		a := qa.Assertion
+		cs := a.Claims
+		subj := a.Subject
+		w := tabwriter.NewWriter(os.Stdout, 1, 1, 1, ' ', 0)
+		fmt.Fprintf(w, "checksum\t%x\n", qa.Checksum)
+		if !qa.QueuedAt.IsZero() {
+			fmt.Fprintf(w, "queued_at\t%s\n",
+				qa.QueuedAt.Local().Format(time.RFC3339))
+		}
+		if qa.NotBeforeBatch != 0 {
+			fmt.Fprintf(w, "not_before_batch\t%d\n", qa.NotBeforeBatch)
+		}
+		if qa.Label != "" {
+			fmt.Fprintf(w, "label\t%q\n", qa.Label)
+		}
+		fmt.Fprintf(w, "subject_type\t%s\n", subj.Type())
+		switch subj.(type) {
+		case *mtc.TLSSubject, *mtc.MultiTLSSubject, *mtc.CompactTLSSubject:
+			writeAbridgedSubject(w, subj.Abridge())
+		}
+		if len(cs.DNS) != 0 {
+			fmt.Fprintf(w, "dns\t%s\n", cs.DNS)
+		}
+		if len(cs.ENS) != 0 {
+			fmt.Fprintf(w, "ens\t%s\n", cs.ENS)
+		}
+		if len(cs.DNSWildcard) != 0 {
+			fmt.Fprintf(w, "dns_wildcard\t%s\n", cs.DNSWildcard)
+		}
+		if len(cs.IPv4) != 0 {
+			fmt.Fprintf(w, "ip4\t%s\n", cs.IPv4)
+		}
+		if len(cs.IPv6) != 0 {
+			fmt.Fprintf(w, "ip6\t%s\n", cs.IPv6)
+		}
+		if len(cs.Email) != 0 {
+			fmt.Fprintf(w, "email\t%s\n", cs.Email)
+		}
+		w.Flush()
+		fmt.Printf("\n")
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if cc.IsSet("since") || cc.IsSet("until") || cc.IsSet("label") {
+		fmt.Printf("Number of matching assertions in queue: %d\n", count)
+	} else {
+		fmt.Printf("Total number of assertions in queue: %d\n", count)
+	}
+	return nil
+}
+
+func handleCaNew(cc *cli.Context) error {
+	if cc.Args().Len() != 2 {
+		cli.ShowSubcommandHelp(cc)
+		return errArgs
+	}
+	fileMode, err := parseFileMode(cc.String("file-mode"))
+	if err != nil {
+		return err
+	}
+	var schemes []mtc.SignatureScheme
+	for _, name := range cc.StringSlice("allow-subject-scheme") {
+		scheme := mtc.SignatureSchemeFromString(name)
+		if scheme == 0 {
+			return fmt.Errorf("Unknown signature scheme: %s", name)
+		}
+		schemes = append(schemes, scheme)
+	}
+	leafEncoding, err := mtc.LeafEncodingFromString(cc.String("leaf-encoding"))
+	if err != nil {
+		return err
+	}
+	var changes []ca.BatchDurationChange
+	for _, arg := range cc.StringSlice("batch-duration-change") {
+		after, duration, ok := strings.Cut(arg, "=")
+		if !ok {
+			return fmt.Errorf("Expected <after>=<duration>: %s", arg)
+		}
+		var c ca.BatchDurationChange
+		if c.After, err = time.ParseDuration(after); err != nil {
+			return err
+		}
+		if c.BatchDuration, err = time.ParseDuration(duration); err != nil {
+			return err
+		}
+		changes = append(changes, c)
+	}
+	h, err := ca.New(
+		cc.String("ca-path"),
+		ca.NewOpts{
+			IssuerId:   cc.Args().Get(0),
+			HttpServer: cc.Args().Get(1),
+
+			BatchDuration:   cc.Duration("batch-duration"),
+			StorageDuration: cc.Duration("storage-duration"),
+			Lifetime:        cc.Duration("lifetime"),
+
+			Force:       cc.Bool("force"),
+			IfNotExists: cc.Bool("if-not-exists"),
+			FileMode:    fileMode,
+
+			AllowedSubjectSchemes: schemes,
+			LeafEncoding:          leafEncoding,
+			BatchDurationChanges:  changes,
+		},
+	)
+	if errors.Is(err, ca.ErrCAExists) {
+		return fmt.Errorf("%w; pass --force to overwrite it, or --if-not-exists to keep it", err)
+	}
+	if err != nil {
+		return err
+	}
+	h.Close()
+	return nil
+}
+
+type versionInfo struct {
+	Version            string     `json:"version"`
+	GoVersion          string     `json:"go_version"`
+	WireFormatVersions []int      `json:"wire_format_versions"`
+	SignatureSchemes   []codeName `json:"signature_schemes"`
+	CASignatureSchemes []codeName `json:"ca_signature_schemes"`
+	ClaimTypes         []codeName `json:"claim_types"`
+}
+
+type codeName struct {
+	Name string `json:"name"`
+	Code uint16 `json:"code"`
+}
+
+func getVersionInfo() versionInfo {
+	ret := versionInfo{
+		Version:            version,
+		GoVersion:          runtime.Version(),
+		WireFormatVersions: []int{mtc.WireFormatVersion},
+	}
+	if ret.Version == "" {
+		ret.Version = "(devel)"
+		if bi, ok := debug.ReadBuildInfo(); ok && bi.Main.Version != "" {
+			ret.Version = bi.Main.Version
+		}
+	}
+	for _, s := range mtc.SupportedSignatureSchemes {
+		ret.SignatureSchemes = append(ret.SignatureSchemes,
+			codeName{Name: s.String(), Code: uint16(s)})
+	}
+	for _, s := range mtc.SupportedCASignatureSchemes {
+		ret.CASignatureSchemes = append(ret.CASignatureSchemes,
+			codeName{Name: s.String(), Code: uint16(s)})
+	}
+	for _, t := range mtc.SupportedClaimTypes {
+		ret.ClaimTypes = append(ret.ClaimTypes,
+			codeName{Name: t.String(), Code: uint16(t)})
+	}
+	return ret
+}
+
+func handleVersion(cc *cli.Context) error {
+	info := getVersionInfo()
+
+	if cc.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(info)
+	}
+
+	names := func(cns []codeName) string {
+		var ret []string
+		for _, cn := range cns {
+			ret = append(ret, fmt.Sprintf("%s (0x%04x)", cn.Name, cn.Code))
+		}
+		return strings.Join(ret, ", ")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 1, ' ', 0)
+	fmt.Fprintf(w, "version\t%s\n", info.Version)
+	fmt.Fprintf(w, "go version\t%s\n", info.GoVersion)
+	fmt.Fprintf(w, "wire format versions\t%v\n", info.WireFormatVersions)
+	fmt.Fprintf(w, "signature schemes\t%s\n", names(info.SignatureSchemes))
+	fmt.Fprintf(w, "CA signature schemes\t%s\n", names(info.CASignatureSchemes))
+	fmt.Fprintf(w, "claim types\t%s\n", names(info.ClaimTypes))
+	w.Flush()
 	return nil
 }
 
@@ -458,22 +1703,154 @@ func inspectGetReader(cc *cli.Context) (io.ReadCloser, error) {
 	return r, nil
 }
 
+// Writes the producer annotation next to the file being inspected, if any.
+func inspectWriteProducer(w io.Writer, cc *cli.Context) error {
+	producer, err := inspectGetProducer(cc)
+	if err != nil {
+		return err
+	}
+	if producer != "" {
+		fmt.Fprintf(w, "producer\t%s\n", producer)
+	}
+	return nil
+}
+
+// Returns the producer annotation next to the file being inspected, or
+// an empty string if there is none.
+func inspectGetProducer(cc *cli.Context) (string, error) {
+	if cc.Args().Len() == 0 {
+		return "", nil
+	}
+	return ca.ReadProducer(filepath.Dir(cc.Args().Get(0)))
+}
+
+// Flag for the inspect subcommands that can print their result as JSON
+// or YAML, see inspectWriteFormatted.
+func inspectFormatFlag() cli.Flag {
+	return &cli.StringFlag{
+		Name:  "format",
+		Usage: "output format: text, json or yaml",
+		Value: "text",
+	}
+}
+
+// Prints v, which has JSON tags, as JSON or YAML, if requested with
+// --format. Returns false if the caller should print text instead.
+func inspectWriteFormatted(cc *cli.Context, v any) (bool, error) {
+	switch format := cc.String("format"); format {
+	case "", "text":
+		return false, nil
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return true, enc.Encode(v)
+	case "yaml":
+		buf, err := json.Marshal(v)
+		if err != nil {
+			return true, err
+		}
+		buf, err = jsonToYAML(buf)
+		if err != nil {
+			return true, err
+		}
+		_, err = os.Stdout.Write(buf)
+		return true, err
+	default:
+		return false, fmt.Errorf("Unknown format %q: use text, json or yaml", format)
+	}
+}
+
 func inspectGetCAParams(cc *cli.Context) (*mtc.CAParams, error) {
 	var p mtc.CAParams
 	path := cc.String("ca-params")
 	if path == "" {
 		return nil, errNoCaParams
 	}
-	buf, err := os.ReadFile(path)
+
+	var (
+		buf []byte
+		err error
+	)
+	remote := strings.HasPrefix(path, "https://") ||
+		strings.HasPrefix(path, "http://")
+	if remote {
+		buf, err = fetch(path)
+	} else {
+		buf, err = os.ReadFile(path)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("reading %s: %w", path, err)
 	}
 	if err := p.UnmarshalBinary(buf); err != nil {
 		return nil, fmt.Errorf("parsing %s: %w", path, err)
 	}
+
+	pin := cc.String("ca-params-fingerprint")
+	if pin != "" {
+		if err := p.CheckFingerprint(pin); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	} else if remote {
+		// Nothing authenticates the ca-params we fetched, so show the
+		// user what to compare against an out-of-band source.
+		fmt.Fprintf(os.Stderr, "Fetched ca-params of %s from %s\n",
+			p.IssuerId, path)
+		fmt.Fprintf(os.Stderr, "public_key fingerprint %s\n",
+			mtc.VerifierFingerprint(p.PublicKey))
+		fp, err := p.Fingerprint()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		fmt.Fprintf(os.Stderr, "ca-params fingerprint %s\n", fp)
+		fmt.Fprintf(os.Stderr, "Pass it with --ca-params-fingerprint to pin it\n\n")
+	}
 	return &p, nil
 }
 
+// Limits on fetching files from a CA. The deadline covers reading the
+// body too, so a server can't keep us waiting by trickling it.
+const (
+	fetchTimeout = 30 * time.Second
+	fetchMaxSize = 1 << 20
+)
+
+// Fetches the given URL, which is expected to be a (small) MTC file.
+func fetch(url string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected HTTP status %s", resp.Status)
+	}
+
+	// None of the files we fetch come close to this size.
+	if resp.ContentLength > fetchMaxSize {
+		return nil, fmt.Errorf("response of %d bytes exceeds %d bytes",
+			resp.ContentLength, fetchMaxSize)
+	}
+	buf, err := io.ReadAll(http.MaxBytesReader(nil, resp.Body, fetchMaxSize))
+	var mbErr *http.MaxBytesError
+	if errors.As(err, &mbErr) {
+		return nil, fmt.Errorf("response exceeds %d bytes", fetchMaxSize)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
 func handleInspectSignedValidityWindow(cc *cli.Context) error {
 	buf, err := inspectGetBuf(cc)
 	if err != nil {
@@ -490,18 +1867,193 @@ func handleInspectSignedValidityWindow(cc *cli.Context) error {
 		return err
 	}
 
+	info := signedValidityWindowInfo{
+		SignatureScheme: p.PublicKey.Scheme().String(),
+		BatchNumber:     sw.ValidityWindow.BatchNumber,
+	}
+	preEpoch := sw.ValidityWindow.PreEpochSlots(p)
+	for i := 0; i < int(p.ValidityWindowSize); i++ {
+		info.TreeHeads = append(info.TreeHeads, treeHeadInfo{
+			Batch:    int64(sw.ValidityWindow.BatchNumber) + int64(i) - int64(p.ValidityWindowSize) + 1,
+			Head:     hex.EncodeToString(sw.ValidityWindow.TreeHeads[mtc.HashLen*i : mtc.HashLen*(i+1)]),
+			PreEpoch: i < preEpoch,
+		})
+	}
+	info.Producer, err = inspectGetProducer(cc)
+	if err != nil {
+		return err
+	}
+	if ok, err := inspectWriteFormatted(cc, info); ok || err != nil {
+		return err
+	}
+
 	w := tabwriter.NewWriter(os.Stdout, 1, 1, 1, ' ', 0)
 	fmt.Fprintf(w, "signature\t✅\n")
-	fmt.Fprintf(w, "batch_number\t%d\n", sw.ValidityWindow.BatchNumber)
-	for i := 0; i < int(p.ValidityWindowSize); i++ {
-		fmt.Fprintf(
-			w,
-			"tree_heads[%d]\t%x\n",
-			int(sw.ValidityWindow.BatchNumber)+i-int(p.ValidityWindowSize)+1,
-			sw.ValidityWindow.TreeHeads[mtc.HashLen*i:mtc.HashLen*(i+1)],
-		)
+	fmt.Fprintf(w, "signature_scheme\t%s\n", info.SignatureScheme)
+	fmt.Fprintf(w, "batch_number\t%d\n", info.BatchNumber)
+	for _, th := range info.TreeHeads {
+		note := ""
+		if th.PreEpoch {
+			note = " (pre-epoch)"
+		}
+		fmt.Fprintf(w, "tree_heads[%d]\t%s%s\n", th.Batch, th.Head, note)
+	}
+	if info.Producer != "" {
+		fmt.Fprintf(w, "producer\t%s\n", info.Producer)
+	}
+
+	w.Flush()
+	return nil
+}
+
+// Signed validity window, as printed by inspect signed-validity-window.
+// The signature has been checked.
+type signedValidityWindowInfo struct {
+	SignatureScheme string         `json:"signature_scheme"`
+	BatchNumber     uint32         `json:"batch_number"`
+	TreeHeads       []treeHeadInfo `json:"tree_heads"`
+	Producer        string         `json:"producer,omitempty"`
+}
+
+type treeHeadInfo struct {
+	Batch    int64  `json:"batch"` // negative before the first batch
+	Head     string `json:"head"`
+	PreEpoch bool   `json:"pre_epoch,omitempty"`
+}
+
+func handleInspectWindowChain(cc *cli.Context) error {
+	if cc.Args().Len() != 1 {
+		return errArgs
+	}
+	dir := cc.Args().Get(0)
+	p, err := inspectGetCAParams(cc)
+	if err != nil {
+		return err
+	}
+
+	// Either signed-validity-window files, or batch directories, as in
+	// the batches folder of a CA.
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var windows []mtc.SignedValidityWindow
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name())
+		if e.IsDir() {
+			path = filepath.Join(path, "signed-validity-window")
+		} else if !e.Type().IsRegular() {
+			continue
+		}
+		buf, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) && e.IsDir() {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		var sw mtc.SignedValidityWindow
+		if err := sw.UnmarshalBinary(buf, p); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		windows = append(windows, sw)
+	}
+	if len(windows) == 0 {
+		return fmt.Errorf("No validity windows in %s", dir)
+	}
+	slices.SortFunc(windows, func(a, b mtc.SignedValidityWindow) int {
+		return cmp.Compare(a.BatchNumber, b.BatchNumber)
+	})
+
+	for i := range windows {
+		w := &windows[i].ValidityWindow
+		if err := w.CheckPreEpoch(p); err != nil {
+			return err
+		}
+		if i == 0 {
+			continue
+		}
+		prev := &windows[i-1].ValidityWindow
+		if w.BatchNumber != prev.BatchNumber+1 {
+			return fmt.Errorf("Missing validity window: batch %d follows %d",
+				w.BatchNumber, prev.BatchNumber)
+		}
+		if err := w.CheckConsistent(p, prev); err != nil {
+			return err
+		}
 	}
 
+	fmt.Printf("ok: %d consistent windows, batches %d-%d\n", len(windows),
+		windows[0].BatchNumber, windows[len(windows)-1].BatchNumber)
+	return nil
+}
+
+func handleInspectStaple(cc *cli.Context) error {
+	buf, err := inspectGetBuf(cc)
+	if err != nil {
+		return err
+	}
+	p, err := inspectGetCAParams(cc)
+	if err != nil {
+		return err
+	}
+
+	var s mtc.SignedStaple
+	err = s.UnmarshalBinary(buf, p) // this also checks the signature
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 1, ' ', 0)
+	fmt.Fprintf(w, "signature\t✅\n")
+	fmt.Fprintf(w, "key\t%x\n", s.Key)
+	fmt.Fprintf(w, "batch\t%d\n", s.BatchNumber)
+	fmt.Fprintf(w, "as_of\t%d\n", s.AsOf)
+	w.Flush()
+	return nil
+}
+
+func handleInspectDenyList(cc *cli.Context) error {
+	buf, err := inspectGetBuf(cc)
+	if err != nil {
+		return err
+	}
+	p, err := inspectGetCAParams(cc)
+	if err != nil {
+		return err
+	}
+
+	var checkKey []byte
+	if cc.IsSet("check-key") {
+		checkKey, err = hex.DecodeString(cc.String("check-key"))
+		if err != nil || len(checkKey) != mtc.HashLen {
+			return fmt.Errorf("--check-key: expected %d hex encoded bytes",
+				mtc.HashLen)
+		}
+	}
+
+	var l mtc.SignedDenyList
+	err = l.UnmarshalBinary(buf, p) // this also checks the signature
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 1, ' ', 0)
+	fmt.Fprintf(w, "signature\t✅\n")
+	fmt.Fprintf(w, "timestamp\t%d\t%s\n", l.Timestamp,
+		time.Unix(int64(l.Timestamp), 0))
+	fmt.Fprintf(w, "count\t%d\n", len(l.Keys))
+	if checkKey != nil {
+		denied := "not denied"
+		if l.Contains(checkKey) {
+			denied = "denied"
+		}
+		fmt.Fprintf(w, "check_key\t%x\t%s\n", checkKey, denied)
+	} else {
+		for i, key := range l.Keys {
+			fmt.Fprintf(w, "keys[%d]\t%x\n", i, key)
+		}
+	}
 	w.Flush()
 	return nil
 }
@@ -537,13 +2089,14 @@ func handleInspectIndex(cc *cli.Context) error {
 }
 
 func handleInspectTree(cc *cli.Context) error {
-	buf, err := inspectGetBuf(cc)
+	r, err := inspectGetReader(cc)
 	if err != nil {
 		return err
 	}
+	defer r.Close()
 
 	var t mtc.Tree
-	err = t.UnmarshalBinary(buf)
+	_, err = t.ReadFrom(bufio.NewReader(r))
 	if err != nil {
 		return err
 	}
@@ -552,20 +2105,125 @@ func handleInspectTree(cc *cli.Context) error {
 	fmt.Fprintf(w, "number of leaves\t%d\n", t.LeafCount())
 	fmt.Fprintf(w, "number of nodes\t%d\n", t.NodeCount())
 	fmt.Fprintf(w, "root\t%x\n", t.Root())
+	if err := inspectWriteProducer(w, cc); err != nil {
+		return err
+	}
 	w.Flush()
+
+	if cc.IsSet("check-leaf") {
+		return inspectCheckLeaf(cc, &t)
+	}
 	return nil
 }
 
-func writeAssertion(w *tabwriter.Writer, a mtc.Assertion) {
-	aa := a.Abridge()
-	cs := aa.Claims
-	subj := aa.Subject
-	fmt.Fprintf(w, "subject_type\t%s\n", subj.Type())
+// Checks the leaf given by --check-leaf against the abridged-assertions
+// file next to the tree.
+func inspectCheckLeaf(cc *cli.Context, t *mtc.Tree) error {
+	if cc.Args().Len() == 0 {
+		return errors.New("--check-leaf requires the path to the tree")
+	}
+	treePath := cc.Args().Get(0)
+	dir := filepath.Dir(treePath)
+	index := cc.Uint64("check-leaf")
+
+	p, err := inspectGetCAParams(cc)
+	if err != nil {
+		return err
+	}
+
+	var number uint32
+	if cc.IsSet("batch") {
+		number = uint32(cc.Uint("batch"))
+	} else {
+		n, err := strconv.ParseUint(filepath.Base(dir), 10, 32)
+		if err != nil {
+			return fmt.Errorf(
+				"Can't infer batch number from %s: use --batch", treePath)
+		}
+		number = uint32(n)
+	}
+	batch := mtc.Batch{CA: p, Number: number}
+
+	var expectedKey []byte
+	if cc.IsSet("key") {
+		expectedKey, err = hex.DecodeString(cc.String("key"))
+		if err != nil || len(expectedKey) != mtc.HashLen {
+			return fmt.Errorf("--key: expected %d hex encoded bytes", mtc.HashLen)
+		}
+	}
+
+	// Find the abridged assertion at the index.
+	aasPath := filepath.Join(dir, "abridged-assertions")
+	r, err := os.Open(aasPath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var (
+		aa    *mtc.AbridgedAssertion
+		seqno uint64
+	)
+	errFound := errors.New("found")
+	err = mtc.UnmarshalAbridgedAssertions(r, func(_ int,
+		cur *mtc.AbridgedAssertion) error {
+		if seqno == index {
+			aa = cur
+			return errFound
+		}
+		seqno++
+		return nil
+	})
+	if err != nil && err != errFound {
+		return fmt.Errorf("reading %s: %w", aasPath, err)
+	}
+	if aa == nil {
+		return fmt.Errorf("%s has no assertion %d", aasPath, index)
+	}
+
+	key := make([]byte, mtc.HashLen)
+	if err := aa.Key(key); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 1, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintf(w, "leaf\t%d\n", index)
+	fmt.Fprintf(w, "key\t%x\n", key)
+
+	if expectedKey != nil && !bytes.Equal(key, expectedKey) {
+		return fmt.Errorf("Leaf %d has key %x, expected %x", index, key, expectedKey)
+	}
+	if err := batch.CheckLeaf(t, index, aa); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "check\tok\n")
+	return nil
+}
+
+// Writes the signature scheme and public key, or its hash, of each key
+// in subj.
+func writeAbridgedSubject(w *tabwriter.Writer, subj mtc.AbridgedSubject) {
 	switch subj := subj.(type) {
 	case *mtc.AbridgedTLSSubject:
 		fmt.Fprintf(w, "signature_scheme\t%s\n", subj.SignatureScheme)
 		fmt.Fprintf(w, "public_key_hash\t%x\n", subj.PublicKeyHash[:])
+	case *mtc.AbridgedMultiTLSSubject:
+		for i := range subj.Subjects {
+			writeAbridgedSubject(w, &subj.Subjects[i])
+		}
+	case *mtc.AbridgedCompactTLSSubject:
+		fmt.Fprintf(w, "signature_scheme\t%s\n", subj.SignatureScheme)
+		fmt.Fprintf(w, "public_key\t%x\n", subj.PublicKey)
 	}
+}
+
+func writeAssertion(w *tabwriter.Writer, a mtc.Assertion) {
+	aa := a.Abridge()
+	cs := aa.Claims
+	subj := aa.Subject
+	fmt.Fprintf(w, "subject_type\t%s\n", subj.Type())
+	writeAbridgedSubject(w, subj)
 	if len(cs.DNS) != 0 {
 		fmt.Fprintf(w, "dns\t%s\n", cs.DNS)
 	}
@@ -578,9 +2236,60 @@ func writeAssertion(w *tabwriter.Writer, a mtc.Assertion) {
 	if len(cs.IPv4) != 0 {
 		fmt.Fprintf(w, "ip4\t%s\n", cs.IPv4)
 	}
-	if len(cs.IPv6) != 0 {
-		fmt.Fprintf(w, "ip6\t%s\n", cs.IPv6)
+	if len(cs.IPv6) != 0 {
+		fmt.Fprintf(w, "ip6\t%s\n", cs.IPv6)
+	}
+	if len(cs.Email) != 0 {
+		fmt.Fprintf(w, "email\t%s\n", cs.Email)
+	}
+	for _, claim := range cs.Unknown {
+		fmt.Fprintf(w, "unknown_claim\t%d\t%x\n", claim.Type, claim.Info)
+	}
+
+	// Helps to find out why a batch is larger than expected.
+	if buf, err := a.MarshalBinary(); err == nil {
+		fmt.Fprintf(w, "summary\t%d claims, %d bytes\n", cs.Count(), len(buf))
+	} else {
+		fmt.Fprintf(w, "summary\t%d claims\n", cs.Count())
+	}
+}
+
+func handleInspectCertBundle(cc *cli.Context) error {
+	p, err := inspectGetCAParams(cc)
+	if err != nil {
+		return err
+	}
+	buf, err := inspectGetBuf(cc)
+	if err != nil {
+		return err
+	}
+
+	var b mtc.CertificateBundle
+	if err := b.UnmarshalBinary(buf, p); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 1, ' ', 0)
+	writeAssertion(w, b.Certificate.Assertion)
+	fmt.Fprintf(w, "\n")
+	switch anch := b.Certificate.Proof.TrustAnchor().(type) {
+	case *mtc.MerkleTreeTrustAnchor:
+		fmt.Fprintf(w, "issuer_id\t%s\n", anch.IssuerId())
+		fmt.Fprintf(w, "batch\t%d\n", anch.BatchNumber())
+	}
+	fmt.Fprintf(w, "window_batch\t%d\n", b.Window.BatchNumber)
+	fmt.Fprintf(w, "window_signature_scheme\t%s\n", p.PublicKey.Scheme())
+	w.Flush()
+
+	err = mtc.VerifyCertificateBundle(&b, mtc.VerifyOptions{
+		CA:          p,
+		AllowedSkew: time.Duration(p.BatchDuration) * time.Second,
+	})
+	if err != nil {
+		return fmt.Errorf("verifying: %w", err)
 	}
+	fmt.Printf("\nverified\n")
+	return nil
 }
 
 func handleInspectCert(cc *cli.Context) error {
@@ -595,9 +2304,15 @@ func handleInspectCert(cc *cli.Context) error {
 		return err
 	}
 
+	fp, err := c.Fingerprint()
+	if err != nil {
+		return err
+	}
+
 	w := tabwriter.NewWriter(os.Stdout, 1, 1, 1, ' ', 0)
 	writeAssertion(w, c.Assertion)
 	fmt.Fprintf(w, "\n")
+	fmt.Fprintf(w, "fingerprint\t%s\n", fp)
 	fmt.Fprintf(w, "proof_type\t%v\n", c.Proof.TrustAnchor().ProofType())
 
 	switch anch := c.Proof.TrustAnchor().(type) {
@@ -609,6 +2324,15 @@ func handleInspectCert(cc *cli.Context) error {
 	switch proof := c.Proof.(type) {
 	case *mtc.MerkleTreeProof:
 		fmt.Fprintf(w, "index\t%d\n", proof.Index())
+
+		// What the proof adds to the assertion on every connection.
+		proofBuf, err := proof.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "authentication_path_size\t%d bytes\n",
+			len(proof.Path()))
+		fmt.Fprintf(w, "proof_size\t%d bytes\n", len(proofBuf))
 	}
 
 	switch proof := c.Proof.(type) {
@@ -642,6 +2366,23 @@ func handleInspectCert(cc *cli.Context) error {
 			}
 
 			fmt.Fprintf(w, "recomputed root\t%x\n", root)
+
+			// The path has a hash for each level of the tree, which
+			// depends on the number of assertions in the batch.
+			height := len(path) / mtc.HashLen
+			switch {
+			case height == 0:
+				fmt.Fprintf(w, "tree_height\t0\tbatch of 1 assertion\n")
+			case height == 1:
+				fmt.Fprintf(w, "tree_height\t1\tbatch of 2 assertions\n")
+			default:
+				maxLeaves := uint64(1) << height
+				if maxLeaves == 0 { // height 64
+					maxLeaves = math.MaxUint64
+				}
+				fmt.Fprintf(w, "tree_height\t%d\tbatch of %d to %d assertions\n",
+					height, uint64(1)<<(height-1)+1, maxLeaves)
+			}
 		} else if err != errNoCaParams {
 			return err
 		}
@@ -669,7 +2410,13 @@ func handleInspectAssertion(cc *cli.Context) error {
 		return err
 	}
 
+	checksum, err := a.Checksum()
+	if err != nil {
+		return err
+	}
+
 	w := tabwriter.NewWriter(os.Stdout, 1, 1, 1, ' ', 0)
+	fmt.Fprintf(w, "checksum\t%x\n", checksum)
 	writeAssertion(w, a)
 	w.Flush()
 	return nil
@@ -682,23 +2429,47 @@ func handleInspectAbridgedAssertions(cc *cli.Context) error {
 	}
 	defer r.Close()
 
-	count := 0
+	br := bufio.NewReader(r)
+	header, err := mtc.ReadAbridgedAssertionsHeader(br)
+	if err != nil {
+		return fmt.Errorf("reading header: %w", err)
+	}
+
+	offset := cc.Uint64("offset")
+	limit := cc.Uint64("limit")
+	countOnly := cc.Bool("count-only")
+	if countOnly && (cc.IsSet("offset") || cc.IsSet("limit")) {
+		return errors.New("Can't specify --count-only with --offset or --limit")
+	}
+
+	// A single writer for all records: each blank line between records
+	// flushes the tabwriter, so it doesn't hold on to earlier records.
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	w := tabwriter.NewWriter(out, 1, 1, 1, ' ', 0)
+
+	// We've consumed the header ourselves, so that we can report a
+	// mismatching count instead of failing.
+	count := uint64(0)
+	errLimit := errors.New("limit reached")
 	err = mtc.UnmarshalAbridgedAssertions(
-		bufio.NewReader(r),
+		br,
 		func(_ int, aa *mtc.AbridgedAssertion) error {
 			count++
+			if countOnly || count <= offset {
+				return nil
+			}
+			if limit != 0 && count > offset+limit {
+				return errLimit
+			}
 			cs := aa.Claims
 			subj := aa.Subject
 			var key [mtc.HashLen]byte
 			aa.Key(key[:])
-			w := tabwriter.NewWriter(os.Stdout, 1, 1, 1, ' ', 0)
+			fmt.Fprintf(w, "index\t%d\n", count-1)
 			fmt.Fprintf(w, "key\t%x\n", key)
 			fmt.Fprintf(w, "subject_type\t%s\n", subj.Type())
-			switch subj := subj.(type) {
-			case *mtc.AbridgedTLSSubject:
-				fmt.Fprintf(w, "signature_scheme\t%s\n", subj.SignatureScheme)
-				fmt.Fprintf(w, "public_key_hash\t%x\n", subj.PublicKeyHash[:])
-			}
+			writeAbridgedSubject(w, subj)
 			if len(cs.DNS) != 0 {
 				fmt.Fprintf(w, "dns\t%s\n", cs.DNS)
 			}
@@ -714,18 +2485,91 @@ func handleInspectAbridgedAssertions(cc *cli.Context) error {
 			if len(cs.IPv6) != 0 {
 				fmt.Fprintf(w, "ip6\t%s\n", cs.IPv6)
 			}
-			w.Flush()
-			fmt.Printf("\n")
+			if len(cs.Email) != 0 {
+				fmt.Fprintf(w, "email\t%s\n", cs.Email)
+			}
+			fmt.Fprintf(w, "\n")
 			return nil
 		},
 	)
+	w.Flush()
+	if err == errLimit {
+		// We stopped early, so we don't know the total.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Total number of abridged assertions: %d\n", count)
+	if header == nil {
+		fmt.Fprintf(out, "No header: file predates abridged-assertions version 1\n")
+		return nil
+	}
+	fmt.Fprintf(out, "Declared number of abridged assertions: %d\n", header.Count)
+	if header.Count != count {
+		return fmt.Errorf(
+			"header declares %d abridged assertions, but found %d",
+			header.Count,
+			count,
+		)
+	}
+	return nil
+}
+
+func handleInspectBatchSummary(cc *cli.Context) error {
+	buf, err := inspectGetBuf(cc)
+	if err != nil {
+		return err
+	}
+	var s mtc.BatchSummary
+	if err := s.UnmarshalBinary(buf); err != nil {
+		return err
+	}
+
+	info := batchSummaryInfo{
+		BatchNumber:          s.Number,
+		LeafCount:            s.LeafCount,
+		Root:                 hex.EncodeToString(s.Root),
+		FirstKey:             hex.EncodeToString(s.FirstKey),
+		LastKey:              hex.EncodeToString(s.LastKey),
+		IssuedAt:             s.IssuedAt.Unix(),
+		PublicKeyFingerprint: s.Fingerprint(),
+	}
+	info.Producer, err = inspectGetProducer(cc)
 	if err != nil {
 		return err
 	}
-	fmt.Printf("Total number of abridged assertions: %d\n", count)
+	if ok, err := inspectWriteFormatted(cc, info); ok || err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 1, ' ', 0)
+	fmt.Fprintf(w, "batch_number\t%d\n", info.BatchNumber)
+	fmt.Fprintf(w, "leaf_count\t%d\n", info.LeafCount)
+	fmt.Fprintf(w, "root\t%s\n", info.Root)
+	fmt.Fprintf(w, "first_key\t%s\n", info.FirstKey)
+	fmt.Fprintf(w, "last_key\t%s\n", info.LastKey)
+	fmt.Fprintf(w, "issued_at\t%d\t%s\n", info.IssuedAt, s.IssuedAt)
+	fmt.Fprintf(w, "public_key fingerprint\t%s\n", info.PublicKeyFingerprint)
+	if info.Producer != "" {
+		fmt.Fprintf(w, "producer\t%s\n", info.Producer)
+	}
+	w.Flush()
 	return nil
 }
 
+// Batch summary, as printed by inspect batch-summary.
+type batchSummaryInfo struct {
+	BatchNumber          uint32 `json:"batch_number"`
+	LeafCount            uint64 `json:"leaf_count"`
+	Root                 string `json:"root"`
+	FirstKey             string `json:"first_key"`
+	LastKey              string `json:"last_key"`
+	IssuedAt             int64  `json:"issued_at"`
+	PublicKeyFingerprint string `json:"public_key_fingerprint"`
+	Producer             string `json:"producer,omitempty"`
+}
+
 func handleInspectCaParams(cc *cli.Context) error {
 	buf, err := inspectGetBuf(cc)
 	if err != nil {
@@ -736,27 +2580,115 @@ func handleInspectCaParams(cc *cli.Context) error {
 	if err != nil {
 		return err
 	}
+	fp, err := p.Fingerprint()
+	if err != nil {
+		return err
+	}
+
+	info := caParamsInfo{
+		IssuerId:             p.IssuerId,
+		StartTime:            p.StartTime,
+		BatchDuration:        p.BatchDuration,
+		Lifetime:             p.Lifetime,
+		StorageWindowSize:    p.StorageWindowSize,
+		ValidityWindowSize:   p.ValidityWindowSize,
+		HttpServer:           p.HttpServer,
+		PublicKeyFingerprint: mtc.VerifierFingerprint(p.PublicKey),
+		Fingerprint:          fp,
+	}
+	for _, c := range p.BatchDurationChanges {
+		info.BatchDurationChanges = append(info.BatchDurationChanges,
+			batchDurationChangeInfo{
+				EffectiveFrom: c.EffectiveFrom,
+				BatchDuration: c.BatchDuration,
+			})
+	}
+	for _, scheme := range p.AllowedSubjectSchemes {
+		info.AllowedSubjectSchemes = append(info.AllowedSubjectSchemes,
+			scheme.String())
+	}
+	if p.LeafEncoding != mtc.AbridgedAssertionLeaf {
+		info.LeafEncoding = p.LeafEncoding.String()
+	}
+	for _, f := range p.UnknownFields {
+		info.UnknownFields = append(info.UnknownFields, unknownFieldInfo{
+			Type: f.Type,
+			Data: hex.EncodeToString(f.Data),
+		})
+	}
+	info.Producer, err = inspectGetProducer(cc)
+	if err != nil {
+		return err
+	}
+	if ok, err := inspectWriteFormatted(cc, info); ok || err != nil {
+		return err
+	}
+
 	w := tabwriter.NewWriter(os.Stdout, 1, 1, 1, ' ', 0)
-	fmt.Fprintf(w, "issuer_id\t%s\n", p.IssuerId)
-	fmt.Fprintf(w, "start_time\t%d\t%s\n", p.StartTime,
-		time.Unix(int64(p.StartTime), 0))
-	fmt.Fprintf(w, "batch_duration\t%d\t%s\n", p.BatchDuration,
-		time.Second*time.Duration(p.BatchDuration))
-	fmt.Fprintf(w, "life_time\t%d\t%s\n", p.Lifetime,
-		time.Second*time.Duration(p.Lifetime))
-	fmt.Fprintf(w, "storage_window_size\t%d\t%s\n", p.StorageWindowSize,
-		time.Second*time.Duration(p.BatchDuration*p.StorageWindowSize))
-	fmt.Fprintf(w, "validity_window_size\t%d\n", p.ValidityWindowSize)
-	fmt.Fprintf(w, "http_server\t%s\n", p.HttpServer)
-	fmt.Fprintf(
-		w,
-		"public_key fingerprint\t%s\n",
-		mtc.VerifierFingerprint(p.PublicKey),
-	)
+	fmt.Fprintf(w, "issuer_id\t%s\n", info.IssuerId)
+	fmt.Fprintf(w, "start_time\t%d\t%s\n", info.StartTime,
+		time.Unix(int64(info.StartTime), 0))
+	fmt.Fprintf(w, "batch_duration\t%d\t%s\n", info.BatchDuration,
+		time.Second*time.Duration(info.BatchDuration))
+	fmt.Fprintf(w, "life_time\t%d\t%s\n", info.Lifetime,
+		time.Second*time.Duration(info.Lifetime))
+	fmt.Fprintf(w, "storage_window_size\t%d\t%s\n", info.StorageWindowSize,
+		time.Second*time.Duration(info.BatchDuration*info.StorageWindowSize))
+	fmt.Fprintf(w, "validity_window_size\t%d\n", info.ValidityWindowSize)
+	for i, c := range info.BatchDurationChanges {
+		fmt.Fprintf(w, "batch_duration_changes[%d]\t%d\t%s from %s\n",
+			i, c.BatchDuration,
+			time.Second*time.Duration(c.BatchDuration),
+			time.Unix(int64(c.EffectiveFrom), 0))
+	}
+	if len(info.AllowedSubjectSchemes) != 0 {
+		fmt.Fprintf(w, "allowed_subject_schemes\t%s\n",
+			strings.Join(info.AllowedSubjectSchemes, ", "))
+	}
+	if info.LeafEncoding != "" {
+		fmt.Fprintf(w, "leaf_encoding\t%s\n", info.LeafEncoding)
+	}
+	for _, f := range info.UnknownFields {
+		fmt.Fprintf(w, "unknown_field[%d]\t%s\n", f.Type, f.Data)
+	}
+	fmt.Fprintf(w, "http_server\t%s\n", info.HttpServer)
+	fmt.Fprintf(w, "public_key fingerprint\t%s\n", info.PublicKeyFingerprint)
+	fmt.Fprintf(w, "fingerprint\t%s\n", info.Fingerprint)
+	if info.Producer != "" {
+		fmt.Fprintf(w, "producer\t%s\n", info.Producer)
+	}
 	w.Flush()
 	return nil
 }
 
+// CA parameters, as printed by inspect ca-params. Times are in seconds.
+type caParamsInfo struct {
+	IssuerId              string                    `json:"issuer_id"`
+	StartTime             uint64                    `json:"start_time"`
+	BatchDuration         uint64                    `json:"batch_duration"`
+	Lifetime              uint64                    `json:"life_time"`
+	StorageWindowSize     uint64                    `json:"storage_window_size"`
+	ValidityWindowSize    uint64                    `json:"validity_window_size"`
+	BatchDurationChanges  []batchDurationChangeInfo `json:"batch_duration_changes,omitempty"`
+	AllowedSubjectSchemes []string                  `json:"allowed_subject_schemes,omitempty"`
+	LeafEncoding          string                    `json:"leaf_encoding,omitempty"`
+	UnknownFields         []unknownFieldInfo        `json:"unknown_fields,omitempty"`
+	HttpServer            string                    `json:"http_server"`
+	PublicKeyFingerprint  string                    `json:"public_key_fingerprint"`
+	Fingerprint           string                    `json:"fingerprint"`
+	Producer              string                    `json:"producer,omitempty"`
+}
+
+type batchDurationChangeInfo struct {
+	EffectiveFrom uint64 `json:"effective_from"`
+	BatchDuration uint64 `json:"batch_duration"`
+}
+
+type unknownFieldInfo struct {
+	Type uint16 `json:"type"`
+	Data string `json:"data"`
+}
+
 func main() {
 	app := &cli.App{
 		Flags: []cli.Flag{
@@ -764,6 +2696,11 @@ func main() {
 				Name:  "cpuprofile",
 				Usage: "write cpu profile to file",
 			},
+			&cli.StringFlag{
+				Name:  "out-file-mode",
+				Usage: "permissions of files written with --out-file",
+				Value: "0644",
+			},
 		},
 		Commands: []*cli.Command{
 			{
@@ -797,17 +2734,219 @@ func main() {
 								Aliases: []string{"s"},
 								Usage:   "time to serve assertions",
 							},
+							&cli.BoolFlag{
+								Name:  "force",
+								Usage: "overwrite existing CA, including its signing key",
+							},
+							&cli.BoolFlag{
+								Name:  "if-not-exists",
+								Usage: "succeed without changes if a CA with these parameters exists already",
+							},
+							&cli.StringFlag{
+								Name:  "file-mode",
+								Usage: "permissions of published files, such as ca-params and batches",
+								Value: "0644",
+							},
+							&cli.StringSliceFlag{
+								Name:  "allow-subject-scheme",
+								Usage: "only accept subject keys for this signature scheme, as advertised in ca-params; can be repeated",
+							},
+							&cli.StringFlag{
+								Name:  "leaf-encoding",
+								Usage: "what the leaves of the Merkle trees commit to: abridged_assertion, or claims_hash for its hash (no size saving)",
+								Value: "abridged_assertion",
+							},
+							&cli.StringSliceFlag{
+								Name:  "batch-duration-change",
+								Usage: "change the time between batches to <duration> at <after> from the start, as <after>=<duration>, such as 720h=30m; can be repeated",
+							},
 						},
 					},
 					{
 						Name:   "show-queue",
 						Usage:  "prints the queue",
 						Action: handleCaShowQueue,
+						Flags: append(
+							timeRangeFlags(),
+							&cli.StringFlag{
+								Name:  "label",
+								Usage: "only show assertions queued with this label",
+							},
+						),
+					},
+					{
+						Name:   "export-queue",
+						Usage:  "writes the queue to a file, for backup or migration",
+						Action: handleCaExportQueue,
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:    "out-file",
+								Usage:   "path to write the queue to",
+								Aliases: []string{"o"},
+							},
+						},
+					},
+					{
+						Name:      "import-queue",
+						Usage:     "adds the assertions of a file written by export-queue to the queue",
+						Action:    handleCaImportQueue,
+						ArgsUsage: "<path>",
+					},
+					{
+						Name:   "list-batches",
+						Usage:  "lists the issued batches that are still stored",
+						Action: handleCaListBatches,
+						Flags:  timeRangeFlags(),
+					},
+					{
+						Name:   "tree-heads",
+						Usage:  "prints the tree head of each stored batch, from its validity window",
+						Action: handleCaTreeHeads,
 					},
 					{
 						Name:   "issue",
 						Usage:  "certify and issue queued assertions",
 						Action: handleCaIssue,
+						Flags: append(retentionFlags(),
+							&cli.StringFlag{
+								Name:  "audit-source",
+								Usage: "operator recorded in the audit log (default: user@hostname)",
+							},
+							&cli.StringFlag{
+								Name:  "leaf-order",
+								Usage: "order of the leaves in the batch: queue, or subject to group assertions with the same public key",
+								Value: "queue",
+							},
+							&cli.IntFlag{
+								Name:  "workers",
+								Usage: "number of goroutines hashing the tree (default: GOMAXPROCS)",
+							},
+							&cli.BoolFlag{
+								Name:  "restart",
+								Usage: "build the batch from scratch, instead of continuing an interrupted issuance",
+							},
+						),
+					},
+					{
+						Name:   "gc",
+						Usage:  "removes batches outside of the storage window, and archives those the retention policy keeps",
+						Action: handleCaGC,
+						Flags:  retentionFlags(),
+					},
+					{
+						Name:   "compact",
+						Usage:  "removes the abridged assertions of expired batches, keeping their trees and indices",
+						Action: handleCaCompact,
+					},
+					{
+						Name:   "export-pubkey",
+						Usage:  "writes the CA's public key in PKIX form",
+						Action: handleCaExportPubkey,
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:    "out-file",
+								Usage:   "path to write public key to",
+								Aliases: []string{"o"},
+							},
+							&cli.StringFlag{
+								Name:  "format",
+								Usage: "pem or der",
+								Value: "pem",
+							},
+						},
+					},
+					{
+						Name:   "checkpoint",
+						Usage:  "writes a batch's root as a signed transparency log checkpoint",
+						Action: handleCaCheckpoint,
+						Flags: []cli.Flag{
+							&cli.UintFlag{
+								Name:        "batch",
+								Usage:       "batch number",
+								DefaultText: "latest",
+							},
+							&cli.StringFlag{
+								Name:    "out-file",
+								Usage:   "path to write checkpoint to",
+								Aliases: []string{"o"},
+							},
+						},
+					},
+					{
+						Name:      "deny",
+						Usage:     "asks relying parties not to accept an issued assertion",
+						Action:    handleCaDeny,
+						ArgsUsage: "<key>",
+					},
+					{
+						Name:      "staple",
+						Usage:     "signs a statement that an issued assertion is still in good standing, to staple to its certificate",
+						Action:    handleCaStaple,
+						ArgsUsage: "<key>",
+						Flags: []cli.Flag{
+							&cli.UintFlag{
+								Name:     "batch",
+								Usage:    "number of the batch the assertion was issued in",
+								Required: true,
+							},
+							&cli.StringFlag{
+								Name:    "out-file",
+								Usage:   "path to write staple to",
+								Aliases: []string{"o"},
+							},
+						},
+					},
+					{
+						Name:   "audit-log",
+						Usage:  "prints the audit log of issued batches",
+						Action: handleCaAuditLog,
+					},
+					{
+						Name:   "check-consistency",
+						Usage:  "checks the root of a local batch against the windows the CA published",
+						Action: handleCaCheckConsistency,
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "remote",
+								Usage:    "URL of the CA's published files, such as https://ca.example.com/mtc/v1",
+								Required: true,
+							},
+							&cli.UintFlag{
+								Name:     "batch",
+								Usage:    "number of the batch to check",
+								Required: true,
+							},
+						},
+					},
+					{
+						Name:   "reissue-window",
+						Usage:  "signs the validity window of an issued batch anew, without changing its tree heads",
+						Action: handleCaReissueWindow,
+						Flags: []cli.Flag{
+							&cli.UintFlag{
+								Name:     "batch",
+								Usage:    "number of the batch whose window to sign",
+								Required: true,
+							},
+						},
+					},
+					{
+						Name:   "project-storage",
+						Usage:  "estimates disk usage at steady state for a given issuance rate",
+						Action: handleCaProjectStorage,
+						Flags: append(
+							assertionFlags(true),
+							&cli.Uint64Flag{
+								Name:     "rate",
+								Usage:    "number of assertions per batch",
+								Required: true,
+							},
+						),
+					},
+					{
+						Name:   "verify",
+						Usage:  "checks that the stored batches and audit log are consistent and in order",
+						Action: handleCaVerify,
 					},
 					{
 						Name:   "queue",
@@ -815,6 +2954,26 @@ func main() {
 						Action: handleCaQueue,
 						Flags: append(
 							assertionFlags(true),
+							&cli.UintFlag{
+								Name:  "not-before-batch",
+								Usage: "don't issue the assertion in a batch before this one",
+							},
+							&cli.StringFlag{
+								Name:  "label",
+								Usage: "reference of your own, such as a subscriber id, shown by show-queue; not part of the assertion",
+							},
+							&cli.IntFlag{
+								Name:  "min-key-bits",
+								Usage: "refuse subject keys with a lower security level, such as 112 for RSA-2048 or 128 for P-256",
+							},
+							&cli.StringSliceFlag{
+								Name:  "allow-scheme",
+								Usage: "refuse subject keys for other signature schemes; can be repeated",
+							},
+							&cli.BoolFlag{
+								Name:  "log",
+								Usage: "append to the queue log, which is moved into the queue when issuing, instead of waiting for the lock of the CA",
+							},
 							&cli.IntFlag{
 								Name:     "debug-repeat",
 								Category: "Debug",
@@ -839,10 +2998,25 @@ func main() {
 								Usage:   "path to write assertion to",
 								Aliases: []string{"o"},
 							},
+							&cli.BoolFlag{
+								Name:  "embed-window",
+								Usage: "write a bundle with the latest signed validity window, for offline verification",
+							},
 						),
 					},
 				},
 			},
+			{
+				Name:   "version",
+				Usage:  "prints version and supported features",
+				Action: handleVersion,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "print as JSON",
+					},
+				},
+			},
 			{
 				Name: "inspect",
 				Subcommands: []*cli.Command{
@@ -851,18 +3025,65 @@ func main() {
 						Usage:     "parses ca-params file",
 						Action:    handleInspectCaParams,
 						ArgsUsage: "[path]",
+						Flags:     []cli.Flag{inspectFormatFlag()},
+					},
+					{
+						Name:      "batch-summary",
+						Usage:     "parses batch's summary file",
+						Action:    handleInspectBatchSummary,
+						ArgsUsage: "[path]",
+						Flags:     []cli.Flag{inspectFormatFlag()},
 					},
 					{
 						Name:      "signed-validity-window",
 						Usage:     "parses batch's signed-validity-window file",
 						Action:    handleInspectSignedValidityWindow,
 						ArgsUsage: "[path]",
+						Flags:     []cli.Flag{inspectFormatFlag()},
+					},
+					{
+						Name:      "window-chain",
+						Usage:     "checks that the signed validity windows in a directory are consecutive and agree on their tree heads",
+						Action:    handleInspectWindowChain,
+						ArgsUsage: "<dir>",
+					},
+					{
+						Name:      "staple",
+						Usage:     "parses and checks the signature of a staple",
+						Action:    handleInspectStaple,
+						ArgsUsage: "[path]",
+					},
+					{
+						Name:      "deny-list",
+						Usage:     "parses CA's deny-list file, and checks its signature",
+						Action:    handleInspectDenyList,
+						ArgsUsage: "[path]",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "check-key",
+								Usage: "hex encoded assertion key to look up, instead of listing all keys",
+							},
+						},
 					},
 					{
 						Name:      "abridged-assertions",
 						Usage:     "parses batch's abridged-assertions file",
 						Action:    handleInspectAbridgedAssertions,
 						ArgsUsage: "[path]",
+						Flags: []cli.Flag{
+							&cli.Uint64Flag{
+								Name:  "offset",
+								Usage: "skip this many abridged assertions",
+							},
+							&cli.Uint64Flag{
+								Name:  "limit",
+								Usage: "show at most this many abridged assertions (0 for all)",
+							},
+							&cli.BoolFlag{
+								Name:  "count-only",
+								Usage: "only count the abridged assertions",
+							},
+						},
 					},
 					{
 						Name:      "assertion",
@@ -875,6 +3096,21 @@ func main() {
 						Usage:     "parses batch's tree file",
 						Action:    handleInspectTree,
 						ArgsUsage: "[path]",
+						Flags: []cli.Flag{
+							&cli.Uint64Flag{
+								Name:  "check-leaf",
+								Usage: "checks the leaf at this index against abridged-assertions and the root",
+							},
+							&cli.StringFlag{
+								Name:  "key",
+								Usage: "with --check-leaf, hex encoded key the leaf should have",
+							},
+							&cli.UintFlag{
+								Name:        "batch",
+								Usage:       "with --check-leaf, batch number of the tree",
+								DefaultText: "from path",
+							},
+						},
 					},
 					{
 						Name:      "index",
@@ -888,13 +3124,67 @@ func main() {
 						Action:    handleInspectCert,
 						ArgsUsage: "[path]",
 					},
+					{
+						Name:      "cert-bundle",
+						Usage:     "parses and verifies a certificate with embedded validity window",
+						Action:    handleInspectCertBundle,
+						ArgsUsage: "[path]",
+					},
 				},
 				Flags: []cli.Flag{
 					&cli.StringFlag{
 						Name:    "ca-params",
-						Usage:   "path to CA parameters required to parse some files",
+						Usage:   "path or URL of CA parameters required to parse some files",
 						Aliases: []string{"p"},
 					},
+					&cli.StringFlag{
+						Name:  "ca-params-fingerprint",
+						Usage: "refuse CA parameters without this fingerprint, as printed by inspect ca-params",
+					},
+				},
+			},
+			{
+				Name:      "cert-to-x509-template",
+				Usage:     "writes the claims and public key of a certificate or assertion as X.509 fields",
+				Action:    handleCertToX509Template,
+				ArgsUsage: "[path]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "out-file",
+						Usage:   "path to write template to",
+						Aliases: []string{"o"},
+					},
+				},
+			},
+			{
+				Name:   "assertion-template",
+				Usage:  "writes an assertion as a JSON template for ca queue --template",
+				Action: handleAssertionTemplate,
+				Flags: append(
+					assertionFlags(false),
+					&cli.StringFlag{
+						Name:    "out-file",
+						Usage:   "path to write template to",
+						Aliases: []string{"o"},
+					},
+				),
+			},
+			{
+				Name:   "gen-key",
+				Usage:  "generates a subject key pair, for use with --tls-pem",
+				Action: handleGenKey,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "scheme",
+						Usage: "TLS signature scheme the key is for",
+						Value: "p256",
+					},
+					&cli.StringFlag{
+						Name:     "out-file",
+						Usage:    "path to write the private key to; the public key goes to the same path with .pub appended",
+						Aliases:  []string{"o"},
+						Required: true,
+					},
 				},
 			},
 			{
@@ -912,8 +3202,12 @@ func main() {
 			},
 		},
 		Before: func(cc *cli.Context) error {
+			var err error
+			outFileMode, err = parseFileMode(cc.String("out-file-mode"))
+			if err != nil {
+				return err
+			}
 			if path := cc.String("cpuprofile"); path != "" {
-				var err error
 				fCpuProfile, err = os.Create(path)
 				if err != nil {
 					return fmt.Errorf("create(%s): %w", path, err)
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/bwesterb/mtc"
+)
+
+func TestListBatchesTimeRange(t *testing.T) {
+	p := mtc.CAParams{StartTime: 1000, BatchDuration: 10}
+	at := func(ts int64) *time.Time {
+		ret := time.Unix(ts, 0)
+		return &ret
+	}
+
+	for _, tc := range []struct {
+		since, until *time.Time
+		batches      []uint32
+	}{
+		{nil, nil, []uint32{0, 1, 2, 3}},
+		{at(1015), nil, []uint32{1, 2, 3}},
+		{at(1020), nil, []uint32{1, 2, 3}}, // batch 1 ends at 1020
+		{nil, at(1020), []uint32{0, 1}},    // batch 2 starts at 1020
+		{nil, at(1021), []uint32{0, 1, 2}},
+		{at(1015), at(1025), []uint32{1, 2}},
+		{at(2000), nil, nil},
+		{nil, at(1000), nil},
+	} {
+		var got []uint32
+		for number := uint32(0); number < 4; number++ {
+			start, end := p.BatchTimeRange(number)
+			if overlapsTimeRange(tc.since, tc.until, start, end) {
+				got = append(got, number)
+			}
+		}
+		if !slices.Equal(got, tc.batches) {
+			t.Fatalf("since %v until %v: expected batches %v; got %v",
+				tc.since, tc.until, tc.batches, got)
+		}
+	}
+}
+
+func TestQueueTimeRange(t *testing.T) {
+	queuedAt := time.Unix(1000, 0)
+	before, after := time.Unix(999, 0), time.Unix(1001, 0)
+
+	if !overlapsTimeRange(&queuedAt, nil, queuedAt, queuedAt) {
+		t.Fatal("--since is inclusive")
+	}
+	if overlapsTimeRange(nil, &queuedAt, queuedAt, queuedAt) {
+		t.Fatal("--until is exclusive")
+	}
+	if !overlapsTimeRange(&before, &after, queuedAt, queuedAt) {
+		t.Fatal("expected a match")
+	}
+
+	// Entries queued before QueuedAt was recorded only match without
+	// --since and --until.
+	if !overlapsTimeRange(nil, nil, time.Time{}, time.Time{}) {
+		t.Fatal("expected a match without bounds")
+	}
+	if overlapsTimeRange(&before, nil, time.Time{}, time.Time{}) {
+		t.Fatal("entry without time matched --since")
+	}
+}
+
+func TestPublicKeyFromPEM(t *testing.T) {
+	certPub, certPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certDer, err := x509.CreateCertificate(nil, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+	}, &x509.Certificate{}, certPub, certPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubDer, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privDer, err := x509.MarshalPKCS8PrivateKey(certPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf []byte
+	for _, block := range []pem.Block{
+		{Type: "PRIVATE KEY", Bytes: privDer},
+		{Type: "CERTIFICATE", Bytes: certDer},
+		{Type: "PUBLIC KEY", Bytes: pubDer},
+	} {
+		buf = append(buf, pem.EncodeToMemory(&block)...)
+	}
+
+	for _, tc := range []struct {
+		index int
+		want  ed25519.PublicKey // nil if an error is expected
+	}{
+		{autoPEMIndex, certPub},
+		{0, nil}, // not a public key
+		{1, certPub},
+		{2, pub},
+		{3, nil},
+		{-2, nil},
+	} {
+		got, err := publicKeyFromPEM(buf, tc.index)
+		if tc.want == nil {
+			if err == nil {
+				t.Fatalf("index %d: expected an error", tc.index)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("index %d: %v", tc.index, err)
+		}
+		if !tc.want.Equal(got) {
+			t.Fatalf("index %d: wrong key", tc.index)
+		}
+	}
+
+	// Without a public key or certificate, there's nothing to pick.
+	buf = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDer})
+	if _, err := publicKeyFromPEM(buf, autoPEMIndex); err == nil {
+		t.Fatal("expected an error")
+	}
+	if _, err := publicKeyFromPEM([]byte("not PEM"), autoPEMIndex); err == nil {
+		t.Fatal("expected an error")
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+// A small YAML writer for --format yaml. Instead of a YAML library, it
+// converts the output of encoding/json, so that the YAML has the same
+// structure and field names as --format json, in the same order.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// JSON value, with the order of the fields of objects kept.
+type yamlNode struct {
+	kind   json.Delim // '{' or '[', or zero for a scalar
+	keys   []string   // of an object
+	values []*yamlNode
+	scalar string // in YAML
+}
+
+// Converts the JSON document in buf to YAML.
+func jsonToYAML(buf []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	n, err := readYAMLNode(dec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("Trailing data after JSON value")
+	}
+
+	var ret bytes.Buffer
+	if n.inline() {
+		ret.WriteString(n.inlineString() + "\n")
+	} else {
+		for _, line := range n.lines() {
+			ret.WriteString(line + "\n")
+		}
+	}
+	return ret.Bytes(), nil
+}
+
+func readYAMLNode(dec *json.Decoder) (*yamlNode, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch t := tok.(type) {
+	case json.Delim:
+		n := &yamlNode{kind: t}
+		for dec.More() {
+			if t == '{' {
+				key, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				n.keys = append(n.keys, key.(string))
+			}
+			v, err := readYAMLNode(dec)
+			if err != nil {
+				return nil, err
+			}
+			n.values = append(n.values, v)
+		}
+		if _, err := dec.Token(); err != nil { // closing delimiter
+			return nil, err
+		}
+		return n, nil
+	case string:
+		return &yamlNode{scalar: yamlString(t)}, nil
+	case json.Number:
+		return &yamlNode{scalar: t.String()}, nil
+	case bool:
+		return &yamlNode{scalar: strconv.FormatBool(t)}, nil
+	case nil:
+		return &yamlNode{scalar: "null"}, nil
+	}
+	return nil, fmt.Errorf("Unexpected JSON token %v", tok)
+}
+
+// Returns whether the node fits on the line of its key or list item.
+func (n *yamlNode) inline() bool {
+	return n.kind == 0 || len(n.values) == 0
+}
+
+func (n *yamlNode) inlineString() string {
+	switch n.kind {
+	case '{':
+		return "{}"
+	case '[':
+		return "[]"
+	}
+	return n.scalar
+}
+
+// Returns the lines of a node that's not inline, indented relative to it.
+func (n *yamlNode) lines() []string {
+	var ret []string
+	for i, v := range n.values {
+		var prefix string
+		if n.kind == '{' {
+			prefix = yamlString(n.keys[i]) + ":"
+		} else {
+			prefix = "-"
+		}
+		if v.inline() {
+			ret = append(ret, prefix+" "+v.inlineString())
+			continue
+		}
+
+		sub := v.lines()
+		if n.kind == '[' {
+			// The first line of the item goes after the dash.
+			ret = append(ret, prefix+" "+sub[0])
+			sub = sub[1:]
+		} else {
+			ret = append(ret, prefix)
+		}
+		for _, line := range sub {
+			ret = append(ret, "  "+line)
+		}
+	}
+	return ret
+}
+
+// Strings that can be written without quotes, unless they look like
+// another type of value.
+var yamlPlainRegex = regexp.MustCompile("^[a-zA-Z0-9_][a-zA-Z0-9_./+-]*$")
+
+// Returns s as a YAML string, only quoted if needed.
+func yamlString(s string) string {
+	if !yamlPlainRegex.MatchString(s) {
+		return strconv.Quote(s)
+	}
+	switch strings.ToLower(s) {
+	case "true", "false", "yes", "no", "on", "off", "y", "n", "null",
+		".inf", ".nan":
+		return strconv.Quote(s)
+	}
+	if s[0] >= '0' && s[0] <= '9' && strings.Contains(s, "-") {
+		return strconv.Quote(s) // might be read as a date
+	}
+	if _, err := strconv.ParseFloat(s, 64); err == nil {
+		return strconv.Quote(s)
+	}
+	if _, err := strconv.ParseInt(s, 0, 64); err == nil {
+		return strconv.Quote(s)
+	}
+	return s
+}
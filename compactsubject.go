@@ -0,0 +1,108 @@
+package mtc
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// Subject type for a TLS subject with a small public key, such as an
+// Ed25519 key, whose abridged form carries the public key itself instead
+// of its hash. A relying party that only has the abridged assertion can
+// then check a handshake signature without fetching the key. As the key
+// is no larger than a hash, this only costs the length prefix of the key
+// in each leaf. The draft doesn't define such a subject type, so we use
+// a codepoint from the private use region.
+const CompactTLSSubjectType SubjectType = 0xff01
+
+// Maximum size of the public key of a CompactTLSSubject.
+const MaxCompactPublicKeySize = HashLen
+
+// Returned by NewCompactTLSSubject for a public key larger than
+// MaxCompactPublicKeySize.
+var ErrPublicKeyTooLarge = errors.New("Public key too large for compact subject")
+
+// TLS subject whose abridged form carries the public key. Both its
+// subject_info and abridged_subject_info are a TLSSubjectInfo.
+type CompactTLSSubject struct {
+	TLSSubject
+}
+
+// Abridged form of CompactTLSSubject.
+type AbridgedCompactTLSSubject struct {
+	SignatureScheme SignatureScheme
+	PublicKey       []byte
+}
+
+// Returns a compact TLS subject for the public key, or ErrPublicKeyTooLarge
+// if it's too large. See AssertionBuilder.Compact() to fall back to
+// a TLSSubject instead.
+func NewCompactTLSSubject(scheme SignatureScheme, pk crypto.PublicKey) (
+	*CompactTLSSubject, error) {
+	subj, err := NewTLSSubject(scheme, pk)
+	if err != nil {
+		return nil, err
+	}
+	if n := len(subj.pk.Bytes()); n > MaxCompactPublicKeySize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrPublicKeyTooLarge, n)
+	}
+	return &CompactTLSSubject{*subj}, nil
+}
+
+// Parses the subject_info of a CompactTLSSubject.
+func unmarshalCompactTLSSubject(info cryptobyte.String) (*CompactTLSSubject, error) {
+	var subj AbridgedCompactTLSSubject
+	packed := []byte(info)
+	if err := subj.unmarshal(info); err != nil {
+		return nil, err
+	}
+	return &CompactTLSSubject{TLSSubject{packed: packed}}, nil
+}
+
+func (s *CompactTLSSubject) Type() SubjectType { return CompactTLSSubjectType }
+
+func (s *CompactTLSSubject) Abridge() AbridgedSubject {
+	var ret AbridgedCompactTLSSubject
+	if err := ret.unmarshal(cryptobyte.String(s.packed)); err != nil {
+		panic(err)
+	}
+	return &ret
+}
+
+func (s *AbridgedCompactTLSSubject) Type() SubjectType {
+	return CompactTLSSubjectType
+}
+
+func (s *AbridgedCompactTLSSubject) Info() []byte {
+	var b cryptobyte.Builder
+	b.AddUint16(uint16(s.SignatureScheme))
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(s.PublicKey)
+	})
+	buf, _ := b.Bytes()
+	return buf
+}
+
+// Returns the verifier for the public key, to check handshake signatures
+// with just the abridged assertion.
+func (s *AbridgedCompactTLSSubject) Verifier() (Verifier, error) {
+	return UnmarshalVerifier(s.SignatureScheme, s.PublicKey)
+}
+
+func (s *AbridgedCompactTLSSubject) unmarshal(info cryptobyte.String) error {
+	var publicKey cryptobyte.String
+	if !info.ReadUint16((*uint16)(&s.SignatureScheme)) ||
+		!info.ReadUint16LengthPrefixed(&publicKey) {
+		return ErrTruncated
+	}
+	if !info.Empty() {
+		return ErrExtraBytes
+	}
+	if len(publicKey) > MaxCompactPublicKeySize {
+		return fmt.Errorf("%w: %d bytes", ErrPublicKeyTooLarge, len(publicKey))
+	}
+	s.PublicKey = []byte(publicKey)
+	return nil
+}
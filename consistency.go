@@ -0,0 +1,64 @@
+package mtc
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Batches are independent trees, so unlike in RFC 6962 there is no tree
+// that grows, and nothing to prove within a tree. What a monitor needs is
+// that the CA never signed different heads for the same batch: that its
+// validity windows form a single history. The window of each batch covers
+// the ValidityWindowSize batches up to it, so a chain of windows, each
+// covering the last batch of the one before, and agreeing with it on the
+// heads they share, shows that the window of a batch is consistent with
+// that of an earlier one.
+
+// Returned by VerifyConsistencyProof if the windows of the proof are not
+// of the expected batches.
+var ErrConsistencyProofInvalid = errors.New("Invalid consistency proof")
+
+// Returns the batches between from and to, with from < to, whose windows
+// form the proof that the windows of from and to are consistent. Each is
+// ValidityWindowSize-1 batches after the previous, so that consecutive
+// windows share a head. Empty if the windows of from and to share a head
+// themselves.
+func (p *CAParams) ConsistencyProofBatches(from, to uint32) []uint32 {
+	step := uint32(max(p.ValidityWindowSize-1, 1))
+	var ret []uint32
+	for number := uint64(from) + uint64(step); number < uint64(to); number += uint64(step) {
+		ret = append(ret, uint32(number))
+	}
+	return ret
+}
+
+// Checks that the validity windows from and to, with from before to, are
+// consistent, given the windows of the batches ConsistencyProofBatches
+// returns for them, in order. The signatures on the windows are not
+// checked: parse them with SignedValidityWindow.UnmarshalBinary.
+func VerifyConsistencyProof(p *CAParams, from, to *ValidityWindow,
+	proof []*ValidityWindow) error {
+	if from.BatchNumber >= to.BatchNumber {
+		return fmt.Errorf("%w: window %d is not before window %d",
+			ErrConsistencyProofInvalid, from.BatchNumber, to.BatchNumber)
+	}
+	expected := p.ConsistencyProofBatches(from.BatchNumber, to.BatchNumber)
+	if len(proof) != len(expected) {
+		return fmt.Errorf("%w: %d windows, expected %d",
+			ErrConsistencyProofInvalid, len(proof), len(expected))
+	}
+	for i, w := range proof {
+		if w.BatchNumber != expected[i] {
+			return fmt.Errorf("%w: window %d is of batch %d, expected %d",
+				ErrConsistencyProofInvalid, i, w.BatchNumber, expected[i])
+		}
+	}
+
+	chain := append(append([]*ValidityWindow{from}, proof...), to)
+	for i := 1; i < len(chain); i++ {
+		if err := chain[i].CheckConsistent(p, chain[i-1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
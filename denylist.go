@@ -0,0 +1,171 @@
+package mtc
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+var ErrAssertionDenied = errors.New("Assertion is on the CA's deny list")
+
+// List of keys of assertions the CA asks relying parties not to accept,
+// even though they have not expired yet.
+//
+// MTC relies on short lifetimes instead of revocation. The deny list is
+// an optional safety valve for the exceptional case that an assertion
+// must not be honored until it expires. It's only enforced by verifiers
+// that fetch it from the CA, and pass it as VerifyOptions.DenyList. The
+// CA drops keys from the list once their assertions have expired.
+type DenyList struct {
+	// Time the list was signed, in seconds since the epoch. Allows
+	// relying parties to prefer the most recent list.
+	Timestamp uint64
+
+	// Keys of the denied assertions, see AbridgedAssertion.Key().
+	// Sorted, without duplicates.
+	Keys [][HashLen]byte
+}
+
+type SignedDenyList struct {
+	DenyList
+	Signature []byte
+}
+
+// Adds the given key to the list, keeping it sorted. Returns false if
+// the key was already on the list.
+func (l *DenyList) Add(key [HashLen]byte) bool {
+	i, found := l.search(key[:])
+	if found {
+		return false
+	}
+	l.Keys = slices.Insert(l.Keys, i, key)
+	return true
+}
+
+func (l *DenyList) search(key []byte) (int, bool) {
+	return slices.BinarySearchFunc(
+		l.Keys,
+		key,
+		func(a [HashLen]byte, b []byte) int {
+			return bytes.Compare(a[:], b)
+		},
+	)
+}
+
+// Returns whether the assertion with the given key is on the list.
+func (l *DenyList) Contains(key []byte) bool {
+	_, found := l.search(key)
+	return found
+}
+
+// Returns ErrAssertionDenied if the assertion is on the list.
+func (l *DenyList) Check(a *AbridgedAssertion) error {
+	var key [HashLen]byte
+	if err := a.Key(key[:]); err != nil {
+		return err
+	}
+	if l.Contains(key[:]) {
+		return ErrAssertionDenied
+	}
+	return nil
+}
+
+func (l *DenyList) MarshalBinary() ([]byte, error) {
+	var b cryptobyte.Builder
+	b.AddUint64(l.Timestamp)
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, key := range l.Keys {
+			b.AddBytes(key[:])
+		}
+	})
+	return b.Bytes()
+}
+
+func (l *DenyList) unmarshal(s *cryptobyte.String) error {
+	var keys cryptobyte.String
+	if !s.ReadUint64(&l.Timestamp) || !s.ReadUint24LengthPrefixed(&keys) {
+		return ErrTruncated
+	}
+	if len(keys)%HashLen != 0 {
+		return ErrTruncated
+	}
+	l.Keys = make([][HashLen]byte, len(keys)/HashLen)
+	for i := range l.Keys {
+		keys.CopyBytes(l.Keys[i][:])
+		if i > 0 && bytes.Compare(l.Keys[i-1][:], l.Keys[i][:]) >= 0 {
+			return errors.New("Deny list is not sorted or has duplicates")
+		}
+	}
+	return nil
+}
+
+// Returns the marshalled LabeledDenyList, which is signed by the CA.
+func (l *DenyList) LabeledDenyList(ca *CAParams) ([]byte, error) {
+	var b cryptobyte.Builder
+	b.AddBytes([]byte("Merkle Tree Crts DenyList\000"))
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes([]byte(ca.IssuerId))
+	})
+	buf, err := l.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	b.AddBytes(buf)
+	return b.Bytes()
+}
+
+// Signs the deny list for the given CA.
+func (l *DenyList) Sign(signer Signer, ca *CAParams) (SignedDenyList, error) {
+	toSign, err := l.LabeledDenyList(ca)
+	if err != nil {
+		return SignedDenyList{}, err
+	}
+	return SignedDenyList{
+		DenyList:  *l,
+		Signature: signer.Sign(toSign),
+	}, nil
+}
+
+func (l *SignedDenyList) MarshalBinary() ([]byte, error) {
+	var b cryptobyte.Builder
+	list, err := l.DenyList.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	b.AddBytes(list)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(l.Signature)
+	})
+	return b.Bytes()
+}
+
+// Parses the signed deny list, and checks its signature.
+func (l *SignedDenyList) UnmarshalBinary(data []byte, p *CAParams) error {
+	err := l.UnmarshalBinaryWithoutVerification(data)
+	if err != nil {
+		return err
+	}
+	toSign, err := l.DenyList.LabeledDenyList(p)
+	if err != nil {
+		return err
+	}
+	return p.PublicKey.Verify(toSign, l.Signature)
+}
+
+// Like UnmarshalBinary() but doesn't check the signature.
+func (l *SignedDenyList) UnmarshalBinaryWithoutVerification(data []byte) error {
+	s := cryptobyte.String(data)
+	err := l.DenyList.unmarshal(&s)
+	if err != nil {
+		return err
+	}
+	if !s.ReadUint16LengthPrefixed((*cryptobyte.String)(&l.Signature)) {
+		return ErrTruncated
+	}
+	if !s.Empty() {
+		return ErrExtraBytes
+	}
+	return nil
+}
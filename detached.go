@@ -0,0 +1,79 @@
+package mtc
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// Returned when a detached proof is for another assertion.
+var ErrProofKeyMismatch = errors.New("Proof is for a different assertion")
+
+// A MerkleTreeProof kept apart from its certificate, for instance in
+// a cache. It's bound to the key of the abridged assertion it proves, so
+// that it can't be paired with the wrong assertion. Encoded as
+//
+//	struct {
+//	    opaque key[HashLen];
+//	    Proof proof;
+//	} DetachedProof;
+//
+// The proof includes its trust anchor, and thus the batch number.
+type DetachedProof struct {
+	Key   [HashLen]byte
+	Proof *MerkleTreeProof
+}
+
+// Returns a detached proof of the given assertion.
+func NewDetachedProof(a *Assertion, proof *MerkleTreeProof) (*DetachedProof, error) {
+	ret := &DetachedProof{Proof: proof}
+	aa := a.Abridge()
+	if err := aa.Key(ret.Key[:]); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Returns the number of the batch the proof is for.
+func (p *DetachedProof) BatchNumber() uint32 {
+	return p.Proof.anchor.batchNumber
+}
+
+func (p *DetachedProof) MarshalBinary() ([]byte, error) {
+	var b cryptobyte.Builder
+	b.AddBytes(p.Key[:])
+	marshalProof(&b, p.Proof)
+	return b.Bytes()
+}
+
+func (p *DetachedProof) UnmarshalBinary(data []byte) error {
+	s := cryptobyte.String(data)
+	if !s.CopyBytes(p.Key[:]) {
+		return ErrTruncated
+	}
+	var proof MerkleTreeProof
+	if err := proof.UnmarshalBinary([]byte(s)); err != nil {
+		return err
+	}
+	p.Proof = &proof
+	return nil
+}
+
+// Checks that the detached proof is for the given assertion, and then
+// verifies them together as a certificate. See VerifyCertificate.
+func VerifyDetachedProof(a *Assertion, p *DetachedProof, opts VerifyOptions) error {
+	aa := a.Abridge()
+	var key [HashLen]byte
+	if err := aa.Key(key[:]); err != nil {
+		return err
+	}
+	if key != p.Key {
+		return fmt.Errorf("%w: proof is for key %x, but the assertion has key %x",
+			ErrProofKeyMismatch, p.Key, key)
+	}
+	return VerifyCertificate(&BikeshedCertificate{
+		Assertion: *a,
+		Proof:     p.Proof,
+	}, opts)
+}
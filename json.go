@@ -0,0 +1,234 @@
+package mtc
+
+// JSON encoding of assertions, for instance
+//
+//   {
+//     "subject_type": "TLS",
+//     "signature_scheme": "p256",
+//     "public_key": "-----BEGIN PUBLIC KEY-----\n…\n-----END PUBLIC KEY-----\n",
+//     "dns": ["example.com"],
+//     "ip4": ["192.0.2.1"]
+//   }
+//
+// The public key is PEM encoded. The signature scheme may be left out,
+// unless several schemes match the public key, as is the case for RSA.
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+type assertionJSON struct {
+	SubjectType     string             `json:"subject_type"`
+	SignatureScheme string             `json:"signature_scheme,omitempty"`
+	PublicKey       string             `json:"public_key"`
+	DNS             []string           `json:"dns,omitempty"`
+	DNSWildcard     []string           `json:"dns_wildcard,omitempty"`
+	ENS             []string           `json:"ens,omitempty"`
+	IPv4            []net.IP           `json:"ip4,omitempty"`
+	IPv6            []net.IP           `json:"ip6,omitempty"`
+	Email           []string           `json:"email,omitempty"`
+	Unknown         []unknownClaimJSON `json:"unknown_claims,omitempty"`
+}
+
+type unknownClaimJSON struct {
+	Type ClaimType `json:"type"`
+	Info []byte    `json:"info"`
+}
+
+func (a *Assertion) MarshalJSON() ([]byte, error) {
+	subj, ok := a.Subject.(*TLSSubject)
+	if !ok {
+		return nil, errors.New("Only TLS subjects are supported")
+	}
+	v, err := subj.Verifier()
+	if err != nil {
+		return nil, err
+	}
+	pk, err := MarshalPKIXVerifier(v)
+	if err != nil {
+		return nil, err
+	}
+
+	cs := a.Claims
+	ret := assertionJSON{
+		SubjectType:     TLSSubjectType.String(),
+		SignatureScheme: v.Scheme().String(),
+		PublicKey: string(pem.EncodeToMemory(&pem.Block{
+			Type:  "PUBLIC KEY",
+			Bytes: pk,
+		})),
+		DNS:         cs.DNS,
+		DNSWildcard: cs.DNSWildcard,
+		ENS:         cs.ENS,
+		IPv4:        cs.IPv4,
+		IPv6:        cs.IPv6,
+		Email:       cs.Email,
+	}
+	for _, c := range cs.Unknown {
+		ret.Unknown = append(ret.Unknown, unknownClaimJSON{c.Type, c.Info})
+	}
+	return json.Marshal(ret)
+}
+
+// Parses an assertion in the JSON format written by MarshalJSON. Claims
+// don't need to be sorted. Errors mention the offending field.
+func (a *Assertion) UnmarshalJSON(data []byte) error {
+	var aj assertionJSON
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&aj); err != nil {
+		return err
+	}
+
+	if !strings.EqualFold(aj.SubjectType, TLSSubjectType.String()) {
+		return fmt.Errorf("subject_type: unsupported subject type %q",
+			aj.SubjectType)
+	}
+
+	b := NewAssertionBuilder()
+	if aj.SignatureScheme != "" {
+		scheme := SignatureSchemeFromString(aj.SignatureScheme)
+		if scheme == 0 {
+			return fmt.Errorf("signature_scheme: %w %q",
+				ErrUnsupportedScheme, aj.SignatureScheme)
+		}
+		b.Scheme(scheme)
+	}
+
+	block, _ := pem.Decode([]byte(aj.PublicKey))
+	if block == nil {
+		return errors.New("public_key: expected PEM encoded public key")
+	}
+	if block.Type != "PUBLIC KEY" {
+		return fmt.Errorf("public_key: expected PEM block of type PUBLIC KEY; got %s",
+			block.Type)
+	}
+	pk, err := parsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("public_key: %w", err)
+	}
+
+	a2, err := b.TLSKey(pk).
+		DNS(aj.DNS...).
+		DNSWildcard(aj.DNSWildcard...).
+		ENS(aj.ENS...).
+		IP4(aj.IPv4...).
+		IP6(aj.IPv6...).
+		Email(aj.Email...).
+		Build()
+	if err != nil {
+		return err
+	}
+	for _, c := range aj.Unknown {
+		a2.Claims.Unknown = append(a2.Claims.Unknown, UnknownClaim{c.Type, c.Info})
+	}
+
+	// Round trip through the binary encoding, so that the claims are
+	// sorted as they would be after parsing.
+	buf, err := a2.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("unknown_claims: %w", err)
+	}
+	return a.UnmarshalBinary(buf)
+}
+
+// JSON encoding of a MerkleTreeProof, for instance
+//
+//	{
+//	  "issuer_id": "my-mtc-ca",
+//	  "batch": 2,
+//	  "index": 0,
+//	  "path": ["ALF9+NkJ/T53AFSGoWygD9ya84+SojNRNZ/UINny73g="]
+//	}
+//
+// The path is a list of base64 encoded hashes, from the leaf up.
+type merkleTreeProofJSON struct {
+	IssuerId    string   `json:"issuer_id"`
+	BatchNumber uint32   `json:"batch"`
+	Index       uint64   `json:"index"`
+	Path        []string `json:"path"`
+}
+
+func (p *MerkleTreeProof) MarshalJSON() ([]byte, error) {
+	ret := merkleTreeProofJSON{
+		IssuerId:    p.anchor.issuerId,
+		BatchNumber: p.anchor.batchNumber,
+		Index:       p.index,
+		Path:        make([]string, 0, len(p.path)/HashLen),
+	}
+	for i := 0; i+HashLen <= len(p.path); i += HashLen {
+		ret.Path = append(ret.Path,
+			base64.StdEncoding.EncodeToString(p.path[i:i+HashLen]))
+	}
+	return json.Marshal(ret)
+}
+
+// Parses a proof in the JSON format written by MarshalJSON. Errors
+// mention the offending field.
+func (p *MerkleTreeProof) UnmarshalJSON(data []byte) error {
+	var pj merkleTreeProofJSON
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&pj); err != nil {
+		return err
+	}
+
+	if len(pj.IssuerId) == 0 || len(pj.IssuerId) > 32 {
+		return errors.New("issuer_id: must be between 1 and 32 bytes")
+	}
+	path := make([]byte, 0, len(pj.Path)*HashLen)
+	for i, h := range pj.Path {
+		buf, err := base64.StdEncoding.DecodeString(h)
+		if err != nil {
+			return fmt.Errorf("path[%d]: %w", i, err)
+		}
+		if len(buf) != HashLen {
+			return fmt.Errorf("path[%d]: expected %d bytes; got %d",
+				i, HashLen, len(buf))
+		}
+		path = append(path, buf...)
+	}
+	if len(path) > 65535 {
+		return errors.New("path: too long")
+	}
+
+	*p = MerkleTreeProof{
+		anchor: &MerkleTreeTrustAnchor{
+			issuerId:    pj.IssuerId,
+			batchNumber: pj.BatchNumber,
+		},
+		index: pj.Index,
+		path:  path,
+	}
+	return nil
+}
+
+// Parses a PKIX public key, including Dilithium5 keys as written by
+// MarshalPKIXVerifier.
+func parsePKIXPublicKey(der []byte) (crypto.PublicKey, error) {
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	rest, err := asn1.Unmarshal(der, &spki)
+	if err == nil && len(rest) == 0 &&
+		spki.Algorithm.Algorithm.Equal(oidDilithium5r3) {
+		v, err := UnmarshalVerifier(TLSDilitihium5r3, spki.PublicKey.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return VerifierPublicKey(v)
+	}
+	return x509.ParsePKIXPublicKey(der)
+}
@@ -1,23 +1,64 @@
 package mtc
 
 import (
+	"bufio"
 	"bytes"
+	"cmp"
 	"crypto"
 	"crypto/sha256"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"math/bits"
 	"net"
+	"net/url"
 	"regexp"
+	"runtime"
 	"slices"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/cryptobyte"
 )
 
-// Public parameters of a Merkle Tree CA
+// Public parameters of a Merkle Tree CA. Encoded as
+//
+//	struct {
+//	    opaque issuer_id<1..32>;
+//	    SignatureScheme signature_scheme;
+//	    opaque public_key<0..2^16-1>;
+//	    uint64 start_time;
+//	    uint64 batch_duration;
+//	    uint64 lifetime;
+//	    uint64 validity_window_size;
+//	    uint64 storage_window_size;
+//	    opaque http_server<0..2^16-1>;
+//	    CAParamsFields fields; // optional
+//	} CAParams;
+//
+//	struct {
+//	    uint16 version = 1;
+//	    CAParamsField fields<0..2^16-1>;
+//	} CAParamsFields;
+//
+//	struct {
+//	    uint16 type;
+//	    opaque data<0..2^16-1>;
+//	} CAParamsField;
+//
+// All fields up to http_server are mandatory. Later additions are fields
+// in CAParamsFields, in increasing order of type, so that older readers
+// can skip those they don't know. The fields are omitted if there are
+// none, which gives the encoding from before they were introduced.
+//
+// A CA with a LeafEncoding other than AbridgedAssertionLeaf uses version 2
+// of CAParamsFields instead, with the same layout. Readers that don't know
+// about leaf encodings would compute the wrong leaves, so they have to
+// reject these parameters instead of skipping the field.
 type CAParams struct {
 	IssuerId           string
 	PublicKey          Verifier
@@ -27,10 +68,94 @@ type CAParams struct {
 	ValidityWindowSize uint64
 	StorageWindowSize  uint64
 	HttpServer         string
+
+	// Changes to BatchDuration after StartTime, in chronological order.
+	// Batches before a change keep their original timing. The validity
+	// and storage windows are counted in batches, so after a change,
+	// the lifetime of an assertion is ValidityWindowSize times the new
+	// batch duration. BatchDuration and Lifetime keep describing the
+	// batches at StartTime; see MaxLifetime. Optional.
+	//
+	// Like the other parameters, they're fixed when the CA is created:
+	// changing them changes the fingerprint, and so the CA.
+	BatchDurationChanges []BatchDurationChange
+
+	// Signature schemes the CA accepts for the public keys of subjects,
+	// in increasing order, so that subscribers can check before they
+	// submit. If empty, any scheme is accepted. Optional.
+	AllowedSubjectSchemes []SignatureScheme
+
+	// What the leaves of the Merkle tree of a batch commit to. See
+	// LeafEncoding. Defaults to AbridgedAssertionLeaf.
+	LeafEncoding LeafEncoding
+
+	// Fields in the encoding that this version of the package doesn't
+	// know about. They're kept, so that they survive a round trip.
+	UnknownFields []CAParamsField
+}
+
+// Field of the encoding of CAParams. See CAParams.
+type CAParamsField struct {
+	Type uint16
+	Data []byte
+}
+
+// Versions of CAParamsFields, and the types of the fields we know.
+const (
+	caParamsFieldsVersion = 1
+
+	// Used instead if the LeafEncoding isn't the default. See CAParams.
+	caParamsFieldsVersionLeafEncoding = 2
+
+	batchDurationChangesField  uint16 = 0
+	allowedSubjectSchemesField uint16 = 1
+	leafEncodingField          uint16 = 2
+)
+
+// Construction of the leaves of the Merkle tree of a batch.
+//
+// With AbridgedAssertionLeaf, as in the draft, each leaf is the hash of
+// an abridged assertion, so that checking a batch's tree requires all its
+// abridged assertions. With ClaimsHashLeaf, a leaf commits to the claims
+// hash of the assertion instead: the hash of its abridged subject and
+// claims, see AbridgedAssertion.ClaimsHash, so that the tree can be
+// recomputed from the claims hashes alone with ComputeTreeFromClaimsHashes.
+//
+// This gives no size saving. The CA publishes the same full abridged
+// assertions either way, and no claims hashes, and certificates are the
+// same size, as the authentication path only depends on the number of
+// assertions. The cost is on the side of the verifier, which hashes the
+// abridged assertion once more to get the claims hash, before hashing it
+// into the leaf.
+type LeafEncoding uint8
+
+const (
+	AbridgedAssertionLeaf LeafEncoding = iota
+	ClaimsHashLeaf
+)
+
+// Change of the CA's batch duration. See CAParams.BatchDurationChanges.
+type BatchDurationChange struct {
+	// Time from which the new batch duration is used. Must fall on the
+	// boundary between two batches under the previous batch duration.
+	EffectiveFrom uint64
+
+	BatchDuration uint64
+}
+
+// Part of the schedule of batches with a fixed batch duration.
+type scheduleSegment struct {
+	start      uint64 // time at which the first batch starts
+	duration   uint64
+	firstBatch uint64
 }
 
 const (
 	HashLen = 32
+
+	// Version of the encoding of CA parameters, assertions, certificates,
+	// and published batches. The CA publishes them under /mtc/v1.
+	WireFormatVersion = 1
 )
 
 type ClaimType uint16
@@ -41,15 +166,31 @@ const (
 	EnsClaimType
 	Ipv4ClaimType
 	Ipv6ClaimType
+
+	// Email addresses (RFC 822 names, as in S/MIME) are not part of the
+	// draft, so we use a codepoint far away from those that are.
+	EmailClaimType ClaimType = 0xfe01
 )
 
-// List of claims.
+// Claim types that are understood, instead of stored as UnknownClaim.
+var SupportedClaimTypes = []ClaimType{
+	DnsClaimType,
+	DnsWildcardClaimType,
+	Ipv4ClaimType,
+	Ipv6ClaimType,
+	EnsClaimType,
+	EmailClaimType,
+}
+
+// List of claims. Any combination is valid: an assertion doesn't need a DNS
+// or IP claim, and may for instance only have ENS claims.
 type Claims struct {
 	DNS         []string
 	DNSWildcard []string
-        ENS	    []string
+	ENS         []string
 	IPv4        []net.IP
 	IPv6        []net.IP
+	Email       []string
 	Unknown     []UnknownClaim
 }
 
@@ -112,12 +253,36 @@ const (
 	TLSECDSAWithP521AndSHA512 SignatureScheme = 0x0603
 	TLSEd25519                SignatureScheme = 0x0807
 
+	// Only available after the curve has been registered with
+	// RegisterBrainpoolCurve.
+	TLSECDSAWithBrainpoolP256r1AndSHA256 SignatureScheme = 0x081a
+	TLSECDSAWithBrainpoolP384r1AndSHA384 SignatureScheme = 0x081b
+	TLSECDSAWithBrainpoolP512r1AndSHA512 SignatureScheme = 0x081c
+
 	// Just for testing we use round 3 Dilithium5 with a codepoint in the
 	// private use region. For production SPHINCS⁺-128s would be a better
 	// choice.
 	TLSDilitihium5r3 SignatureScheme = 0xfe3c
 )
 
+// Signature schemes supported for subject public keys. The brainpool
+// schemes are not listed, as they require RegisterBrainpoolCurve.
+var SupportedSignatureSchemes = []SignatureScheme{
+	TLSPSSWithSHA256,
+	TLSPSSWithSHA384,
+	TLSPSSWithSHA512,
+	TLSECDSAWithP256AndSHA256,
+	TLSECDSAWithP384AndSHA384,
+	TLSECDSAWithP521AndSHA512,
+	TLSEd25519,
+	TLSDilitihium5r3,
+}
+
+// Signature schemes a CA can sign with. See GenerateSigningKeypair.
+var SupportedCASignatureSchemes = []SignatureScheme{
+	TLSDilitihium5r3,
+}
+
 type AbridgedTLSSubject struct {
 	SignatureScheme SignatureScheme
 	PublicKeyHash   [HashLen]byte
@@ -170,6 +335,17 @@ type ValidityWindow struct {
 	TreeHeads   []byte
 }
 
+// Validity window signed by the CA, encoded as in the draft:
+//
+//	struct {
+//	    ValidityWindow window;
+//	    opaque signature<0..2^16-1>;
+//	} SignedValidityWindow;
+//
+// The signature is over the LabeledValidityWindow, with the key in the
+// CA parameters. The window doesn't record the signature scheme: that's
+// the scheme of that key. A CA can't move to a key of another scheme
+// without new CA parameters, and so becoming a new trust anchor.
 type SignedValidityWindow struct {
 	ValidityWindow
 	Signature []byte
@@ -304,23 +480,54 @@ type Tree struct {
 	nLeaves uint64 // Number of assertions
 }
 
-// Write the tree to w
-func (t *Tree) WriteTo(w io.Writer) error {
-	var b cryptobyte.Builder
-	b.AddUint64(t.nLeaves)
-	buf, err := b.Bytes()
+// Write the tree to w, without copying it in memory first.
+// Implements io.WriterTo.
+func (t *Tree) WriteTo(w io.Writer) (int64, error) {
+	var header [8]byte
+	binary.BigEndian.PutUint64(header[:], t.nLeaves)
+	n1, err := w.Write(header[:])
 	if err != nil {
-		return err
+		return int64(n1), err
 	}
-	_, err = w.Write(buf)
+	n2, err := w.Write(t.buf)
+	return int64(n1 + n2), err
+}
+
+// Reads a tree, as written by WriteTo, from r. Implements io.ReaderFrom.
+// Unlike UnmarshalBinary, doesn't require the whole encoding in memory
+// besides the tree itself.
+func (t *Tree) ReadFrom(r io.Reader) (int64, error) {
+	var header [8]byte
+	n1, err := io.ReadFull(r, header[:])
 	if err != nil {
-		return err
+		return int64(n1), ErrTruncated
 	}
-	_, err = w.Write(t.buf)
-	if err != nil {
-		return err
+	nLeaves := binary.BigEndian.Uint64(header[:])
+	size, ok := treeSize(nLeaves)
+	if !ok {
+		return int64(n1), ErrTruncated
 	}
-	return nil
+
+	// Grow the buffer as we read, instead of trusting nLeaves up front.
+	var buf bytes.Buffer
+	n2, err := io.CopyN(&buf, r, size)
+	if err != nil || n2 != size {
+		return int64(n1) + n2, ErrTruncated
+	}
+
+	t.nLeaves = nLeaves
+	t.buf = buf.Bytes()
+	return int64(n1) + n2, nil
+}
+
+// Returns the size of the nodes of a tree with nLeaves leaves, or false
+// if no stream could hold them.
+func treeSize(nLeaves uint64) (int64, bool) {
+	// A tree has fewer than 2*nLeaves + 64 nodes.
+	if nLeaves > (math.MaxInt64/HashLen-64)/2 {
+		return 0, false
+	}
+	return int64(TreeNodeCount(nLeaves)) * HashLen, true
 }
 
 func (t *Tree) NodeCount() uint {
@@ -354,9 +561,11 @@ func (t *Tree) UnmarshalBinary(buf []byte) error {
 		return ErrTruncated
 	}
 
-	nNodes := TreeNodeCount(t.nLeaves)
-
-	if !s.ReadBytes(&t.buf, int(nNodes)*HashLen) {
+	size, ok := treeSize(t.nLeaves)
+	if !ok || size > int64(len(s)) {
+		return ErrTruncated
+	}
+	if !s.ReadBytes(&t.buf, int(size)) {
 		return ErrTruncated
 	}
 	if !s.Empty() {
@@ -372,13 +581,7 @@ func (c *BikeshedCertificate) MarshalBinary() ([]byte, error) {
 		return nil, fmt.Errorf("Failed to marshal Assertion: %w", err)
 	}
 	b.AddBytes(buf)
-	b.AddUint16(uint16(c.Proof.TrustAnchor().ProofType()))
-	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
-		b.AddBytes(c.Proof.TrustAnchor().Info())
-	})
-	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-		b.AddBytes(c.Proof.Info())
-	})
+	marshalProof(&b, c.Proof)
 	return b.Bytes()
 }
 
@@ -388,6 +591,39 @@ func (c *BikeshedCertificate) UnmarshalBinary(data []byte) error {
 	if err != nil {
 		return fmt.Errorf("Failed to unmarshal Assertion: %w", err)
 	}
+	c.Proof, err = unmarshalProof(&s)
+	if err != nil {
+		return err
+	}
+	if !s.Empty() {
+		return ErrExtraBytes
+	}
+	return nil
+}
+
+// Returns an identifier of this particular certificate: the SHA-256 hash
+// of its encoding, as sha256:<hex>. Unlike the key of the assertion, it
+// differs between certificates for the same assertion in different
+// batches.
+func (c *BikeshedCertificate) Fingerprint() (string, error) {
+	buf, err := c.MarshalBinary()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(buf)), nil
+}
+
+func marshalProof(b *cryptobyte.Builder, p Proof) {
+	b.AddUint16(uint16(p.TrustAnchor().ProofType()))
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(p.TrustAnchor().Info())
+	})
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(p.Info())
+	})
+}
+
+func unmarshalProof(s *cryptobyte.String) (Proof, error) {
 	var (
 		typ        ProofType
 		proofInfo  cryptobyte.String
@@ -396,10 +632,7 @@ func (c *BikeshedCertificate) UnmarshalBinary(data []byte) error {
 	if !s.ReadUint16((*uint16)(&typ)) ||
 		!s.ReadUint8LengthPrefixed(&anchorInfo) ||
 		!s.ReadUint16LengthPrefixed(&proofInfo) {
-		return ErrTruncated
-	}
-	if !s.Empty() {
-		return ErrExtraBytes
+		return nil, ErrTruncated
 	}
 	switch typ {
 	case MerkleTreeProofType:
@@ -409,40 +642,110 @@ func (c *BikeshedCertificate) UnmarshalBinary(data []byte) error {
 		var issuerId []byte
 		if !anchorInfo.ReadUint8LengthPrefixed((*cryptobyte.String)(&issuerId)) ||
 			!anchorInfo.ReadUint32(&proof.anchor.batchNumber) {
-			return ErrTruncated
+			return nil, ErrTruncated
 		}
 		proof.anchor.issuerId = string(issuerId)
 		if !anchorInfo.Empty() {
-			return ErrExtraBytes
+			return nil, ErrExtraBytes
 		}
 		if !proofInfo.ReadUint64(&proof.index) ||
 			!proofInfo.ReadUint16LengthPrefixed((*cryptobyte.String)(&proof.path)) {
-			return ErrTruncated
+			return nil, ErrTruncated
 		}
 		if !proofInfo.Empty() {
-			return ErrExtraBytes
+			return nil, ErrExtraBytes
 		}
-		c.Proof = proof
-		return nil
+		return proof, nil
 	}
-	c.Proof = &UnknownProof{
+	return &UnknownProof{
 		anchor: &UnknownTrustAnchor{
 			typ:  typ,
 			info: []byte(anchorInfo),
 		},
 		info: []byte(proofInfo),
+	}, nil
+}
+
+// Encodes the proof with its trust anchor, as it appears at the end of
+// a BikeshedCertificate.
+func (p *MerkleTreeProof) MarshalBinary() ([]byte, error) {
+	var b cryptobyte.Builder
+	marshalProof(&b, p)
+	return b.Bytes()
+}
+
+func (p *MerkleTreeProof) UnmarshalBinary(data []byte) error {
+	s := cryptobyte.String(data)
+	proof, err := unmarshalProof(&s)
+	if err != nil {
+		return err
+	}
+	if !s.Empty() {
+		return ErrExtraBytes
+	}
+	mtp, ok := proof.(*MerkleTreeProof)
+	if !ok {
+		return fmt.Errorf(
+			"Expected proof type %s; got %s",
+			MerkleTreeProofType,
+			proof.TrustAnchor().ProofType(),
+		)
 	}
+	*p = *mtp
 	return nil
 }
 
+// Returns the schedule of batches as segments, starting with the one
+// beginning at StartTime.
+func (p *CAParams) schedule() []scheduleSegment {
+	ret := []scheduleSegment{{
+		start:    p.StartTime,
+		duration: p.BatchDuration,
+	}}
+	for _, c := range p.BatchDurationChanges {
+		prev := ret[len(ret)-1]
+		ret = append(ret, scheduleSegment{
+			start:      c.EffectiveFrom,
+			duration:   c.BatchDuration,
+			firstBatch: prev.firstBatch + (c.EffectiveFrom-prev.start)/prev.duration,
+		})
+	}
+	return ret
+}
+
+// Returns the number of the batch whose period contains the given
+// timestamp, or -1 if it's before StartTime.
+func (p *CAParams) batchNumberAt(ts int64) int64 {
+	if ts < int64(p.StartTime) {
+		return -1
+	}
+	sched := p.schedule()
+	seg := sched[0]
+	for _, s := range sched[1:] {
+		if ts >= int64(s.start) {
+			seg = s
+		}
+	}
+	return int64(seg.firstBatch) + (ts-int64(seg.start))/int64(seg.duration)
+}
+
+// Returns the number of the batch whose period contains the given time.
+// Returns false if the time is before StartTime.
+func (p *CAParams) BatchNumberFor(dt time.Time) (uint32, bool) {
+	number := p.batchNumberAt(dt.Unix())
+	if number < 0 {
+		return 0, false
+	}
+	return uint32(number), true
+}
+
 // Batches that are expected to be available at this CA, at the given time.
 // The last few might not yet have been published.
 func (p *CAParams) StoredBatches(dt time.Time) BatchRange {
-	ts := dt.Unix()
-	if ts < int64(p.StartTime) {
+	currentNumber := p.batchNumberAt(dt.Unix())
+	if currentNumber < 0 {
 		return BatchRange{} // none
 	}
-	currentNumber := (ts - int64(p.StartTime)) / int64(p.BatchDuration)
 	start := currentNumber - int64(p.StorageWindowSize)
 	if start < 0 {
 		start = 0
@@ -453,27 +756,49 @@ func (p *CAParams) StoredBatches(dt time.Time) BatchRange {
 	}
 }
 
+// Returns the start and end of the period covered by the given batch.
+// The batch can be issued once that period has ended.
+func (p *CAParams) BatchTimeRange(number uint32) (start, end time.Time) {
+	sched := p.schedule()
+	seg := sched[0]
+	for _, s := range sched[1:] {
+		if uint64(number) >= s.firstBatch {
+			seg = s
+		}
+	}
+	startTs := seg.start + seg.duration*(uint64(number)-seg.firstBatch)
+	return time.Unix(int64(startTs), 0),
+		time.Unix(int64(startTs+seg.duration), 0)
+}
+
 // Returns the the time when the next batch starts.
 func (p *CAParams) NextBatchAt(dt time.Time) time.Time {
-	ts := dt.Unix()
-	currentNumber := (ts - int64(p.StartTime)) / int64(p.BatchDuration)
+	currentNumber := p.batchNumberAt(dt.Unix())
 	if currentNumber < 0 {
 		return time.Unix(int64(p.StartTime), 0)
 	}
 
-	return time.Unix(
-		int64(p.StartTime+p.BatchDuration*uint64(currentNumber+1)),
-		0,
-	)
+	_, end := p.BatchTimeRange(uint32(currentNumber))
+	return end
+}
+
+// Returns the longest lifetime of assertions issued by the CA: that of
+// the longest batch duration in its schedule. Equals Lifetime, unless
+// the batch duration changes. See BatchDurationChanges.
+func (p *CAParams) MaxLifetime() time.Duration {
+	var longest uint64
+	for _, s := range p.schedule() {
+		longest = max(longest, s.duration)
+	}
+	return time.Duration(p.ValidityWindowSize*longest) * time.Second
 }
 
 // Batches that are non-expired, and either issued or ready, at the given time.
 func (p *CAParams) ActiveBatches(dt time.Time) BatchRange {
-	ts := dt.Unix()
-	if ts < int64(p.StartTime) {
+	currentNumber := p.batchNumberAt(dt.Unix())
+	if currentNumber < 0 {
 		return BatchRange{} // none
 	}
-	currentNumber := (ts - int64(p.StartTime)) / int64(p.BatchDuration)
 	start := currentNumber - int64(p.ValidityWindowSize)
 	if start < 0 {
 		start = 0
@@ -502,6 +827,58 @@ func (p *CAParams) MarshalBinary() ([]byte, error) {
 	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
 		b.AddBytes([]byte(p.HttpServer))
 	})
+
+	fields := append([]CAParamsField(nil), p.UnknownFields...)
+	if len(p.BatchDurationChanges) != 0 {
+		var cb cryptobyte.Builder
+		for _, c := range p.BatchDurationChanges {
+			cb.AddUint64(c.EffectiveFrom)
+			cb.AddUint64(c.BatchDuration)
+		}
+		fields = append(fields, CAParamsField{
+			Type: batchDurationChangesField,
+			Data: cb.BytesOrPanic(),
+		})
+	}
+	if len(p.AllowedSubjectSchemes) != 0 {
+		var cb cryptobyte.Builder
+		for _, scheme := range p.AllowedSubjectSchemes {
+			cb.AddUint16(uint16(scheme))
+		}
+		fields = append(fields, CAParamsField{
+			Type: allowedSubjectSchemesField,
+			Data: cb.BytesOrPanic(),
+		})
+	}
+	version := uint16(caParamsFieldsVersion)
+	if p.LeafEncoding != AbridgedAssertionLeaf {
+		fields = append(fields, CAParamsField{
+			Type: leafEncodingField,
+			Data: []byte{uint8(p.LeafEncoding)},
+		})
+		version = caParamsFieldsVersionLeafEncoding
+	}
+	slices.SortFunc(fields, func(a, b CAParamsField) int {
+		return cmp.Compare(a.Type, b.Type)
+	})
+
+	// Omitted if empty, so that the encoding of CAParams without fields
+	// is the same as before fields were introduced.
+	if len(fields) != 0 {
+		b.AddUint16(version)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			for i, f := range fields {
+				if i > 0 && fields[i-1].Type == f.Type {
+					b.SetError(fmt.Errorf("Duplicate CAParams field %d", f.Type))
+					return
+				}
+				b.AddUint16(f.Type)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddBytes(f.Data)
+				})
+			}
+		})
+	}
 	return b.Bytes()
 }
 
@@ -527,20 +904,207 @@ func (p *CAParams) UnmarshalBinary(data []byte) error {
 		return ErrTruncated
 	}
 
+	p.BatchDurationChanges = nil
+	p.AllowedSubjectSchemes = nil
+	p.LeafEncoding = AbridgedAssertionLeaf
+	p.UnknownFields = nil
+	if !s.Empty() {
+		var version uint16
+		if !s.ReadUint16(&version) {
+			return ErrTruncated
+		}
+		if version == caParamsFieldsVersion ||
+			version == caParamsFieldsVersionLeafEncoding {
+			if err := p.unmarshalFields(&s); err != nil {
+				return err
+			}
+			// The leaf encoding is set exactly when the version says so,
+			// so that the encoding is unique.
+			leafEncodingSet := p.LeafEncoding != AbridgedAssertionLeaf
+			if leafEncodingSet != (version == caParamsFieldsVersionLeafEncoding) {
+				return fmt.Errorf(
+					"CAParams fields version %d doesn't match leaf encoding %s",
+					version, p.LeafEncoding)
+			}
+		} else {
+			return fmt.Errorf("Unsupported CAParams fields version %d", version)
+		}
+	}
+
 	if !s.Empty() {
 		return ErrExtraBytes
 	}
 
 	p.IssuerId = string(issuerBuf)
 	p.HttpServer = string(httpServerBuf)
+	// The public key is tagged with its signature scheme, so that we can
+	// reject schemes we don't support, instead of misparsing the key.
 	p.PublicKey, err = UnmarshalVerifier(sigScheme, pkBuf)
 	if err != nil {
-		return err
+		return fmt.Errorf("parsing CA public key: %w", err)
 	}
 
 	return p.Validate()
 }
 
+func (p *CAParams) unmarshalFields(s *cryptobyte.String) error {
+	var fields cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&fields) {
+		return ErrTruncated
+	}
+	if fields.Empty() {
+		// MarshalBinary omits an empty list.
+		return errors.New("CAParams fields can't be empty if present")
+	}
+	first := true
+	var previousType uint16
+	for !fields.Empty() {
+		var (
+			typ  uint16
+			data cryptobyte.String
+		)
+		if !fields.ReadUint16(&typ) || !fields.ReadUint16LengthPrefixed(&data) {
+			return ErrTruncated
+		}
+		if !first && previousType >= typ {
+			return errors.New("CAParams fields duplicated or not sorted")
+		}
+		first = false
+		previousType = typ
+
+		switch typ {
+		case batchDurationChangesField:
+			if err := p.unmarshalBatchDurationChanges(data); err != nil {
+				return err
+			}
+		case allowedSubjectSchemesField:
+			if err := p.unmarshalAllowedSubjectSchemes(data); err != nil {
+				return err
+			}
+		case leafEncodingField:
+			if !data.ReadUint8((*uint8)(&p.LeafEncoding)) {
+				return ErrTruncated
+			}
+			if !data.Empty() {
+				return ErrExtraBytes
+			}
+			if p.LeafEncoding == AbridgedAssertionLeaf {
+				// MarshalBinary omits the default.
+				return errors.New("leaf encoding can't be the default if present")
+			}
+		default:
+			p.UnknownFields = append(p.UnknownFields, CAParamsField{
+				Type: typ,
+				Data: append([]byte(nil), data...),
+			})
+		}
+	}
+	return nil
+}
+
+func (p *CAParams) unmarshalBatchDurationChanges(changes cryptobyte.String) error {
+	if changes.Empty() {
+		return errors.New("batch duration changes can't be empty if present")
+	}
+	for !changes.Empty() {
+		var c BatchDurationChange
+		if !changes.ReadUint64(&c.EffectiveFrom) ||
+			!changes.ReadUint64(&c.BatchDuration) {
+			return ErrTruncated
+		}
+		p.BatchDurationChanges = append(p.BatchDurationChanges, c)
+	}
+	return nil
+}
+
+func (p *CAParams) unmarshalAllowedSubjectSchemes(schemes cryptobyte.String) error {
+	if schemes.Empty() {
+		return errors.New("allowed subject schemes can't be empty if present")
+	}
+	for !schemes.Empty() {
+		var scheme SignatureScheme
+		if !schemes.ReadUint16((*uint16)(&scheme)) {
+			return ErrTruncated
+		}
+		p.AllowedSubjectSchemes = append(p.AllowedSubjectSchemes, scheme)
+	}
+	return nil
+}
+
+// Returns the base URL of the CA's HTTP server. HttpServer is usually
+// a host with an optional path, such as "ca.example.com/path", for which
+// https is implied, but an absolute http or https URL is accepted too.
+// Fails if it's not a well-formed URL with a valid host.
+func (p *CAParams) HttpServerURL() (*url.URL, error) {
+	s := p.HttpServer
+	if s == "" {
+		return nil, errors.New("CA has no http_server")
+	}
+	if !strings.Contains(s, "://") {
+		s = "https://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("http_server %q is not a valid URL: %w",
+			p.HttpServer, err)
+	}
+	switch {
+	case u.Scheme != "https" && u.Scheme != "http":
+		return nil, fmt.Errorf("http_server %q has unsupported scheme %q",
+			p.HttpServer, u.Scheme)
+	case u.Host == "":
+		return nil, fmt.Errorf("http_server %q is missing a host", p.HttpServer)
+	case u.User != nil:
+		return nil, fmt.Errorf("http_server %q can't contain credentials",
+			p.HttpServer)
+	case u.RawQuery != "" || u.ForceQuery || u.Fragment != "":
+		return nil, fmt.Errorf("http_server %q can't have a query or fragment",
+			p.HttpServer)
+	}
+	if host := u.Hostname(); net.ParseIP(host) == nil {
+		if _, err := sortAndCheckDomainNames([]string{host}); err != nil {
+			return nil, fmt.Errorf("http_server %q has an invalid host: %w",
+				p.HttpServer, err)
+		}
+	}
+	return u, nil
+}
+
+// Returns an identifier of the CA parameters: the SHA-256 hash of their
+// encoding, as sha256:<hex>. A relying party that fetches the parameters
+// over the network can pin it, see VerifyOptions.CAFingerprint.
+func (p *CAParams) Fingerprint() (string, error) {
+	buf, err := p.MarshalBinary()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(buf)), nil
+}
+
+// Checks that the CA parameters have the given fingerprint, as returned
+// by Fingerprint. Returns an error wrapping ErrCAFingerprintMismatch if not.
+func (p *CAParams) CheckFingerprint(fingerprint string) error {
+	got, err := p.Fingerprint()
+	if err != nil {
+		return fmt.Errorf("computing fingerprint of CA parameters: %w", err)
+	}
+	if got != fingerprint {
+		return fmt.Errorf("%w: %s has fingerprint %s, not %s",
+			ErrCAFingerprintMismatch, p.IssuerId, got, fingerprint)
+	}
+	return nil
+}
+
+// Returns whether the CA accepts subject keys for the signature scheme.
+// See AllowedSubjectSchemes.
+func (p *CAParams) AllowsSubjectScheme(scheme SignatureScheme) bool {
+	if len(p.AllowedSubjectSchemes) == 0 {
+		return true
+	}
+	_, ok := slices.BinarySearch(p.AllowedSubjectSchemes, scheme)
+	return ok
+}
+
 func (p *CAParams) Validate() error {
 	if len(p.IssuerId) > 32 {
 		return errors.New("issuer_id must be 32 bytes or less")
@@ -548,6 +1112,9 @@ func (p *CAParams) Validate() error {
 	if len(p.IssuerId) == 0 {
 		return errors.New("issuer_id can't be empty")
 	}
+	if p.BatchDuration == 0 {
+		return errors.New("batch_duration can't be zero")
+	}
 	if p.Lifetime%p.BatchDuration != 0 {
 		return errors.New("lifetime must be a multiple of batch_duration")
 	}
@@ -557,10 +1124,45 @@ func (p *CAParams) Validate() error {
 	if p.StorageWindowSize < 2*p.ValidityWindowSize {
 		return errors.New("storage_window_size < 2*validity_window_size")
 	}
+	prevStart, prevDuration := p.StartTime, p.BatchDuration
+	for _, c := range p.BatchDurationChanges {
+		if c.BatchDuration == 0 {
+			return errors.New("batch_duration can't be zero")
+		}
+		if c.EffectiveFrom <= prevStart {
+			return errors.New("batch duration changes must be in order")
+		}
+		if (c.EffectiveFrom-prevStart)%prevDuration != 0 {
+			return errors.New(
+				"batch duration change must start on a batch boundary",
+			)
+		}
+		prevStart, prevDuration = c.EffectiveFrom, c.BatchDuration
+	}
+	if p.HttpServer != "" {
+		if _, err := p.HttpServerURL(); err != nil {
+			return err
+		}
+	}
+	for i := 1; i < len(p.AllowedSubjectSchemes); i++ {
+		if p.AllowedSubjectSchemes[i-1] >= p.AllowedSubjectSchemes[i] {
+			return errors.New(
+				"allowed subject schemes must be sorted without duplicates",
+			)
+		}
+	}
+	if p.LeafEncoding > ClaimsHashLeaf {
+		return fmt.Errorf("unknown leaf encoding %d", p.LeafEncoding)
+	}
 	return nil
 }
 
 // Returns the roots of the validity window prior the epoch.
+//
+// The first ValidityWindowSize-1 windows cover batches before batch 0,
+// which don't exist. Their slots hold the root of an empty batch 0, and
+// batch 0 extends this window. Verifiers check these slots with
+// ValidityWindow.CheckPreEpoch.
 func (p *CAParams) PreEpochRoots() []byte {
 	b := Batch{
 		Number: 0,
@@ -585,6 +1187,8 @@ func (w *ValidityWindow) unmarshal(s *cryptobyte.String, p *CAParams) error {
 	return nil
 }
 
+// Parses the window, and checks it's signed by the CA's public key. Also
+// checks the slots for batches before batch 0, if any.
 func (w *SignedValidityWindow) UnmarshalBinary(data []byte, p *CAParams) error {
 	err := w.UnmarshalBinaryWithoutVerification(data, p)
 	if err != nil {
@@ -594,7 +1198,10 @@ func (w *SignedValidityWindow) UnmarshalBinary(data []byte, p *CAParams) error {
 	if err != nil {
 		return err
 	}
-	return p.PublicKey.Verify(toSign, w.Signature)
+	if err := p.PublicKey.Verify(toSign, w.Signature); err != nil {
+		return err
+	}
+	return w.ValidityWindow.CheckPreEpoch(p)
 }
 
 // Like UnmarshalBinary() but doesn't check the signature.
@@ -749,6 +1356,46 @@ func (s *TLSSubject) Verifier() (Verifier, error) {
 	return pk, nil
 }
 
+func (t ClaimType) String() string {
+	switch t {
+	case DnsClaimType:
+		return "dns"
+	case DnsWildcardClaimType:
+		return "dns_wildcard"
+	case Ipv4ClaimType:
+		return "ipv4"
+	case Ipv6ClaimType:
+		return "ipv6"
+	case EnsClaimType:
+		return "ens"
+	case EmailClaimType:
+		return "email"
+	default:
+		return fmt.Sprintf("ClaimType(%d)", t)
+	}
+}
+
+func (e LeafEncoding) String() string {
+	switch e {
+	case AbridgedAssertionLeaf:
+		return "abridged_assertion"
+	case ClaimsHashLeaf:
+		return "claims_hash"
+	default:
+		return fmt.Sprintf("LeafEncoding(%d)", e)
+	}
+}
+
+// Returns the LeafEncoding with the given name, as returned by String.
+func LeafEncodingFromString(s string) (LeafEncoding, error) {
+	for _, e := range []LeafEncoding{AbridgedAssertionLeaf, ClaimsHashLeaf} {
+		if e.String() == s {
+			return e, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown leaf encoding %q", s)
+}
+
 func (p ProofType) String() string {
 	switch p {
 	case MerkleTreeProofType:
@@ -762,6 +1409,10 @@ func (s SubjectType) String() string {
 	switch s {
 	case TLSSubjectType:
 		return "TLS"
+	case MultiTLSSubjectType:
+		return "MultiTLS"
+	case CompactTLSSubjectType:
+		return "CompactTLS"
 	default:
 		return fmt.Sprintf("SubjectType(%d)", s)
 	}
@@ -827,6 +1478,19 @@ func (a *Assertion) MarshalBinary() ([]byte, error) {
 	return b.Bytes()
 }
 
+// Returns the checksum of the assertion: the SHA-256 hash of its encoding
+// as returned by MarshalBinary. This is the checksum the queue of a CA
+// stores with each entry, and which `mtc new-assertion` prints, so it can
+// be computed independently to check what the CA queued.
+func (a *Assertion) Checksum() ([]byte, error) {
+	buf, err := a.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	ret := sha256.Sum256(buf)
+	return ret[:], nil
+}
+
 func (a *Assertion) UnmarshalBinary(data []byte) error {
 	s := cryptobyte.String(data)
 	err := a.unmarshal(&s)
@@ -857,9 +1521,36 @@ func (a *Assertion) unmarshal(s *cryptobyte.String) error {
 
 	switch subjectType {
 	case TLSSubjectType:
-		a.Subject = &TLSSubject{
+		// Check the subject_info now, so that Abridge can't fail later.
+		var (
+			info      = subjectInfo
+			scheme    uint16
+			publicKey cryptobyte.String
+		)
+		if !info.ReadUint16(&scheme) ||
+			!info.ReadUint16LengthPrefixed(&publicKey) {
+			return fmt.Errorf("Failed to unmarshal subject: %w", ErrTruncated)
+		}
+		if !info.Empty() {
+			return fmt.Errorf("Failed to unmarshal subject: %w", ErrExtraBytes)
+		}
+		a.Subject = &TLSSubject{
+			packed: []byte(subjectInfo),
+		}
+	case MultiTLSSubjectType:
+		subject := &MultiTLSSubject{
 			packed: []byte(subjectInfo),
 		}
+		if _, err := subject.Subjects(); err != nil {
+			return fmt.Errorf("Failed to unmarshal subject: %w", err)
+		}
+		a.Subject = subject
+	case CompactTLSSubjectType:
+		subject, err := unmarshalCompactTLSSubject(subjectInfo)
+		if err != nil {
+			return fmt.Errorf("Failed to unmarshal subject: %w", err)
+		}
+		a.Subject = subject
 	default:
 		a.Subject = &UnknownSubject{
 			typ:  subjectType,
@@ -933,6 +1624,18 @@ func (a *AbridgedAssertion) unmarshal(s *cryptobyte.String) error {
 		}
 		copy(subject.PublicKeyHash[:], pkHash)
 		a.Subject = &subject
+	case MultiTLSSubjectType:
+		var subject AbridgedMultiTLSSubject
+		if err := subject.unmarshal(subjectInfo); err != nil {
+			return fmt.Errorf("Failed to unmarshal subject: %w", err)
+		}
+		a.Subject = &subject
+	case CompactTLSSubjectType:
+		var subject AbridgedCompactTLSSubject
+		if err := subject.unmarshal(subjectInfo); err != nil {
+			return fmt.Errorf("Failed to unmarshal subject: %w", err)
+		}
+		a.Subject = &subject
 	default:
 		a.Subject = &UnknownSubject{
 			typ:  subjectType,
@@ -952,27 +1655,109 @@ func (t *Tree) Root() []byte {
 	return t.buf[len(t.buf)-HashLen : len(t.buf)]
 }
 
+// Returns the proofs for the assertions at the given indices in the tree
+// of this batch, in the same order, computed by the given number of
+// workers in parallel. If workers is not positive, uses one per CPU.
+//
+// Only reads from the tree, so other goroutines may use it concurrently.
+func (batch *Batch) MultiProofConcurrent(t *Tree, indices []uint64,
+	workers int) ([]*MerkleTreeProof, error) {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if workers > len(indices) {
+		workers = len(indices)
+	}
+
+	ret := make([]*MerkleTreeProof, len(indices))
+	errs := make([]error, len(indices))
+	todo := make(chan int)
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range todo {
+				path, err := t.AuthenticationPath(indices[i])
+				if err != nil {
+					errs[i] = fmt.Errorf("index %d: %w", indices[i], err)
+					continue
+				}
+				ret[i] = NewMerkleTreeProof(batch, indices[i], path)
+			}
+		}()
+	}
+
+	for i := range indices {
+		todo <- i
+	}
+	close(todo)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// Checks that the leaf at the given index in the tree of this batch is
+// the hash of aa, and that its authentication path recomputes to the
+// root stored in the tree.
+func (batch *Batch) CheckLeaf(t *Tree, index uint64, aa *AbridgedAssertion) error {
+	path, err := t.AuthenticationPath(index)
+	if err != nil {
+		return err
+	}
+
+	h := make([]byte, HashLen)
+	if err := aa.Hash(h, batch, index); err != nil {
+		return err
+	}
+	if !bytes.Equal(h, t.buf[index*HashLen:(index+1)*HashLen]) {
+		return fmt.Errorf("Leaf %d in tree is not the hash of the assertion", index)
+	}
+
+	if err := batch.CheckAuthenticationPathLength(t.nLeaves, path); err != nil {
+		return err
+	}
+	return batch.VerifyAuthenticationPath(index, path, t.Root(), aa)
+}
+
 // Return authentication path proving that the leaf at the given index
 // is included in the Merkle tree.
 func (t *Tree) AuthenticationPath(index uint64) ([]byte, error) {
-	if index >= t.nLeaves {
+	return ReadAuthenticationPath(bytes.NewReader(t.buf), t.nLeaves, index)
+}
+
+// Returns the authentication path for the leaf at the given index in a tree
+// with nLeaves leaves, whose nodes are laid out as in Tree and read from r.
+// Only the sibling nodes on the path are read.
+func ReadAuthenticationPath(r io.ReaderAt, nLeaves, index uint64) ([]byte, error) {
+	if index >= nLeaves {
 		return nil, errors.New("Tree index out of range")
 	}
 
+	var buf [HashLen]byte
 	ret := bytes.Buffer{}
-	offset := 0
-	nNodes := t.nLeaves
+	offset := int64(0) // offset of the current level
+	nNodes := nLeaves
 	for nNodes != 1 {
 		index ^= 1 // index of sibling
-		start := offset + int(HashLen*index)
-		_, _ = ret.Write(t.buf[start : start+HashLen])
+		_, err := r.ReadAt(buf[:], offset+int64(HashLen*index))
+		if err != nil {
+			return nil, err
+		}
+		_, _ = ret.Write(buf[:])
 
 		// Account for the empty node
 		if nNodes&1 == 1 {
 			nNodes++
 		}
 
-		offset += HashLen * int(nNodes)
+		offset += HashLen * int64(nNodes)
 		index >>= 1
 		nNodes >>= 1
 	}
@@ -989,7 +1774,8 @@ func (batch *Batch) hashLeaves(r io.Reader) ([]byte, error) {
 	var index uint64
 	hash := make([]byte, HashLen)
 
-	err := unmarshal(r, func(_ int, aa *AbridgedAssertion) error {
+	err := UnmarshalAbridgedAssertions(r, func(_ int,
+		aa *AbridgedAssertion) error {
 		err := aa.Hash(hash, batch, index)
 		if err != nil {
 			return err
@@ -1006,14 +1792,144 @@ func (batch *Batch) hashLeaves(r io.Reader) ([]byte, error) {
 	return ret.Bytes(), nil
 }
 
+// Header at the start of an abridged-assertions file.
+//
+// Files written before the header was introduced start directly with the
+// first abridged assertion. These are still accepted, see
+// ReadAbridgedAssertionsHeader.
+type AbridgedAssertionsHeader struct {
+	Version uint16
+
+	// Number of abridged assertions in the file.
+	Count uint64
+}
+
+const (
+	// Current version of the abridged-assertions file format.
+	AbridgedAssertionsVersion = 1
+
+	// Size of the marshalled AbridgedAssertionsHeader.
+	AbridgedAssertionsHeaderSize = 14
+)
+
+// Starts the header. As the first two bytes of a headerless file are the
+// subject type of its first abridged assertion, which is TLS (0) in
+// practice, the two are easily told apart.
+var abridgedAssertionsMagic = [4]byte{0xff, 'A', 'A', 'S'}
+
+func (h *AbridgedAssertionsHeader) MarshalBinary() ([]byte, error) {
+	var b cryptobyte.Builder
+	b.AddBytes(abridgedAssertionsMagic[:])
+	b.AddUint16(h.Version)
+	b.AddUint64(h.Count)
+	return b.Bytes()
+}
+
+func (h *AbridgedAssertionsHeader) UnmarshalBinary(data []byte) error {
+	s := cryptobyte.String(data)
+	var magic []byte
+	if !s.ReadBytes(&magic, len(abridgedAssertionsMagic)) ||
+		!s.ReadUint16(&h.Version) ||
+		!s.ReadUint64(&h.Count) {
+		return ErrTruncated
+	}
+	if !bytes.Equal(magic, abridgedAssertionsMagic[:]) {
+		return errors.New("Not an abridged-assertions header")
+	}
+	if h.Version != AbridgedAssertionsVersion {
+		return fmt.Errorf(
+			"Unsupported abridged-assertions version %d",
+			h.Version,
+		)
+	}
+	if !s.Empty() {
+		return ErrExtraBytes
+	}
+	return nil
+}
+
+// Reads the header of an abridged-assertions file from r, if present.
+//
+// Returns nil without consuming any input for a headerless file.
+func ReadAbridgedAssertionsHeader(r *bufio.Reader) (
+	*AbridgedAssertionsHeader, error) {
+	magic, err := r.Peek(len(abridgedAssertionsMagic))
+	if err == io.EOF || (err == nil &&
+		!bytes.Equal(magic, abridgedAssertionsMagic[:])) {
+		return nil, nil
+	}
+	if err == io.ErrUnexpectedEOF {
+		return nil, ErrTruncated
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, AbridgedAssertionsHeaderSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, ErrTruncated
+		}
+		return nil, err
+	}
+
+	var h AbridgedAssertionsHeader
+	if err := h.UnmarshalBinary(buf); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
 // Unmarshals AbridgedAssertions from r and calls f for each, with
 // the offset in the stream as first argument, and the abridged
 // assertion as second argument.
 //
-// Returns early one rror.
+// Skips the header, if present, and checks that the number of abridged
+// assertions matches the count declared in it. Offsets are from the start
+// of the stream, including the header.
+//
+// Returns early on error. If the stream ends within an abridged assertion,
+// as with a partial download, or r returns io.ErrUnexpectedEOF, the error
+// wraps ErrTruncated, and names the index and offset of that assertion.
 func UnmarshalAbridgedAssertions(r io.Reader,
 	f func(int, *AbridgedAssertion) error) error {
-	return unmarshal(r, f)
+	br := bufio.NewReader(r)
+	h, err := ReadAbridgedAssertionsHeader(br)
+	if err != nil {
+		return fmt.Errorf("reading header: %w", err)
+	}
+
+	if h == nil {
+		return unmarshal(br, 0, f)
+	}
+
+	var count uint64
+	err = unmarshal(br, AbridgedAssertionsHeaderSize,
+		func(offset int, aa *AbridgedAssertion) error {
+			count++
+			return f(offset, aa)
+		})
+	if err != nil {
+		return err
+	}
+
+	if count < h.Count {
+		return fmt.Errorf(
+			"%w: header declares %d abridged assertions, but found %d",
+			ErrTruncated,
+			h.Count,
+			count,
+		)
+	}
+	if count > h.Count {
+		return fmt.Errorf(
+			"%w: header declares %d abridged assertions, but found %d",
+			ErrExtraBytes,
+			h.Count,
+			count,
+		)
+	}
+	return nil
 }
 
 // Compute batch root from authentication path.
@@ -1026,6 +1942,11 @@ func (batch *Batch) ComputeRootFromAuthenticationPath(index uint64,
 		return nil, err
 	}
 
+	if len(path) > 64*HashLen {
+		return nil, fmt.Errorf("%w: %d bytes is more than 64 levels",
+			ErrAuthenticationPathLength, len(path))
+	}
+
 	level := uint8(0)
 	var left, right []byte
 	for len(path) != 0 {
@@ -1045,12 +1966,34 @@ func (batch *Batch) ComputeRootFromAuthenticationPath(index uint64,
 	}
 
 	if index != 0 {
-		return nil, fmt.Errorf("Authentication path too short")
+		return nil, fmt.Errorf("%w: too short for the index",
+			ErrAuthenticationPathLength)
 	}
 
 	return h, nil
 }
 
+// Returns the height of the tree of a batch with the given number of
+// leaves. That's the number of hashes in its authentication paths.
+func TreeHeight(nLeaves uint64) int {
+	if nLeaves <= 1 {
+		return 0
+	}
+	return bits.Len64(nLeaves - 1)
+}
+
+// Checks that path has the length of an authentication path in the tree
+// of the batch, if it has nLeaves leaves. ComputeRootFromAuthenticationPath
+// can't check this by itself, as the path doesn't record the leaf count.
+func (batch *Batch) CheckAuthenticationPathLength(nLeaves uint64, path []byte) error {
+	height := TreeHeight(nLeaves)
+	if len(path) != height*HashLen {
+		return fmt.Errorf("%w: %d bytes, but the tree of batch %d has height %d",
+			ErrAuthenticationPathLength, len(path), batch.Number, height)
+	}
+	return nil
+}
+
 // Check validity of authentication path.
 //
 // Return nil on valid authentication path.
@@ -1063,7 +2006,8 @@ func (batch *Batch) VerifyAuthenticationPath(index uint64, path, root []byte,
 	}
 
 	if !bytes.Equal(root, h) {
-		return fmt.Errorf("Authentication path invalid")
+		return fmt.Errorf("%w: batch %d, index %d",
+			ErrAuthenticationPathInvalid, batch.Number, index)
 	}
 
 	return nil
@@ -1121,6 +2065,87 @@ func (batch *Batch) ComputeTree(r io.Reader) (*Tree, error) {
 		return nil, fmt.Errorf("HashLeaves: %w", err)
 	}
 
+	return batch.computeTreeFromLeaves(leaves)
+}
+
+// Compute Merkle tree from a list of AbridgedAssertions in memory.
+//
+// The result is the same as that of ComputeTree on the concatenation of
+// the marshalled assertions, but this doesn't require a CA or
+// abridged-assertions file.
+func (batch *Batch) ComputeTreeFromAssertions(aas []AbridgedAssertion) (
+	*Tree, error) {
+	leaves := make([]byte, HashLen*len(aas))
+	for i := 0; i < len(aas); i++ {
+		err := aas[i].Hash(leaves[i*HashLen:(i+1)*HashLen], batch, uint64(i))
+		if err != nil {
+			return nil, fmt.Errorf("hashing assertion %d: %w", i, err)
+		}
+	}
+
+	return batch.computeTreeFromLeaves(leaves)
+}
+
+// Compute Merkle tree from the concatenated claims hashes of the assertions
+// of the batch, see AbridgedAssertion.ClaimsHash. Only for a CA with
+// ClaimsHashLeaf, for which the result is the same as that of
+// ComputeTreeFromAssertions.
+func (batch *Batch) ComputeTreeFromClaimsHashes(claimsHashes []byte) (
+	*Tree, error) {
+	if len(claimsHashes)%HashLen != 0 {
+		return nil, fmt.Errorf("Claims hashes aren't a multiple of %d bytes",
+			HashLen)
+	}
+	n := len(claimsHashes) / HashLen
+	leaves := make([]byte, len(claimsHashes))
+	for i := 0; i < n; i++ {
+		err := batch.HashLeafFromClaimsHash(
+			leaves[i*HashLen:(i+1)*HashLen],
+			uint64(i),
+			claimsHashes[i*HashLen:(i+1)*HashLen],
+		)
+		if err != nil {
+			return nil, fmt.Errorf("hashing leaf %d: %w", i, err)
+		}
+	}
+
+	return batch.computeTreeFromLeaves(leaves)
+}
+
+// Returns the root a CA publishes for the given batch if it issued exactly
+// the given assertions, so that a monitor can compare it to the validity
+// window.
+//
+// As the CA does when issuing, duplicate assertions are dropped, keeping
+// the first. The assertions must be in the order the CA put them in the
+// tree, which is the order they were queued, unless the CA uses another
+// ca.LeafOrder.
+func ExpectedRoot(params *CAParams, batch uint32,
+	assertions []AbridgedAssertion) ([]byte, error) {
+	seen := make(map[[HashLen]byte]struct{})
+	aas := make([]AbridgedAssertion, 0, len(assertions))
+	var key [HashLen]byte
+	for i := range assertions {
+		if err := assertions[i].Key(key[:]); err != nil {
+			return nil, fmt.Errorf("computing key of assertion %d: %w", i, err)
+		}
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		aas = append(aas, assertions[i])
+	}
+
+	b := Batch{CA: params, Number: batch}
+	tree, err := b.ComputeTreeFromAssertions(aas)
+	if err != nil {
+		return nil, err
+	}
+	return tree.Root(), nil
+}
+
+// Compute Merkle tree from the concatenated leaf hashes.
+func (batch *Batch) computeTreeFromLeaves(leaves []byte) (*Tree, error) {
 	nLeaves := uint64(len(leaves)) / uint64(HashLen)
 	buf := bytes.NewBuffer(leaves)
 
@@ -1172,6 +2197,252 @@ func (batch *Batch) ComputeTree(r io.Reader) (*Tree, error) {
 	return &Tree{buf: buf.Bytes(), nLeaves: nLeaves}, nil
 }
 
+// Storage for a tree being built by WriteTree, such as an *os.File.
+type TreeWriter interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// Computes the Merkle tree from a stream of AbridgedAssertions, like
+// ComputeTree, but writes it to w in the format of Tree.WriteTo instead of
+// keeping it in memory. Each level is computed from the previous one,
+// which is read back from w, so only a few nodes are in memory at a time.
+//
+// Returns the number of leaves and the root.
+func (batch *Batch) WriteTree(r io.Reader, w TreeWriter) (uint64, []byte, error) {
+	return batch.WriteTreeConcurrent(r, w, 1)
+}
+
+// Number of nodes WriteTreeConcurrent hashes at a time.
+const writeTreeChunkSize = 4096
+
+// Like WriteTree, but hashes the nodes of each level using the given
+// number of workers in parallel. If workers is not positive, uses
+// GOMAXPROCS. The tree doesn't depend on the number of workers.
+func (batch *Batch) WriteTreeConcurrent(r io.Reader, w TreeWriter,
+	workers int) (uint64, []byte, error) {
+	return batch.WriteTreeResumable(r, w, workers, TreeProgress{}, nil)
+}
+
+// How far WriteTreeResumable got: the number of leaves, and the number of
+// levels of the tree, starting with the leaves, written out completely.
+type TreeProgress struct {
+	Leaves uint64
+	Levels uint8
+}
+
+// Like WriteTreeConcurrent, but calls checkpoint, if not nil, each time
+// a level below the root has been written to w. If checkpoint returns an
+// error, stops with that error.
+//
+// If from is not the zero TreeProgress, continues where the call that
+// reported it left off, on the same w, without reading r. The levels
+// reported have to be on w: checkpoint could sync w, if it's a file.
+func (batch *Batch) WriteTreeResumable(r io.Reader, w TreeWriter,
+	workers int, from TreeProgress,
+	checkpoint func(TreeProgress) error) (uint64, []byte, error) {
+	const headerSize = 8
+
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	// Offset in w of the current level, and of the end of the tree.
+	offset := int64(headerSize)
+	end := offset
+
+	bw := bufio.NewWriter(io.NewOffsetWriter(w, end))
+	h := make([]byte, HashLen)
+	write := func(hs []byte) error {
+		_, err := bw.Write(hs)
+		end += int64(len(hs))
+		return err
+	}
+	hs := make([]byte, writeTreeChunkSize*HashLen)
+
+	// Hash the leaves, a chunk at a time. The parser reuses its buffers,
+	// so we keep the encoded assertions.
+	var (
+		nLeaves uint64
+		leaves  [][]byte
+	)
+	hashLeaves := func() error {
+		first := nLeaves - uint64(len(leaves))
+		err := parallelFor(len(leaves), workers, func(i int) error {
+			return batch.hashLeaf(hs[i*HashLen:(i+1)*HashLen],
+				first+uint64(i), leaves[i])
+		})
+		if err != nil {
+			return err
+		}
+		err = write(hs[:len(leaves)*HashLen])
+		leaves = leaves[:0]
+		return err
+	}
+	var (
+		level   uint8
+		nNodes  uint64
+		resumed bool // whether the current level was written before
+	)
+	if from.Levels == 0 {
+		err := UnmarshalAbridgedAssertions(r, func(_ int,
+			aa *AbridgedAssertion) error {
+			buf, err := aa.MarshalBinary()
+			if err != nil {
+				return err
+			}
+			leaves = append(leaves, buf)
+			nLeaves++
+			if len(leaves) == writeTreeChunkSize {
+				return hashLeaves()
+			}
+			return nil
+		})
+		if err == nil {
+			err = hashLeaves()
+		}
+		if err != nil {
+			return 0, nil, fmt.Errorf("hashing leaves: %w", err)
+		}
+
+		if nLeaves == 0 {
+			if err := batch.hashEmpty(h, 0, 0); err != nil {
+				return 0, nil, err
+			}
+			if err := write(h); err != nil {
+				return 0, nil, err
+			}
+		}
+		nNodes = nLeaves
+	} else {
+		// Skip to the last level that was written, which can't be the root.
+		nLeaves = from.Leaves
+		nNodes = nLeaves
+		for ; level < from.Levels-1 && nNodes > 1; level++ {
+			nNodes += nNodes & 1
+			offset += int64(nNodes * HashLen)
+			nNodes >>= 1
+		}
+		if nNodes <= 1 {
+			return 0, nil, fmt.Errorf(
+				"Tree of %d leaves has no level %d to resume from",
+				from.Leaves, from.Levels-1,
+			)
+		}
+		end = offset + int64((nNodes+nNodes&1)*HashLen)
+		bw = bufio.NewWriter(io.NewOffsetWriter(w, end))
+		resumed = true
+	}
+
+	// Hash up the tree
+	children := make([]byte, 2*writeTreeChunkSize*HashLen)
+	for nNodes > 1 {
+		// Add empty node if number of nodes on this level is odd
+		if nNodes&1 == 1 {
+			if !resumed {
+				if err := batch.hashEmpty(h, nNodes, level); err != nil {
+					return 0, nil, err
+				}
+				if err := write(h); err != nil {
+					return 0, nil, err
+				}
+			}
+			nNodes++
+		}
+
+		// The level we're about to read has to be written out completely.
+		if err := bw.Flush(); err != nil {
+			return 0, nil, err
+		}
+		if checkpoint != nil && !resumed {
+			err := checkpoint(TreeProgress{Leaves: nLeaves, Levels: level + 1})
+			if err != nil {
+				return 0, nil, err
+			}
+		}
+		resumed = false
+
+		br := bufio.NewReader(io.NewSectionReader(w, offset, end-offset))
+		offset = end
+
+		nNodes >>= 1
+		level++
+
+		for first := uint64(0); first < nNodes; first += writeTreeChunkSize {
+			n := int(min(nNodes-first, writeTreeChunkSize))
+			if _, err := io.ReadFull(br, children[:2*n*HashLen]); err != nil {
+				return 0, nil, fmt.Errorf("reading back tree: %w", err)
+			}
+			err := parallelFor(n, workers, func(i int) error {
+				left := children[2*i*HashLen : (2*i+1)*HashLen]
+				right := children[(2*i+1)*HashLen : (2*i+2)*HashLen]
+				return batch.hashNode(hs[i*HashLen:(i+1)*HashLen],
+					left, right, first+uint64(i), level)
+			})
+			if err != nil {
+				return 0, nil, err
+			}
+			if err := write(hs[:n*HashLen]); err != nil {
+				return 0, nil, err
+			}
+		}
+		copy(h, hs[:HashLen])
+	}
+
+	if nLeaves == 1 {
+		copy(h, hs[:HashLen])
+	}
+
+	if err := bw.Flush(); err != nil {
+		return 0, nil, err
+	}
+
+	var header [headerSize]byte
+	binary.BigEndian.PutUint64(header[:], nLeaves)
+	if _, err := w.WriteAt(header[:], 0); err != nil {
+		return 0, nil, err
+	}
+
+	return nLeaves, h, nil
+}
+
+// Calls f for 0, ..., n-1, split into contiguous ranges over at most the
+// given number of goroutines. Returns the first error by index.
+func parallelFor(n, workers int, f func(int) error) error {
+	workers = min(workers, n)
+	if workers <= 1 {
+		for i := 0; i < n; i++ {
+			if err := f(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func(w int) {
+			defer wg.Done()
+			for i := n * w / workers; i < n*(w+1)/workers; i++ {
+				if err := f(i); err != nil {
+					errs[w] = err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Computes the key of the AbridgedAssertion used in the index.
 func (a *AbridgedAssertion) Key(out []byte) error {
 	buf, err := a.MarshalBinary()
@@ -1187,19 +2458,63 @@ func (a *AbridgedAssertion) Key(out []byte) error {
 // Computes the leaf hash of the AbridgedAssertion in the Merkle tree
 // computed for the batch.
 func (a *AbridgedAssertion) Hash(out []byte, batch *Batch, index uint64) error {
+	buf, err := a.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return batch.hashLeaf(out, index, buf)
+}
+
+// Returns the claims hash of the AbridgedAssertion: the SHA-256 hash of
+// its encoding, which covers the abridged subject and the claims. With
+// ClaimsHashLeaf, this is what the leaf commits to.
+func (a *AbridgedAssertion) ClaimsHash() ([]byte, error) {
+	buf, err := a.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.Sum256(buf)
+	return h[:], nil
+}
+
+// Like AbridgedAssertion.Hash, but with the assertion already marshalled.
+func (batch *Batch) hashLeaf(out []byte, index uint64, aa []byte) error {
+	if batch.CA.LeafEncoding == ClaimsHashLeaf {
+		claimsHash := sha256.Sum256(aa)
+		return batch.HashLeafFromClaimsHash(out, index, claimsHash[:])
+	}
+	return batch.hashLeafInput(out, 2, index, aa)
+}
+
+// Computes the leaf at the given index in the Merkle tree of the batch
+// from the claims hash of the assertion, see AbridgedAssertion.ClaimsHash.
+// Only for a CA with ClaimsHashLeaf.
+func (batch *Batch) HashLeafFromClaimsHash(out []byte, index uint64,
+	claimsHash []byte) error {
+	if batch.CA.LeafEncoding != ClaimsHashLeaf {
+		return fmt.Errorf("Leaves of CA %s don't commit to claims hashes",
+			batch.CA.IssuerId)
+	}
+	if len(claimsHash) != HashLen {
+		return fmt.Errorf("Claims hash has %d bytes instead of %d",
+			len(claimsHash), HashLen)
+	}
+	// A distinct first byte, so that the two kinds of leaves can't
+	// collide.
+	return batch.hashLeafInput(out, 3, index, claimsHash)
+}
+
+func (batch *Batch) hashLeafInput(out []byte, distinguisher uint8,
+	index uint64, data []byte) error {
 	var b cryptobyte.Builder
-	b.AddUint8(2)
+	b.AddUint8(distinguisher)
 	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
 		b.AddBytes([]byte(batch.CA.IssuerId))
 	})
 	b.AddUint32(batch.Number)
 	b.AddUint64(index)
-	buf, err := a.MarshalBinary()
-	if err != nil {
-		return err
-	}
-	b.AddBytes(buf)
-	buf, err = b.Bytes()
+	b.AddBytes(data)
+	buf, err := b.Bytes()
 	if err != nil {
 		return err
 	}
@@ -1211,6 +2526,22 @@ func (a *AbridgedAssertion) Hash(out []byte, batch *Batch, index uint64) error {
 
 var domainLabelRegex = regexp.MustCompile("^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?$")
 
+var (
+	ErrDomainNameTooLong   = errors.New("Domain name too long")
+	ErrDomainLabelTooLong  = errors.New("Label in domain name too long")
+	ErrTooManyDomainLabels = errors.New("Too many labels in domain name")
+)
+
+const (
+	// Maximum length of a domain name in a claim, and maximum number of
+	// labels in it. Checked whenever claims are built or parsed.
+	maxDomainNameLength = 253
+	maxDomainLabels     = 32
+
+	// Maximum length of a label in a domain name, set by DNS.
+	maxDomainLabelLength = 63
+)
+
 func (c Claims) String() string {
 	bits := []string{}
 	if len(c.DNS) != 0 {
@@ -1234,6 +2565,9 @@ func (c Claims) String() string {
 			bits = append(bits, ip.String())
 		}
 	}
+	if len(c.Email) != 0 {
+		bits = append(bits, c.Email...)
+	}
 	if len(c.Unknown) != 0 {
 		for _, claim := range c.Unknown {
 			bits = append(bits, fmt.Sprintf(
@@ -1245,6 +2579,113 @@ func (c Claims) String() string {
 	return strings.Join(bits, ", ")
 }
 
+// Returns the total number of claims, including unknown ones.
+func (c Claims) Count() int {
+	return len(c.DNS) + len(c.DNSWildcard) + len(c.ENS) + len(c.IPv4) +
+		len(c.IPv6) + len(c.Email) + len(c.Unknown)
+}
+
+// Returns whether the claims authorize the given email address.
+//
+// The domain part is compared case-insensitively, and the local part
+// exactly.
+func (c Claims) CoversEmail(addr string) bool {
+	addr, err := normalizeEmail(addr)
+	if err != nil {
+		return false
+	}
+	return slices.Contains(c.Email, addr)
+}
+
+// Checks the email address, and returns it with its domain lowercased.
+func normalizeEmail(addr string) (string, error) {
+	local, domain, ok := strings.Cut(addr, "@")
+	if !ok || strings.Contains(domain, "@") {
+		return "", fmt.Errorf("Email address must contain a single @: %s", addr)
+	}
+	if len(local) == 0 || len(local) > 64 {
+		return "", fmt.Errorf("Invalid local part in email address: %s", addr)
+	}
+	for _, r := range local {
+		if r <= ' ' || r >= 0x7f {
+			return "", fmt.Errorf(
+				"Local part of email address contains invalid characters: %s",
+				addr,
+			)
+		}
+	}
+	domain = strings.ToLower(domain)
+	if _, err := sortAndCheckDomainNames([]string{domain}); err != nil {
+		return "", fmt.Errorf("Invalid domain in email address %s: %w", addr, err)
+	}
+	return local + "@" + domain, nil
+}
+
+// Normalizes and sorts the email addresses.
+func sortAndCheckEmails(addrs []string) ([]string, error) {
+	ret := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		normalized, err := normalizeEmail(addr)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, normalized)
+	}
+	slices.Sort(ret)
+	for i := 1; i < len(ret); i++ {
+		if ret[i-1] == ret[i] {
+			return nil, errors.New("Duplicate email address")
+		}
+	}
+	return ret, nil
+}
+
+// Returns whether the claims authorize the given hostname or IP address.
+//
+// Hostnames are compared case-insensitively, ignoring a trailing dot.
+// A DNSWildcard claim for example.com covers exactly one additional
+// left-most label: it covers a.example.com, but neither example.com
+// itself nor a.b.example.com. IP addresses are only matched against the
+// IPv4 and IPv6 claims. ENS claims are not considered.
+func (c Claims) Covers(name string) bool {
+	if ip := net.ParseIP(name); ip != nil {
+		for _, ip2 := range c.IPv4 {
+			if ip.Equal(ip2) {
+				return true
+			}
+		}
+		for _, ip2 := range c.IPv6 {
+			if ip.Equal(ip2) {
+				return true
+			}
+		}
+		return false
+	}
+
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return false
+	}
+
+	for _, domain := range c.DNS {
+		if strings.EqualFold(name, domain) {
+			return true
+		}
+	}
+
+	label, parent, ok := strings.Cut(name, ".")
+	if !ok || label == "" || label == "*" {
+		return false
+	}
+	for _, domain := range c.DNSWildcard {
+		if strings.EqualFold(parent, domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
 // Checks whether the given strings are valid domain names, and sorts them
 // hierarchically.
 func sortAndCheckDomainNames(ds []string) ([]string, error) {
@@ -1254,13 +2695,19 @@ func sortAndCheckDomainNames(ds []string) ([]string, error) {
 		if len(domain) == 0 {
 			return nil, errors.New("Empty domain name")
 		}
-		if len(domain) >= 256 {
-			return nil, errors.New("Domain name too long")
+		if len(domain) > maxDomainNameLength {
+			return nil, fmt.Errorf("%w: %d bytes, but at most %d are allowed",
+				ErrDomainNameTooLong, len(domain), maxDomainNameLength)
 		}
 		splitDomain := strings.Split(domain, ".")
+		if len(splitDomain) > maxDomainLabels {
+			return nil, fmt.Errorf("%w: %d labels, but at most %d are allowed",
+				ErrTooManyDomainLabels, len(splitDomain), maxDomainLabels)
+		}
 		for _, label := range splitDomain {
-			if len(label) >= 64 {
-				return nil, errors.New("Label in domain name too long")
+			if len(label) > maxDomainLabelLength {
+				return nil, fmt.Errorf("%w: %d bytes, but at most %d are allowed",
+					ErrDomainLabelTooLong, len(label), maxDomainLabelLength)
 			}
 			if !domainLabelRegex.Match([]byte(label)) {
 				return nil, errors.New(
@@ -1290,6 +2737,11 @@ func sortAndCheckDomainNames(ds []string) ([]string, error) {
 	for _, splitDomain := range splitDomains {
 		ret = append(ret, strings.Join(splitDomain, "."))
 	}
+	for i := 1; i < len(ret); i++ {
+		if ret[i-1] == ret[i] {
+			return nil, errors.New("Duplicate domain name")
+		}
+	}
 
 	return ret, nil
 }
@@ -1313,14 +2765,11 @@ func (c *Claims) UnmarshalBinary(data []byte) error {
 			return ErrTruncated
 		}
 
-		if first {
-			first = false
-		} else {
-			if previousType >= claimType {
-				return errors.New("Claims duplicated or not sorted")
-			}
-			previousType = claimType
+		if !first && previousType >= claimType {
+			return errors.New("Claims duplicated or not sorted")
 		}
+		first = false
+		previousType = claimType
 
 		switch claimType {
 		case DnsClaimType, DnsWildcardClaimType, EnsClaimType:
@@ -1358,14 +2807,52 @@ func (c *Claims) UnmarshalBinary(data []byte) error {
 				return errors.New("Domains were not sorted")
 			}
 
-			if claimType == DnsClaimType {
+			switch claimType {
+			case DnsClaimType:
 				c.DNS = domains
-			} else  if claimType == DnsClaimType {
+			case DnsWildcardClaimType:
 				c.DNSWildcard = domains
-			} else { 
+			default:
 				c.ENS = domains
 			}
 
+		case EmailClaimType:
+			var (
+				packed cryptobyte.String
+				addrs  []string
+			)
+
+			if !claimInfo.ReadUint16LengthPrefixed(&packed) {
+				return ErrTruncated
+			}
+
+			if !claimInfo.Empty() {
+				return ErrExtraBytes
+			}
+
+			if packed.Empty() {
+				return errors.New("Email claim must list at least one address")
+			}
+
+			for !packed.Empty() {
+				var addr []byte
+				if !packed.ReadUint16LengthPrefixed((*cryptobyte.String)(&addr)) {
+					return ErrTruncated
+				}
+
+				addrs = append(addrs, string(addr))
+			}
+
+			sorted, err := sortAndCheckEmails(addrs)
+			if err != nil {
+				return err
+			}
+			if !slices.Equal(sorted, addrs) {
+				return errors.New("Email addresses were not normalized and sorted")
+			}
+
+			c.Email = addrs
+
 		case Ipv4ClaimType, Ipv6ClaimType:
 			var (
 				packed cryptobyte.String
@@ -1396,14 +2883,14 @@ func (c *Claims) UnmarshalBinary(data []byte) error {
 				if !packed.ReadBytes((*[]byte)(&ip), entrySize) {
 					return ErrTruncated
 				}
-				if first {
-					first = false
-				} else {
-					if slices.Compare(previousIp, ip) >= 0 {
-						return errors.New("IPs were not sorted")
-					}
-					previousIp = ip
+				if claimType == Ipv6ClaimType && ip.To4() != nil {
+					return ErrIPv4MappedAddress
+				}
+				if !first && slices.Compare(previousIp, ip) >= 0 {
+					return errors.New("IPs were not sorted")
 				}
+				first = false
+				previousIp = ip
 
 				ips = append(ips, ip)
 			}
@@ -1473,6 +2960,12 @@ func (c *Claims) MarshalBinary() ([]byte, error) {
 			if ipv4 {
 				ip = ip.To4()
 			} else {
+				// IPv4 addresses, including IPv4-mapped IPv6 addresses,
+				// belong in the IPv4 claim. Allowing them here would
+				// give the same address two encodings.
+				if ip.To4() != nil {
+					return ErrIPv4MappedAddress
+				}
 				ip = ip.To16()
 			}
 			if ip == nil {
@@ -1483,6 +2976,11 @@ func (c *Claims) MarshalBinary() ([]byte, error) {
 		sort.Slice(sorted, func(i, j int) bool {
 			return slices.Compare(sorted[i], sorted[j]) < 0
 		})
+		for i := 1; i < len(sorted); i++ {
+			if sorted[i-1].Equal(sorted[i]) {
+				return errors.New("Duplicate IP address")
+			}
+		}
 
 		if ipv4 {
 			b.AddUint16(uint16(Ipv4ClaimType))
@@ -1506,16 +3004,51 @@ func (c *Claims) MarshalBinary() ([]byte, error) {
 		return nil, err
 	}
 
+	marshalEmails := func() error {
+		if len(c.Email) == 0 {
+			return nil
+		}
+		sorted, err := sortAndCheckEmails(c.Email)
+		if err != nil {
+			return err
+		}
+
+		b.AddUint16(uint16(EmailClaimType))
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { // claim_info
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { // addresses
+				for _, addr := range sorted {
+					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+						b.AddBytes([]byte(addr))
+					})
+				}
+			})
+		})
+		return nil
+	}
+
+	// Unknown claims are interleaved with the claims in the private use
+	// region to keep the claims sorted by type.
+	private := []struct {
+		claimType ClaimType
+		marshal   func() error
+	}{
+		{EmailClaimType, marshalEmails},
+	}
 	for i := 0; i < len(c.Unknown); i++ {
 		claim := c.Unknown[i]
-		if i == 0 {
-			if claim.Type <= Ipv6ClaimType {
-				return nil, errors.New("Parseable UnknownClaim")
-			}
-		} else {
-			if claim.Type <= c.Unknown[i-1].Type {
-				return nil, errors.New("Duplicate or unsorted unknown claims")
+		if i != 0 && claim.Type <= c.Unknown[i-1].Type {
+			return nil, errors.New("Duplicate or unsorted unknown claims")
+		}
+		if slices.Contains(SupportedClaimTypes, claim.Type) ||
+			claim.Type <= Ipv6ClaimType {
+			return nil, errors.New("Parseable UnknownClaim")
+		}
+
+		for len(private) > 0 && private[0].claimType < claim.Type {
+			if err := private[0].marshal(); err != nil {
+				return nil, err
 			}
+			private = private[1:]
 		}
 
 		b.AddUint16(uint16(claim.Type))
@@ -1524,6 +3057,12 @@ func (c *Claims) MarshalBinary() ([]byte, error) {
 		})
 	}
 
+	for _, p := range private {
+		if err := p.marshal(); err != nil {
+			return nil, err
+		}
+	}
+
 	return b.Bytes()
 }
 
@@ -0,0 +1,216 @@
+package mtc
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// Subject type for an assertion that binds its claims to several TLS
+// subjects, for instance a classical and a post-quantum key. A relying
+// party accepts a handshake signed by any of them. The draft doesn't
+// define such a subject type, so we use a codepoint from the private use
+// region.
+const MultiTLSSubjectType SubjectType = 0xff00
+
+// Returned by NewMultiTLSSubject, and when unmarshalling a multi subject,
+// for a single or repeated subject.
+var ErrMultiSubjectCount = errors.New(
+	"Multi subject requires at least two distinct subjects")
+
+// Several TLS subjects. The subject_info is the concatenation of the
+// TLSSubjectInfo of each, in order:
+//
+//	struct {
+//	    TLSSubjectInfo subjects<0..2^16-1>;
+//	} MultiTLSSubjectInfo;
+//
+// where the length prefix is the one of subject_info itself.
+type MultiTLSSubject struct {
+	subjects []*TLSSubject
+	packed   []byte
+}
+
+// Abridged form of MultiTLSSubject: the concatenation of the
+// AbridgedTLSSubjectInfo of each subject, in the same order.
+type AbridgedMultiTLSSubject struct {
+	Subjects []AbridgedTLSSubject
+}
+
+// Returns a subject that binds an assertion to each of the given TLS
+// subjects. The order is kept, and is part of the assertion.
+func NewMultiTLSSubject(subjects ...*TLSSubject) (*MultiTLSSubject, error) {
+	if len(subjects) < 2 {
+		return nil, ErrMultiSubjectCount
+	}
+	var b cryptobyte.Builder
+	for i, s := range subjects {
+		for _, s2 := range subjects[:i] {
+			if bytes.Equal(s.packed, s2.packed) {
+				return nil, ErrMultiSubjectCount
+			}
+		}
+		b.AddBytes(s.packed)
+	}
+	packed, err := b.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	if len(packed) > 65535 {
+		return nil, errors.New("Multi subject too large")
+	}
+	return &MultiTLSSubject{
+		subjects: subjects,
+		packed:   packed,
+	}, nil
+}
+
+// Returns the TLS subjects.
+func (s *MultiTLSSubject) Subjects() ([]*TLSSubject, error) {
+	if s.subjects != nil {
+		return s.subjects, nil
+	}
+
+	var ret []*TLSSubject
+	ss := cryptobyte.String(s.packed)
+	for !ss.Empty() {
+		var (
+			scheme    uint16
+			publicKey cryptobyte.String
+		)
+		start := ss
+		if !ss.ReadUint16(&scheme) ||
+			!ss.ReadUint16LengthPrefixed(&publicKey) {
+			return nil, ErrTruncated
+		}
+		packed := start[:len(start)-len(ss)]
+		for _, s2 := range ret {
+			if bytes.Equal(packed, s2.packed) {
+				return nil, ErrMultiSubjectCount
+			}
+		}
+		ret = append(ret, &TLSSubject{packed: packed})
+	}
+	if len(ret) < 2 {
+		return nil, ErrMultiSubjectCount
+	}
+
+	s.subjects = ret
+	return ret, nil
+}
+
+// Returns a verifier for each of the subjects. A handshake signature
+// should be accepted if any of them accepts it.
+func (s *MultiTLSSubject) Verifiers() ([]Verifier, error) {
+	subjects, err := s.Subjects()
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]Verifier, 0, len(subjects))
+	for i, subj := range subjects {
+		v, err := subj.Verifier()
+		if err != nil {
+			return nil, fmt.Errorf("subject %d: %w", i, err)
+		}
+		ret = append(ret, v)
+	}
+	return ret, nil
+}
+
+func (s *MultiTLSSubject) Type() SubjectType { return MultiTLSSubjectType }
+
+func (s *MultiTLSSubject) Info() []byte {
+	return s.packed
+}
+
+// The subjects are checked by NewMultiTLSSubject and when unmarshalling,
+// so unlike Subjects, this can't fail. Only a zero MultiTLSSubject, which
+// has no subjects, gives an AbridgedMultiTLSSubject without subjects.
+func (s *MultiTLSSubject) Abridge() AbridgedSubject {
+	ret := &AbridgedMultiTLSSubject{
+		Subjects: make([]AbridgedTLSSubject, 0, len(s.subjects)),
+	}
+	for _, subj := range s.subjects {
+		ret.Subjects = append(ret.Subjects,
+			*subj.Abridge().(*AbridgedTLSSubject))
+	}
+	return ret
+}
+
+func (s *AbridgedMultiTLSSubject) Type() SubjectType { return MultiTLSSubjectType }
+
+func (s *AbridgedMultiTLSSubject) Info() []byte {
+	var b cryptobyte.Builder
+	for _, subj := range s.Subjects {
+		b.AddBytes(subj.Info())
+	}
+	buf, _ := b.Bytes()
+	return buf
+}
+
+func (s *AbridgedMultiTLSSubject) unmarshal(info cryptobyte.String) error {
+	s.Subjects = nil
+	for !info.Empty() {
+		var subj AbridgedTLSSubject
+		if !info.ReadUint16((*uint16)(&subj.SignatureScheme)) ||
+			!info.CopyBytes(subj.PublicKeyHash[:]) {
+			return ErrTruncated
+		}
+		for _, subj2 := range s.Subjects {
+			if subj == subj2 {
+				return ErrMultiSubjectCount
+			}
+		}
+		s.Subjects = append(s.Subjects, subj)
+	}
+	if len(s.Subjects) < 2 {
+		return ErrMultiSubjectCount
+	}
+	return nil
+}
+
+// Returns the verifiers for the public keys the assertion binds its claims
+// to: one for a TLS or compact TLS subject, and one for each of the
+// subjects of a MultiTLSSubject. A handshake signed with any of them is acceptable.
+func (a *Assertion) Verifiers() ([]Verifier, error) {
+	switch subj := a.Subject.(type) {
+	case *TLSSubject:
+		v, err := subj.Verifier()
+		if err != nil {
+			return nil, err
+		}
+		return []Verifier{v}, nil
+	case *MultiTLSSubject:
+		return subj.Verifiers()
+	case *CompactTLSSubject:
+		v, err := subj.Verifier()
+		if err != nil {
+			return nil, err
+		}
+		return []Verifier{v}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported subject type %s", a.Subject.Type())
+	}
+}
+
+// Checks the signature on a handshake by the subject of the assertion,
+// made with the given signature scheme. For a MultiTLSSubject, the
+// signature is checked against the subject with that scheme.
+func (a *Assertion) VerifySignature(scheme SignatureScheme, msg, sig []byte) error {
+	vs, err := a.Verifiers()
+	if err != nil {
+		return err
+	}
+	err = fmt.Errorf("Assertion has no subject with scheme %s", scheme)
+	for _, v := range vs {
+		if v.Scheme() != scheme {
+			continue
+		}
+		if err = v.Verify(msg, sig); err == nil {
+			return nil
+		}
+	}
+	return err
+}
@@ -2,22 +2,85 @@ package main
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
+	"math/big"
+	"net"
 	"net/http"
 	"os"
+	gopath "path"
 
 	"os/exec"
+	"strconv"
 	"strings"
+	"time"
 
 	"errors"
 	"tideland.dev/go/wait"
 
+	"github.com/bwesterb/mtc"
+	"github.com/bwesterb/mtc/ca"
+
 	"github.com/gorilla/mux"
 )
 
+var (
+	caPath = flag.String("ca-path", ".", "path to CA state")
+
+	wellKnownPath = flag.String(
+		"well-known-path",
+		"/mtc/v1",
+		"path at which the CA's ca-params and batches are served",
+	)
+
+	corsOrigin = flag.String(
+		"cors-origin",
+		"",
+		"value of Access-Control-Allow-Origin for the read endpoints; "+
+			"CORS is disabled if empty",
+	)
+
+	listenAddr = flag.String("listen", ":4433", "address to listen on")
+
+	tlsCert = flag.String(
+		"tls-cert",
+		"",
+		"path to PEM encoded TLS certificate chain; "+
+			"plain HTTP is served if neither this nor -tls-self-signed is set",
+	)
+	tlsKey        = flag.String("tls-key", "", "path to PEM encoded private key for -tls-cert")
+	tlsSelfSigned = flag.Bool(
+		"tls-self-signed",
+		false,
+		"serve TLS with a fresh self-signed certificate for localhost, for development",
+	)
+
+	issueBatches = flag.Bool(
+		"issue",
+		false,
+		"issue each batch when it's ready, instead of relying on cron to run `mtc ca issue`",
+	)
+
+	hstsMaxAge = flag.Duration(
+		"hsts-max-age",
+		365*24*time.Hour,
+		"max-age of Strict-Transport-Security on the read endpoints when serving TLS; "+
+			"disabled if zero",
+	)
+)
+
 type ThrottledHandler struct {
 	throttle *wait.Throttle
 	handler  http.Handler
@@ -43,6 +106,270 @@ func (h *ThrottledHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	h.throttle.Process(context.Background(), evt)
 }
 
+// Sets CORS headers on the response, if enabled, so that browser-based
+// verifiers can fetch the CA's public data. Answers preflight requests.
+func WithCORS(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if *corsOrigin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", *corsOrigin)
+			w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+			w.Header().Set("Access-Control-Max-Age", "86400")
+			if *corsOrigin != "*" {
+				w.Header().Add("Vary", "Origin")
+			}
+		}
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// Sets Strict-Transport-Security on responses served over TLS, so that
+// clients don't fall back to fetching the CA's public data over plain HTTP.
+func WithHSTS(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && *hstsMaxAge > 0 {
+			w.Header().Set("Strict-Transport-Security",
+				fmt.Sprintf("max-age=%d", int64(hstsMaxAge.Seconds())))
+		}
+		handler(w, r)
+	}
+}
+
+// Returns the TLS configuration set by the flags, or nil to serve
+// plain HTTP.
+func tlsConfig() (*tls.Config, error) {
+	switch {
+	case *tlsSelfSigned && *tlsCert != "":
+		return nil, errors.New("-tls-self-signed and -tls-cert are mutually exclusive")
+	case *tlsSelfSigned:
+		cert, err := selfSignedCertificate()
+		if err != nil {
+			return nil, fmt.Errorf("creating self-signed certificate: %w", err)
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+	case *tlsCert != "":
+		if *tlsKey == "" {
+			return nil, errors.New("-tls-cert requires -tls-key")
+		}
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+	case *tlsKey != "":
+		return nil, errors.New("-tls-key requires -tls-cert")
+	}
+	return nil, nil
+}
+
+// Creates a self-signed certificate for localhost, valid for a day.
+func selfSignedCertificate() (tls.Certificate, error) {
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &sk.PublicKey, sk)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: sk}, nil
+}
+
+// Writes out the file at path relative to the CA's public www/mtc/v1 folder.
+func serveCAFile(w http.ResponseWriter, r *http.Request, path string) {
+	buf, err := os.ReadFile(gopath.Join(*caPath, "www", "mtc", "v1", path))
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Print(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(buf)
+}
+
+func ServeCAParams(w http.ResponseWriter, r *http.Request) {
+	serveCAFile(w, r, "ca-params")
+}
+
+// Serves the CA's signed deny list, if it published one.
+func ServeDenyList(w http.ResponseWriter, r *http.Request) {
+	serveCAFile(w, r, "deny-list")
+}
+
+// Serves the signed validity window of the given batch, which may
+// also be "latest".
+func ServeValidityWindow(w http.ResponseWriter, r *http.Request) {
+	batch := mux.Vars(r)["batch"]
+	if batch != "latest" {
+		if _, err := strconv.ParseUint(batch, 10, 32); err != nil {
+			http.Error(w, "Invalid batch number", http.StatusBadRequest)
+			return
+		}
+	}
+	serveCAFile(w, r, gopath.Join("batches", batch, "signed-validity-window"))
+}
+
+// Serves the summary of the given batch, which may also be "latest", so
+// that monitors can poll for new batches cheaply.
+func ServeBatchSummary(w http.ResponseWriter, r *http.Request) {
+	batch := mux.Vars(r)["batch"]
+	if batch != "latest" {
+		if _, err := strconv.ParseUint(batch, 10, 32); err != nil {
+			http.Error(w, "Invalid batch number", http.StatusBadRequest)
+			return
+		}
+	}
+	serveCAFile(w, r, gopath.Join("batches", batch, "summary"))
+}
+
+// Response to ServeCurrentBatch.
+type CurrentBatch struct {
+	Batch uint32    `json:"batch"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+
+	// Seconds until the end of the current batch, after which the CA
+	// issues it, and a new validity window becomes available.
+	NextBatchIn float64 `json:"next_batch_in"`
+}
+
+// Serves the number and time range of the current batch, derived from the
+// CA's parameters, so that clients know when to fetch a new validity window.
+func ServeCurrentBatch(w http.ResponseWriter, r *http.Request) {
+	buf, err := os.ReadFile(gopath.Join(*caPath, "www", "mtc", "v1", "ca-params"))
+	if err != nil {
+		log.Print(err.Error())
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	var p mtc.CAParams
+	if err := p.UnmarshalBinary(buf); err != nil {
+		log.Print(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	number, ok := p.BatchNumberFor(now)
+	if !ok {
+		http.Error(w, "CA hasn't started yet", http.StatusNotFound)
+		return
+	}
+	start, end := p.BatchTimeRange(number)
+	resp := CurrentBatch{
+		Batch:       number,
+		Start:       start.UTC(),
+		End:         end.UTC(),
+		NextBatchIn: end.Sub(now).Seconds(),
+	}
+
+	// The answer only changes when the next batch starts.
+	w.Header().Set("Cache-Control",
+		fmt.Sprintf("max-age=%d", int(end.Sub(now).Seconds())))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Serves the proof for the assertion with the given key in the given batch,
+// so that clients can fetch a proof on demand instead of a full certificate.
+func ServeProof(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	batch, err := strconv.ParseUint(q.Get("batch"), 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid batch number", http.StatusBadRequest)
+		return
+	}
+	key, err := hex.DecodeString(q.Get("key"))
+	if err != nil || len(key) != mtc.HashLen {
+		http.Error(w, "Invalid key", http.StatusBadRequest)
+		return
+	}
+
+	// Doesn't take the lock, so that proofs are served while the CA is
+	// issuing, be it in this process or in another.
+	h, err := ca.OpenReadOnly(*caPath)
+	if err != nil {
+		log.Print(err.Error())
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	defer h.Close()
+
+	proof, err := h.ProofFor(uint32(batch), key)
+	switch {
+	case errors.Is(err, ca.ErrBatchExpired):
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	case errors.Is(err, ca.ErrUnknownBatch), errors.Is(err, ca.ErrUnknownKey):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		log.Print(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Web clients can ask for JSON instead of the binary encoding.
+	w.Header().Set("Vary", "Accept")
+	contentType := "application/octet-stream"
+	var buf []byte
+	if acceptsJSON(r) {
+		contentType = "application/json"
+		buf, err = proof.MarshalJSON()
+	} else {
+		buf, err = proof.MarshalBinary()
+	}
+	if err != nil {
+		log.Print(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(buf)
+}
+
+// Returns whether the client prefers JSON: whether it lists
+// application/json in its Accept header before any binary type.
+func acceptsJSON(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(accept, ",") {
+			params := strings.Split(part, ";")
+			if len(params) > 1 && strings.TrimSpace(params[1]) == "q=0" {
+				continue
+			}
+			switch strings.ToLower(strings.TrimSpace(params[0])) {
+			case "application/json":
+				return true
+			case "application/octet-stream", "*/*":
+				return false
+			}
+		}
+	}
+	return false
+}
+
 func InspectAssertion(w http.ResponseWriter, r *http.Request) {
 	app := "mtc"
 	arg0 := "inspect"
@@ -59,15 +386,17 @@ func InspectAssertion(w http.ResponseWriter, r *http.Request) {
 
 	w.Write([]byte(string(stdout)))
 }
-func CreateAssertion(w http.ResponseWriter, r *http.Request) {
 
+// Decodes the JSON request body into dst. On failure, writes an error
+// response and returns false.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, dst interface{}) bool {
 	ct := r.Header.Get("Content-Type")
 	if ct != "" {
 		mediaType := strings.ToLower(strings.TrimSpace(strings.Split(ct, ";")[0]))
 		if mediaType != "application/json" {
 			msg := "Content-Type header is not application/json"
 			http.Error(w, msg, http.StatusUnsupportedMediaType)
-			return
+			return false
 		}
 	}
 
@@ -76,8 +405,7 @@ func CreateAssertion(w http.ResponseWriter, r *http.Request) {
 	dec := json.NewDecoder(r.Body)
 	dec.DisallowUnknownFields()
 
-	var p Assertion
-	err := dec.Decode(&p)
+	err := dec.Decode(dst)
 	if err != nil {
 		var syntaxError *json.SyntaxError
 		var unmarshalTypeError *json.UnmarshalTypeError
@@ -113,13 +441,110 @@ func CreateAssertion(w http.ResponseWriter, r *http.Request) {
 			log.Print(err.Error())
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		}
-		return
+		return false
 	}
 
 	err = dec.Decode(&struct{}{})
 	if !errors.Is(err, io.EOF) {
 		msg := "Request body must only contain a single JSON object"
 		http.Error(w, msg, http.StatusBadRequest)
+		return false
+	}
+
+	return true
+}
+
+// Builds the assertion CreateAssertion would queue for the given request:
+// the subject is the PEM encoded public key, and the claims are the ENS name
+// and the IPv4 address of the requester.
+func assertionFromRequest(p Assertion, ens string, r *http.Request) (
+	*mtc.Assertion, error) {
+	block, _ := pem.Decode([]byte(p.Pem))
+	if block == nil {
+		return nil, errors.New("failed to parse PEM block")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing public key: %w", err)
+	}
+	b := mtc.NewAssertionBuilder().TLSKey(pub).ENS(ens)
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err == nil {
+		if ip := net.ParseIP(host).To4(); ip != nil {
+			b.IP4(ip)
+		}
+	}
+
+	return b.Build()
+}
+
+// Response to PreviewAssertion.
+type AssertionPreview struct {
+	Checksum        string   `json:"checksum"`
+	SubjectType     string   `json:"subject_type"`
+	SignatureScheme string   `json:"signature_scheme"`
+	PublicKeyHash   string   `json:"public_key_hash"`
+	DNS             []string `json:"dns,omitempty"`
+	DNSWildcard     []string `json:"dns_wildcard,omitempty"`
+	ENS             []string `json:"ens,omitempty"`
+	IPv4            []net.IP `json:"ip4,omitempty"`
+	IPv6            []net.IP `json:"ip6,omitempty"`
+	Email           []string `json:"email,omitempty"`
+}
+
+// Returns the checksum, normalized claims and subject of the assertion
+// that would be created for the request, without queueing it.
+func PreviewAssertion(w http.ResponseWriter, r *http.Request) {
+	var p Assertion
+	if !decodeJSONBody(w, r, &p) {
+		return
+	}
+
+	a, err := assertionFromRequest(p, p.Ens, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	qa := ca.QueuedAssertion{Assertion: *a}
+	if err := qa.Check(); err != nil { // sets checksum
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Normalize claims by a round trip through their wire format.
+	buf, err := a.Claims.MarshalBinary()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var cs mtc.Claims
+	if err := cs.UnmarshalBinary(buf); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	asubj := a.Subject.Abridge().(*mtc.AbridgedTLSSubject)
+	resp := AssertionPreview{
+		Checksum:        hex.EncodeToString(qa.Checksum),
+		SubjectType:     a.Subject.Type().String(),
+		SignatureScheme: asubj.SignatureScheme.String(),
+		PublicKeyHash:   hex.EncodeToString(asubj.PublicKeyHash[:]),
+		DNS:             cs.DNS,
+		DNSWildcard:     cs.DNSWildcard,
+		ENS:             cs.ENS,
+		IPv4:            cs.IPv4,
+		IPv6:            cs.IPv6,
+		Email:           cs.Email,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func CreateAssertion(w http.ResponseWriter, r *http.Request) {
+	var p Assertion
+	if !decodeJSONBody(w, r, &p) {
 		return
 	}
 
@@ -157,33 +582,195 @@ func CreateAssertion(w http.ResponseWriter, r *http.Request) {
 
 	w.Write([]byte(string(stdout)))
 }
+
+// Request body of CreateRoot. Durations are as accepted by
+// time.ParseDuration, such as "5m". Omitted ones get the defaults of
+// ca.New.
+type NewRoot struct {
+	IssuerId        string `json:"issuer_id"`
+	HttpServer      string `json:"http_server"`
+	BatchDuration   string `json:"batch_duration,omitempty"`
+	Lifetime        string `json:"lifetime,omitempty"`
+	StorageDuration string `json:"storage_duration,omitempty"`
+}
+
+// Response to CreateRoot.
+type NewRootResponse struct {
+	IssuerId           string `json:"issuer_id"`
+	HttpServer         string `json:"http_server"`
+	StartTime          uint64 `json:"start_time"`
+	BatchDuration      uint64 `json:"batch_duration"`
+	Lifetime           uint64 `json:"lifetime"`
+	ValidityWindowSize uint64 `json:"validity_window_size"`
+	StorageWindowSize  uint64 `json:"storage_window_size"`
+	SignatureScheme    string `json:"signature_scheme"`
+}
+
+// Creates a new CA at -ca-path with the parameters in the request. Refuses
+// to replace an existing CA.
 func CreateRoot(w http.ResponseWriter, r *http.Request) {
-	app := "mtc"
-	arg0 := "ca"
-	arg1 := "new"
-	arg2 := "--batch-duration"
-	arg3 := "5m"
-	arg4 := "--lifetime"
-	arg5 := "1h"
-	arg6 := "ens-pki"
-	arg7 := "ca.login.limo/root"
-
-	cmd := exec.Command(app, arg0, arg1, arg2, arg3, arg4, arg5, arg6, arg7)
-	stdout, err := cmd.Output()
+	var req NewRoot
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
 
-	if err != nil {
-		fmt.Println(err.Error())
+	if req.IssuerId == "" || req.HttpServer == "" {
+		http.Error(w, "issuer_id and http_server are required", http.StatusBadRequest)
+		return
+	}
+	opts := ca.NewOpts{
+		IssuerId:   req.IssuerId,
+		HttpServer: req.HttpServer,
+	}
+	for _, d := range []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{"batch_duration", req.BatchDuration, &opts.BatchDuration},
+		{"lifetime", req.Lifetime, &opts.Lifetime},
+		{"storage_duration", req.StorageDuration, &opts.StorageDuration},
+	} {
+		if d.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil || v <= 0 {
+			http.Error(w, fmt.Sprintf("Invalid %s %q", d.name, d.value),
+				http.StatusBadRequest)
+			return
+		}
+		*d.dst = v
+	}
+
+	h, err := ca.New(*caPath, opts)
+	var pathError *fs.PathError
+	switch {
+	case errors.Is(err, ca.ErrCAExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.As(err, &pathError):
+		log.Print(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	case err != nil:
+		// Otherwise, the parameters were rejected.
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	p := h.Params()
+	h.Close()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(NewRootResponse{
+		IssuerId:           p.IssuerId,
+		HttpServer:         p.HttpServer,
+		StartTime:          p.StartTime,
+		BatchDuration:      p.BatchDuration,
+		Lifetime:           p.Lifetime,
+		ValidityWindowSize: p.ValidityWindowSize,
+		StorageWindowSize:  p.StorageWindowSize,
+		SignatureScheme:    p.PublicKey.Scheme().String(),
+	})
+}
 
-	w.Write([]byte(string(stdout)))
+// How long to wait before trying to issue again after a failure.
+const issueRetryDelay = time.Minute
+
+// Issues batches as they become ready, until ctx is done. The CA is only
+// opened, and so locked, while issuing, so the other endpoints and `mtc ca`
+// can use it in between.
+func issueLoop(ctx context.Context) {
+	for {
+		next, err := issueReadyBatches(ctx)
+		if err != nil {
+			log.Printf("Issuing batches: %v", err)
+			next = time.Now().Add(issueRetryDelay)
+		}
+
+		t := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Issues the batches that are ready, and returns when the next one will be.
+//
+// If we weren't running when earlier batches became ready, they're issued
+// too, as `mtc ca issue` does: all but the last one empty. Batches that
+// fall out of the storage window are archived or removed according to the
+// retention policy stored with the CA, as set by `mtc ca gc --keep-every`.
+// Without one, the archive is left alone.
+//
+// This is the only handle of the server that takes the lock of the CA. As
+// the lock belongs to the process, a second one would be granted it too,
+// and clobber this one's temporary files. Handlers that only read use
+// ca.OpenReadOnly.
+func issueReadyBatches(ctx context.Context) (time.Time, error) {
+	h, err := ca.Open(*caPath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer h.Close()
+
+	p := h.Params()
+	existing, err := h.ExistingBatches()
+	if err != nil {
+		return time.Time{}, err
+	}
+	expected := p.ActiveBatches(time.Now())
+	if existing.Len() != 0 && expected.End > existing.End+1 {
+		log.Printf(
+			"Missed batches %d-%d: issuing them empty, and the queue in batch %d",
+			existing.End, expected.End-2, expected.End-1,
+		)
+	}
+
+	if err := h.IssueContext(ctx); err != nil {
+		return time.Time{}, err
+	}
+	return p.NextBatchAt(time.Now()), nil
 }
 
 func main() {
+	flag.Parse()
+
+	if *issueBatches {
+		go issueLoop(context.Background())
+	}
 
 	r := mux.NewRouter()
+	wk := strings.TrimSuffix(*wellKnownPath, "/")
+	r.HandleFunc(wk+"/ca-params", WithHSTS(WithCORS(ServeCAParams))).Methods("GET", "OPTIONS")
+	r.HandleFunc(wk+"/deny-list", WithHSTS(WithCORS(ServeDenyList))).Methods("GET", "OPTIONS")
+	r.HandleFunc(wk+"/batches/{batch}/signed-validity-window", WithHSTS(WithCORS(ServeValidityWindow))).Methods("GET", "OPTIONS")
+	r.HandleFunc(wk+"/current-batch", WithHSTS(WithCORS(ServeCurrentBatch))).Methods("GET", "OPTIONS")
+	r.HandleFunc(wk+"/batches/{batch}/summary", WithHSTS(WithCORS(ServeBatchSummary))).Methods("GET", "OPTIONS")
+	r.HandleFunc(wk+"/proof", NewThrottledHandler(5, WithHSTS(WithCORS(ServeProof))).ServeHTTP).Methods("GET", "OPTIONS")
 	r.HandleFunc("/newroot", NewThrottledHandler(5, http.HandlerFunc(CreateRoot)).ServeHTTP).Methods("POST")
+	r.HandleFunc("/mtc/assertion/preview", NewThrottledHandler(5, http.HandlerFunc(PreviewAssertion)).ServeHTTP).Methods("POST")
 	r.HandleFunc("/assertion/{ens}", NewThrottledHandler(5, http.HandlerFunc(CreateAssertion)).ServeHTTP).Methods("POST")
 	r.HandleFunc("/assertion", NewThrottledHandler(5, http.HandlerFunc(InspectAssertion)).ServeHTTP).Methods("GET")
-	log.Fatal(http.ListenAndServe(":4433", r))
+
+	cfg, err := tlsConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	srv := &http.Server{
+		Addr:              *listenAddr,
+		Handler:           r,
+		TLSConfig:         cfg,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if cfg == nil {
+		log.Printf("Serving plain HTTP on %s", *listenAddr)
+		log.Fatal(srv.ListenAndServe())
+	}
+	log.Printf("Serving HTTPS on %s", *listenAddr)
+	log.Fatal(srv.ListenAndServeTLS("", ""))
 }
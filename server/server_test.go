@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwesterb/mtc"
+	"github.com/bwesterb/mtc/ca"
+)
+
+// Issues batches while proofs are being served, as with -issue.
+func TestIssueWhileServingProofs(t *testing.T) {
+	path := t.TempDir()
+	oldCaPath := *caPath
+	*caPath = path
+	t.Cleanup(func() { *caPath = oldCaPath })
+
+	h, err := ca.New(path, ca.NewOpts{
+		IssuerId:      "example",
+		HttpServer:    "ca.example.com",
+		BatchDuration: time.Second,
+		Lifetime:      10 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Enough assertions for issuance to take a while.
+	var a *mtc.Assertion
+	if err := h.QueueMultiple(func(yield func(ca.QueuedAssertion) error) error {
+		for i := 0; i < 1000; i++ {
+			pk, _, err := ed25519.GenerateKey(nil)
+			if err != nil {
+				return err
+			}
+			a, err = mtc.NewAssertionBuilder().DNS("example.com").TLSKey(pk).Build()
+			if err != nil {
+				return err
+			}
+			if err := yield(ca.QueuedAssertion{Assertion: *a}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	aa := a.Abridge()
+	var key [mtc.HashLen]byte
+	if err := aa.Key(key[:]); err != nil {
+		t.Fatal(err)
+	}
+	url := "/mtc/v1/proof?batch=0&key=" + hex.EncodeToString(key[:])
+	serveProof := func() int {
+		rec := httptest.NewRecorder()
+		ServeProof(rec, httptest.NewRequest("GET", url, nil))
+		return rec.Code
+	}
+
+	// While h holds the lock, as the handle of issueReadyBatches does,
+	// serving a proof leaves the lock and temporary files alone.
+	leftover := filepath.Join(path, "tmp", "in-progress")
+	if err := os.WriteFile(leftover, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if code := serveProof(); code != http.StatusNotFound {
+		t.Fatalf("proof request got %d", code)
+	}
+	if _, err := os.Stat(filepath.Join(path, "lock")); err != nil {
+		t.Fatalf("lock removed: %v", err)
+	}
+	if _, err := os.Stat(leftover); err != nil {
+		t.Fatalf("temporary file removed: %v", err)
+	}
+	if err := os.Remove(leftover); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				// Not found until batch 0 is issued.
+				if code := serveProof(); code != http.StatusOK &&
+					code != http.StatusNotFound {
+					t.Errorf("proof request got %d", code)
+					return
+				}
+			}
+		}()
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := issueReadyBatches(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		ro, err := ca.OpenReadOnly(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		existing, err := ro.ExistingBatches()
+		ro.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if existing.Contains(0) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("batch 0 wasn't issued")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	close(done)
+	wg.Wait()
+
+	if code := serveProof(); code != http.StatusOK {
+		t.Fatalf("proof request got %d", code)
+	}
+
+	h, err = ca.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if err := h.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Without a stored retention policy, issuing leaves archived batches alone.
+func TestIssueKeepsArchive(t *testing.T) {
+	path := t.TempDir()
+	oldCaPath := *caPath
+	*caPath = path
+	t.Cleanup(func() { *caPath = oldCaPath })
+
+	h, err := ca.New(path, ca.NewOpts{
+		IssuerId:      "example",
+		HttpServer:    "ca.example.com",
+		BatchDuration: time.Second,
+		Lifetime:      10 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := h.Params()
+	next := p.NextBatchAt(time.Now())
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	archived := filepath.Join(path, "archive", "0")
+	if err := os.MkdirAll(archived, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Until(next))
+	if _, err := issueReadyBatches(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(archived); err != nil {
+		t.Fatalf("archived batch removed: %v", err)
+	}
+}
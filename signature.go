@@ -8,12 +8,19 @@ import (
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
 	"errors"
 	"fmt"
+	"sync"
 
 	dil5 "github.com/cloudflare/circl/sign/dilithium/mode5"
 )
 
+// Returned when parsing or creating a key for a signature scheme that is
+// not supported.
+var ErrUnsupportedScheme = errors.New("Unsupported SignatureScheme")
+
 // Signing public key with specific hash and options.
 type Verifier interface {
 	Verify(message, signature []byte) error
@@ -90,20 +97,55 @@ func (v *dil5Verifier) Verify(msg, sig []byte) error {
 	return errors.New("dilithium5 verification failed")
 }
 
+// Brainpool curves registered with RegisterBrainpoolCurve.
+var (
+	brainpoolMux    sync.RWMutex
+	brainpoolCurves = make(map[SignatureScheme]elliptic.Curve)
+)
+
+// Names of the brainpool curves as found in their elliptic.CurveParams.
+var brainpoolSchemes = map[string]SignatureScheme{
+	"brainpoolP256r1": TLSECDSAWithBrainpoolP256r1AndSHA256,
+	"brainpoolP384r1": TLSECDSAWithBrainpoolP384r1AndSHA384,
+	"brainpoolP512r1": TLSECDSAWithBrainpoolP512r1AndSHA512,
+}
+
+// Enables support for subject public keys on the given brainpool curve.
+//
+// The standard library doesn't implement the brainpool curves, so an
+// implementation has to be provided, such as that of
+// github.com/ebfe/brainpool. The curve is recognised by the name in its
+// parameters, for instance brainpoolP256r1.
+func RegisterBrainpoolCurve(curve elliptic.Curve) error {
+	name := curve.Params().Name
+	scheme, ok := brainpoolSchemes[name]
+	if !ok {
+		return fmt.Errorf("Not a supported brainpool curve: %s", name)
+	}
+	brainpoolMux.Lock()
+	defer brainpoolMux.Unlock()
+	brainpoolCurves[scheme] = curve
+	return nil
+}
+
 func signatureSchemeToHash(scheme SignatureScheme) (crypto.Hash, error) {
 	switch scheme {
-	case TLSPSSWithSHA256, TLSECDSAWithP256AndSHA256:
+	case TLSPSSWithSHA256, TLSECDSAWithP256AndSHA256,
+		TLSECDSAWithBrainpoolP256r1AndSHA256:
 		return crypto.SHA256, nil
-	case TLSPSSWithSHA384, TLSECDSAWithP384AndSHA384:
+	case TLSPSSWithSHA384, TLSECDSAWithP384AndSHA384,
+		TLSECDSAWithBrainpoolP384r1AndSHA384:
 		return crypto.SHA384, nil
-	case TLSPSSWithSHA512, TLSECDSAWithP521AndSHA512:
+	case TLSPSSWithSHA512, TLSECDSAWithP521AndSHA512,
+		TLSECDSAWithBrainpoolP512r1AndSHA512:
 		return crypto.SHA512, nil
 	case TLSEd25519, TLSDilitihium5r3:
 		return 0, nil
 	}
-	return 0, errors.New("Unsupported SignatureScheme")
+	return 0, fmt.Errorf("%w: %s", ErrUnsupportedScheme, scheme)
 }
 
+// Returns nil for a brainpool curve that hasn't been registered.
 func signatureSchemeToCurve(scheme SignatureScheme) elliptic.Curve {
 	switch scheme {
 	case TLSECDSAWithP256AndSHA256:
@@ -112,6 +154,12 @@ func signatureSchemeToCurve(scheme SignatureScheme) elliptic.Curve {
 		return elliptic.P384()
 	case TLSECDSAWithP521AndSHA512:
 		return elliptic.P521()
+	case TLSECDSAWithBrainpoolP256r1AndSHA256,
+		TLSECDSAWithBrainpoolP384r1AndSHA384,
+		TLSECDSAWithBrainpoolP512r1AndSHA512:
+		brainpoolMux.RLock()
+		defer brainpoolMux.RUnlock()
+		return brainpoolCurves[scheme]
 	}
 	panic("Unsupported curve")
 }
@@ -137,12 +185,18 @@ func NewVerifier(scheme SignatureScheme, pk crypto.PublicKey) (
 			return nil, errors.New("Expected ed25519.PublicKey")
 		}
 		return ed25519Verifier(epk), nil
-	case TLSECDSAWithP256AndSHA256, TLSECDSAWithP384AndSHA384, TLSECDSAWithP521AndSHA512:
+	case TLSECDSAWithP256AndSHA256, TLSECDSAWithP384AndSHA384,
+		TLSECDSAWithP521AndSHA512, TLSECDSAWithBrainpoolP256r1AndSHA256,
+		TLSECDSAWithBrainpoolP384r1AndSHA384,
+		TLSECDSAWithBrainpoolP512r1AndSHA512:
 		epk, ok := pk.(*ecdsa.PublicKey)
 		if !ok {
 			return nil, errors.New("Expected *ecdsa.PublicKey")
 		}
 		curve := signatureSchemeToCurve(scheme)
+		if curve == nil {
+			return nil, fmt.Errorf("Curve for %s has not been registered", scheme)
+		}
 		if curve != epk.Curve {
 			return nil, fmt.Errorf("Expected curve %v, got %v", curve, epk.Curve)
 		}
@@ -154,7 +208,7 @@ func NewVerifier(scheme SignatureScheme, pk crypto.PublicKey) (
 		}
 		return (*dil5Verifier)(dpk), nil
 	default:
-		return nil, errors.New("Unsupported SignatureScheme")
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedScheme, scheme)
 	}
 }
 
@@ -177,8 +231,14 @@ func UnmarshalVerifier(scheme SignatureScheme, data []byte) (
 			return nil, errors.New("Wrong length for ed25519 public key")
 		}
 		return ed25519Verifier(data), nil
-	case TLSECDSAWithP521AndSHA512, TLSECDSAWithP384AndSHA384, TLSECDSAWithP256AndSHA256:
+	case TLSECDSAWithP521AndSHA512, TLSECDSAWithP384AndSHA384,
+		TLSECDSAWithP256AndSHA256, TLSECDSAWithBrainpoolP256r1AndSHA256,
+		TLSECDSAWithBrainpoolP384r1AndSHA384,
+		TLSECDSAWithBrainpoolP512r1AndSHA512:
 		curve := signatureSchemeToCurve(scheme)
+		if curve == nil {
+			return nil, fmt.Errorf("Curve for %s has not been registered", scheme)
+		}
 		x, y := elliptic.Unmarshal(curve, data)
 		if x == nil {
 			return nil, errors.New("Failed to unmarshal ecdsa public key")
@@ -204,7 +264,7 @@ func UnmarshalVerifier(scheme SignatureScheme, data []byte) (
 		pk.Unpack(&buf)
 		return (*dil5Verifier)(&pk), nil
 	default:
-		return nil, errors.New("Unsupported SignatureScheme")
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedScheme, scheme)
 	}
 }
 
@@ -249,7 +309,7 @@ func UnmarshalSigner(scheme SignatureScheme, data []byte) (
 		sk.Unpack(&buf)
 		return (*dil5Signer)(&sk), nil
 	default:
-		return nil, errors.New("Unsupported SignatureScheme")
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedScheme, scheme)
 	}
 }
 
@@ -267,7 +327,7 @@ func GenerateSigningKeypair(scheme SignatureScheme) (Signer, Verifier, error) {
 		}
 		return (*dil5Signer)(sk), (*dil5Verifier)(pk), nil
 	default:
-		return nil, nil, errors.New("Unsupported SignatureScheme")
+		return nil, nil, fmt.Errorf("%w: %s", ErrUnsupportedScheme, scheme)
 	}
 }
 
@@ -289,6 +349,12 @@ func (s SignatureScheme) String() string {
 		return "ed25519"
 	case TLSDilitihium5r3:
 		return "dilithium5"
+	case TLSECDSAWithBrainpoolP256r1AndSHA256:
+		return "brainpoolP256r1"
+	case TLSECDSAWithBrainpoolP384r1AndSHA384:
+		return "brainpoolP384r1"
+	case TLSECDSAWithBrainpoolP512r1AndSHA512:
+		return "brainpoolP512r1"
 	}
 	return fmt.Sprintf("unknown:%d", uint16(s))
 }
@@ -312,6 +378,9 @@ func SignatureSchemeFromString(s string) SignatureScheme {
 	case "ed25519":
 		return TLSEd25519
 	}
+	if scheme, ok := brainpoolSchemes[s]; ok {
+		return scheme
+	}
 	return 0
 }
 
@@ -333,6 +402,10 @@ func SignatureSchemesFor(pk crypto.PublicKey) []SignatureScheme {
 		case "P-521":
 			return []SignatureScheme{TLSECDSAWithP521AndSHA512}
 		}
+		scheme, ok := brainpoolSchemes[pk.Curve.Params().Name]
+		if ok && signatureSchemeToCurve(scheme) != nil {
+			return []SignatureScheme{scheme}
+		}
 		return []SignatureScheme{}
 	case ed25519.PublicKey:
 		return []SignatureScheme{TLSEd25519}
@@ -342,6 +415,46 @@ func SignatureSchemesFor(pk crypto.PublicKey) []SignatureScheme {
 	return []SignatureScheme{}
 }
 
+// There is no standard OID for round 3 Dilithium5, so we use the one
+// of the Open Quantum Safe project.
+var oidDilithium5r3 = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 2, 267, 7, 8, 7}
+
+// Returns the public key of the verifier.
+func VerifierPublicKey(v Verifier) (crypto.PublicKey, error) {
+	switch v := v.(type) {
+	case *pssVerifier:
+		return v.pk, nil
+	case ed25519Verifier:
+		return ed25519.PublicKey(v.Bytes()), nil
+	case *ecdsaVerifier:
+		return v.pk, nil
+	case *dil5Verifier:
+		return (*dil5.PublicKey)(v), nil
+	}
+	return nil, fmt.Errorf("Unsupported verifier for %s", v.Scheme())
+}
+
+// Encodes the public key of the verifier as a PKIX, ASN.1 DER,
+// SubjectPublicKeyInfo.
+func MarshalPKIXVerifier(v Verifier) ([]byte, error) {
+	if _, ok := v.(*dil5Verifier); ok {
+		pk := v.Bytes()
+		return asn1.Marshal(struct {
+			Algorithm pkix.AlgorithmIdentifier
+			PublicKey asn1.BitString
+		}{
+			Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidDilithium5r3},
+			PublicKey: asn1.BitString{Bytes: pk, BitLength: 8 * len(pk)},
+		})
+	}
+
+	pk, err := VerifierPublicKey(v)
+	if err != nil {
+		return nil, err
+	}
+	return x509.MarshalPKIXPublicKey(pk)
+}
+
 // Returns [scheme]:[sha256]
 func VerifierFingerprint(v Verifier) string {
 	buf := v.Bytes()
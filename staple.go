@@ -0,0 +1,169 @@
+package mtc
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+var (
+	// Returned when a staple is for another assertion or batch than the
+	// certificate it's stapled to.
+	ErrStapleMismatch = errors.New("Staple is for a different certificate")
+
+	// Returned when a staple is older than the verifier accepts.
+	ErrStapleStale = errors.New("Staple is too old")
+)
+
+// Statement by the CA that an assertion it issued was still in good
+// standing when it issued batch AsOf: it was not on the CA's deny list.
+// A subscriber can staple it to its certificate, for relying parties that
+// want a fresher signal than the lifetime of the batch. Encoded as
+//
+//	struct {
+//	    opaque key[HashLen];
+//	    uint32 batch_number;
+//	    uint32 as_of;
+//	} Staple;
+type Staple struct {
+	// Key of the abridged assertion, see AbridgedAssertion.Key().
+	Key [HashLen]byte
+
+	// Batch the assertion was issued in.
+	BatchNumber uint32
+
+	// Latest batch issued when the staple was signed.
+	AsOf uint32
+}
+
+type SignedStaple struct {
+	Staple
+	Signature []byte
+}
+
+func (s *Staple) MarshalBinary() ([]byte, error) {
+	var b cryptobyte.Builder
+	b.AddBytes(s.Key[:])
+	b.AddUint32(s.BatchNumber)
+	b.AddUint32(s.AsOf)
+	return b.Bytes()
+}
+
+func (s *Staple) unmarshal(str *cryptobyte.String) error {
+	if !str.CopyBytes(s.Key[:]) ||
+		!str.ReadUint32(&s.BatchNumber) ||
+		!str.ReadUint32(&s.AsOf) {
+		return ErrTruncated
+	}
+	return nil
+}
+
+// Returns the marshalled LabeledStaple, which is signed by the CA.
+func (s *Staple) LabeledStaple(ca *CAParams) ([]byte, error) {
+	var b cryptobyte.Builder
+	b.AddBytes([]byte("Merkle Tree Crts Staple\000"))
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes([]byte(ca.IssuerId))
+	})
+	buf, err := s.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	b.AddBytes(buf)
+	return b.Bytes()
+}
+
+// Signs the staple for the given CA.
+func (s *Staple) Sign(signer Signer, ca *CAParams) (SignedStaple, error) {
+	if s.AsOf < s.BatchNumber {
+		return SignedStaple{}, errors.New("Staple predates the batch")
+	}
+	toSign, err := s.LabeledStaple(ca)
+	if err != nil {
+		return SignedStaple{}, err
+	}
+	return SignedStaple{
+		Staple:    *s,
+		Signature: signer.Sign(toSign),
+	}, nil
+}
+
+func (s *SignedStaple) MarshalBinary() ([]byte, error) {
+	var b cryptobyte.Builder
+	buf, err := s.Staple.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	b.AddBytes(buf)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(s.Signature)
+	})
+	return b.Bytes()
+}
+
+// Parses the signed staple, and checks its signature.
+func (s *SignedStaple) UnmarshalBinary(data []byte, p *CAParams) error {
+	err := s.UnmarshalBinaryWithoutVerification(data)
+	if err != nil {
+		return err
+	}
+	toSign, err := s.Staple.LabeledStaple(p)
+	if err != nil {
+		return err
+	}
+	return p.PublicKey.Verify(toSign, s.Signature)
+}
+
+// Like UnmarshalBinary() but doesn't check the signature.
+func (s *SignedStaple) UnmarshalBinaryWithoutVerification(data []byte) error {
+	str := cryptobyte.String(data)
+	if err := s.Staple.unmarshal(&str); err != nil {
+		return err
+	}
+	if !str.ReadUint16LengthPrefixed((*cryptobyte.String)(&s.Signature)) {
+		return ErrTruncated
+	}
+	if !str.Empty() {
+		return ErrExtraBytes
+	}
+	return nil
+}
+
+// Checks that the staple, whose signature should already have been
+// checked by SignedStaple.UnmarshalBinary, is for the given certificate,
+// and was signed at most maxAge batches before the current one at now.
+//
+// Doesn't verify the certificate itself: see VerifyCertificate.
+func VerifyStaple(c *BikeshedCertificate, s *Staple, p *CAParams,
+	now time.Time, maxAge uint32) error {
+	proof, ok := c.Proof.(*MerkleTreeProof)
+	if !ok {
+		return ErrUnsupportedProof
+	}
+	switch c.Assertion.Subject.(type) {
+	case *TLSSubject, *MultiTLSSubject, *CompactTLSSubject:
+	default:
+		return ErrUnsupportedSubject
+	}
+
+	aa := c.Assertion.Abridge()
+	var key [HashLen]byte
+	if err := aa.Key(key[:]); err != nil {
+		return err
+	}
+	if key != s.Key || proof.anchor.batchNumber != s.BatchNumber {
+		return fmt.Errorf("%w: staple is for key %x in batch %d",
+			ErrStapleMismatch, s.Key, s.BatchNumber)
+	}
+
+	// The batch that's being built at now. The latest issued batch is the
+	// one before it, so a staple as of that batch has age zero.
+	current := p.ActiveBatches(now).End
+	if uint64(s.AsOf)+1+uint64(maxAge) < uint64(current) {
+		return fmt.Errorf("%w: staple is as of batch %d, and batch %d is due",
+			ErrStapleStale, s.AsOf, current)
+	}
+	return nil
+}
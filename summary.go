@@ -0,0 +1,131 @@
+package mtc
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// Small manifest of an issued batch, so that monitors can notice new
+// batches without fetching the abridged assertions. Encoded as
+//
+//	struct {
+//	    uint32 batch_number;
+//	    uint64 leaf_count;
+//	    opaque root[HashLen];
+//	    opaque first_key<0..HashLen>;
+//	    opaque last_key<0..HashLen>;
+//	    uint64 issued_at;
+//	    SignatureScheme scheme;
+//	    opaque key_fingerprint[HashLen];
+//	} BatchSummary;
+//
+// The keys are empty for a batch without assertions.
+type BatchSummary struct {
+	Number    uint32
+	LeafCount uint64
+	Root      []byte
+
+	// Smallest and largest key of the abridged assertions in the batch.
+	FirstKey []byte
+	LastKey  []byte
+
+	IssuedAt time.Time // to the second
+
+	// Scheme and SHA-256 hash of the CA's public key.
+	Scheme         SignatureScheme
+	KeyFingerprint []byte
+}
+
+// Returns the summary of the batch with the given root, from its abridged
+// assertions in r, which may start with a header. Reads r once, without
+// keeping the assertions in memory.
+func (batch *Batch) Summary(root []byte, r io.Reader, issuedAt time.Time) (
+	*BatchSummary, error) {
+	if len(root) != HashLen {
+		return nil, fmt.Errorf("Expected root to be %d bytes; got %d", HashLen, len(root))
+	}
+
+	fp := sha256.Sum256(batch.CA.PublicKey.Bytes())
+	ret := &BatchSummary{
+		Number:         batch.Number,
+		Root:           root,
+		IssuedAt:       time.Unix(issuedAt.Unix(), 0),
+		Scheme:         batch.CA.PublicKey.Scheme(),
+		KeyFingerprint: fp[:],
+	}
+
+	var key [HashLen]byte
+	err := UnmarshalAbridgedAssertions(r, func(_ int, aa *AbridgedAssertion) error {
+		if err := aa.Key(key[:]); err != nil {
+			return err
+		}
+		if ret.FirstKey == nil || bytes.Compare(key[:], ret.FirstKey) < 0 {
+			ret.FirstKey = bytes.Clone(key[:])
+		}
+		if ret.LastKey == nil || bytes.Compare(key[:], ret.LastKey) > 0 {
+			ret.LastKey = bytes.Clone(key[:])
+		}
+		ret.LeafCount++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Returns the fingerprint of the CA's key, as VerifierFingerprint does.
+func (s *BatchSummary) Fingerprint() string {
+	return fmt.Sprintf("%s:%x", s.Scheme, s.KeyFingerprint)
+}
+
+func (s *BatchSummary) MarshalBinary() ([]byte, error) {
+	if len(s.Root) != HashLen || len(s.KeyFingerprint) != HashLen {
+		return nil, fmt.Errorf("Root and KeyFingerprint have to be %d bytes", HashLen)
+	}
+	if len(s.FirstKey) > HashLen || len(s.LastKey) > HashLen {
+		return nil, fmt.Errorf("FirstKey and LastKey are at most %d bytes", HashLen)
+	}
+	var b cryptobyte.Builder
+	b.AddUint32(s.Number)
+	b.AddUint64(s.LeafCount)
+	b.AddBytes(s.Root)
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(s.FirstKey)
+	})
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(s.LastKey)
+	})
+	b.AddUint64(uint64(s.IssuedAt.Unix()))
+	b.AddUint16(uint16(s.Scheme))
+	b.AddBytes(s.KeyFingerprint)
+	return b.Bytes()
+}
+
+func (s *BatchSummary) UnmarshalBinary(data []byte) error {
+	str := cryptobyte.String(data)
+	var issuedAt uint64
+	if !str.ReadUint32(&s.Number) ||
+		!str.ReadUint64(&s.LeafCount) ||
+		!str.ReadBytes(&s.Root, HashLen) ||
+		!str.ReadUint8LengthPrefixed((*cryptobyte.String)(&s.FirstKey)) ||
+		!str.ReadUint8LengthPrefixed((*cryptobyte.String)(&s.LastKey)) ||
+		!str.ReadUint64(&issuedAt) ||
+		!str.ReadUint16((*uint16)(&s.Scheme)) ||
+		!str.ReadBytes(&s.KeyFingerprint, HashLen) {
+		return ErrTruncated
+	}
+	if !str.Empty() {
+		return ErrExtraBytes
+	}
+	if len(s.FirstKey) > HashLen || len(s.LastKey) > HashLen {
+		return fmt.Errorf("keys in batch summary are at most %d bytes", HashLen)
+	}
+	s.IssuedAt = time.Unix(int64(issuedAt), 0)
+	return nil
+}
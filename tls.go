@@ -0,0 +1,81 @@
+package mtc
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// TLS certificate type (RFC 7250) for BikeshedCertificates, to be
+// negotiated with the server_certificate_type extension. The draft leaves
+// the codepoint to be assigned, so we use one from the private use range.
+const BikeshedCertificateType uint8 = 0xe0
+
+// Returns the body of the TLS 1.3 Certificate message (RFC 8446, section
+// 4.4.2) a server sends to present cert, once the BikeshedCertificateType
+// has been negotiated. That is
+//
+//	struct {
+//	    opaque certificate_request_context<0..2^8-1>;
+//	    CertificateEntry certificate_list<0..2^24-1>;
+//	} Certificate;
+//
+// with an empty context, and a single entry, without extensions, whose
+// cert_data<1..2^24-1> is the encoded BikeshedCertificate. The handshake
+// message header isn't included.
+func TLSCertificate(cert *BikeshedCertificate) ([]byte, error) {
+	certData, err := cert.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	var b cryptobyte.Builder
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {})
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(certData)
+		})
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {})
+	})
+	return b.Bytes()
+}
+
+// Parses the body of a TLS 1.3 Certificate message with the
+// BikeshedCertificateType, as written by TLSCertificate, on the peer side.
+//
+// Any certificate_request_context and extensions on the entry are
+// ignored. Expects exactly one entry, as a BikeshedCertificate can't have
+// a chain.
+func ParseTLSCertificate(data []byte) (*BikeshedCertificate, error) {
+	var (
+		s        = cryptobyte.String(data)
+		context  cryptobyte.String
+		list     cryptobyte.String
+		certData cryptobyte.String
+		exts     cryptobyte.String
+	)
+	if !s.ReadUint8LengthPrefixed(&context) ||
+		!s.ReadUint24LengthPrefixed(&list) {
+		return nil, ErrTruncated
+	}
+	if !s.Empty() {
+		return nil, ErrExtraBytes
+	}
+	if list.Empty() {
+		return nil, errors.New("Certificate message has no entries")
+	}
+	if !list.ReadUint24LengthPrefixed(&certData) ||
+		!list.ReadUint16LengthPrefixed(&exts) {
+		return nil, ErrTruncated
+	}
+	if !list.Empty() {
+		return nil, errors.New("Certificate message has more than one entry")
+	}
+
+	var cert BikeshedCertificate
+	if err := cert.UnmarshalBinary(certData); err != nil {
+		return nil, fmt.Errorf("parsing cert_data: %w", err)
+	}
+	return &cert, nil
+}
@@ -0,0 +1,73 @@
+package mtc
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Returned when a certificate is from an issuer that's not in the
+// TrustStore.
+var ErrUntrustedIssuer = errors.New("Certificate is from an untrusted issuer")
+
+// The CAs a relying party trusts, keyed by issuer id: the analog of a
+// root store. The zero value is an empty store.
+type TrustStore struct {
+	cas map[string]*CAParams
+}
+
+// Adds the CA to the store. Fails if there is another CA with the same
+// issuer id already, as certificates only name their issuer by it.
+func (s *TrustStore) Add(p *CAParams) error {
+	if s.cas == nil {
+		s.cas = make(map[string]*CAParams)
+	}
+	if _, ok := s.cas[p.IssuerId]; ok {
+		return fmt.Errorf("TrustStore has a CA with issuer id %q already",
+			p.IssuerId)
+	}
+	s.cas[p.IssuerId] = p
+	return nil
+}
+
+// Removes the CA with the given issuer id, if any.
+func (s *TrustStore) Remove(issuerId string) {
+	delete(s.cas, issuerId)
+}
+
+// Returns the CA with the given issuer id, or nil if it's not trusted.
+func (s *TrustStore) Get(issuerId string) *CAParams {
+	return s.cas[issuerId]
+}
+
+// Returns the issuer ids of the CAs in the store, sorted.
+func (s *TrustStore) IssuerIds() []string {
+	ret := make([]string, 0, len(s.cas))
+	for id := range s.cas {
+		ret = append(ret, id)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Verifies the certificate with VerifyCertificate against the CA named by
+// the trust anchor of its proof, and the given validity window, which has
+// to be of that CA. Returns ErrUntrustedIssuer if the CA is not in the
+// store.
+//
+// The CA and Window of opts are set by Verify.
+func (s *TrustStore) Verify(c *BikeshedCertificate, window *ValidityWindow,
+	opts VerifyOptions) error {
+	proof, ok := c.Proof.(*MerkleTreeProof)
+	if !ok {
+		return ErrUnsupportedProof
+	}
+	issuerId := proof.anchor.issuerId
+	p := s.Get(issuerId)
+	if p == nil {
+		return fmt.Errorf("%w: %q", ErrUntrustedIssuer, issuerId)
+	}
+	opts.CA = p
+	opts.Window = window
+	return VerifyCertificate(c, opts)
+}
@@ -4,6 +4,7 @@ import (
 	"golang.org/x/crypto/cryptobyte"
 
 	"errors"
+	"fmt"
 	"io"
 	"reflect"
 )
@@ -16,6 +17,10 @@ var (
 	// ErrExtraBytes is a parsing error returned when there are extraneous
 	// bytes at the end of, or within, the data.
 	ErrExtraBytes = errors.New("Unexpected extra (internal) bytes")
+
+	// ErrIPv4MappedAddress is returned when an IPv4 or IPv4-mapped IPv6
+	// address is used in an IPv6 claim. These belong in the IPv4 claim.
+	ErrIPv4MappedAddress = errors.New("IPv4(-mapped) address in IPv6 claim")
 )
 
 type unmarshaler interface {
@@ -32,21 +37,30 @@ type unmarshaler interface {
 }
 
 // Unmarshals a stream of T from r, and call f on each of them as second
-// argument, with the offset in the stream as the first argument.
+// argument, with the offset in the stream as the first argument. The
+// stream starts at the given offset, for instance after a header.
 //
-// If f returns an error, break.
-func unmarshal[T unmarshaler](r io.Reader, f func(int, T) error) error {
+// If f returns an error, break. If r ends within a record, or returns
+// io.ErrUnexpectedEOF, returns ErrTruncated with the index and offset
+// of the record. Other read errors are returned with the same context.
+func unmarshal[T unmarshaler](r io.Reader, offset int,
+	f func(int, T) error) error {
 	// Create a new instance of T
 	var msg T
 	reflect.ValueOf(&msg).Elem().Set(reflect.New(reflect.TypeOf(msg).Elem()))
 
 	buf := make([]byte, 512)
-	s := cryptobyte.String(buf[:0])
 	maxSize := msg.maxSize()
-	offset := 0
+	lo, hi := 0, 0 // data in buf that's yet to be parsed
+	index := 0
+	emptyReads := 0
+
+	// Error of the last read. Only acted on once the data before it has
+	// been parsed.
+	var readErr error
 
 	for {
-		oldS := s
+		s := cryptobyte.String(buf[lo:hi])
 		err := msg.unmarshal(&s)
 
 		// Success? Call f and continue
@@ -54,21 +68,34 @@ func unmarshal[T unmarshaler](r io.Reader, f func(int, T) error) error {
 			if err := f(offset, msg); err != nil {
 				return err
 			}
-			offset += len(oldS) - len(s)
+			n := hi - lo - len(s)
+			offset += n
+			lo += n
+			index++
 			continue
 		}
 
 		if err != ErrTruncated {
-			return err
+			return fmt.Errorf("record %d at offset %d: %w", index, offset, err)
+		}
+
+		switch {
+		case readErr == io.EOF && lo == hi:
+			return nil
+		case readErr == io.EOF || readErr == io.ErrUnexpectedEOF:
+			return fmt.Errorf("%w: record %d at offset %d has only %d bytes",
+				ErrTruncated, index, offset, hi-lo)
+		case readErr != nil:
+			return fmt.Errorf("reading record %d at offset %d: %w",
+				index, offset, readErr)
 		}
 
-		// Did we have sucecss in the last iteration?
-		if cap(oldS) != cap(buf) {
-			// Yes, we need to move the remaining data to the front.
-			copy(buf[:len(oldS)], oldS)
-		} else {
-			// No. We grow the buffer. No need to move the remaining data:
-			// it's still in front.
+		// Move the partial record to the front, and grow the buffer only
+		// if it's full, so that short reads don't blow it up.
+		copy(buf, buf[lo:hi])
+		hi -= lo
+		lo = 0
+		if hi == len(buf) {
 			if len(buf) > maxSize {
 				// This shouldn't be possible, but let's error gracefully.
 				return errors.New("Unexpected ErrTruncated")
@@ -77,14 +104,19 @@ func unmarshal[T unmarshaler](r io.Reader, f func(int, T) error) error {
 			buf = append(buf, make([]byte, len(buf))...)
 		}
 
-		n, err := r.Read(buf[len(oldS):])
-		if n == 0 && err == io.EOF {
-			break
+		n, err := r.Read(buf[hi:])
+		hi += n
+		readErr = err
+		if n != 0 || err != nil {
+			emptyReads = 0
+			continue
 		}
-		if n == 0 {
-			return err
+
+		// Readers are discouraged from returning nothing, but may.
+		emptyReads++
+		if emptyReads == 100 {
+			return fmt.Errorf("reading record %d at offset %d: %w",
+				index, offset, io.ErrNoProgress)
 		}
-		s = cryptobyte.String(buf[:len(oldS)+n])
 	}
-	return nil
 }
@@ -0,0 +1,282 @@
+package mtc
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrCertificateExpired     = errors.New("Certificate has expired")
+	ErrCertificateNotYetValid = errors.New("Certificate is not yet valid")
+	ErrBatchNotInWindow       = errors.New("Batch is not covered by the validity window")
+	ErrIssuerMismatch         = errors.New("Certificate is from a different issuer")
+	ErrUnsupportedProof       = errors.New("Unsupported proof type")
+	ErrUnsupportedSubject     = errors.New("Unsupported subject type")
+
+	// Returned when an authentication path doesn't lead to the head of
+	// the batch in the validity window.
+	ErrAuthenticationPathInvalid = errors.New("Authentication path invalid")
+
+	// Returned when an authentication path doesn't have the height of
+	// the tree it's supposed to be in.
+	ErrAuthenticationPathLength = errors.New("Authentication path has the wrong length")
+
+	// Returned when the certificate is from a batch newer than the
+	// validity window. Fetching the latest window and retrying might help.
+	ErrWindowStale = errors.New("Validity window is older than the certificate")
+
+	// Returned when the slots of a validity window for batches before
+	// batch 0 don't hold the pre-epoch roots. See CAParams.PreEpochRoots.
+	ErrPreEpochRoots = errors.New("Validity window has unexpected roots before batch 0")
+
+	// Returned when a fetched validity window is for a batch that can't
+	// have been issued yet, or is too old to be the CA's latest.
+	ErrWindowImplausible = errors.New("Validity window has an implausible batch number")
+
+	// Returned when two validity windows have different tree heads for
+	// the same batch.
+	ErrWindowsInconsistent = errors.New("Validity windows disagree on a tree head")
+
+	// Returned when the CA parameters don't have the pinned fingerprint.
+	// See VerifyOptions.CAFingerprint.
+	ErrCAFingerprintMismatch = errors.New("CA parameters don't match the pinned fingerprint")
+)
+
+type VerifyOptions struct {
+	// Parameters of the CA that issued the certificate.
+	CA *CAParams
+
+	// Validity window of the CA. Its signature should already have been
+	// checked, for instance by SignedValidityWindow.UnmarshalBinary.
+	Window *ValidityWindow
+
+	// Time to check the certificate's lifetime at. Defaults to the
+	// current time.
+	Now time.Time
+
+	// Allows the clock of the verifier to be off by this much in either
+	// direction. Without it, a verifier whose clock lags only slightly
+	// rejects certificates just after they've been issued. One
+	// BatchDuration is a reasonable choice.
+	AllowedSkew time.Duration
+
+	// If set, rejects assertions on the deny list. The verifier has to
+	// fetch the list from the CA itself: without it, denied assertions
+	// are accepted until they expire. See DenyList.
+	DenyList *DenyList
+
+	// If set, the number of leaves of batches, for instance from their
+	// summaries. The authentication path of a certificate from one of
+	// these batches has to have the height of its tree.
+	LeafCounts map[uint32]uint64
+
+	// If set, the fingerprint the CA has to have, see CAParams.Fingerprint.
+	// Pins the CA, like a pinned key for X.509, so that parameters
+	// fetched over the network can't be swapped for those of another CA
+	// with the same issuer id.
+	CAFingerprint string
+}
+
+// Returns the tree head of the given batch, and whether it's covered by
+// the window. The window ends with the head of batch w.BatchNumber, and its
+// size follows from the length of TreeHeads.
+func (w *ValidityWindow) HeadForBatch(number uint32) ([]byte, bool) {
+	if len(w.TreeHeads)%HashLen != 0 {
+		return nil, false
+	}
+	size := int64(len(w.TreeHeads) / HashLen)
+	i := int64(number) - (int64(w.BatchNumber) - size + 1)
+	if i < 0 || i >= size {
+		return nil, false
+	}
+	return w.TreeHeads[i*HashLen : (i+1)*HashLen], true
+}
+
+// Returns the root of the given batch, or nil if it's not covered by the
+// window, or the window doesn't have the size set by the CA.
+func (w *ValidityWindow) Root(p *CAParams, number uint32) []byte {
+	if len(w.TreeHeads) != int(p.ValidityWindowSize)*HashLen {
+		return nil
+	}
+	head, _ := w.HeadForBatch(number)
+	return head
+}
+
+// Checks that the batch of the window could have been issued at now,
+// allowing for the clock to be off by skew. If latest is set, as for
+// a window served as the CA's latest, it also has to cover the oldest
+// active batch, as the CA would otherwise have stopped issuing long ago.
+//
+// Meant for windows fetched from a CA: a broken or malicious server could
+// otherwise pin a client to a window far in the past or future.
+func (w *ValidityWindow) CheckPlausible(p *CAParams, now time.Time,
+	skew time.Duration, latest bool) error {
+	_, issuable := p.BatchTimeRange(w.BatchNumber)
+	if issuable.After(now.Add(skew)) {
+		return fmt.Errorf("%w: batch %d can't be issued before %s",
+			ErrWindowImplausible, w.BatchNumber, issuable.UTC())
+	}
+	if !latest {
+		return nil
+	}
+	if active := p.ActiveBatches(now.Add(-skew)); w.BatchNumber < active.Begin {
+		return fmt.Errorf("%w: latest batch is %d, but batch %d is active",
+			ErrWindowImplausible, w.BatchNumber, active.Begin)
+	}
+	return nil
+}
+
+// Verifies the encoded certificate against the encoded CA parameters and
+// signed validity window, at the given time, as VerifyCertificate does.
+//
+// Meant for bindings that pass byte slices, such as one for syscall/js in
+// a WebAssembly build: it doesn't touch the filesystem, and malformed
+// input results in an error, not a panic.
+func VerifyEncoded(caParams, window, cert []byte, now time.Time) error {
+	var p CAParams
+	if err := p.UnmarshalBinary(caParams); err != nil {
+		return fmt.Errorf("parsing CA parameters: %w", err)
+	}
+	var sw SignedValidityWindow
+	if err := sw.UnmarshalBinary(window, &p); err != nil {
+		return fmt.Errorf("parsing validity window: %w", err)
+	}
+	var c BikeshedCertificate
+	if err := c.UnmarshalBinary(cert); err != nil {
+		return fmt.Errorf("parsing certificate: %w", err)
+	}
+	return VerifyCertificate(&c, VerifyOptions{
+		CA:          &p,
+		Window:      &sw.ValidityWindow,
+		Now:         now,
+		AllowedSkew: time.Duration(p.BatchDuration) * time.Second,
+	})
+}
+
+// Checks that w and other, in either order, have the same tree heads for
+// the batches they both cover. Windows signed by an honest CA always do.
+func (w *ValidityWindow) CheckConsistent(p *CAParams, other *ValidityWindow) error {
+	for _, x := range []*ValidityWindow{w, other} {
+		if len(x.TreeHeads) != int(p.ValidityWindowSize)*HashLen {
+			return fmt.Errorf("Validity window %d has %d bytes of tree heads",
+				x.BatchNumber, len(x.TreeHeads))
+		}
+	}
+	newest := int64(min(w.BatchNumber, other.BatchNumber))
+	oldest := int64(max(w.BatchNumber, other.BatchNumber)) -
+		int64(p.ValidityWindowSize) + 1
+	for number := max(oldest, 0); number <= newest; number++ {
+		head := w.Root(p, uint32(number))
+		otherHead := other.Root(p, uint32(number))
+		if !bytes.Equal(head, otherHead) {
+			return fmt.Errorf(
+				"%w: batch %d has head %x in window %d, but %x in window %d",
+				ErrWindowsInconsistent, number, head, w.BatchNumber,
+				otherHead, other.BatchNumber)
+		}
+	}
+	return nil
+}
+
+// Returns the number of slots at the start of the window that are for
+// batches before batch 0.
+func (w *ValidityWindow) PreEpochSlots(p *CAParams) int {
+	if uint64(w.BatchNumber)+1 >= p.ValidityWindowSize {
+		return 0
+	}
+	return int(p.ValidityWindowSize - uint64(w.BatchNumber) - 1)
+}
+
+// Checks that the slots for batches before batch 0 hold the pre-epoch
+// roots, as the signer puts them.
+func (w *ValidityWindow) CheckPreEpoch(p *CAParams) error {
+	n := w.PreEpochSlots(p) * HashLen
+	if n == 0 {
+		return nil
+	}
+	if len(w.TreeHeads) < n ||
+		!bytes.Equal(w.TreeHeads[:n], p.PreEpochRoots()[:n]) {
+		return fmt.Errorf("%w: batch %d", ErrPreEpochRoots, w.BatchNumber)
+	}
+	return nil
+}
+
+// Checks that the certificate is valid at the given time, and is
+// included in a batch covered by the validity window.
+//
+// The trust anchor of the proof has to name the issuer of the CA exactly,
+// and the authentication path has to lead to the head the window has for
+// the batch the anchor names. Heads of other batches don't count, even if
+// they happen to be the same: the batch number is part of every hash in
+// the tree.
+//
+// Does not check whether the certificate covers any particular name:
+// see Claims.Covers for that.
+func VerifyCertificate(c *BikeshedCertificate, opts VerifyOptions) error {
+	if opts.CA == nil || opts.Window == nil {
+		return errors.New("VerifyOptions lack CA or Window")
+	}
+	if opts.CAFingerprint != "" {
+		if err := opts.CA.CheckFingerprint(opts.CAFingerprint); err != nil {
+			return err
+		}
+	}
+	proof, ok := c.Proof.(*MerkleTreeProof)
+	if !ok {
+		return ErrUnsupportedProof
+	}
+	switch c.Assertion.Subject.(type) {
+	case *TLSSubject, *MultiTLSSubject, *CompactTLSSubject:
+	default:
+		return ErrUnsupportedSubject
+	}
+	anchor := proof.anchor
+	if anchor.issuerId != opts.CA.IssuerId {
+		return ErrIssuerMismatch
+	}
+
+	now := opts.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	// With a skewed clock, the current time might be anywhere in
+	// [now - skew, now + skew], so we accept the batch if it's active
+	// at any point in that range.
+	number := anchor.batchNumber
+	if number < opts.CA.ActiveBatches(now.Add(-opts.AllowedSkew)).Begin {
+		return ErrCertificateExpired
+	}
+	if number >= opts.CA.ActiveBatches(now.Add(opts.AllowedSkew)).End {
+		return ErrCertificateNotYetValid
+	}
+
+	if number > opts.Window.BatchNumber {
+		return fmt.Errorf("%w: batch %d, window %d", ErrWindowStale,
+			number, opts.Window.BatchNumber)
+	}
+
+	root := opts.Window.Root(opts.CA, number)
+	if root == nil {
+		return fmt.Errorf("%w: batch %d, window %d", ErrBatchNotInWindow,
+			number, opts.Window.BatchNumber)
+	}
+
+	aa := c.Assertion.Abridge()
+	if opts.DenyList != nil {
+		if err := opts.DenyList.Check(&aa); err != nil {
+			return err
+		}
+	}
+
+	batch := Batch{CA: opts.CA, Number: number}
+	if nLeaves, ok := opts.LeafCounts[number]; ok {
+		err := batch.CheckAuthenticationPathLength(nLeaves, proof.path)
+		if err != nil {
+			return err
+		}
+	}
+	return batch.VerifyAuthenticationPath(proof.index, proof.path, root, &aa)
+}
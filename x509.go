@@ -0,0 +1,42 @@
+package mtc
+
+import (
+	"crypto/x509"
+	"errors"
+)
+
+// Returns an X.509 certificate template with the subject public key and
+// the claims of the assertion as subject alternative names, to issue an
+// X.509 certificate alongside an MTC certificate.
+//
+// The template isn't signed. ENS and unknown claims have no counterpart
+// in X.509, and are returned separately, so the caller can decide
+// whether to proceed without them.
+func (a *Assertion) X509Template() (*x509.Certificate, Claims, error) {
+	subj, ok := a.Subject.(*TLSSubject)
+	if !ok {
+		return nil, Claims{}, errors.New("Only TLS subjects are supported")
+	}
+	v, err := subj.Verifier()
+	if err != nil {
+		return nil, Claims{}, err
+	}
+	pk, err := VerifierPublicKey(v)
+	if err != nil {
+		return nil, Claims{}, err
+	}
+
+	cs := a.Claims
+	tmpl := &x509.Certificate{
+		PublicKey:      pk,
+		EmailAddresses: cs.Email,
+	}
+	tmpl.DNSNames = append(tmpl.DNSNames, cs.DNS...)
+	for _, domain := range cs.DNSWildcard {
+		tmpl.DNSNames = append(tmpl.DNSNames, "*."+domain)
+	}
+	tmpl.IPAddresses = append(tmpl.IPAddresses, cs.IPv4...)
+	tmpl.IPAddresses = append(tmpl.IPAddresses, cs.IPv6...)
+
+	return tmpl, Claims{ENS: cs.ENS, Unknown: cs.Unknown}, nil
+}